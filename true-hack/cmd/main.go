@@ -1,55 +1,42 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
+	"true-hack/internal/cache"
 	"true-hack/internal/chain"
 	"true-hack/internal/collector"
+	"true-hack/internal/config"
+	"true-hack/internal/embedding"
+	"true-hack/internal/llm"
+	"true-hack/internal/rag"
 	"true-hack/internal/server"
 
 	"github.com/sashabaranov/go-openai"
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v3"
 )
 
-type Config struct {
-	Server struct {
-		Port int `yaml:"port"`
-	} `yaml:"server"`
-	Prometheus struct {
-		URL string `yaml:"url"`
-	} `yaml:"prometheus"`
-	Jaeger struct {
-		URL string `yaml:"url"`
-	} `yaml:"jaeger"`
-	OpenAI struct {
-		Model   string `yaml:"model"`
-		BaseURL string `yaml:"base_url"`
-	} `yaml:"openai"`
-}
-
 func main() {
 	// Read config
-	configFile, err := os.ReadFile("config.yaml")
-	if err != nil {
-		log.Fatalf("Failed to read config file: %v", err)
-	}
-
-	var config Config
-	if err := yaml.Unmarshal(configFile, &config); err != nil {
-		log.Fatalf("Failed to parse config: %v", err)
+	configPath := os.Getenv("CONFIG_PATH")
+	if configPath == "" {
+		configPath = "config.yaml"
 	}
 
-	apiKeyBytes, err := os.ReadFile(".token_key")
+	cfg, err := config.Load(configPath)
 	if err != nil {
-		log.Fatalf("Failed to read API key file: %v", err)
+		log.Fatalf("Failed to load config: %v", err)
 	}
-	apiKey := "Bearer " + strings.TrimSpace(string(apiKeyBytes))
+
+	apiKey := "Bearer " + cfg.OpenAI.APIKey
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Initialize logger
 	logger, err := zap.NewProduction()
@@ -59,55 +46,130 @@ func main() {
 	defer logger.Sync()
 
 	// Initialize collectors
-	prometheusCollector, err := collector.NewPrometheusCollector(config.Prometheus.URL, logger)
+	prometheusCollector, err := collector.NewPrometheusCollector(cfg.Prometheus, logger)
 	if err != nil {
 		logger.Fatal("Failed to initialize Prometheus collector", zap.Error(err))
 	}
 
-	jaegerCollector, err := collector.NewJaegerCollector(config.Jaeger.URL, logger)
+	lokiCollector, err := collector.NewLokiCollector(cfg.Loki, logger)
+	if err != nil {
+		logger.Fatal("Failed to initialize Loki collector", zap.Error(err))
+	}
+
+	jaegerCollector, err := collector.NewJaegerCollector(cfg.Jaeger, logger)
 	if err != nil {
 		logger.Fatal("Failed to initialize Jaeger collector", zap.Error(err))
 	}
 
+	collectors, err := collector.NewRegistry(prometheusCollector, lokiCollector, jaegerCollector)
+	if err != nil {
+		logger.Fatal("Failed to initialize collectors", zap.Error(err))
+	}
+	for _, source := range cfg.Sources {
+		c, err := collector.New(source, logger)
+		if err != nil {
+			logger.Fatal("Failed to initialize data source", zap.Error(err))
+		}
+		if err := collectors.Add(c); err != nil {
+			logger.Fatal("Failed to register data source", zap.Error(err))
+		}
+	}
+
 	// Initialize OpenAI client with custom base URL
 	openaiConfig := openai.DefaultConfig(apiKey)
-	openaiConfig.BaseURL = config.OpenAI.BaseURL
+	openaiConfig.BaseURL = cfg.OpenAI.BaseURL
 	openaiClient := openai.NewClientWithConfig(openaiConfig)
 
-	// Initialize cache
-	cache := chain.NewCache(30 * time.Minute)
+	// Initialize LLM providers, the openai one is asked first
+	providers := []llm.LLM{llm.NewOpenAI(cfg.OpenAI.Name, openaiClient, "", cfg.OpenAI.Timeout)}
+	for _, fallback := range cfg.LLM.Fallbacks {
+		provider, err := llm.New(fallback)
+		if err != nil {
+			logger.Fatal("Failed to initialize LLM provider", zap.Error(err))
+		}
+		providers = append(providers, provider)
+	}
 
-	// Initialize analyzer config
-	analyzerConfig := &chain.Config{
-		Model:           config.OpenAI.Model,
-		Temperature:     0.7,
-		MaxTokens:       2000,
-		SystemPrompt:    "You are an experienced SRE/DevOps engineer analyzing system metrics. Provide concise, actionable insights focusing on critical issues and potential improvements. Be direct and technical, avoiding unnecessary explanations. Format: [SEVERITY] Issue: Brief description. Action: Specific recommendation.",
-		MetricsTemplate: "Metrics data for time range from {{.StartTime}} to {{.EndTime}}:\n{{.Data}}",
-		LogsTemplate:    "Logs for time range from {{.StartTime}} to {{.EndTime}}:\n{{.Data}}",
-		TracesTemplate:  "Traces for time range from {{.StartTime}} to {{.EndTime}}:\n{{.Data}}",
+	// Initialize metric index
+	embedder, err := embedding.New(cfg.Embeddings, openaiClient)
+	if err != nil {
+		logger.Fatal("Failed to initialize embedder", zap.Error(err))
 	}
+	metricIndex := chain.NewMetricIndex(prometheusCollector, embedder, logger)
+	go metricIndex.Run(ctx, cfg.Chain.MetricIndexRefresh)
+
+	// Initialize evidence index
+	var evidenceIndex *rag.Index
+	if cfg.RAG.Path != "" {
+		store, err := rag.Open(cfg.RAG.Path, cfg.RAG.Retention)
+		if err != nil {
+			logger.Fatal("Failed to open rag store", zap.Error(err))
+		}
+		defer store.Close()
+		evidenceIndex = rag.NewIndex(store, embedder, cfg.RAG.ChunkLines, logger)
+		go evidenceIndex.Run(ctx, cfg.RAG.CleanupInterval)
+	}
+
+	// Initialize caches
+	var answers chain.Cache
+	switch cfg.Cache.Backend {
+	case chain.CacheSQLite:
+		store, err := cache.OpenSQLite(cfg.Cache.Path, cfg.Cache.TTL, cfg.Cache.MaxEntries, logger)
+		if err != nil {
+			logger.Fatal("Failed to open cache", zap.Error(err))
+		}
+		defer store.Close()
+		go store.Run(ctx, cfg.Cache.CleanupInterval)
+		answers = chain.NewStoreCache(store)
+	case chain.CacheRedis:
+		store, err := cache.NewRedis(cfg.Cache.RedisURL, cfg.Cache.RedisPrefix, cfg.Cache.TTL)
+		if err != nil {
+			logger.Fatal("Failed to initialize cache", zap.Error(err))
+		}
+		defer store.Close()
+		// The server may come up later, until then answers are just not cached
+		if err := store.Ping(ctx); err != nil {
+			logger.Warn("Cache server is unreachable", zap.Error(err))
+		}
+		answers = chain.NewStoreCache(store)
+	default:
+		memory, err := chain.NewMemoryCache(cfg.Cache.TTL, cfg.Cache.MaxEntries)
+		if err != nil {
+			logger.Fatal("Failed to initialize cache", zap.Error(err))
+		}
+		go memory.Run(ctx, cfg.Cache.CleanupInterval)
+		answers = memory
+	}
+	evidence, err := cache.New[any](cfg.Cache.EvidenceTTL, cfg.Cache.EvidenceMaxEntries)
+	if err != nil {
+		logger.Fatal("Failed to initialize evidence cache", zap.Error(err))
+	}
+	go evidence.Run(ctx, cfg.Cache.CleanupInterval)
+	collectors.UseCache(evidence)
 
 	// Initialize analyzer
 	analyzer, err := chain.NewAnalyzer(
-		openaiClient,
+		providers,
 		logger,
-		prometheusCollector,
-		nil, // Loki collector
-		jaegerCollector,
-		analyzerConfig,
-		cache,
+		collectors,
+		metricIndex,
+		evidenceIndex,
+		cfg.ChainConfig(),
+		answers,
 	)
 	if err != nil {
 		logger.Fatal("Failed to initialize analyzer", zap.Error(err))
 	}
 
 	// Initialize server
-	server := server.NewServer(analyzer, logger)
+	server, err := server.NewServer(analyzer, collectors, logger)
+	if err != nil {
+		logger.Fatal("Failed to initialize server", zap.Error(err))
+	}
 
 	// Start server in a goroutine
 	go func() {
-		if err := server.Start(config.Server.Port); err != nil {
+		if err := server.Start(ctx, cfg.Server.Port); err != nil {
 			logger.Fatal("Failed to start server", zap.Error(err))
 		}
 	}()
@@ -118,4 +180,27 @@ func main() {
 	<-sigChan
 
 	logger.Info("Shutting down server...")
+
+	// Abort running analyses first, otherwise Shutdown would wait for their LLM calls
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Failed to shut down server", zap.Error(err))
+	}
+
+	if memory, ok := answers.(*chain.MemoryCache); ok {
+		logCacheStats(logger, "answers", memory.Stats())
+	}
+	logCacheStats(logger, "evidence", evidence.Stats())
+}
+
+func logCacheStats(logger *zap.Logger, name string, stats cache.Stats) {
+	logger.Info("Cache stats",
+		zap.String("cache", name),
+		zap.Uint64("hits", stats.Hits),
+		zap.Uint64("misses", stats.Misses),
+		zap.Uint64("evictions", stats.Evictions),
+		zap.Uint64("expirations", stats.Expirations),
+		zap.Int("entries", stats.Entries))
 }
@@ -0,0 +1,19 @@
+// Package docs embeds the API description, so the binary serves the spec it was built with
+package docs
+
+import "embed"
+
+// OpenAPI is the OpenAPI 3 description of the HTTP API, requests are validated against it
+//
+//go:embed openapi.yaml
+var OpenAPI []byte
+
+// SwaggerUI is the page rendering OpenAPI with Swagger UI
+//
+//go:embed swagger.html
+var SwaggerUI []byte
+
+// SwaggerUIFiles are the script and styles of Swagger UI, vendored so the page works offline
+//
+//go:embed swagger-ui/swagger-ui-bundle.js swagger-ui/swagger-ui.css
+var SwaggerUIFiles embed.FS
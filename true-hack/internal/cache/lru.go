@@ -0,0 +1,147 @@
+// Package cache provides the in-memory LRU with TTL used for analysis results and collected data,
+// and the SQLite and Redis stores that keep analysis results across restarts and replicas
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Stats are the counters of an LRU since it was created
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+	// Evictions are entries dropped to make room for new ones
+	Evictions uint64
+	// Expirations are entries dropped because their TTL passed
+	Expirations uint64
+	Entries     int
+}
+
+type entry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+}
+
+// LRU keeps values for a TTL. It holds at most maxEntries of them, the least recently used
+// one is evicted to make room for a new one. Expired entries are dropped when they are read
+// and by Run in the background.
+type LRU[V any] struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds *entry[V], the most recently used at the front
+	lru        *list.List
+	ttl        time.Duration
+	maxEntries int
+	stats      Stats
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// New creates an LRU, maxEntries must be positive
+func New[V any](ttl time.Duration, maxEntries int) (*LRU[V], error) {
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("max entries must be positive, got %d", maxEntries)
+	}
+
+	return &LRU[V]{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+	}, nil
+}
+
+func (c *LRU[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return zero, false
+	}
+
+	e := element.Value.(*entry[V])
+	if c.now().After(e.expiresAt) {
+		c.remove(element)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return zero, false
+	}
+
+	c.lru.MoveToFront(element)
+	c.stats.Hits++
+	return e.value, true
+}
+
+func (c *LRU[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		e := element.Value.(*entry[V])
+		e.value = value
+		e.expiresAt = expiresAt
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.lru.PushFront(&entry[V]{key: key, value: value, expiresAt: expiresAt})
+}
+
+// Cleanup drops expired entries
+func (c *LRU[V]) Cleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for _, element := range c.entries {
+		if now.After(element.Value.(*entry[V]).expiresAt) {
+			c.remove(element)
+			c.stats.Expirations++
+		}
+	}
+}
+
+// Run calls Cleanup every interval until ctx is done
+func (c *LRU[V]) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Cleanup()
+		}
+	}
+}
+
+// Stats returns a snapshot of the counters
+func (c *LRU[V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// remove must be called with c.mu held
+func (c *LRU[V]) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*entry[V]).key)
+}
@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clock is a fake time source advanced by the tests
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestLRU(t *testing.T, ttl time.Duration, maxEntries int) (*LRU[int], *clock) {
+	t.Helper()
+
+	c, err := New[int](ttl, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := &clock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c.now = clk.Now
+	return c, clk
+}
+
+func TestNewRejectsNonPositiveMaxEntries(t *testing.T) {
+	for _, maxEntries := range []int{0, -1} {
+		if _, err := New[int](time.Minute, maxEntries); err == nil {
+			t.Errorf("New(maxEntries=%d) succeeded, want an error", maxEntries)
+		}
+	}
+}
+
+// op is a step of a scenario: set a key, get it expecting a value or a miss, or advance the clock
+type op struct {
+	set     string
+	get     string
+	want    int
+	miss    bool
+	advance time.Duration
+	cleanup bool
+}
+
+func TestLRU(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		maxEntries int
+		ops        []op
+		want       Stats
+	}{
+		{
+			name:       "hit and miss",
+			ttl:        time.Minute,
+			maxEntries: 10,
+			ops: []op{
+				{set: "a"},
+				{get: "a", want: 1},
+				{get: "b", miss: true},
+			},
+			want: Stats{Hits: 1, Misses: 1, Entries: 1},
+		},
+		{
+			name:       "expired on read",
+			ttl:        time.Minute,
+			maxEntries: 10,
+			ops: []op{
+				{set: "a"},
+				{advance: 59 * time.Second},
+				{get: "a", want: 1},
+				{advance: 2 * time.Second},
+				{get: "a", miss: true},
+			},
+			want: Stats{Hits: 1, Misses: 1, Expirations: 1},
+		},
+		{
+			name:       "set renews the ttl",
+			ttl:        time.Minute,
+			maxEntries: 10,
+			ops: []op{
+				{set: "a"},
+				{advance: 50 * time.Second},
+				{set: "a"},
+				{advance: 50 * time.Second},
+				{get: "a", want: 2},
+			},
+			want: Stats{Hits: 1, Entries: 1},
+		},
+		{
+			name:       "least recently set is evicted",
+			ttl:        time.Minute,
+			maxEntries: 2,
+			ops: []op{
+				{set: "a"},
+				{set: "b"},
+				{set: "c"},
+				{get: "a", miss: true},
+				{get: "b", want: 2},
+				{get: "c", want: 3},
+			},
+			want: Stats{Hits: 2, Misses: 1, Evictions: 1, Entries: 2},
+		},
+		{
+			name:       "read moves to the front",
+			ttl:        time.Minute,
+			maxEntries: 2,
+			ops: []op{
+				{set: "a"},
+				{set: "b"},
+				{get: "a", want: 1},
+				{set: "c"},
+				{get: "b", miss: true},
+				{get: "a", want: 1},
+				{get: "c", want: 3},
+			},
+			want: Stats{Hits: 3, Misses: 1, Evictions: 1, Entries: 2},
+		},
+		{
+			name:       "cleanup drops expired only",
+			ttl:        time.Minute,
+			maxEntries: 10,
+			ops: []op{
+				{set: "a"},
+				{set: "b"},
+				{advance: 30 * time.Second},
+				{set: "c"},
+				{advance: 40 * time.Second},
+				{cleanup: true},
+				{get: "c", want: 3},
+			},
+			want: Stats{Hits: 1, Expirations: 2, Entries: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, clk := newTestLRU(t, tt.ttl, tt.maxEntries)
+			next := 0
+			for i, op := range tt.ops {
+				switch {
+				case op.set != "":
+					next++
+					c.Set(op.set, next)
+				case op.get != "":
+					value, ok := c.Get(op.get)
+					if ok == op.miss || (ok && value != op.want) {
+						t.Fatalf("op %d: Get(%q) = %d, %v, want %d, %v", i, op.get, value, ok, op.want, !op.miss)
+					}
+				case op.advance > 0:
+					clk.Advance(op.advance)
+				case op.cleanup:
+					c.Cleanup()
+				}
+			}
+
+			if got := c.Stats(); got != tt.want {
+				t.Errorf("Stats() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLRURun(t *testing.T) {
+	c, clk := newTestLRU(t, time.Minute, 10)
+	c.Set("a", 1)
+	clk.Advance(2 * time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Entries != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Run didn't drop the expired entry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := c.Stats().Expirations; got != 1 {
+		t.Errorf("Expirations = %d, want 1", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after ctx was canceled")
+	}
+}
+
+func TestLRUConcurrent(t *testing.T) {
+	const (
+		workers    = 8
+		iterations = 1000
+		maxEntries = 50
+	)
+	c, err := New[int](time.Minute, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range iterations {
+				key := fmt.Sprintf("key-%d", (w*iterations+i)%(2*maxEntries))
+				c.Set(key, i)
+				c.Get(key)
+				if i%100 == 0 {
+					c.Cleanup()
+					c.Stats()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	if stats.Entries > maxEntries {
+		t.Errorf("Entries = %d, want at most %d", stats.Entries, maxEntries)
+	}
+	if stats.Hits+stats.Misses != workers*iterations {
+		t.Errorf("Hits+Misses = %d, want %d", stats.Hits+stats.Misses, workers*iterations)
+	}
+}
@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keeps values in a server speaking the Redis protocol, so replicas share them. Entries
+// expire by the TTL of their keys, evicting them is up to the maxmemory policy of the server.
+type Redis struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedis connects to the server at url, e.g. redis://:password@localhost:6379/0. Keys are
+// prefixed with prefix, so several caches can share a database.
+func NewRedis(url, prefix string, ttl time.Duration) (*Redis, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis url: %w", err)
+	}
+
+	return &Redis{
+		client: redis.NewClient(options),
+		prefix: prefix,
+		ttl:    ttl,
+	}, nil
+}
+
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("get cache entry: %w", err)
+	}
+	return value, true, nil
+}
+
+func (r *Redis) Set(ctx context.Context, key string, value []byte) error {
+	if err := r.client.Set(ctx, r.prefix+key, value, r.ttl).Err(); err != nil {
+		return fmt.Errorf("set cache entry: %w", err)
+	}
+	return nil
+}
+
+// Ping checks the server is reachable
+func (r *Redis) Ping(ctx context.Context) error {
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("ping redis: %w", err)
+	}
+	return nil
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
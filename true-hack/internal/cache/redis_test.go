@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedis(t *testing.T, prefix string, ttl time.Duration) (*Redis, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	r, err := NewRedis("redis://"+server.Addr()+"/0", prefix, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, server
+}
+
+func TestRedisRoundTrip(t *testing.T) {
+	ctx := t.Context()
+	r, server := newTestRedis(t, "answers:", time.Hour)
+
+	if err := r.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wantEntry(t, ctx, r, "a", "")
+	if err := r.Set(ctx, "a", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	wantEntry(t, ctx, r, "a", "first")
+	if err := r.Set(ctx, "a", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	wantEntry(t, ctx, r, "a", "second")
+
+	if !server.Exists("answers:a") {
+		t.Errorf("keys = %v, want the prefixed key", server.Keys())
+	}
+}
+
+func TestRedisTTL(t *testing.T) {
+	ctx := t.Context()
+	r, server := newTestRedis(t, "answers:", time.Minute)
+
+	if err := r.Set(ctx, "a", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	server.FastForward(30 * time.Second)
+	if err := r.Set(ctx, "b", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	server.FastForward(40 * time.Second)
+	wantEntry(t, ctx, r, "a", "")
+	wantEntry(t, ctx, r, "b", "new")
+}
+
+// Eviction is left to the server, the volatile-* maxmemory policies only evict keys with a TTL
+func TestRedisEviction(t *testing.T) {
+	ctx := t.Context()
+	r, server := newTestRedis(t, "answers:", time.Minute)
+
+	if err := r.Set(ctx, "a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("answers:a"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL = %s, want at most a minute", ttl)
+	}
+
+	// An evicted key is a miss, not an error
+	server.Del("answers:a")
+	wantEntry(t, ctx, r, "a", "")
+
+	// Caches sharing a database don't see each other's keys
+	other, err := NewRedis("redis://"+server.Addr()+"/0", "evidence:", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := other.Set(ctx, "b", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	wantEntry(t, ctx, r, "b", "")
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS entries (
+	key        TEXT PRIMARY KEY,
+	value      BLOB NOT NULL,
+	expires_at INTEGER NOT NULL,
+	used_at    INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS entries_expires_at ON entries (expires_at);
+CREATE INDEX IF NOT EXISTS entries_used_at ON entries (used_at);`
+
+// SQLite keeps values in a database file, so they survive restarts and can be shared by
+// processes on the same host. Like LRU it drops expired entries and, in Cleanup, the least
+// recently used ones above maxEntries.
+type SQLite struct {
+	db         *sql.DB
+	logger     *zap.Logger
+	ttl        time.Duration
+	maxEntries int
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// OpenSQLite opens the database at path, creating the file if needed
+func OpenSQLite(path string, ttl time.Duration, maxEntries int, logger *zap.Logger) (*SQLite, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create cache directory: %w", err)
+	}
+
+	// Other processes may write to the file, wait for their locks instead of failing
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("open cache database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create cache schema: %w", err)
+	}
+
+	return &SQLite{
+		db:         db,
+		logger:     logger,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+	}, nil
+}
+
+func (s *SQLite) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	now := s.now().UnixNano()
+
+	var value []byte
+	err := s.db.QueryRowContext(ctx, `SELECT value FROM entries WHERE key = ? AND expires_at > ?`, key, now).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("get cache entry: %w", err)
+	}
+
+	if _, err := s.db.ExecContext(ctx, `UPDATE entries SET used_at = ? WHERE key = ?`, now, key); err != nil {
+		return nil, false, fmt.Errorf("touch cache entry: %w", err)
+	}
+	return value, true, nil
+}
+
+func (s *SQLite) Set(ctx context.Context, key string, value []byte) error {
+	now := s.now()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO entries (key, value, expires_at, used_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at, used_at = excluded.used_at`,
+		key, value, now.Add(s.ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return fmt.Errorf("set cache entry: %w", err)
+	}
+	return nil
+}
+
+// Cleanup drops expired entries, then the least recently used ones above maxEntries
+func (s *SQLite) Cleanup(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM entries WHERE expires_at <= ?`, s.now().UnixNano()); err != nil {
+		return fmt.Errorf("delete expired cache entries: %w", err)
+	}
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM entries WHERE key IN (
+			SELECT key FROM entries ORDER BY used_at DESC LIMIT -1 OFFSET ?
+		)`, s.maxEntries)
+	if err != nil {
+		return fmt.Errorf("evict cache entries: %w", err)
+	}
+	return nil
+}
+
+// Run calls Cleanup every interval until ctx is done
+func (s *SQLite) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Cleanup(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Warn("Failed to clean up cache", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
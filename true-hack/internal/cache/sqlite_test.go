@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func openTestSQLite(t *testing.T, path string, ttl time.Duration, maxEntries int) (*SQLite, *clock) {
+	t.Helper()
+
+	s, err := OpenSQLite(path, ttl, maxEntries, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	clk := &clock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.now = clk.Now
+	return s, clk
+}
+
+func wantEntry(t *testing.T, ctx context.Context, s interface {
+	Get(context.Context, string) ([]byte, bool, error)
+}, key, want string) {
+	t.Helper()
+
+	value, ok, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	switch {
+	case want == "" && ok:
+		t.Errorf("Get(%q) = %q, want a miss", key, value)
+	case want != "" && (!ok || string(value) != want):
+		t.Errorf("Get(%q) = %q, %v, want %q", key, value, ok, want)
+	}
+}
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	ctx := t.Context()
+	path := filepath.Join(t.TempDir(), "cache", "answers.db")
+	s, _ := openTestSQLite(t, path, time.Hour, 10)
+
+	wantEntry(t, ctx, s, "a", "")
+	if err := s.Set(ctx, "a", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	wantEntry(t, ctx, s, "a", "first")
+	if err := s.Set(ctx, "a", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	wantEntry(t, ctx, s, "a", "second")
+	s.Close()
+
+	// Entries survive a restart
+	s, _ = openTestSQLite(t, path, time.Hour, 10)
+	wantEntry(t, ctx, s, "a", "second")
+}
+
+func TestSQLiteTTL(t *testing.T) {
+	ctx := t.Context()
+	s, clk := openTestSQLite(t, filepath.Join(t.TempDir(), "answers.db"), time.Minute, 10)
+
+	if err := s.Set(ctx, "a", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(30 * time.Second)
+	if err := s.Set(ctx, "b", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(40 * time.Second)
+	wantEntry(t, ctx, s, "a", "")
+	wantEntry(t, ctx, s, "b", "new")
+
+	if err := s.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := s.db.QueryRow(`SELECT count(*) FROM entries`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d entries after Cleanup, want 1", count)
+	}
+}
+
+func TestSQLiteEviction(t *testing.T) {
+	ctx := t.Context()
+	s, clk := openTestSQLite(t, filepath.Join(t.TempDir(), "answers.db"), time.Hour, 2)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.Set(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		clk.Advance(time.Second)
+	}
+	// Reading a makes b the least recently used
+	wantEntry(t, ctx, s, "a", "a")
+	clk.Advance(time.Second)
+
+	if err := s.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wantEntry(t, ctx, s, "a", "a")
+	wantEntry(t, ctx, s, "b", "")
+	wantEntry(t, ctx, s, "c", "c")
+}
@@ -0,0 +1,243 @@
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// Analysis modes of AnalysisRequest
+const (
+	// ModePrompt collects evidence from every source up front and asks the model once
+	ModePrompt = "prompt"
+	// ModeAgent lets the model query the sources itself with tools, see runAgent
+	ModeAgent = "agent"
+)
+
+// agentInstruction is appended to the system prompt in agent mode
+const agentInstruction = `Instead of being given the data, you query the data sources yourself with the provided tools.
+Start broad: list_metrics shows what can be queried, query_promql gives error rates and latencies, query_logql finds error logs
+and find_traces finds failing and slow traces. Then narrow down to the cause, get_trace shows all spans of a single trace.
+Times of the tools default to the analyzed period. Don't repeat queries that already returned.
+When you know enough, or when you are told to finish, call ` + reportFunctionName + ` with the final answer.`
+
+// ToolCall is an entry of the agent transcript: a tool the model called and what it was shown
+type ToolCall struct {
+	// Step is the number of the model request the call was made in, starting from 1
+	Step int `json:"step"`
+	// Thought is what the model wrote along with the calls of the step, if anything
+	Thought   string `json:"thought,omitempty"`
+	Tool      string `json:"tool"`
+	Arguments string `json:"arguments"`
+	// Result is what the model got back, truncated to Config.AgentToolResultTokens
+	Result     string `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// content is the tool message the model gets for the call
+func (c ToolCall) content() string {
+	if c.Error == "" {
+		return c.Result
+	}
+	if c.Result == "" {
+		return "error: " + c.Error
+	}
+	return "error: " + c.Error + "\n" + c.Result
+}
+
+// runAgent answers the question by letting the model call tools backed by the collectors until it
+// reports the answer. The loop is bounded by Config.AgentMaxSteps model requests and
+// Config.AgentMaxTokens tokens sent and received, the last allowed step must answer. The oldest
+// tool results are dropped when the conversation outgrows the context window.
+// Every tool call is returned in LLMResponse.Transcript.
+func (a *Analyzer) runAgent(ctx context.Context, req AnalysisRequest, timeRange ResolvedTimeRange, progress ProgressFunc) (*LLMResponse, error) {
+	now := time.Now()
+	tools := a.newToolbox(timeRange, now)
+
+	messages := []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: a.config.SystemPrompt + "\n\n" + agentInstruction,
+		},
+		{
+			Role:    openai.ChatMessageRoleUser,
+			Content: a.agentPrompt(req, timeRange, now),
+		},
+	}
+
+	chatReq := openai.ChatCompletionRequest{
+		Model:       a.config.Model,
+		MaxTokens:   a.config.MaxTokens,
+		Temperature: a.config.Temperature,
+		Tools:       tools.definitions(),
+	}
+	definitions, err := json.Marshal(chatReq.Tools)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode tools: %v", err)
+	}
+	toolTokens := a.tokenizer.Count(string(definitions))
+
+	var transcript []ToolCall
+	var used int
+	for step := 1; ; step++ {
+		prompt, err := a.fitContext(messages, toolTokens)
+		if err != nil {
+			return nil, err
+		}
+		// The last step, and a step after which the token limit would be exceeded, must answer
+		final := step >= a.config.AgentMaxSteps ||
+			used+prompt+a.config.MaxTokens > a.config.AgentMaxTokens
+
+		chatReq.Messages = messages
+		chatReq.ToolChoice = nil
+		if final {
+			chatReq.ToolChoice = openai.ToolChoice{
+				Type:     openai.ToolTypeFunction,
+				Function: openai.ToolFunction{Name: reportFunctionName},
+			}
+		}
+
+		progress.emit(Event{Type: EventProgress, Phase: PhaseAgent, Status: StatusStarted, Step: step})
+		// Tool arguments are not streamed as tokens, progress reports every call instead
+		message, provider, err := a.complete(ctx, chatReq, nil)
+		if err != nil {
+			progress.emit(Event{Type: EventProgress, Phase: PhaseAgent, Status: StatusFailed, Step: step, Error: err.Error()})
+			return nil, err
+		}
+		progress.emit(Event{Type: EventProgress, Phase: PhaseAgent, Status: StatusDone, Step: step})
+
+		used += prompt + a.countMessages([]openai.ChatCompletionMessage{message})
+		messages = append(messages, message)
+
+		// A message without tool calls is taken as the answer
+		answer, reportID := message.Content, ""
+		thought := strings.TrimSpace(message.Content)
+		for _, call := range message.ToolCalls {
+			if call.Function.Name == reportFunctionName {
+				answer, reportID = call.Function.Arguments, call.ID
+				continue
+			}
+
+			progress.emit(Event{Type: EventProgress, Phase: PhaseTool, Source: call.Function.Name, Status: StatusStarted, Step: step})
+			record := tools.call(ctx, step, call)
+			record.Thought, thought = thought, ""
+			transcript = append(transcript, record)
+
+			status := StatusDone
+			if record.Error != "" {
+				status = StatusFailed
+			}
+			progress.emit(Event{Type: EventProgress, Phase: PhaseTool, Source: record.Tool, Status: status, Step: step, Error: record.Error, Tool: &record})
+
+			messages = append(messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				ToolCallID: call.ID,
+				Content:    record.content(),
+			})
+		}
+		if len(message.ToolCalls) > 0 && reportID == "" {
+			if final {
+				return nil, fmt.Errorf("agent didn't answer within %d steps", step)
+			}
+			continue
+		}
+
+		result, err := decodeLLMResponse(answer)
+		if err != nil && final {
+			// Fallback to best effort parsing
+			result, err = parseLLMResponse(answer)
+		}
+		if err == nil {
+			result.Transcript = transcript
+			result.Provider = provider
+			return result, nil
+		}
+
+		a.logger.Warn("Agent answer does not match schema",
+			zap.Int("step", step),
+			zap.Error(err))
+		repair := fmt.Sprintf("Your answer is invalid: %v. Call %s again with the corrected answer.", err, reportFunctionName)
+		if reportID != "" {
+			// Rejected answers are part of the transcript too
+			transcript = append(transcript, ToolCall{Step: step, Tool: reportFunctionName, Arguments: answer, Error: err.Error()})
+			messages = append(messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				ToolCallID: reportID,
+				Content:    repair,
+			})
+		} else {
+			messages = append(messages, openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleUser,
+				Content: repair,
+			})
+		}
+	}
+}
+
+// droppedToolResult replaces tool results that no longer fit into the context window
+const droppedToolResult = "[result dropped to fit the context window, repeat the call if it is still needed]"
+
+// fitContext replaces the oldest tool results with droppedToolResult until the request fits into
+// the context window with Config.MaxTokens left for the answer, and returns the tokens it takes.
+// Tool messages are kept, every tool call of the model must be followed by its result.
+func (a *Analyzer) fitContext(messages []openai.ChatCompletionMessage, toolTokens int) (int, error) {
+	limit := a.contextWindow() - a.config.MaxTokens
+	prompt := toolTokens + a.countMessages(messages)
+	for i := range messages {
+		if prompt <= limit {
+			return prompt, nil
+		}
+		if messages[i].Role != openai.ChatMessageRoleTool {
+			continue
+		}
+		// Short results, and those already dropped, take no more than the note
+		saved := a.tokenizer.Count(messages[i].Content) - a.tokenizer.Count(droppedToolResult)
+		if saved <= 0 {
+			continue
+		}
+		prompt -= saved
+		messages[i].Content = droppedToolResult
+	}
+	if prompt > limit {
+		return 0, fmt.Errorf("agent request of %d tokens doesn't fit into the context window of %d tokens with %d reserved for the answer",
+			prompt, a.contextWindow(), a.config.MaxTokens)
+	}
+	return prompt, nil
+}
+
+// agentPrompt states the question and the period, the model collects the evidence itself
+func (a *Analyzer) agentPrompt(req AnalysisRequest, timeRange ResolvedTimeRange, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Question: %s\n\n", req.Query)
+	fmt.Fprintf(&b, "Analyzed period: %s to %s, now is %s\n",
+		timeRange.Start.Format(time.RFC3339), timeRange.End.Format(time.RFC3339), now.Format(time.RFC3339))
+	if req.Baseline != nil {
+		fmt.Fprintf(&b, "Compare it with the baseline period %s to %s and explain what changed\n",
+			req.Baseline.Start.Format(time.RFC3339), req.Baseline.End.Format(time.RFC3339))
+	}
+	if len(req.Metrics) > 0 {
+		fmt.Fprintf(&b, "Metrics the user is interested in: %s\n", strings.Join(req.Metrics, ", "))
+	}
+
+	gitText := a.tokenizer.Truncate(a.gitInfo.LastCommitHash+"\n"+a.gitInfo.LastCommitDiff, a.config.AgentToolResultTokens)
+	fmt.Fprintf(&b, "\nRecent changes:\n%s", gitText)
+	return b.String()
+}
+
+// countMessages counts the tokens of messages as the model sees them
+func (a *Analyzer) countMessages(messages []openai.ChatCompletionMessage) int {
+	var total int
+	for _, message := range messages {
+		total += a.tokenizer.Count(message.Content) + messageOverhead
+		for _, call := range message.ToolCalls {
+			total += a.tokenizer.Count(call.Function.Name) + a.tokenizer.Count(call.Function.Arguments)
+		}
+	}
+	return total
+}
@@ -0,0 +1,262 @@
+package chain
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/llm"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// newAgentAnalyzer is an analyzer whose tools are backed by a queryCollector
+func newAgentAnalyzer(t *testing.T, config *Config, source *queryCollector, provider llm.LLM) *Analyzer {
+	t.Helper()
+
+	collectors, err := collector.NewRegistry(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, err := NewMemoryCache(time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	analyzer, err := NewAnalyzer([]llm.LLM{provider}, zap.NewNop(), collectors, nil, nil, config, answers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	analyzer.gitInfo = &GitInfo{LastCommitHash: "abc123", LastCommitDiff: "+ retries = 0"}
+	return analyzer
+}
+
+func runTestAgent(t *testing.T, analyzer *Analyzer) (*LLMResponse, error) {
+	t.Helper()
+
+	req := testRequest()
+	timeRange := ResolvedTimeRange{Start: req.TimeRange.Start, End: req.TimeRange.End}
+	return analyzer.runAgent(t.Context(), req, timeRange, nil)
+}
+
+// firstPromptTokens is the size of the first agent request, the limits of the tests are set around it
+func firstPromptTokens(t *testing.T, config *Config, source *queryCollector) int {
+	t.Helper()
+
+	provider := llm.NewFake("fake", testAnswer).Record()
+	analyzer := newAgentAnalyzer(t, config, source, provider)
+	if _, err := runTestAgent(t, analyzer); err != nil {
+		t.Fatal(err)
+	}
+
+	req := provider.Requests()[0]
+	definitions, err := json.Marshal(req.Tools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return analyzer.countMessages(req.Messages) + analyzer.tokenizer.Count(string(definitions))
+}
+
+func forcedReport(req openai.ChatCompletionRequest) bool {
+	choice, ok := req.ToolChoice.(openai.ToolChoice)
+	return ok && choice.Function.Name == reportFunctionName
+}
+
+func TestAgentToolLoop(t *testing.T) {
+	config := testConfig()
+	config.AgentMaxSteps = 5
+	provider := llm.NewFake("fake", testAnswer).
+		CallTools(1,
+			openai.FunctionCall{Name: "query_promql", Arguments: `{"query": "up"}`},
+			openai.FunctionCall{Name: "query_promql", Arguments: `{}`}).
+		CallTools(2,
+			openai.FunctionCall{Name: "query_logql", Arguments: `{"query": "{app=\"api\"}"}`},
+			openai.FunctionCall{Name: "get_trace", Arguments: `{"trace_id": "t1"}`}).
+		Record()
+	analyzer := newAgentAnalyzer(t, config, &queryCollector{series: 1}, provider)
+
+	result, err := runTestAgent(t, analyzer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Analysis != "Errors of the api started after the deploy" || result.Provider != "fake" {
+		t.Errorf("got %+v", result)
+	}
+
+	want := []struct {
+		step          int
+		tool          string
+		arguments     string
+		result, error string
+	}{
+		{step: 1, tool: "query_promql", arguments: `{"query": "up"}`, result: "1 series\nseries{pod=api-0}: n=2"},
+		{step: 1, tool: "query_promql", arguments: `{}`, error: "query is required"},
+		{step: 2, tool: "query_logql", arguments: `{"query": "{app=\"api\"}"}`, result: "request failed: connection refused"},
+		{step: 2, tool: "get_trace", arguments: `{"trace_id": "t1"}`, result: "Trace t1: 1 spans\n  api GET /users"},
+	}
+	if len(result.Transcript) != len(want) {
+		t.Fatalf("transcript has %d calls, want %d: %+v", len(result.Transcript), len(want), result.Transcript)
+	}
+	for i, w := range want {
+		got := result.Transcript[i]
+		if got.Step != w.step || got.Tool != w.tool || got.Arguments != w.arguments || got.Error != w.error {
+			t.Errorf("call %d = %+v, want %+v", i, got, w)
+		}
+		if !strings.Contains(got.Result, w.result) || (w.result == "" && got.Result != "") {
+			t.Errorf("call %d result = %q, want %q", i, got.Result, w.result)
+		}
+	}
+
+	requests := provider.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("model was asked %d times, want 3", len(requests))
+	}
+	for i, req := range requests {
+		if forcedReport(req) {
+			t.Errorf("request %d forces the answer before the last step", i+1)
+		}
+	}
+
+	// The results of the first step follow its calls in the next request
+	messages := requests[1].Messages
+	results := messages[len(messages)-2:]
+	if results[0].Role != openai.ChatMessageRoleTool || results[0].ToolCallID != "call_1_0" ||
+		!strings.HasPrefix(results[0].Content, "1 series") {
+		t.Errorf("first result message = %+v", results[0])
+	}
+	if results[1].ToolCallID != "call_1_1" || results[1].Content != "error: query is required" {
+		t.Errorf("second result message = %+v", results[1])
+	}
+}
+
+func TestAgentFinalStep(t *testing.T) {
+	source := &queryCollector{series: 1}
+	prompt := firstPromptTokens(t, testConfig(), source)
+
+	tests := []struct {
+		name      string
+		configure func(config *Config)
+	}{
+		{
+			name: "max steps",
+			configure: func(config *Config) {
+				config.AgentMaxSteps = 2
+			},
+		},
+		{
+			// The first request fits, after it the second one with the answer would exceed the limit
+			name: "max tokens",
+			configure: func(config *Config) {
+				config.AgentMaxSteps = 5
+				config.AgentMaxTokens = prompt + config.MaxTokens + prompt/2
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			tt.configure(config)
+			// The model keeps querying, it answers only because it is forced to
+			query := openai.FunctionCall{Name: "query_promql", Arguments: `{"query": "up"}`}
+			provider := llm.NewFake("fake", testAnswer).
+				CallTools(1, query).
+				CallTools(2, query).
+				CallTools(3, query).
+				Record()
+			analyzer := newAgentAnalyzer(t, config, source, provider)
+
+			result, err := runTestAgent(t, analyzer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Analysis == "" || len(result.Transcript) != 1 {
+				t.Errorf("got %+v", result)
+			}
+
+			requests := provider.Requests()
+			if len(requests) != 2 {
+				t.Fatalf("model was asked %d times, want 2", len(requests))
+			}
+			if forcedReport(requests[0]) {
+				t.Error("first request forces the answer")
+			}
+			if !forcedReport(requests[1]) {
+				t.Errorf("last request doesn't force %s, tool choice %+v", reportFunctionName, requests[1].ToolChoice)
+			}
+		})
+	}
+}
+
+func TestAgentContextWindow(t *testing.T) {
+	config := testConfig()
+	config.AgentMaxTokens = 100000
+	config.AgentToolResultTokens = 200
+	// Every query result is truncated to the full AgentToolResultTokens
+	source := &queryCollector{series: 50}
+	prompt := firstPromptTokens(t, config, source)
+
+	t.Run("oldest results are dropped", func(t *testing.T) {
+		config := *config
+		config.AgentMaxSteps = 3
+		// Room for one result but not for two
+		config.ContextWindow = prompt + config.MaxTokens + 350
+		query := openai.FunctionCall{Name: "query_promql", Arguments: `{"query": "up"}`}
+		provider := llm.NewFake("fake", testAnswer).
+			CallTools(1, query).
+			CallTools(2, query).
+			Record()
+		analyzer := newAgentAnalyzer(t, &config, source, provider)
+
+		result, err := runTestAgent(t, analyzer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The transcript keeps what the model was shown at the time
+		for i, call := range result.Transcript {
+			if !strings.HasPrefix(call.Result, "50 series") {
+				t.Errorf("transcript call %d result = %q", i, call.Result)
+			}
+		}
+
+		requests := provider.Requests()
+		if len(requests) != 3 {
+			t.Fatalf("model was asked %d times, want 3", len(requests))
+		}
+		var results []string
+		for _, message := range requests[2].Messages {
+			if message.Role == openai.ChatMessageRoleTool {
+				results = append(results, message.Content)
+			}
+		}
+		if len(results) != 2 || results[0] != droppedToolResult || !strings.HasPrefix(results[1], "50 series") {
+			t.Errorf("tool results of the last request = %q", results)
+		}
+
+		definitions, err := json.Marshal(requests[2].Tools)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := analyzer.countMessages(requests[2].Messages) + analyzer.tokenizer.Count(string(definitions))
+		if size > config.ContextWindow-config.MaxTokens {
+			t.Errorf("last request takes %d tokens, only %d fit", size, config.ContextWindow-config.MaxTokens)
+		}
+	})
+
+	t.Run("request that doesn't fit fails", func(t *testing.T) {
+		config := *config
+		config.ContextWindow = prompt + config.MaxTokens - 100
+		provider := llm.NewFake("fake", testAnswer)
+		analyzer := newAgentAnalyzer(t, &config, source, provider)
+
+		_, err := runTestAgent(t, analyzer)
+		if err == nil || !strings.Contains(err.Error(), "doesn't fit into the context window") {
+			t.Fatalf("got error %v, want a context window error", err)
+		}
+		if provider.Calls() != 0 {
+			t.Errorf("model was asked %d times, want 0", provider.Calls())
+		}
+	})
+}
@@ -2,39 +2,200 @@ package chain
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"maps"
 	"os/exec"
 	"slices"
 	"strings"
+	"text/template"
 	"time"
 
+	"true-hack/internal/cache"
 	"true-hack/internal/collector"
+	"true-hack/internal/llm"
+	"true-hack/internal/rag"
+	"true-hack/internal/timerange"
+	"true-hack/internal/tokenizer"
 
-	"github.com/lithammer/fuzzysearch/fuzzy"
 	"github.com/sashabaranov/go-openai"
 	"go.uber.org/zap"
 )
 
 type Analyzer struct {
-	client     *openai.Client
+	// providers are asked in order, the next one when one fails
+	providers  []llm.LLM
 	logger     *zap.Logger
-	prometheus *collector.PrometheusCollector
-	loki       *collector.LokiCollector
-	jaeger     *collector.JaegerCollector
+	collectors *collector.Registry
 	config     *Config
-	cache      *Cache
+	cache      Cache
 	gitInfo    *GitInfo
+	templates  *promptTemplates
+	// metricIndex is optional, without it all metrics are collected
+	metricIndex *MetricIndex
+	// evidenceIndex is optional, without it the most recent logs are used
+	evidenceIndex *rag.Index
+	tokenizer     tokenizer.Tokenizer
+	sessions      *SessionStore
+	flights       *flightGroup
+	// prompts maps request keys to the prompt keys of their answers, nil without EvidenceTTL
+	prompts *cache.LRU[string]
 }
 
 type Config struct {
-	Model           string
-	Temperature     float32
-	MaxTokens       int
+	// Model is requested from providers without a model of their own, prompts are budgeted for it
+	Model       string
+	Temperature float32
+	MaxTokens   int
+	// ContextWindow overrides the context window known for Model, zero means the known one
+	ContextWindow   int
 	SystemPrompt    string
 	MetricsTemplate string
 	LogsTemplate    string
 	TracesTemplate  string
+	// ComparisonTemplate renders the differences from the baseline, its TimeRange is the baseline period
+	ComparisonTemplate string
+	// ResponseMode is one of ResponseModeJSON (default), ResponseModeFunction or ResponseModeText
+	ResponseMode string
+	// MaxRepairAttempts is how many times the model is re-prompted with validation errors
+	MaxRepairAttempts int
+	// MetricsTopK is how many metrics related to the question are taken from the metric index,
+	// anomalous series of other metrics are shown too
+	MetricsTopK int
+	// LogsTopK and TracesTopK are how many log chunks and traces are retrieved from the evidence index
+	LogsTopK   int
+	TracesTopK int
+	// AnomalyBaseline is the length of the window before the analyzed one metrics are compared with, zero disables it
+	AnomalyBaseline time.Duration
+	// MetricSeriesTopK is how many of the most anomalous series are put into the prompt
+	MetricSeriesTopK int
+	// SessionTTL is how long a session is kept since it was last accessed
+	SessionTTL time.Duration
+	// MaxSessions limits the sessions kept in memory, each one holds the evidence it collected
+	MaxSessions int
+	// DefaultTimeRange is how far back the analysis looks when neither the request nor the question name a period
+	DefaultTimeRange time.Duration
+	// AgentMaxSteps is how many model requests the agent mode makes at most, the last one must answer
+	AgentMaxSteps int
+	// AgentMaxTokens limits the tokens sent and received by all requests of an agent run
+	AgentMaxTokens int
+	// AgentToolResultTokens is how much of a tool result the model is shown
+	AgentToolResultTokens int
+	// EvidenceTTL is how long the sources cache their query results, a request repeated within it
+	// gets the cached answer without collecting again. Zero always collects.
+	EvidenceTTL time.Duration
+}
+
+// Validate checks required fields and that all templates parse
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Model == "" {
+		errs = append(errs, errors.New("model: must not be empty"))
+	}
+	if strings.TrimSpace(c.SystemPrompt) == "" {
+		errs = append(errs, errors.New("system prompt: must not be empty"))
+	}
+
+	switch c.ResponseMode {
+	case "", ResponseModeJSON, ResponseModeFunction, ResponseModeText:
+	default:
+		errs = append(errs, fmt.Errorf("response mode: unknown mode %q", c.ResponseMode))
+	}
+	if c.MetricSeriesTopK <= 0 {
+		errs = append(errs, fmt.Errorf("metric series top k: must be positive, got %d", c.MetricSeriesTopK))
+	}
+	if c.SessionTTL <= 0 {
+		errs = append(errs, fmt.Errorf("session ttl: must be positive, got %s", c.SessionTTL))
+	}
+	if c.MaxSessions <= 0 {
+		errs = append(errs, fmt.Errorf("max sessions: must be positive, got %d", c.MaxSessions))
+	}
+	if c.DefaultTimeRange <= 0 {
+		errs = append(errs, fmt.Errorf("default time range: must be positive, got %s", c.DefaultTimeRange))
+	}
+	if c.AgentMaxSteps <= 0 {
+		errs = append(errs, fmt.Errorf("agent max steps: must be positive, got %d", c.AgentMaxSteps))
+	}
+	if c.AgentMaxTokens <= 0 {
+		errs = append(errs, fmt.Errorf("agent max tokens: must be positive, got %d", c.AgentMaxTokens))
+	}
+	if c.AgentToolResultTokens <= 0 {
+		errs = append(errs, fmt.Errorf("agent tool result tokens: must be positive, got %d", c.AgentToolResultTokens))
+	}
+	if c.AnomalyBaseline < 0 {
+		errs = append(errs, fmt.Errorf("anomaly baseline: must not be negative, got %s", c.AnomalyBaseline))
+	}
+	if c.ContextWindow < 0 {
+		errs = append(errs, fmt.Errorf("context window: must not be negative, got %d", c.ContextWindow))
+	}
+	if c.MaxRepairAttempts < 0 {
+		errs = append(errs, fmt.Errorf("max repair attempts: must not be negative, got %d", c.MaxRepairAttempts))
+	}
+
+	templates := []struct {
+		name string
+		text string
+	}{
+		{"metrics template", c.MetricsTemplate},
+		{"logs template", c.LogsTemplate},
+		{"traces template", c.TracesTemplate},
+		{"comparison template", c.ComparisonTemplate},
+	}
+	for _, t := range templates {
+		if _, err := template.New(t.name).Parse(t.text); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// templateData is passed to the metrics, logs and traces templates from Config
+type templateData struct {
+	StartTime time.Time
+	EndTime   time.Time
+	// TimeRange is a human readable form of StartTime and EndTime
+	TimeRange string
+	Data      string
+}
+
+func newTemplateData(startTime, endTime time.Time, data []string) templateData {
+	return templateData{
+		StartTime: startTime,
+		EndTime:   endTime,
+		TimeRange: fmt.Sprintf("from %s to %s", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339)),
+		Data:      strings.Join(data, ""),
+	}
+}
+
+type promptTemplates struct {
+	metrics    *template.Template
+	logs       *template.Template
+	traces     *template.Template
+	comparison *template.Template
+}
+
+func newPromptTemplates(config *Config) (*promptTemplates, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	// Validate has already checked that templates parse
+	return &promptTemplates{
+		metrics: template.Must(template.New("metrics").Parse(config.MetricsTemplate)),
+		logs:    template.Must(template.New("logs").Parse(config.LogsTemplate)),
+		traces:  template.Must(template.New("traces").Parse(config.TracesTemplate)),
+
+		comparison: template.Must(template.New("comparison").Parse(config.ComparisonTemplate)),
+	}, nil
+}
+
+func renderTemplate(tmpl *template.Template, data templateData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("execute %s template: %w", tmpl.Name(), err)
+	}
+	return b.String(), nil
 }
 
 type GitInfo struct {
@@ -43,14 +204,28 @@ type GitInfo struct {
 }
 
 func NewAnalyzer(
-	client *openai.Client,
+	providers []llm.LLM,
 	logger *zap.Logger,
-	prometheus *collector.PrometheusCollector,
-	loki *collector.LokiCollector,
-	jaeger *collector.JaegerCollector,
+	collectors *collector.Registry,
+	metricIndex *MetricIndex,
+	evidenceIndex *rag.Index,
 	config *Config,
-	cache *Cache,
+	cache Cache,
 ) (*Analyzer, error) {
+	if len(providers) == 0 {
+		return nil, errors.New("at least one LLM provider is required")
+	}
+
+	templates, err := newPromptTemplates(config)
+	if err != nil {
+		return nil, err
+	}
+
+	prompts, err := newRequestPrompts(config.EvidenceTTL)
+	if err != nil {
+		return nil, err
+	}
+
 	gitInfo, err := getGitInfo()
 	if err != nil {
 		logger.Warn("Failed to get git information", zap.Error(err))
@@ -58,24 +233,54 @@ func NewAnalyzer(
 	}
 
 	return &Analyzer{
-		client:     client,
+		providers:  providers,
 		logger:     logger,
-		prometheus: prometheus,
-		loki:       loki,
-		jaeger:     jaeger,
+		collectors: collectors,
 		config:     config,
 		cache:      cache,
 		gitInfo:    gitInfo,
+		templates:  templates,
+
+		metricIndex:   metricIndex,
+		evidenceIndex: evidenceIndex,
+		tokenizer:     tokenizer.ForModel(config.Model),
+		sessions:      NewSessionStore(config.SessionTTL, config.MaxSessions),
+		flights:       newFlightGroup(),
+		prompts:       prompts,
 	}, nil
 }
 
+type TimeRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Sources of the analyzed period, see ResolvedTimeRange
+const (
+	TimeRangeFromRequest  = "request"
+	TimeRangeFromQuestion = "question"
+	TimeRangeDefault      = "default"
+)
+
+// ResolvedTimeRange is the period that was analyzed and where it came from
+type ResolvedTimeRange struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Source string    `json:"source"`
+	// Phrase is the part of the question the period was inferred from
+	Phrase string `json:"phrase,omitempty"`
+}
+
 type AnalysisRequest struct {
-	Query     string
-	TimeRange struct {
-		Start time.Time
-		End   time.Time
-	}
-	Metrics []string
+	Query string
+	// TimeRange is the period to analyze. Without Start it is inferred from the question,
+	// without End it lasts until now.
+	TimeRange TimeRange
+	// Baseline is an optional reference period, the analysis then explains what changed compared to it
+	Baseline *TimeRange
+	Metrics  []string
+	// Mode is ModePrompt (default) or ModeAgent. Sessions always use ModePrompt.
+	Mode string
 }
 
 type AnalysisResponse struct {
@@ -85,180 +290,504 @@ type AnalysisResponse struct {
 	Suggestions     []string
 }
 
-func (a *Analyzer) Analyze(ctx context.Context, question string, startTime, endTime time.Time, metrics []string) (*LLMResponse, error) {
-	// Check cache first
-	cacheKey := CacheKey{
-		Question:  question,
-		StartTime: startTime,
-		EndTime:   endTime,
-		Metrics:   metrics,
+func (a *Analyzer) Analyze(ctx context.Context, req AnalysisRequest) (*LLMResponse, error) {
+	return a.analyze(ctx, req, nil)
+}
+
+// AnalyzeStream is Analyze that reports collection progress and streams the model answer token by token
+func (a *Analyzer) AnalyzeStream(ctx context.Context, req AnalysisRequest, progress ProgressFunc) (*LLMResponse, error) {
+	result, err := a.analyze(ctx, req, progress)
+	if err != nil {
+		return nil, err
 	}
-	if cached, ok := a.cache.Get(cacheKey); ok {
-		return cached, nil
+
+	progress.emit(Event{Type: EventResult, Result: result})
+	return result, nil
+}
+
+func (a *Analyzer) analyze(ctx context.Context, req AnalysisRequest, progress ProgressFunc) (*LLMResponse, error) {
+	timeRange := a.resolveTimeRange(req, time.Now())
+	req.TimeRange = TimeRange{Start: timeRange.Start, End: timeRange.End}
+
+	// Identical requests made at the same time, e.g. during an incident, share one analysis
+	key := requestKey(req)
+	result, shared, err := a.flights.do(ctx, key, progress, func(ctx context.Context, progress ProgressFunc) (*LLMResponse, error) {
+		return a.runAnalysis(ctx, req, timeRange, progress)
+	})
+	if shared {
+		a.logger.Debug("Joined analysis in flight",
+			zap.String("query", req.Query),
+			zap.String("key", key))
 	}
+	return result, err
+}
 
-	// Collect data from Prometheus
-	prometheusData, err := a.collectPrometheusData(startTime, endTime, metrics)
-	if err != nil {
-		return nil, fmt.Errorf("failed to collect Prometheus data: %v", err)
+// runAnalysis answers the request over the resolved period. The answer may be shared by
+// several requests, it must not be modified.
+func (a *Analyzer) runAnalysis(ctx context.Context, req AnalysisRequest, timeRange ResolvedTimeRange, progress ProgressFunc) (*LLMResponse, error) {
+	switch req.Mode {
+	case "", ModePrompt:
+	case ModeAgent:
+		// Agent runs are not cached, the model picks its queries anew every time
+		result, err := a.runAgent(ctx, req, timeRange, progress)
+		if err != nil {
+			return nil, err
+		}
+		result.TimeRange = &timeRange
+		return result, nil
+	default:
+		return nil, fmt.Errorf("unknown mode %q", req.Mode)
 	}
 
-	// Create a more concise prompt
-	userPrompt := fmt.Sprintf("Question: %s\n\nMetrics data:\n%s\n\nRecent changes:\n%s\n%s",
-		question,
-		strings.Join(prometheusData, ""),
-		a.gitInfo.LastCommitHash,
-		a.gitInfo.LastCommitDiff)
+	// Answers are cached by the prompt, so one is reused whenever the question and the data are
+	// the same. The data of a request can't change while the sources cache it, for that long the
+	// prompt key of the request is remembered and the answer is found without collecting again.
+	reqKey := requestKey(req)
+	if promptKey, ok := a.requestPrompt(reqKey); ok {
+		if answer, ok := a.cachedAnswer(ctx, promptKey, timeRange); ok {
+			return answer, nil
+		}
+	}
 
-	// Create messages for chat completion
-	messages := []openai.ChatCompletionMessage{
-		{
-			Role:    openai.ChatMessageRoleSystem,
-			Content: "You are a system metrics analyzer. Analyze the provided metrics and provide insights. Be concise and focus on key findings. Consider recent code changes when analyzing the metrics.",
-		},
-		{
-			Role:    openai.ChatMessageRoleUser,
-			Content: userPrompt,
-		},
+	set, err := a.gather(ctx, req, timeRange, progress)
+	if err != nil {
+		return nil, err
 	}
 
-	// Send request to OpenAI
-	resp, err := a.client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model:     a.config.Model,
-			Messages:  messages,
-			MaxTokens: a.config.MaxTokens,
-		},
-	)
+	messages, err := a.buildMessages(ctx, req.Query, set, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get chat completion: %v", err)
+		return nil, err
 	}
 
-	// Parse the response
-	result, err := parseLLMResponse(resp.Choices[0].Message.Content)
+	cacheKey := a.promptKey(messages)
+	if answer, ok := a.cachedAnswer(ctx, cacheKey, timeRange); ok {
+		a.rememberPrompt(reqKey, cacheKey)
+		return answer, nil
+	}
+
+	result, err := a.requestAnalysis(ctx, messages, progress)
 	if err != nil {
-		a.logger.Warn("Failed to parse LLM response", zap.Error(err))
-		// Fallback to simple response
-		result = &LLMResponse{
-			Analysis: resp.Choices[0].Message.Content,
-		}
+		return nil, err
 	}
+	result.Notes = set.notes
+	result.TimeRange = &timeRange
 
-	// Cache the result
-	a.cache.Set(cacheKey, result)
+	// Partial results are not cached, the next request may get the full data
+	if len(set.notes) == 0 {
+		if err := a.cache.Set(ctx, cacheKey, result); err != nil {
+			a.logger.Warn("Failed to cache answer", zap.Error(err))
+		}
+		a.rememberPrompt(reqKey, cacheKey)
+	}
 
 	return result, nil
 }
 
-// estimateTokens приблизительно оценивает количество токенов в строке
-// В среднем 1 токен ~ 4 символа для английского текста
-func estimateTokens(text string) int {
-	// Базовое количество токенов для системного промпта и вопроса
-	baseTokens := 100
+// evidenceSet is everything collected for an analysis. Sessions keep it to answer follow-up questions.
+type evidenceSet struct {
+	timeRange ResolvedTimeRange
+	baseline  *TimeRange
+	// query is what the sources were asked, query.Metrics grows with follow-up questions
+	query            collector.Query
+	evidence         []*collector.Evidence
+	baselineEvidence []*collector.Evidence
+	// notes describe sources that failed or returned partial data
+	notes []string
+}
+
+// gather collects evidence of the analyzed period from every registered data source
+func (a *Analyzer) gather(ctx context.Context, req AnalysisRequest, timeRange ResolvedTimeRange, progress ProgressFunc) (*evidenceSet, error) {
+	// Without explicitly chosen metrics all of them are collected. The ones related to the question
+	// are picked when the prompt is built, after ranking, so an unrelated but anomalous one isn't lost.
+	metrics := req.Metrics
+
+	// Metrics are also queried for the requested baseline or the window right before
+	// the analyzed one to tell which of them behave unusually.
+	query := collector.Query{
+		Question: req.Query,
+		Start:    timeRange.Start,
+		End:      timeRange.End,
+		Metrics:  metrics,
+	}
+	switch {
+	case req.Baseline != nil:
+		query.BaselineStart = req.Baseline.Start
+		query.BaselineEnd = req.Baseline.End
+	case a.config.AnomalyBaseline > 0:
+		query.BaselineStart = timeRange.Start.Add(-a.config.AnomalyBaseline)
+		query.BaselineEnd = timeRange.Start
+	}
+	evidence, notes, err := a.collect(ctx, PhaseCollect, a.collectors.Collectors(), query, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &evidenceSet{
+		timeRange: timeRange,
+		baseline:  req.Baseline,
+		query:     query,
+		evidence:  evidence,
+		notes:     notes,
+	}
+
+	// Logs and traces of the baseline are collected separately, it's only needed for comparison
+	if req.Baseline != nil {
+		set.baselineEvidence, set.notes = a.collectBaseline(ctx, evidence, query, set.notes, progress)
+	}
 
-	// Оцениваем количество токенов в тексте
-	// Учитываем, что метрики содержат много чисел и специальных символов
-	tokenCount := len(text) / 3 // Более консервативная оценка
+	if a.evidenceIndex != nil {
+		a.indexEvidence(ctx, evidence)
+	}
 
-	return baseTokens + tokenCount
+	return set, nil
 }
 
-func (a *Analyzer) collectPrometheusData(startTime, endTime time.Time, metrics []string) ([]string, error) {
-	// If no specific metrics are requested, get all available metrics
-	if len(metrics) == 0 {
-		allMetrics, err := a.prometheus.GetAllMetrics()
+// buildMessages renders the evidence chosen for the question into the prompt. history holds
+// earlier questions and answers of a session, they go between the system prompt and the question.
+func (a *Analyzer) buildMessages(ctx context.Context, question string, set *evidenceSet, history []openai.ChatCompletionMessage) ([]openai.ChatCompletionMessage, error) {
+	startTime, endTime := set.timeRange.Start, set.timeRange.End
+
+	var metricsData []collector.MetricData
+	var logsData []collector.LogEntry
+	var tracesData []collector.Span
+	for _, e := range set.evidence {
+		switch e.Kind {
+		case collector.KindMetrics:
+			metricsData = append(metricsData, e.Metrics...)
+		case collector.KindLogs:
+			logsData = append(logsData, e.Logs...)
+		case collector.KindTraces:
+			tracesData = append(tracesData, e.Spans...)
+		}
+	}
+	// Logs of several sources are merged into a single timeline
+	slices.SortStableFunc(logsData, func(a, b collector.LogEntry) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	budget, err := a.newPromptBudget(question, set, history)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sections are filled from the smallest to the largest, each one gets what the previous left unused
+	gitText := a.tokenizer.Truncate(a.gitInfo.LastCommitHash+"\n"+a.gitInfo.LastCommitDiff, budget.take(sectionGit))
+	budget.spend(sectionGit, a.tokenizer.Count(gitText))
+
+	var comparisonLines []string
+	if set.baseline != nil {
+		var comparisonTokens int
+		comparison := compareEvidence(logsData, tracesData, endTime.Sub(startTime),
+			set.baselineEvidence, set.baseline.End.Sub(set.baseline.Start))
+		comparisonLines, comparisonTokens = budget.fit(comparison, budget.take(sectionComparison))
+		budget.spend(sectionComparison, comparisonTokens)
+	}
+
+	// With an evidence index traces related to the question are added next to the summary
+	// and logs are chosen by relevance to the question instead of recency
+	traceTokens := budget.take(sectionTraces)
+	var retrievedTraces []string
+	var retrievedTraceTokens int
+	if a.evidenceIndex != nil {
+		retrievedTraces, retrievedTraceTokens = a.retrieve(ctx, question, rag.KindSpan, startTime, endTime, a.config.TracesTopK, traceTokens/3)
+	}
+	traceLines, summaryTokens := a.selectTraces(tracesData, budget, traceTokens-retrievedTraceTokens)
+	if len(retrievedTraces) > 0 {
+		traceLines = append(traceLines, "Traces related to the question:\n")
+		traceLines = append(traceLines, retrievedTraces...)
+	}
+	budget.spend(sectionTraces, summaryTokens+retrievedTraceTokens)
+
+	logTokens := budget.take(sectionLogs)
+	var logLines []string
+	var usedLogTokens int
+	if a.evidenceIndex != nil {
+		logLines, usedLogTokens = a.retrieve(ctx, question, rag.KindLog, startTime, endTime, a.config.LogsTopK, logTokens)
+	}
+	if len(logLines) == 0 {
+		logLines, usedLogTokens = a.selectLogs(logsData, budget, logTokens)
+	}
+	budget.spend(sectionLogs, usedLogTokens)
+
+	// Chosen metrics are all wanted, of all metrics only those related to the question
+	var related []string
+	if len(set.query.Metrics) == 0 {
+		related = a.searchMetrics(ctx, question)
+	}
+	metricLines, usedMetricTokens := a.selectMetrics(metricsData, related, set.baseline != nil, budget, budget.take(sectionMetrics))
+	budget.spend(sectionMetrics, usedMetricTokens)
+
+	// Render the configured templates for every kind of evidence
+	var sections []string
+	for _, section := range []struct {
+		tmpl *template.Template
+		data []string
+	}{
+		{a.templates.metrics, metricLines},
+		{a.templates.logs, logLines},
+		{a.templates.traces, traceLines},
+	} {
+		text, err := renderTemplate(section.tmpl, newTemplateData(startTime, endTime, section.data))
 		if err != nil {
-			return nil, fmt.Errorf("failed to get all metrics: %v", err)
+			return nil, fmt.Errorf("failed to render prompt: %v", err)
 		}
-		metrics = allMetrics
+		sections = append(sections, text)
+	}
+	if set.baseline != nil {
+		text, err := renderTemplate(a.templates.comparison, newTemplateData(set.baseline.Start, set.baseline.End, comparisonLines))
+		if err != nil {
+			return nil, fmt.Errorf("failed to render prompt: %v", err)
+		}
+		sections = append(sections, text)
 	}
 
-	// Filter important metrics
-	importantMetrics := []string{
-		"machine_cpu_cores",
-		"machine_cpu_physical_cores",
-		"machine_memory_bytes",
-		// "process_cpu_seconds_total",
-		// "process_resident_memory_bytes",
-		// "container_cpu_usage_seconds_total",
-		// "container_memory_usage_bytes",
-		"grpc_server_handled_total",
+	// Tell the model which data is missing so it doesn't read a timeout as an absence of problems
+	if len(set.notes) > 0 {
+		sections = append(sections, "Data collection notes:\n- "+strings.Join(set.notes, "\n- ")+"\n")
 	}
 
-	// Create a map of important metrics for quick lookup
-	importantMap := make(map[string]bool)
-	for _, m := range importantMetrics {
-		importantMap[m] = true
+	userPrompt := fmt.Sprintf("Question: %s\n\n%s\n\nRecent changes:\n%s",
+		question,
+		strings.Join(sections, "\n"),
+		gitText)
+
+	// Create messages for chat completion
+	messages := []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: a.config.SystemPrompt,
+		},
 	}
+	messages = append(messages, history...)
+	messages = append(messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: userPrompt,
+	})
 
-	// Максимальное количество токенов для входных данных
-	// Оставляем место для системного промпта и ответа
-	maxInputTokens := 20000
+	return messages, nil
+}
 
-	// Collect data for each metric, prioritizing important ones
-	var result []string
-	var totalTokens int
+// resolveTimeRange returns the requested period. Without one the period the question names is
+// analyzed, e.g. "what happened in the last 30 minutes", otherwise the last DefaultTimeRange.
+// The period is widened to the step boundaries of metric queries, so requests made seconds
+// apart analyze the same period and share cached data and answers.
+func (a *Analyzer) resolveTimeRange(req AnalysisRequest, now time.Time) ResolvedTimeRange {
+	var result ResolvedTimeRange
+	if !req.TimeRange.Start.IsZero() {
+		end := req.TimeRange.End
+		if end.IsZero() {
+			end = now
+		}
+		result = ResolvedTimeRange{Start: req.TimeRange.Start, End: end, Source: TimeRangeFromRequest}
+	} else if start, end, phrase, ok := timerange.FromQuestion(req.Query, now); ok {
+		result = ResolvedTimeRange{Start: start, End: end, Source: TimeRangeFromQuestion, Phrase: phrase}
+	} else {
+		result = ResolvedTimeRange{Start: now.Add(-a.config.DefaultTimeRange), End: now, Source: TimeRangeDefault}
+	}
 
-	for _, metric := range metrics {
-		// Пропускаем неважные метрики, если уже набрали достаточно данных
-		if totalTokens >= maxInputTokens && !importantMap[metric] {
-			continue
+	result.Start, result.End = collector.AlignWindow(result.Start, result.End)
+	return result
+}
+
+// collect queries the sources one by one. A failing source is skipped, the collection only fails if none succeeded
+// or ctx is done. The returned notes describe sources that failed or returned partial data.
+func (a *Analyzer) collect(ctx context.Context, phase string, collectors []collector.Collector, q collector.Query, progress ProgressFunc) ([]*collector.Evidence, []string, error) {
+	var result []*collector.Evidence
+	var notes []string
+	var errs []error
+	for _, c := range collectors {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, fmt.Errorf("failed to collect data: %w", err)
 		}
 
-		data, err := a.prometheus.GetMetricData(metric, startTime, endTime)
+		progress.emit(Event{Type: EventProgress, Phase: phase, Source: c.Name(), Status: StatusStarted})
+
+		e, err := c.Collect(ctx, q)
 		if err != nil {
-			a.logger.Warn("Failed to get metric data",
-				zap.String("metric", metric),
+			a.logger.Warn("Failed to collect data",
+				zap.String("phase", phase),
+				zap.String("source", c.Name()),
 				zap.Error(err))
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name(), err))
+			notes = append(notes, fmt.Sprintf("%s is unavailable: %v", c.Name(), err))
+			progress.emit(Event{Type: EventProgress, Phase: phase, Source: c.Name(), Status: StatusFailed, Error: err.Error()})
 			continue
 		}
-		if data == "" {
+		result = append(result, e)
+		notes = append(notes, e.Notes...)
+		progress.emit(Event{Type: EventProgress, Phase: phase, Source: c.Name(), Status: StatusDone})
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to collect data: %w", err)
+	}
+	if len(collectors) > 0 && len(result) == 0 {
+		return nil, nil, fmt.Errorf("failed to collect data from any source: %w", errors.Join(errs...))
+	}
+
+	return result, notes, nil
+}
+
+// collectBaseline queries the baseline window from the sources that returned logs or traces,
+// metric sources have already returned their baseline series. The analysis goes on without
+// the baseline if it can't be collected, the notes tell the model about it.
+func (a *Analyzer) collectBaseline(ctx context.Context, evidence []*collector.Evidence, q collector.Query, notes []string, progress ProgressFunc) ([]*collector.Evidence, []string) {
+	var collectors []collector.Collector
+	for _, e := range evidence {
+		if e.Kind == collector.KindMetrics {
 			continue
 		}
+		if c, ok := a.collectors.Get(e.Source); ok {
+			collectors = append(collectors, c)
+		}
+	}
+	if len(collectors) == 0 {
+		return nil, notes
+	}
+
+	baseline, baselineNotes, err := a.collect(ctx, PhaseBaseline, collectors, collector.Query{
+		Question: q.Question,
+		Start:    q.BaselineStart,
+		End:      q.BaselineEnd,
+	}, progress)
+	if err != nil {
+		a.logger.Warn("Failed to collect baseline", zap.Error(err))
+		return nil, append(notes, fmt.Sprintf("logs and traces of the baseline period are unavailable: %v", err))
+	}
+
+	for _, note := range baselineNotes {
+		notes = append(notes, "baseline: "+note)
+	}
+	return baseline, notes
+}
 
-		// Оцениваем количество токенов для новой метрики
-		metricData := fmt.Sprintf("Metric: %s\n", data)
-		metricTokens := estimateTokens(metricData)
+// selectMetrics fits the most anomalous series into maxTokens, each with the reason it was picked
+// and, when comparing with a baseline, with its change from the baseline. Series of metrics not in
+// related are only taken if they are anomalous, nil related means every metric is related.
+// Metrics that come as text only can't be ranked and fill what is left.
+func (a *Analyzer) selectMetrics(metrics []collector.MetricData, related []string, compare bool, budget *promptBudget, maxTokens int) ([]string, int) {
+	var result []string
+	var totalTokens int
+	var anomalous int
+
+	ranked := rankSeries(metrics)
+	if related != nil {
+		ranked = slices.DeleteFunc(ranked, func(series rankedSeries) bool {
+			return series.score < anomalyThreshold && !slices.Contains(related, series.metric)
+		})
+	}
+	for _, series := range ranked[:min(a.config.MetricSeriesTopK, len(ranked))] {
+		text := formatSeries(series.metric, series.series)
+		if text == "" {
+			continue
+		}
+		metricData := "Metric: " + text
+		if series.score >= anomalyThreshold {
+			metricData += "  anomaly: " + series.anomaly.String() + "\n"
+			anomalous++
+		}
+		if compare {
+			if delta := seriesDelta(series.metric, series.series.Points, series.baseline); delta != "" {
+				metricData += "  vs baseline: " + delta + "\n"
+			}
+		}
 
 		// Если добавление этой метрики превысит лимит, пропускаем её
-		if totalTokens+metricTokens > maxInputTokens && !importantMap[metric] {
+		metricTokens := budget.tokenizer.Count(metricData)
+		if totalTokens+metricTokens > maxTokens {
+			continue
+		}
+
+		result = append(result, metricData)
+		totalTokens += metricTokens
+	}
+
+	for _, metric := range metrics {
+		if len(metric.Series) > 0 || metric.Text == "" {
+			continue
+		}
+		if related != nil && !slices.Contains(related, metric.Name) {
 			continue
 		}
 
-		// Для важных метрик добавляем в начало
-		if importantMap[metric] {
-			result = append([]string{metricData}, result...)
-		} else {
-			result = append(result, metricData)
+		metricData := fmt.Sprintf("Metric: %s\n", metric.Text)
+		metricTokens := budget.tokenizer.Count(metricData)
+		if totalTokens+metricTokens > maxTokens {
+			continue
 		}
 
+		result = append(result, metricData)
 		totalTokens += metricTokens
 	}
 
 	a.logger.Debug("Collected metrics data",
-		zap.Int("total_metrics", len(result)),
-		zap.Int("estimated_tokens", totalTokens))
+		zap.Int("total_series", len(ranked)),
+		zap.Int("anomalous_series", anomalous),
+		zap.Int("selected", len(result)),
+		zap.Int("tokens", totalTokens),
+		zap.Int("budget", maxTokens))
 
-	return result, nil
+	return result, totalTokens
 }
 
-func findBestMatch(userQuery string, data []string) []string {
-	matches := map[int][]string{}
-	for _, target := range data {
-		rank := fuzzy.RankMatchNormalizedFold(userQuery, target)
-		matches[rank] = append(matches[rank], target)
+// selectLogs takes the most recent lines that fit into maxTokens
+func (a *Analyzer) selectLogs(entries []collector.LogEntry, budget *promptBudget, maxTokens int) ([]string, int) {
+	var result []string
+	var totalTokens int
+
+	// Самые свежие строки обычно полезнее, поэтому идём с конца окна
+	for _, entry := range slices.Backward(entries) {
+		line := entry.String() + "\n"
+		lineTokens := budget.tokenizer.Count(line)
+		if totalTokens+lineTokens > maxTokens {
+			break
+		}
+
+		result = append(result, line)
+		totalTokens += lineTokens
 	}
+	slices.Reverse(result)
 
-	ranks := slices.Collect(maps.Keys(matches))
-	slices.Sort(ranks)
+	a.logger.Debug("Collected logs data",
+		zap.Int("total_lines", len(result)),
+		zap.Int("tokens", totalTokens),
+		zap.Int("budget", maxTokens))
 
-	var result []string
-	for _, rank := range slices.Backward(ranks) {
-		result = append(result, matches[rank]...)
+	return result, totalTokens
+}
+
+// selectTraces summarizes spans and cuts the summary to maxTokens
+func (a *Analyzer) selectTraces(spans []collector.Span, budget *promptBudget, maxTokens int) ([]string, int) {
+	// Сводка уже упорядочена по важности, поэтому просто обрезаем хвост
+	result, totalTokens := budget.fit(summarizeTraces(spans), maxTokens)
+
+	a.logger.Debug("Collected traces data",
+		zap.Int("total_spans", len(spans)),
+		zap.Int("summary_lines", len(result)),
+		zap.Int("tokens", totalTokens),
+		zap.Int("budget", maxTokens))
+
+	return result, totalTokens
+}
+
+// searchMetrics returns the metrics most related to the question, nil when the index is not
+// available, which means "all metrics"
+func (a *Analyzer) searchMetrics(ctx context.Context, question string) []string {
+	if a.metricIndex == nil {
+		return nil
 	}
 
-	return result
+	metrics, err := a.metricIndex.Search(ctx, question, a.config.MetricsTopK)
+	if err != nil {
+		a.logger.Warn("Failed to search metric index", zap.Error(err))
+		return nil
+	}
+
+	a.logger.Debug("Selected metrics for question",
+		zap.String("question", question),
+		zap.Strings("metrics", metrics))
+
+	return metrics
 }
 
 func getGitInfo() (*GitInfo, error) {
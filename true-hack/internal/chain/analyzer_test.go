@@ -0,0 +1,248 @@
+package chain
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/llm"
+
+	"go.uber.org/zap"
+)
+
+const testAnswer = `{"analysis": "Errors of the api started after the deploy", "confidence": 0.8, "suggestions": ["Roll back the deploy"], "relevant_metrics": []}`
+
+// countingCollector returns a log line of the queried period and counts its calls
+type countingCollector struct {
+	calls atomic.Int32
+}
+
+func (c *countingCollector) Name() string {
+	return "logs"
+}
+
+func (c *countingCollector) Collect(_ context.Context, q collector.Query) (*collector.Evidence, error) {
+	c.calls.Add(1)
+	return &collector.Evidence{
+		Source: c.Name(),
+		Kind:   collector.KindLogs,
+		Logs: []collector.LogEntry{{
+			Timestamp: q.End.Add(-time.Minute),
+			Labels:    map[string]string{"app": "api"},
+			Line:      "request failed: connection refused",
+		}},
+	}, nil
+}
+
+func testConfig() *Config {
+	return &Config{
+		Model:              "gpt-4o",
+		MaxTokens:          1000,
+		SystemPrompt:       "You analyze incidents.",
+		MetricsTemplate:    "Metrics: {{.Data}}",
+		LogsTemplate:       "Logs: {{.Data}}",
+		TracesTemplate:     "Traces: {{.Data}}",
+		ComparisonTemplate: "Changes: {{.Data}}",
+		MetricSeriesTopK:   10,
+		SessionTTL:         time.Hour,
+		MaxSessions:        10,
+		DefaultTimeRange:   time.Hour,
+		AgentMaxSteps:      3,
+		AgentMaxTokens:     10000,
+
+		AgentToolResultTokens: 1000,
+	}
+}
+
+func newTestAnalyzer(t *testing.T, config *Config, providers ...llm.LLM) (*Analyzer, *countingCollector) {
+	t.Helper()
+
+	source := &countingCollector{}
+	collectors, err := collector.NewRegistry(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answers, err := NewMemoryCache(time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	analyzer, err := NewAnalyzer(providers, zap.NewNop(), collectors, nil, nil, config, answers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return analyzer, source
+}
+
+func testRequest() AnalysisRequest {
+	end := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	return AnalysisRequest{
+		Query:     "Why does the api fail?",
+		TimeRange: TimeRange{Start: end.Add(-time.Hour), End: end},
+	}
+}
+
+func TestAnalyzeCachedAnswer(t *testing.T) {
+	tests := []struct {
+		name        string
+		evidenceTTL time.Duration
+		wantCollect int32
+	}{
+		{name: "repeated request skips collection", evidenceTTL: 10 * time.Minute, wantCollect: 1},
+		{name: "without evidence ttl collection runs again", evidenceTTL: 0, wantCollect: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.EvidenceTTL = tt.evidenceTTL
+			provider := llm.NewFake("fake", testAnswer)
+			analyzer, source := newTestAnalyzer(t, config, provider)
+
+			for i := range 2 {
+				result, err := analyzer.Analyze(t.Context(), testRequest())
+				if err != nil {
+					t.Fatalf("analysis %d: %v", i, err)
+				}
+				if result.Analysis == "" || result.TimeRange == nil {
+					t.Fatalf("analysis %d: got %+v", i, result)
+				}
+			}
+
+			if got := source.calls.Load(); got != tt.wantCollect {
+				t.Errorf("collected %d times, want %d", got, tt.wantCollect)
+			}
+			if got := provider.Calls(); got != 1 {
+				t.Errorf("model was asked %d times, want 1", got)
+			}
+		})
+	}
+}
+
+func TestSelectMetricsRelated(t *testing.T) {
+	analyzer, _ := newTestAnalyzer(t, testConfig(), llm.NewFake("fake", testAnswer))
+	budget := &promptBudget{tokenizer: analyzer.tokenizer}
+
+	flat := func() []collector.Series {
+		return []collector.Series{{Points: testPoints(time.Minute, levels(30, 10, 0.1)...)}}
+	}
+	metrics := []collector.MetricData{
+		{Name: "http_requests_total", Series: flat()},
+		{Name: "node_memory_bytes", Series: flat()},
+		// Nothing in its name relates it to the question, but it stepped
+		{Name: "node_disk_io_seconds", Series: []collector.Series{{
+			Points: testPoints(time.Minute, append(levels(15, 10, 0.1), levels(15, 50, 0.1)...)...),
+		}}},
+		{Name: "build_info", Text: "build_info 1.2.3"},
+	}
+
+	tests := []struct {
+		name    string
+		related []string
+		want    []string // line prefixes in order
+	}{
+		{
+			name:    "all metrics are related without an index",
+			related: nil,
+			want:    []string{"Metric: node_disk_io_seconds", "Metric: http_requests_total", "Metric: node_memory_bytes", "Metric: build_info"},
+		},
+		{
+			name:    "anomalous metric passes regardless of relation",
+			related: []string{"http_requests_total"},
+			want:    []string{"Metric: node_disk_io_seconds", "Metric: http_requests_total"},
+		},
+		{
+			name:    "related text metric",
+			related: []string{"build_info"},
+			want:    []string{"Metric: node_disk_io_seconds", "Metric: build_info"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, _ := analyzer.selectMetrics(metrics, tt.related, false, budget, 10000)
+			if len(lines) != len(tt.want) {
+				t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(tt.want), strings.Join(lines, ""))
+			}
+			for i, prefix := range tt.want {
+				if !strings.HasPrefix(lines[i], prefix) {
+					t.Errorf("line %d is %q, want %s", i, lines[i], prefix)
+				}
+			}
+			if !strings.Contains(lines[0], "anomaly:") {
+				t.Errorf("first line is not marked as an anomaly: %q", lines[0])
+			}
+		})
+	}
+}
+
+// slowCollector stands for a source that times out: it returns what it got so far with a note,
+// or fails if it got nothing
+type slowCollector struct {
+	name    string
+	partial bool
+	calls   atomic.Int32
+}
+
+func (c *slowCollector) Name() string {
+	return c.name
+}
+
+func (c *slowCollector) Collect(_ context.Context, q collector.Query) (*collector.Evidence, error) {
+	c.calls.Add(1)
+	if !c.partial {
+		return nil, context.DeadlineExceeded
+	}
+	return &collector.Evidence{
+		Source: c.name,
+		Kind:   collector.KindLogs,
+		Logs:   []collector.LogEntry{{Timestamp: q.End, Line: "request failed"}},
+		Notes:  []string{c.name + " timed out after 1s, logs before 12:00 are missing"},
+	}, nil
+}
+
+func TestAnalyzeSlowSources(t *testing.T) {
+	partial := &slowCollector{name: "loki", partial: true}
+	failed := &slowCollector{name: "jaeger"}
+	collectors, err := collector.NewRegistry(partial, failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := llm.NewFake("fake", testAnswer).Record()
+	answers, err := NewMemoryCache(time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	analyzer, err := NewAnalyzer([]llm.LLM{provider}, zap.NewNop(), collectors, nil, nil, testConfig(), answers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2 {
+		result, err := analyzer.Analyze(t.Context(), testRequest())
+		if err != nil {
+			t.Fatalf("analysis %d: %v", i, err)
+		}
+		want := []string{
+			"loki timed out after 1s, logs before 12:00 are missing",
+			"jaeger is unavailable: context deadline exceeded",
+		}
+		if !slices.Equal(result.Notes, want) {
+			t.Errorf("analysis %d: notes = %q, want %q", i, result.Notes, want)
+		}
+	}
+
+	// The model is told what is missing
+	prompt := provider.Requests()[0].Messages
+	if last := prompt[len(prompt)-1].Content; !strings.Contains(last, "jaeger is unavailable") {
+		t.Errorf("prompt doesn't mention the missing source:\n%s", last)
+	}
+	// Partial answers are not cached, the sources are asked again
+	if got := partial.calls.Load(); got != 2 {
+		t.Errorf("collected %d times, want 2", got)
+	}
+}
@@ -0,0 +1,166 @@
+package chain
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"true-hack/internal/collector"
+)
+
+const (
+	// anomalyThreshold is the robust z-score from which a series is reported as anomalous
+	anomalyThreshold = 3.5
+	// minBaselinePoints is how many baseline points are needed to trust its median and spread
+	minBaselinePoints = 5
+	// maxScore caps scores of series that leave a flat baseline, their deviation is infinite in theory
+	maxScore = 1000
+)
+
+// counterSuffixes mark Prometheus counters, their raw values only grow, so their rate is analyzed instead
+var counterSuffixes = []string{"_total", "_count", "_sum", "_bucket"}
+
+// anomaly explains how unusual a series is
+type anomaly struct {
+	// score is the largest deviation found, in robust standard deviations
+	score   float64
+	reasons []string
+}
+
+// rankedSeries is a series with its anomaly, see rankSeries
+type rankedSeries struct {
+	metric   string
+	series   collector.Series
+	baseline []collector.Point
+	anomaly
+}
+
+// rankSeries scores every series against its baseline and its own changepoints,
+// the most anomalous first. Ties keep the order of metrics, so the ranking is deterministic.
+func rankSeries(metrics []collector.MetricData) []rankedSeries {
+	var result []rankedSeries
+	for _, m := range metrics {
+		baselines := make(map[string][]collector.Point, len(m.Baseline))
+		for _, s := range m.Baseline {
+			baselines[s.LabelString()] = s.Points
+		}
+
+		for _, s := range m.Series {
+			baseline := baselines[s.LabelString()]
+			result = append(result, rankedSeries{
+				metric:   m.Name,
+				series:   s,
+				baseline: baseline,
+				anomaly:  detectAnomaly(m.Name, s.Points, baseline),
+			})
+		}
+	}
+
+	slices.SortStableFunc(result, func(a, b rankedSeries) int {
+		return cmp.Compare(b.score, a.score)
+	})
+	return result
+}
+
+// detectAnomaly compares the window with the baseline using the median and the median absolute
+// deviation, which unlike the mean and the standard deviation are not skewed by the spikes we
+// are looking for, and looks for step changes within the window
+func detectAnomaly(name string, points, baseline []collector.Point) anomaly {
+	points = cleanPoints(points)
+	baseline = cleanPoints(baseline)
+
+	what := "value"
+	if isCounter(name) {
+		points = counterRate(points)
+		baseline = counterRate(baseline)
+		what = "rate"
+	}
+
+	var result anomaly
+	if len(points) == 0 {
+		return result
+	}
+
+	if len(baseline) >= minBaselinePoints {
+		current := values(points)
+		reference := values(baseline)
+
+		level := median(reference)
+		spread := mad(reference)
+		if spread == 0 {
+			// A constant baseline, any deviation from it is unusual. Scale by the level
+			// so a change by a thousandth counts as one deviation.
+			spread = math.Max(math.Abs(level)*1e-3, 1e-9)
+		}
+
+		// The median of the window catches a sustained shift, the peak catches short spikes
+		shift := math.Max(math.Min((median(current)-level)/spread, maxScore), -maxScore)
+		peak := math.Max(math.Min((extreme(current, level)-level)/spread, maxScore), -maxScore)
+
+		if math.Abs(shift) >= anomalyThreshold {
+			result.add(math.Abs(shift), fmt.Sprintf("median %s is %s vs baseline %s (z=%+.1f)",
+				what, formatValue(median(current)), formatValue(level), shift))
+		}
+		if math.Abs(peak) >= anomalyThreshold && math.Abs(peak) > 2*math.Abs(shift) {
+			result.add(math.Abs(peak), fmt.Sprintf("%s peaked at %s vs baseline %s (z=%+.1f)",
+				what, formatValue(extreme(current, level)), formatValue(level), peak))
+		}
+	}
+
+	for _, step := range findStepChanges(points) {
+		result.add(step.score, fmt.Sprintf("%s stepped from %s to %s at %s",
+			what, formatValue(step.before), formatValue(step.after), step.time.Format(time.RFC3339)))
+	}
+
+	return result
+}
+
+func (a *anomaly) add(score float64, reason string) {
+	a.score = max(a.score, score)
+	a.reasons = append(a.reasons, reason)
+}
+
+func (a anomaly) String() string {
+	return strings.Join(a.reasons, "; ")
+}
+
+func isCounter(name string) bool {
+	return slices.ContainsFunc(counterSuffixes, func(suffix string) bool {
+		return strings.HasSuffix(name, suffix)
+	})
+}
+
+// counterRate turns counter values into per second rates, a decrease is a counter reset
+func counterRate(points []collector.Point) []collector.Point {
+	if len(points) < 2 {
+		return nil
+	}
+
+	rates := make([]collector.Point, 0, len(points)-1)
+	for i := 1; i < len(points); i++ {
+		seconds := points[i].Time.Sub(points[i-1].Time).Seconds()
+		if seconds <= 0 {
+			continue
+		}
+		delta := points[i].Value - points[i-1].Value
+		if delta < 0 {
+			delta = points[i].Value
+		}
+		rates = append(rates, collector.Point{Time: points[i].Time, Value: delta / seconds})
+	}
+	return rates
+}
+
+// extreme returns the value farthest from level
+func extreme(values []float64, level float64) float64 {
+	result := values[0]
+	for _, v := range values[1:] {
+		if math.Abs(v-level) > math.Abs(result-level) {
+			result = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,276 @@
+package chain
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/llm"
+)
+
+func TestDetectAnomaly(t *testing.T) {
+	baselinePoints := func(values ...float64) []collector.Point {
+		points := testPoints(time.Minute, values...)
+		for i := range points {
+			points[i].Time = points[i].Time.Add(-time.Hour)
+		}
+		return points
+	}
+
+	tests := []struct {
+		name       string
+		metric     string
+		points     []collector.Point
+		baseline   []collector.Point
+		wantScore  float64
+		wantReason string
+	}{
+		{
+			name:     "flat",
+			metric:   "queue_size",
+			points:   testPoints(time.Minute, levels(30, 10, 0)...),
+			baseline: baselinePoints(levels(30, 10, 0)...),
+		},
+		{
+			name:     "noise like the baseline",
+			metric:   "queue_size",
+			points:   testPoints(time.Minute, levels(30, 10, 1)...),
+			baseline: baselinePoints(levels(31, 10, 1)...),
+		},
+		{
+			name:       "spike",
+			metric:     "queue_size",
+			points:     testPoints(time.Minute, append(levels(15, 10, 1), append([]float64{100}, levels(14, 10, 1)...)...)...),
+			baseline:   baselinePoints(levels(31, 10, 1)...),
+			wantScore:  anomalyThreshold,
+			wantReason: "value peaked at 100",
+		},
+		{
+			name:       "sustained shift",
+			metric:     "queue_size",
+			points:     testPoints(time.Minute, levels(30, 20, 1)...),
+			baseline:   baselinePoints(levels(31, 10, 1)...),
+			wantScore:  anomalyThreshold,
+			wantReason: "median value is",
+		},
+		{
+			name:       "step change without baseline",
+			metric:     "queue_size",
+			points:     testPoints(time.Minute, append(levels(20, 10, 0.1), levels(20, 20, 0.1)...)...),
+			wantScore:  stepThreshold,
+			wantReason: "value stepped from",
+		},
+		{
+			// Too few baseline points to trust, only the window itself is looked at
+			name:     "short baseline",
+			metric:   "queue_size",
+			points:   testPoints(time.Minute, levels(30, 20, 0)...),
+			baseline: baselinePoints(levels(minBaselinePoints-1, 10, 0)...),
+		},
+		{
+			name:     "empty window",
+			metric:   "queue_size",
+			baseline: baselinePoints(levels(30, 10, 0)...),
+		},
+		{
+			// MAD of a constant baseline is 0, a thousandth of its level counts as a deviation
+			name:       "constant baseline small change",
+			metric:     "queue_size",
+			points:     testPoints(time.Minute, levels(30, 10.05, 0)...),
+			baseline:   baselinePoints(levels(30, 10, 0)...),
+			wantScore:  5,
+			wantReason: "median value is 10.05 vs baseline 10 (z=+5.0)",
+		},
+		{
+			name:       "constant zero baseline",
+			metric:     "queue_size",
+			points:     testPoints(time.Minute, levels(30, 1, 0)...),
+			baseline:   baselinePoints(levels(30, 0, 0)...),
+			wantScore:  maxScore,
+			wantReason: "median value is 1 vs baseline 0 (z=+1000.0)",
+		},
+		{
+			// Counters are compared by rate, growing at the usual rate is normal
+			name:     "counter growing as usual",
+			metric:   "http_requests_total",
+			points:   testPoints(time.Minute, ramp(30, 1000)...),
+			baseline: baselinePoints(ramp(30, 0)...),
+		},
+		{
+			name:     "counter reset",
+			metric:   "http_requests_total",
+			points:   testPoints(time.Minute, append(ramp(15, 1000), ramp(15, 1)...)...),
+			baseline: baselinePoints(ramp(30, 0)...),
+		},
+		{
+			name:       "counter rate grows",
+			metric:     "http_requests_total",
+			points:     testPoints(time.Minute, 0, 60, 180, 360, 600, 900),
+			baseline:   baselinePoints(ramp(30, 0)...),
+			wantScore:  anomalyThreshold,
+			wantReason: "median rate is",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := detectAnomaly(tt.metric, tt.points, tt.baseline)
+			if tt.wantReason == "" {
+				if got.score != 0 || len(got.reasons) != 0 {
+					t.Errorf("got score %v: %s, want no anomaly", got.score, got)
+				}
+				return
+			}
+
+			if got.score < tt.wantScore-1e-6 {
+				t.Errorf("score = %v, want at least %v", got.score, tt.wantScore)
+			}
+			if got.score > maxScore {
+				t.Errorf("score = %v is above the cap of %v", got.score, maxScore)
+			}
+			if !strings.Contains(got.String(), tt.wantReason) {
+				t.Errorf("reasons %q don't contain %q", got, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestCounterRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []collector.Point
+		want   []float64
+	}{
+		{name: "empty", points: nil, want: nil},
+		{name: "single point", points: testPoints(10*time.Second, 5), want: nil},
+		{name: "growing", points: testPoints(10*time.Second, 0, 100, 300), want: []float64{10, 20}},
+		{name: "reset", points: testPoints(10*time.Second, 0, 100, 200, 50, 150), want: []float64{10, 10, 5, 10}},
+		{name: "reset to zero", points: testPoints(10*time.Second, 100, 0, 100), want: []float64{0, 10}},
+		{
+			name: "duplicate timestamps",
+			points: []collector.Point{
+				{Time: seriesStart, Value: 0},
+				{Time: seriesStart, Value: 10},
+				{Time: seriesStart.Add(10 * time.Second), Value: 110},
+			},
+			want: []float64{10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := values(counterRate(tt.points))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got rates %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if math.Abs(got[i]-tt.want[i]) > 1e-9 {
+					t.Errorf("got rates %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestRankSeries(t *testing.T) {
+	baseline := func(labels map[string]string, level float64) collector.Series {
+		points := testPoints(time.Minute, levels(30, level, 1)...)
+		for i := range points {
+			points[i].Time = points[i].Time.Add(-time.Hour)
+		}
+		return collector.Series{Labels: labels, Points: points}
+	}
+	window := func(labels map[string]string, values ...float64) collector.Series {
+		return collector.Series{Labels: labels, Points: testPoints(time.Minute, values...)}
+	}
+	api := map[string]string{"job": "api"}
+	db := map[string]string{"job": "db"}
+
+	metrics := []collector.MetricData{
+		{
+			Name:     "cpu",
+			Series:   []collector.Series{window(api, levels(30, 10, 1)...), window(db, levels(30, 30, 1)...)},
+			Baseline: []collector.Series{baseline(db, 10), baseline(api, 10)},
+		},
+		{
+			Name:     "memory",
+			Series:   []collector.Series{window(api, levels(30, 20, 1)...), window(db, levels(30, 10, 1)...)},
+			Baseline: []collector.Series{baseline(api, 10), baseline(db, 10)},
+		},
+		{
+			// Without baseline and changes nothing stands out
+			Name:   "disk",
+			Series: []collector.Series{window(api, levels(30, 50, 1)...)},
+		},
+	}
+
+	ranked := rankSeries(metrics)
+	var order []string
+	for _, r := range ranked {
+		order = append(order, r.metric+r.series.LabelString())
+	}
+	// Shifts by 20 and 10 first, then the series without anomalies in the order of metrics
+	want := "cpu{job=db} memory{job=api} cpu{job=api} memory{job=db} disk{job=api}"
+	if got := strings.Join(order, " "); got != want {
+		t.Errorf("ranked %s, want %s", got, want)
+	}
+
+	// Series are matched with the baseline of the same labels
+	if got := ranked[0].baseline; len(got) != 30 || math.Abs(median(values(got))-10) > 1 {
+		t.Errorf("cpu{job=db} got a baseline of %d points around %v", len(got), median(values(got)))
+	}
+	if ranked[0].score <= ranked[1].score || ranked[1].score < anomalyThreshold {
+		t.Errorf("scores %v and %v, want anomalous and decreasing", ranked[0].score, ranked[1].score)
+	}
+	for _, r := range ranked[2:] {
+		if r.score != 0 {
+			t.Errorf("%s%s scored %v: %s", r.metric, r.series.LabelString(), r.score, r.anomaly)
+		}
+	}
+}
+
+func TestSelectMetricsTopK(t *testing.T) {
+	config := testConfig()
+	config.MetricSeriesTopK = 2
+	analyzer, _ := newTestAnalyzer(t, config, llm.NewFake("fake", testAnswer))
+	budget := &promptBudget{tokenizer: analyzer.tokenizer}
+
+	var series []collector.Series
+	for _, job := range []string{"api", "db", "cache"} {
+		series = append(series, collector.Series{
+			Labels: map[string]string{"job": job},
+			Points: testPoints(time.Minute, levels(30, 10, 0.1)...),
+		})
+	}
+	// The db series steps, it must come first and be the only one marked as an anomaly
+	series[1].Points = testPoints(time.Minute, append(levels(15, 10, 0.1), levels(15, 50, 0.1)...)...)
+	metrics := []collector.MetricData{
+		{Name: "cpu", Series: series},
+		{Name: "version", Text: "build_info 1.2.3"},
+	}
+
+	lines, tokens := analyzer.selectMetrics(metrics, nil, false, budget, 10000)
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want top 2 series and the text metric:\n%s", len(lines), strings.Join(lines, ""))
+	}
+	if !strings.HasPrefix(lines[0], "Metric: cpu{job=db}") || !strings.Contains(lines[0], "anomaly: value stepped") {
+		t.Errorf("first line is %q, want the anomalous cpu{job=db}", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "Metric: cpu{job=api}") || strings.Contains(lines[1], "anomaly") {
+		t.Errorf("second line is %q, want cpu{job=api} without anomaly", lines[1])
+	}
+	if lines[2] != "Metric: build_info 1.2.3\n" {
+		t.Errorf("third line is %q, want the text metric", lines[2])
+	}
+
+	var want int
+	for _, line := range lines {
+		want += analyzer.tokenizer.Count(line)
+	}
+	if tokens != want {
+		t.Errorf("reported %d tokens, lines take %d", tokens, want)
+	}
+}
@@ -0,0 +1,123 @@
+package chain
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"true-hack/internal/tokenizer"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Parts of the prompt the evidence budget is split into
+type section int
+
+const (
+	sectionGit section = iota
+	sectionComparison
+	sectionTraces
+	sectionLogs
+	sectionMetrics
+	sectionCount
+)
+
+// sectionShares are fractions of the evidence budget per section. Sections are filled in
+// the order above and the tokens a section leaves unused are passed on to the next one,
+// so metrics, being the last, get everything the others didn't need.
+var sectionShares = [sectionCount]float64{
+	sectionGit:        0.10,
+	sectionComparison: 0.10,
+	sectionTraces:     0.15,
+	sectionLogs:       0.25,
+	sectionMetrics:    0.40,
+}
+
+const (
+	// messageOverhead covers the role markers and separators the chat format adds around messages
+	messageOverhead = 16
+	// repairOverhead covers the validation error message of a repair attempt
+	repairOverhead = 200
+	// historyShare is the part of the context window earlier questions and answers of a session may take
+	historyShare = 0.2
+)
+
+// promptBudget splits what is left of the context window after the fixed parts of the prompt
+// and the reserved completion tokens between the evidence sections
+type promptBudget struct {
+	tokenizer tokenizer.Tokenizer
+	total     int
+	carry     int
+}
+
+// newPromptBudget counts the fixed parts of the prompt: system prompt, schema, question, collection notes,
+// session history and the text of the section templates, and reserves tokens for the answer and repair attempts
+func (a *Analyzer) newPromptBudget(question string, set *evidenceSet, history []openai.ChatCompletionMessage) (*promptBudget, error) {
+	fixed := a.tokenizer.Count(a.config.SystemPrompt) +
+		a.tokenizer.Count(schemaInstruction()) +
+		a.tokenizer.Count(question) +
+		a.tokenizer.Count(strings.Join(set.notes, "\n")) +
+		2*messageOverhead
+	for _, message := range history {
+		fixed += a.tokenizer.Count(message.Content) + messageOverhead
+	}
+
+	templates := []*template.Template{a.templates.metrics, a.templates.logs, a.templates.traces}
+	if set.baseline != nil {
+		templates = append(templates, a.templates.comparison)
+	}
+	for _, tmpl := range templates {
+		text, err := renderTemplate(tmpl, newTemplateData(set.timeRange.Start, set.timeRange.End, nil))
+		if err != nil {
+			return nil, fmt.Errorf("failed to render prompt: %v", err)
+		}
+		fixed += a.tokenizer.Count(text)
+	}
+
+	// Every repair attempt sends the rejected answer back along with the validation error
+	attempts := 1 + a.config.MaxRepairAttempts
+	reserved := attempts*a.config.MaxTokens + a.config.MaxRepairAttempts*(repairOverhead+messageOverhead)
+
+	window := a.contextWindow()
+	total := window - fixed - reserved
+	if total <= 0 {
+		return nil, fmt.Errorf("prompt doesn't fit into the context window of %d tokens: %d tokens are taken by prompts and %d reserved for the answer",
+			window, fixed, reserved)
+	}
+
+	return &promptBudget{
+		tokenizer: a.tokenizer,
+		total:     total,
+	}, nil
+}
+
+// contextWindow is the configured context window or the known one of the model
+func (a *Analyzer) contextWindow() int {
+	if a.config.ContextWindow > 0 {
+		return a.config.ContextWindow
+	}
+	return tokenizer.ContextWindow(a.config.Model)
+}
+
+// take returns the tokens available to a section, which must be followed by spend
+func (b *promptBudget) take(s section) int {
+	return int(float64(b.total)*sectionShares[s]) + b.carry
+}
+
+// spend records how many of the tokens returned by take the section used
+func (b *promptBudget) spend(s section, used int) {
+	b.carry = max(b.take(s)-used, 0)
+}
+
+// fit returns the longest prefix of lines that fits into maxTokens and the tokens it takes
+func (b *promptBudget) fit(lines []string, maxTokens int) ([]string, int) {
+	var total int
+	for i, line := range lines {
+		tokens := b.tokenizer.Count(line)
+		if total+tokens > maxTokens {
+			return lines[:i], total
+		}
+		total += tokens
+	}
+	return lines, total
+}
@@ -0,0 +1,158 @@
+package chain
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/llm"
+)
+
+// newBudgetAnalyzer returns an analyzer with a small context window and the tokens it reserves for answers
+func newBudgetAnalyzer(t *testing.T, window int) (*Analyzer, int) {
+	t.Helper()
+
+	config := testConfig()
+	config.ContextWindow = window
+	config.MaxTokens = 500
+	config.MaxRepairAttempts = 1
+	analyzer, _ := newTestAnalyzer(t, config, llm.NewFake("fake", testAnswer))
+	// The diff of the last commit of the checkout would make results depend on it
+	analyzer.gitInfo = &GitInfo{}
+
+	reserved := 2*config.MaxTokens + config.MaxRepairAttempts*(repairOverhead+messageOverhead)
+	return analyzer, reserved
+}
+
+func testEvidenceSet(evidence ...*collector.Evidence) *evidenceSet {
+	end := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	return &evidenceSet{
+		timeRange: ResolvedTimeRange{Start: end.Add(-time.Hour), End: end},
+		evidence:  evidence,
+	}
+}
+
+func TestPromptBudgetSplit(t *testing.T) {
+	const window = 4000
+	analyzer, reserved := newBudgetAnalyzer(t, window)
+
+	budget, err := analyzer.newPromptBudget("Why does the api fail?", testEvidenceSet(), nil)
+	if err != nil {
+		t.Fatalf("newPromptBudget: %v", err)
+	}
+	if budget.total <= 0 || budget.total > window-reserved {
+		t.Fatalf("total = %d, want within (0, %d]", budget.total, window-reserved)
+	}
+
+	// Sections that use everything they are given never exceed the total
+	var sum int
+	for s := range sectionCount {
+		tokens := budget.take(s)
+		budget.spend(s, tokens)
+		sum += tokens
+	}
+	if sum > budget.total {
+		t.Errorf("sections take %d tokens, more than the total of %d", sum, budget.total)
+	}
+}
+
+func TestPromptBudgetCarry(t *testing.T) {
+	analyzer, _ := newBudgetAnalyzer(t, 4000)
+	budget, err := analyzer.newPromptBudget("Why does the api fail?", testEvidenceSet(), nil)
+	if err != nil {
+		t.Fatalf("newPromptBudget: %v", err)
+	}
+
+	git := budget.take(sectionGit)
+	budget.spend(sectionGit, 10)
+	want := int(float64(budget.total)*sectionShares[sectionComparison]) + git - 10
+	if got := budget.take(sectionComparison); got != want {
+		t.Errorf("comparison takes %d tokens, want its share plus %d unused by git = %d", got, git-10, want)
+	}
+
+	// A section that overspends passes nothing on
+	budget.spend(sectionComparison, want+100)
+	if got, want := budget.take(sectionTraces), int(float64(budget.total)*sectionShares[sectionTraces]); got != want {
+		t.Errorf("traces take %d tokens, want their share %d", got, want)
+	}
+}
+
+func TestPromptBudgetTooSmall(t *testing.T) {
+	analyzer, reserved := newBudgetAnalyzer(t, 1250)
+
+	_, err := analyzer.newPromptBudget("Why does the api fail?", testEvidenceSet(), nil)
+	if err == nil {
+		t.Fatalf("budget of a %d tokens window with %d reserved succeeded", 1250, reserved)
+	}
+	if !strings.Contains(err.Error(), "context window of 1250 tokens") {
+		t.Errorf("error %q doesn't name the window", err)
+	}
+}
+
+func TestPromptBudgetFit(t *testing.T) {
+	analyzer, _ := newBudgetAnalyzer(t, 4000)
+	budget, err := analyzer.newPromptBudget("Why does the api fail?", testEvidenceSet(), nil)
+	if err != nil {
+		t.Fatalf("newPromptBudget: %v", err)
+	}
+
+	// Every line is "hello world\n", 3 tokens
+	lines := []string{"hello world\n", "hello world\n", "hello world\n"}
+	tests := []struct {
+		maxTokens  int
+		wantLines  int
+		wantTokens int
+	}{
+		{maxTokens: 100, wantLines: 3, wantTokens: 9},
+		{maxTokens: 9, wantLines: 3, wantTokens: 9},
+		{maxTokens: 8, wantLines: 2, wantTokens: 6},
+		{maxTokens: 2, wantLines: 0, wantTokens: 0},
+	}
+	for _, tt := range tests {
+		got, tokens := budget.fit(lines, tt.maxTokens)
+		if len(got) != tt.wantLines || tokens != tt.wantTokens {
+			t.Errorf("fit into %d: got %d lines of %d tokens, want %d lines of %d tokens",
+				tt.maxTokens, len(got), tokens, tt.wantLines, tt.wantTokens)
+		}
+	}
+}
+
+func TestBuildMessagesFitsWindow(t *testing.T) {
+	const window = 4000
+	analyzer, reserved := newBudgetAnalyzer(t, window)
+
+	// Far more logs than fit, the newest ones are to be kept
+	set := testEvidenceSet()
+	logs := &collector.Evidence{Source: "logs", Kind: collector.KindLogs}
+	for i := range 2000 {
+		logs.Logs = append(logs.Logs, collector.LogEntry{
+			Timestamp: set.timeRange.Start.Add(time.Duration(i) * time.Second),
+			Labels:    map[string]string{"app": "api"},
+			Line:      fmt.Sprintf("request %d failed: connection refused", i),
+		})
+	}
+	set.evidence = append(set.evidence, logs)
+
+	messages, err := analyzer.buildMessages(t.Context(), "Why does the api fail?", set, nil)
+	if err != nil {
+		t.Fatalf("buildMessages: %v", err)
+	}
+
+	var prompt int
+	for _, message := range messages {
+		prompt += analyzer.tokenizer.Count(message.Content) + messageOverhead
+	}
+	if prompt > window-reserved {
+		t.Errorf("prompt takes %d tokens, more than the %d left after reserving %d for answers", prompt, window-reserved, reserved)
+	}
+
+	user := messages[len(messages)-1].Content
+	if !strings.Contains(user, "request 1999 failed") {
+		t.Error("the newest log line is missing")
+	}
+	if strings.Contains(user, "request 0 failed") {
+		t.Error("the oldest log line is kept although logs don't fit")
+	}
+}
@@ -1,104 +1,153 @@
 package chain
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"strings"
-	"sync"
 	"time"
+
+	"true-hack/internal/cache"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
 )
 
-type CacheKey struct {
-	Question  string
-	StartTime time.Time
-	EndTime   time.Time
-	Metrics   []string
+// Cache backends of the answers
+const (
+	CacheMemory = "memory"
+	CacheSQLite = "sqlite"
+	CacheRedis  = "redis"
+)
+
+// Cache keeps answers of the model by the prompt they were given, see promptKey.
+// Failing caches don't fail analyses, the errors are only logged.
+type Cache interface {
+	Get(ctx context.Context, key string) (*LLMResponse, bool, error)
+	Set(ctx context.Context, key string, value *LLMResponse) error
 }
 
-func (k CacheKey) String() string {
-	var b strings.Builder
-	b.WriteString(k.Question)
-	b.WriteString(k.StartTime.String())
-	b.WriteString(k.EndTime.String())
-	for _, m := range k.Metrics {
-		b.WriteString(m)
-	}
-	return b.String()
+// MemoryCache keeps answers in the process, they are lost on restart
+type MemoryCache struct {
+	lru *cache.LRU[*LLMResponse]
 }
 
-func (k CacheKey) Equal(other CacheKey) bool {
-	if k.Question != other.Question {
-		return false
+func NewMemoryCache(ttl time.Duration, maxEntries int) (*MemoryCache, error) {
+	lru, err := cache.New[*LLMResponse](ttl, maxEntries)
+	if err != nil {
+		return nil, err
 	}
-	if !k.StartTime.Equal(other.StartTime) || !k.EndTime.Equal(other.EndTime) {
-		return false
-	}
-	if len(k.Metrics) != len(other.Metrics) {
-		return false
-	}
-	for i := range k.Metrics {
-		if k.Metrics[i] != other.Metrics[i] {
-			return false
-		}
-	}
-	return true
+	return &MemoryCache{lru: lru}, nil
 }
 
-type CacheEntry struct {
-	Value     *LLMResponse
-	ExpiresAt time.Time
+func (c *MemoryCache) Get(_ context.Context, key string) (*LLMResponse, bool, error) {
+	value, ok := c.lru.Get(key)
+	return value, ok, nil
 }
 
-type Cache struct {
-	entries map[string]CacheEntry
-	ttl     time.Duration
-	mu      sync.RWMutex
+func (c *MemoryCache) Set(_ context.Context, key string, value *LLMResponse) error {
+	c.lru.Set(key, value)
+	return nil
 }
 
-func NewCache(ttl time.Duration) *Cache {
-	return &Cache{
-		entries: make(map[string]CacheEntry),
-		ttl:     ttl,
-	}
+// Run drops expired answers every interval until ctx is done
+func (c *MemoryCache) Run(ctx context.Context, interval time.Duration) {
+	c.lru.Run(ctx, interval)
 }
 
-func (c *Cache) Get(key CacheKey) (*LLMResponse, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (c *MemoryCache) Stats() cache.Stats {
+	return c.lru.Stats()
+}
 
-	entry, ok := c.entries[key.String()]
-	if !ok {
-		return nil, false
+// Store keeps encoded values outside the process, e.g. cache.SQLite or cache.Redis.
+// It expires them itself.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte) error
+}
+
+// StoreCache keeps answers as JSON in a Store, so they survive restarts and can be shared by replicas
+type StoreCache struct {
+	store Store
+}
+
+func NewStoreCache(store Store) *StoreCache {
+	return &StoreCache{store: store}
+}
+
+func (c *StoreCache) Get(ctx context.Context, key string) (*LLMResponse, bool, error) {
+	data, ok, err := c.store.Get(ctx, key)
+	if err != nil || !ok {
+		return nil, false, err
 	}
 
-	if time.Now().After(entry.ExpiresAt) {
-		c.mu.RUnlock()
-		c.mu.Lock()
-		delete(c.entries, key.String())
-		c.mu.Unlock()
-		c.mu.RLock()
-		return nil, false
+	var value LLMResponse
+	if err := json.Unmarshal(data, &value); err != nil {
+		// E.g. written by an incompatible version, the analysis overwrites it
+		return nil, false, fmt.Errorf("decode cached answer: %w", err)
+	}
+	return &value, true, nil
+}
+
+func (c *StoreCache) Set(ctx context.Context, key string, value *LLMResponse) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encode answer: %w", err)
 	}
+	return c.store.Set(ctx, key, data)
+}
 
-	return entry.Value, true
+// maxRequestPrompts bounds how many request keys are mapped to prompt keys
+const maxRequestPrompts = 1000
+
+// newRequestPrompts creates the map of request keys to prompt keys, nil when ttl is zero
+func newRequestPrompts(ttl time.Duration) (*cache.LRU[string], error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+	return cache.New[string](ttl, maxRequestPrompts)
 }
 
-func (c *Cache) Set(key CacheKey, value *LLMResponse) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// requestPrompt returns the prompt key the answer to a request was cached by, see requestKey
+func (a *Analyzer) requestPrompt(reqKey string) (string, bool) {
+	if a.prompts == nil {
+		return "", false
+	}
+	return a.prompts.Get(reqKey)
+}
 
-	c.entries[key.String()] = CacheEntry{
-		Value:     value,
-		ExpiresAt: time.Now().Add(c.ttl),
+func (a *Analyzer) rememberPrompt(reqKey, promptKey string) {
+	if a.prompts != nil {
+		a.prompts.Set(reqKey, promptKey)
 	}
 }
 
-func (c *Cache) Cleanup() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// cachedAnswer returns a copy of the answer cached by the prompt key for the resolved period
+func (a *Analyzer) cachedAnswer(ctx context.Context, promptKey string, timeRange ResolvedTimeRange) (*LLMResponse, bool) {
+	cached, ok, err := a.cache.Get(ctx, promptKey)
+	if err != nil {
+		a.logger.Warn("Failed to read cached answer", zap.Error(err))
+	}
+	if !ok {
+		return nil, false
+	}
+
+	// The cached answer is shared, the period may have been resolved differently
+	answer := *cached
+	answer.TimeRange = &timeRange
+	return &answer, true
+}
 
-	now := time.Now()
-	for key, entry := range c.entries {
-		if now.After(entry.ExpiresAt) {
-			delete(c.entries, key)
-		}
+// promptKey identifies a request to the model: the model settings and the messages with runs
+// of whitespace collapsed. Analyses of the same question over the same aligned period and the
+// same data share the key, however the request was phrased in JSON.
+func (a *Analyzer) promptKey(messages []openai.ChatCompletionMessage) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%g\x00%d\x00%s", a.config.Model, a.config.Temperature, a.config.MaxTokens, a.config.ResponseMode)
+	for _, message := range messages {
+		fmt.Fprintf(h, "\x00%s\x00%s", message.Role, strings.Join(strings.Fields(message.Content), " "))
 	}
+	return hex.EncodeToString(h.Sum(nil))
 }
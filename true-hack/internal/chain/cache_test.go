@@ -0,0 +1,83 @@
+package chain
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mapStore is a Store without expiry
+type mapStore map[string][]byte
+
+func (s mapStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	value, ok := s[key]
+	return value, ok, nil
+}
+
+func (s mapStore) Set(_ context.Context, key string, value []byte) error {
+	s[key] = value
+	return nil
+}
+
+func TestStoreCache(t *testing.T) {
+	ctx := t.Context()
+	start := time.Date(2025, 1, 1, 11, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		answer *LLMResponse
+	}{
+		{
+			name: "answer of the model",
+			answer: &LLMResponse{
+				Analysis:    "Errors of the api started after the deploy",
+				Confidence:  0.8,
+				Suggestions: []string{"Roll back the deploy"},
+				Metrics:     []string{"http_requests_total"},
+				Provider:    "mws",
+			},
+		},
+		{
+			name: "fields set by the analyzer",
+			answer: &LLMResponse{
+				Analysis:    "No errors",
+				Confidence:  0.5,
+				Suggestions: []string{},
+				Metrics:     []string{},
+				Notes:       []string{"jaeger timed out"},
+				TimeRange:   &ResolvedTimeRange{Start: start, End: start.Add(time.Hour), Source: "request"},
+				Transcript:  []ToolCall{{Step: 1, Tool: "query_logql", Arguments: `{"query":"{app=\"api\"}"}`, Result: "no log lines"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewStoreCache(mapStore{})
+
+			if _, ok, err := c.Get(ctx, "key"); ok || err != nil {
+				t.Fatalf("Get() of a missing key = %v, %v", ok, err)
+			}
+			if err := c.Set(ctx, "key", tt.answer); err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := c.Get(ctx, "key")
+			if err != nil || !ok {
+				t.Fatalf("Get() = %v, %v", ok, err)
+			}
+			if !reflect.DeepEqual(got, tt.answer) {
+				t.Errorf("Get() = %+v, want %+v", got, tt.answer)
+			}
+		})
+	}
+}
+
+func TestStoreCacheUndecodable(t *testing.T) {
+	ctx := t.Context()
+	c := NewStoreCache(mapStore{"key": []byte(`{"analysis": `)})
+
+	if _, ok, err := c.Get(ctx, "key"); ok || err == nil {
+		t.Errorf("Get() of a broken entry = %v, %v, want a miss with an error", ok, err)
+	}
+}
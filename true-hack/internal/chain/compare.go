@@ -0,0 +1,294 @@
+package chain
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"true-hack/internal/collector"
+)
+
+const (
+	// maxSignatures limits how many new or grown error signatures are listed
+	maxSignatures = 20
+	// maxLatencyShifts limits how many operations with changed latency are listed
+	maxLatencyShifts = 20
+	// signatureGrowth is how many times more frequent a known error has to become to be listed
+	signatureGrowth = 3
+	// latencyShift is the p95 ratio from which the latency of an operation counts as changed
+	latencyShift = 1.5
+	// maxSignatureLength cuts long log lines, the beginning is enough to recognize the error
+	maxSignatureLength = 200
+)
+
+var (
+	errorLineRegex = regexp.MustCompile(`(?i)\b(error|fatal|panic|exception|fail(ed|ure)?|timeout|refused)\b`)
+
+	// Variable parts of log lines, replaced to group lines of the same error. Order matters:
+	// UUIDs and hex ids would otherwise be eaten by the number pattern piece by piece.
+	signatureReplacements = []struct {
+		regex       *regexp.Regexp
+		replacement string
+	}{
+		{regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`), "<time>"},
+		{regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`), "<uuid>"},
+		{regexp.MustCompile(`(?i)\b(0x)?[0-9a-f]{12,}\b`), "<hex>"},
+		{regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`), "<ip>"},
+		{regexp.MustCompile(`"[^"]*"`), `"<str>"`},
+		{regexp.MustCompile(`\d+(\.\d+)?`), "<n>"},
+	}
+)
+
+// compareEvidence describes how logs and traces of the analyzed period differ from the baseline:
+// error signatures that are new or became much more frequent, and operations whose latency or
+// error rate shifted. window and baselineWindow are the lengths of the periods, they may differ.
+func compareEvidence(logs []collector.LogEntry, spans []collector.Span, window time.Duration, baseline []*collector.Evidence, baselineWindow time.Duration) []string {
+	var baselineLogs []collector.LogEntry
+	var baselineSpans []collector.Span
+	for _, e := range baseline {
+		switch e.Kind {
+		case collector.KindLogs:
+			baselineLogs = append(baselineLogs, e.Logs...)
+		case collector.KindTraces:
+			baselineSpans = append(baselineSpans, e.Spans...)
+		}
+	}
+
+	var result []string
+	result = append(result, compareLogs(logs, window, baselineLogs, baselineWindow)...)
+	result = append(result, compareTraces(spans, baselineSpans)...)
+	return result
+}
+
+// seriesDelta describes how a series moved from its baseline, counters are compared by rate
+func seriesDelta(name string, points, baseline []collector.Point) string {
+	points = cleanPoints(points)
+	baseline = cleanPoints(baseline)
+
+	what := ""
+	if isCounter(name) {
+		points = counterRate(points)
+		baseline = counterRate(baseline)
+		what = "rate "
+	}
+	if len(points) == 0 || len(baseline) == 0 {
+		return ""
+	}
+
+	current := slices.Sorted(slices.Values(values(points)))
+	reference := slices.Sorted(slices.Values(values(baseline)))
+	return fmt.Sprintf("%smean %s, %sp95 %s",
+		what, formatChange(mean(reference), mean(current)),
+		what, formatChange(quantile(reference, 0.95), quantile(current, 0.95)))
+}
+
+func formatChange(before, after float64) string {
+	text := formatValue(before) + " -> " + formatValue(after)
+	if before != 0 {
+		text += fmt.Sprintf(" (%+.0f%%)", (after-before)/math.Abs(before)*100)
+	}
+	return text
+}
+
+type signatureStats struct {
+	signature string
+	example   string
+	count     int
+	// rate and baselineRate are error lines per minute in the analyzed period and in the baseline
+	rate         float64
+	baselineRate float64
+}
+
+// compareLogs compares error signatures by lines per minute, so periods of different length can be compared
+func compareLogs(logs []collector.LogEntry, window time.Duration, baseline []collector.LogEntry, baselineWindow time.Duration) []string {
+	current := countErrorSignatures(logs)
+	reference := countErrorSignatures(baseline)
+
+	var currentTotal, baselineTotal int
+	var appeared, grown []signatureStats
+	for signature, stats := range current {
+		currentTotal += stats.count
+		stats.rate = perMinute(stats.count, window)
+		stats.baselineRate = perMinute(reference[signature].count, baselineWindow)
+		switch {
+		case stats.baselineRate == 0:
+			appeared = append(appeared, stats)
+		case stats.rate >= signatureGrowth*stats.baselineRate:
+			grown = append(grown, stats)
+		}
+	}
+	for _, stats := range reference {
+		baselineTotal += stats.count
+	}
+
+	if currentTotal == 0 && baselineTotal == 0 {
+		return nil
+	}
+
+	result := []string{fmt.Sprintf("Error log lines per minute: %s, in the baseline %s\n",
+		formatValue(perMinute(currentTotal, window)), formatValue(perMinute(baselineTotal, baselineWindow)))}
+
+	bySignificance := func(a, b signatureStats) int {
+		if c := cmp.Compare(b.rate, a.rate); c != 0 {
+			return c
+		}
+		return strings.Compare(a.signature, b.signature)
+	}
+
+	if len(appeared) > 0 {
+		slices.SortFunc(appeared, bySignificance)
+		result = append(result, "New error signatures, not seen in the baseline:\n")
+		for _, stats := range appeared[:min(len(appeared), maxSignatures)] {
+			result = append(result, fmt.Sprintf("  %s/min %s\n", formatValue(stats.rate), stats.example))
+		}
+	}
+	if len(grown) > 0 {
+		slices.SortFunc(grown, bySignificance)
+		result = append(result, "Error signatures that became more frequent:\n")
+		for _, stats := range grown[:min(len(grown), maxSignatures)] {
+			result = append(result, fmt.Sprintf("  %s/min (baseline %s/min) %s\n",
+				formatValue(stats.rate), formatValue(stats.baselineRate), stats.example))
+		}
+	}
+
+	return result
+}
+
+// perMinute turns a count over a period into a rate, a period shorter than a minute counts as one
+func perMinute(count int, window time.Duration) float64 {
+	return float64(count) / max(window.Minutes(), 1)
+}
+
+// countErrorSignatures groups error lines by their text with variable parts replaced
+func countErrorSignatures(logs []collector.LogEntry) map[string]signatureStats {
+	result := make(map[string]signatureStats)
+	for _, entry := range logs {
+		if !isErrorLine(entry) {
+			continue
+		}
+
+		line := entry.Line
+		if len(line) > maxSignatureLength {
+			line = strings.ToValidUTF8(line[:maxSignatureLength], "")
+		}
+		signature := logSignature(line)
+
+		stats := result[signature]
+		if stats.count == 0 {
+			stats.signature = signature
+			stats.example = line
+		}
+		stats.count++
+		result[signature] = stats
+	}
+	return result
+}
+
+func isErrorLine(entry collector.LogEntry) bool {
+	for _, label := range []string{"level", "detected_level", "severity"} {
+		switch strings.ToLower(entry.Labels[label]) {
+		case "error", "err", "fatal", "critical", "panic":
+			return true
+		}
+	}
+	return errorLineRegex.MatchString(entry.Line)
+}
+
+func logSignature(line string) string {
+	for _, r := range signatureReplacements {
+		line = r.regex.ReplaceAllString(line, r.replacement)
+	}
+	return line
+}
+
+type latencyShiftStats struct {
+	operation         string
+	current, baseline *operationStats
+	ratio             float64
+}
+
+func compareTraces(spans, baseline []collector.Span) []string {
+	if len(spans) == 0 || len(baseline) == 0 {
+		return nil
+	}
+
+	current := groupOperations(spans)
+	reference := groupOperations(baseline)
+
+	var shifts []latencyShiftStats
+	var appeared []string
+	for operation, stats := range current {
+		base, ok := reference[operation]
+		if !ok {
+			appeared = append(appeared, fmt.Sprintf("  %s: %d spans, %d errors, p95 %s\n",
+				operation, len(stats.durations), stats.errors, quantile(stats.durations, 0.95)))
+			continue
+		}
+
+		ratio := float64(quantile(stats.durations, 0.95)) / float64(max(quantile(base.durations, 0.95), time.Microsecond))
+		errorRateChange := stats.errorRate() - base.errorRate()
+		if ratio >= latencyShift || ratio <= 1/latencyShift || errorRateChange >= 0.05 {
+			shifts = append(shifts, latencyShiftStats{operation: operation, current: stats, baseline: base, ratio: ratio})
+		}
+	}
+
+	var result []string
+	if len(shifts) > 0 {
+		// Both slowdowns and speedups are interesting, a much faster operation may be failing early
+		slices.SortFunc(shifts, func(a, b latencyShiftStats) int {
+			if c := cmp.Compare(math.Abs(math.Log(b.ratio)), math.Abs(math.Log(a.ratio))); c != 0 {
+				return c
+			}
+			return strings.Compare(a.operation, b.operation)
+		})
+		result = append(result, "Operations whose latency or error rate changed (baseline -> now):\n")
+		for _, shift := range shifts[:min(len(shifts), maxLatencyShifts)] {
+			result = append(result, fmt.Sprintf("  %s: p50 %s -> %s, p95 %s -> %s (x%.1f), errors %.1f%% -> %.1f%%, spans %d -> %d\n",
+				shift.operation,
+				quantile(shift.baseline.durations, 0.5), quantile(shift.current.durations, 0.5),
+				quantile(shift.baseline.durations, 0.95), quantile(shift.current.durations, 0.95), shift.ratio,
+				shift.baseline.errorRate()*100, shift.current.errorRate()*100,
+				len(shift.baseline.durations), len(shift.current.durations)))
+		}
+	}
+	if len(appeared) > 0 {
+		slices.Sort(appeared)
+		result = append(result, "Operations not seen in the baseline:\n")
+		result = append(result, appeared[:min(len(appeared), maxLatencyShifts)]...)
+	}
+
+	return result
+}
+
+// groupOperations groups spans by service and operation, durations are sorted
+func groupOperations(spans []collector.Span) map[string]*operationStats {
+	result := make(map[string]*operationStats)
+	for _, span := range spans {
+		key := span.Service + " " + span.Operation
+		stats, ok := result[key]
+		if !ok {
+			stats = &operationStats{service: span.Service, operation: span.Operation}
+			result[key] = stats
+		}
+		stats.durations = append(stats.durations, span.Duration)
+		if span.Error {
+			stats.errors++
+		}
+	}
+
+	for _, stats := range result {
+		slices.Sort(stats.durations)
+	}
+	return result
+}
+
+func (s *operationStats) errorRate() float64 {
+	if len(s.durations) == 0 {
+		return 0
+	}
+	return float64(s.errors) / float64(len(s.durations))
+}
@@ -0,0 +1,154 @@
+package chain
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+)
+
+// errorLines returns n error log lines of the same signature spread over the window
+func errorLines(n int, window time.Duration, format string) []collector.LogEntry {
+	entries := make([]collector.LogEntry, n)
+	for i := range entries {
+		entries[i] = collector.LogEntry{
+			Timestamp: seriesStart.Add(time.Duration(i) * window / time.Duration(n)),
+			Labels:    map[string]string{"app": "api"},
+			Line:      fmt.Sprintf(format, 1000+i),
+		}
+	}
+	return entries
+}
+
+func TestCompareLogs(t *testing.T) {
+	const (
+		refused = "dial tcp 10.0.0.1:5432: connection refused after %dms"
+		timeout = "request %d failed: upstream timeout"
+	)
+	join := func(parts ...[]collector.LogEntry) []collector.LogEntry {
+		var result []collector.LogEntry
+		for _, part := range parts {
+			result = append(result, part...)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name           string
+		logs           []collector.LogEntry
+		window         time.Duration
+		baseline       []collector.LogEntry
+		baselineWindow time.Duration
+		want           []string
+	}{
+		{
+			name:           "no errors",
+			logs:           []collector.LogEntry{{Timestamp: seriesStart, Line: "request served"}},
+			window:         time.Hour,
+			baseline:       []collector.LogEntry{{Timestamp: seriesStart, Line: "request served"}},
+			baselineWindow: time.Hour,
+			want:           nil,
+		},
+		{
+			name:           "new signature",
+			logs:           join(errorLines(60, time.Hour, refused), errorLines(6, time.Hour, timeout)),
+			window:         time.Hour,
+			baseline:       errorLines(6, time.Hour, timeout),
+			baselineWindow: time.Hour,
+			want: []string{
+				"Error log lines per minute: 1.1, in the baseline 0.1\n",
+				"New error signatures, not seen in the baseline:\n",
+				"  1/min dial tcp 10.0.0.1:5432: connection refused after 1000ms\n",
+			},
+		},
+		{
+			name:           "grown signature",
+			logs:           errorLines(60, time.Hour, timeout),
+			window:         time.Hour,
+			baseline:       errorLines(6, time.Hour, timeout),
+			baselineWindow: time.Hour,
+			want: []string{
+				"Error log lines per minute: 1, in the baseline 0.1\n",
+				"Error signatures that became more frequent:\n",
+				"  1/min (baseline 0.1/min) request 1000 failed: upstream timeout\n",
+			},
+		},
+		{
+			name:           "same rate",
+			logs:           errorLines(6, time.Hour, timeout),
+			window:         time.Hour,
+			baseline:       errorLines(6, time.Hour, timeout),
+			baselineWindow: time.Hour,
+			want: []string{
+				"Error log lines per minute: 0.1, in the baseline 0.1\n",
+			},
+		},
+		{
+			// 30 lines in an hour is 10 times more often than 72 lines in a day, though fewer lines
+			name:           "long baseline hides no growth",
+			logs:           errorLines(30, time.Hour, timeout),
+			window:         time.Hour,
+			baseline:       errorLines(72, 24*time.Hour, timeout),
+			baselineWindow: 24 * time.Hour,
+			want: []string{
+				"Error log lines per minute: 0.5, in the baseline 0.05\n",
+				"Error signatures that became more frequent:\n",
+				"  0.5/min (baseline 0.05/min) request 1000 failed: upstream timeout\n",
+			},
+		},
+		{
+			// 144 lines in a day are more lines than 60 in an hour, but 7 times less often
+			name:           "long window shows no false growth",
+			logs:           errorLines(144, 24*time.Hour, timeout),
+			window:         24 * time.Hour,
+			baseline:       errorLines(60, time.Hour, timeout),
+			baselineWindow: time.Hour,
+			want: []string{
+				"Error log lines per minute: 0.1, in the baseline 1\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := compareLogs(tt.logs, tt.window, tt.baseline, tt.baselineWindow)
+			if strings.Join(got, "") != strings.Join(tt.want, "") {
+				t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, ""), strings.Join(tt.want, ""))
+			}
+		})
+	}
+}
+
+func TestCompareEvidenceWindows(t *testing.T) {
+	baseline := []*collector.Evidence{
+		{Source: "loki", Kind: collector.KindLogs, Logs: errorLines(24, 24*time.Hour, "request %d failed: upstream timeout")},
+	}
+
+	got := compareEvidence(errorLines(12, time.Hour, "request %d failed: upstream timeout"), nil, time.Hour, baseline, 24*time.Hour)
+	want := "Error log lines per minute: 0.2, in the baseline 0.01667\n" +
+		"Error signatures that became more frequent:\n" +
+		"  0.2/min (baseline 0.01667/min) request 1000 failed: upstream timeout\n"
+	if strings.Join(got, "") != want {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, ""), want)
+	}
+}
+
+func TestLogSignature(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"request 1 failed after 20ms", "request 2 failed after 350ms"},
+		{"dial tcp 10.0.0.1:5432: connection refused", "dial tcp 10.0.0.2:6432: connection refused"},
+		{"order 1b4e28ba-2fa1-11d2-883f-0016d3cca427 failed", "order 6ba7b810-9dad-11d1-80b4-00c04fd430c8 failed"},
+		{`user "alice" not found`, `user "bob" not found`},
+		{"2025-01-01T12:00:00Z error in job", "2025-01-02 13:30:00.123+03:00 error in job"},
+	}
+
+	for _, tt := range tests {
+		if a, b := logSignature(tt.a), logSignature(tt.b); a != b {
+			t.Errorf("%q and %q have different signatures %q and %q", tt.a, tt.b, a, b)
+		}
+	}
+}
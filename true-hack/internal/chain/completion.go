@@ -0,0 +1,149 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// requestAnalysis asks the model for an LLMResponse and re-prompts it with the validation
+// error up to Config.MaxRepairAttempts times. If the answer never validates, the regex
+// based parseLLMResponse is used on the last answer.
+// With a non-nil progress the answer is streamed and every piece is reported as EventToken.
+func (a *Analyzer) requestAnalysis(ctx context.Context, messages []openai.ChatCompletionMessage, progress ProgressFunc) (*LLMResponse, error) {
+	mode := a.config.ResponseMode
+	if mode == "" {
+		mode = ResponseModeJSON
+	}
+
+	// The system prompt comes first, extend it with the schema the model must follow
+	messages = append([]openai.ChatCompletionMessage(nil), messages...)
+	if mode != ResponseModeFunction && len(messages) > 0 && messages[0].Role == openai.ChatMessageRoleSystem {
+		messages[0].Content += "\n\n" + schemaInstruction()
+	}
+
+	req := openai.ChatCompletionRequest{
+		Model:       a.config.Model,
+		MaxTokens:   a.config.MaxTokens,
+		Temperature: a.config.Temperature,
+	}
+	switch mode {
+	case ResponseModeJSON:
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONObject,
+		}
+	case ResponseModeFunction:
+		req.Tools = []openai.Tool{{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        reportFunctionName,
+				Description: "Report the result of the analysis",
+				Parameters:  llmResponseSchema,
+			},
+		}}
+		req.ToolChoice = openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: reportFunctionName},
+		}
+	}
+
+	// content and provider are of the last answer
+	var content, provider string
+	for attempt := 0; ; attempt++ {
+		req.Messages = messages
+
+		status := StatusStarted
+		if attempt > 0 {
+			status = StatusRetry
+		}
+		progress.emit(Event{Type: EventProgress, Phase: PhaseLLM, Status: status, Attempt: attempt})
+
+		message, answeredBy, err := a.complete(ctx, req, progress)
+		if err != nil {
+			progress.emit(Event{Type: EventProgress, Phase: PhaseLLM, Status: StatusFailed, Attempt: attempt, Error: err.Error()})
+			return nil, err
+		}
+
+		var toolCallID string
+		content, provider = message.Content, answeredBy
+		if mode == ResponseModeFunction && len(message.ToolCalls) > 0 {
+			toolCallID = message.ToolCalls[0].ID
+			content = message.ToolCalls[0].Function.Arguments
+		}
+
+		result, err := decodeLLMResponse(content)
+		if err == nil {
+			progress.emit(Event{Type: EventProgress, Phase: PhaseLLM, Status: StatusDone, Attempt: attempt})
+			result.Provider = provider
+			return result, nil
+		}
+
+		a.logger.Warn("LLM response does not match schema",
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+		if attempt >= a.config.MaxRepairAttempts {
+			break
+		}
+
+		// Show the model its own answer and what is wrong with it
+		repair := fmt.Sprintf("Your previous response is invalid: %v. Respond again with the corrected JSON only.", err)
+		if toolCallID != "" {
+			messages = append(messages, message, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				ToolCallID: toolCallID,
+				Content:    repair,
+			})
+		} else {
+			messages = append(messages, message, openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleUser,
+				Content: repair,
+			})
+		}
+	}
+
+	// Fallback to best effort parsing
+	progress.emit(Event{Type: EventProgress, Phase: PhaseLLM, Status: StatusDone, Error: "response does not match schema"})
+	result, err := parseLLMResponse(content)
+	if err != nil {
+		return nil, err
+	}
+	result.Provider = provider
+	return result, nil
+}
+
+// complete sends the request to the providers in order until one of them answers, a provider that
+// fails or times out is skipped. It returns the answer and the name of the provider that gave it.
+// With a non-nil progress the answer is streamed and every piece is reported as EventToken.
+func (a *Analyzer) complete(ctx context.Context, req openai.ChatCompletionRequest, progress ProgressFunc) (openai.ChatCompletionMessage, string, error) {
+	var onDelta func(string)
+	if progress != nil {
+		onDelta = func(text string) {
+			progress.emit(Event{Type: EventToken, Text: text})
+		}
+	}
+
+	var errs []error
+	for i, provider := range a.providers {
+		if i > 0 {
+			// Tokens streamed by the failed provider are to be discarded
+			progress.emit(Event{Type: EventProgress, Phase: PhaseLLM, Status: StatusRetry, Source: provider.Name(), Error: errs[i-1].Error()})
+		}
+
+		message, err := provider.Complete(ctx, req, onDelta)
+		if err == nil {
+			return message, provider.Name(), nil
+		}
+		if ctx.Err() != nil {
+			return openai.ChatCompletionMessage{}, "", err
+		}
+
+		a.logger.Warn("LLM provider failed",
+			zap.String("provider", provider.Name()),
+			zap.Error(err))
+		errs = append(errs, fmt.Errorf("%s: %v", provider.Name(), err))
+	}
+	return openai.ChatCompletionMessage{}, "", errors.Join(errs...)
+}
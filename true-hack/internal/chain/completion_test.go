@@ -0,0 +1,133 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/llm"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// hangingLLM never answers, its requests end when its timeout passes like those of real providers
+type hangingLLM struct {
+	name    string
+	timeout time.Duration
+}
+
+func (h hangingLLM) Name() string {
+	return h.name
+}
+
+func (h hangingLLM) Complete(ctx context.Context, _ openai.ChatCompletionRequest, _ func(string)) (openai.ChatCompletionMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	<-ctx.Done()
+	return openai.ChatCompletionMessage{}, ctx.Err()
+}
+
+// fallbackSources lists the providers the analysis fell back to, in order
+func fallbackSources(events []Event) []string {
+	var sources []string
+	for _, e := range events {
+		if e.Phase == PhaseLLM && e.Status == StatusRetry && e.Source != "" {
+			sources = append(sources, e.Source)
+		}
+	}
+	return sources
+}
+
+func TestFallbackInOrder(t *testing.T) {
+	for _, mode := range []string{ResponseModeJSON, ResponseModeFunction, ResponseModeText} {
+		t.Run(mode, func(t *testing.T) {
+			primary := llm.NewFake("primary").FailWith(errors.New("503 service unavailable")).Record()
+			second := llm.NewFake("second").FailWith(errors.New("rate limited")).Record()
+			third := llm.NewFake("third", testAnswer).Record()
+			unused := llm.NewFake("unused", testAnswer)
+
+			config := testConfig()
+			config.ResponseMode = mode
+			analyzer, _ := newTestAnalyzer(t, config, primary, second, third, unused)
+
+			var events recorder
+			result, err := analyzer.AnalyzeStream(t.Context(), testRequest(), events.progress)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Provider != "third" {
+				t.Errorf("Provider = %q, want third", result.Provider)
+			}
+			if got := fallbackSources(events.list()); strings.Join(got, ",") != "second,third" {
+				t.Errorf("fell back to %v, want second then third", got)
+			}
+			if unused.Calls() != 0 {
+				t.Errorf("provider after the one that answered was asked %d times", unused.Calls())
+			}
+
+			// Every provider gets the same request
+			for _, fake := range []*llm.Fake{primary, second, third} {
+				requests := fake.Requests()
+				if len(requests) != 1 {
+					t.Fatalf("%s got %d requests, want 1", fake.Name(), len(requests))
+				}
+				if len(requests[0].Messages) != len(primary.Requests()[0].Messages) {
+					t.Errorf("%s got other messages than the primary provider", fake.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestFallbackOnTimeout(t *testing.T) {
+	primary := hangingLLM{name: "primary", timeout: 50 * time.Millisecond}
+	backup := llm.NewFake("backup", testAnswer)
+	analyzer, _ := newTestAnalyzer(t, testConfig(), primary, backup)
+
+	started := time.Now()
+	result, err := analyzer.Analyze(t.Context(), testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Provider != "backup" {
+		t.Errorf("Provider = %q, want backup", result.Provider)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("analysis took %s, the primary provider wasn't given up after its timeout", elapsed)
+	}
+}
+
+func TestFallbackAllFail(t *testing.T) {
+	primary := llm.NewFake("primary").FailWith(errors.New("503 service unavailable"))
+	backup := llm.NewFake("backup").FailWith(errors.New("connection refused"))
+	analyzer, _ := newTestAnalyzer(t, testConfig(), primary, backup)
+
+	_, err := analyzer.Analyze(t.Context(), testRequest())
+	if err == nil {
+		t.Fatal("analysis succeeded without a working provider")
+	}
+	for _, want := range []string{"primary: 503 service unavailable", "backup: connection refused"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
+
+func TestNoFallbackWhenCanceled(t *testing.T) {
+	primary := hangingLLM{name: "primary", timeout: time.Minute}
+	backup := llm.NewFake("backup", testAnswer)
+	analyzer, _ := newTestAnalyzer(t, testConfig(), primary, backup)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := analyzer.Analyze(ctx, testRequest()); err == nil {
+		t.Fatal("canceled analysis succeeded")
+	}
+	if backup.Calls() != 0 {
+		t.Errorf("backup was asked %d times after the request was canceled", backup.Calls())
+	}
+}
@@ -0,0 +1,57 @@
+package chain
+
+// EventType is the kind of progress event reported by AnalyzeStream
+type EventType string
+
+const (
+	// EventProgress reports a phase of the analysis: collection from a source or the LLM request
+	EventProgress EventType = "progress"
+	// EventToken carries a piece of the model answer as soon as it is generated
+	EventToken EventType = "token"
+	// EventResult is the last event, it carries the validated LLMResponse
+	EventResult EventType = "result"
+)
+
+// Phases and statuses of EventProgress
+const (
+	PhaseCollect = "collect"
+	// PhaseBaseline is the collection of the baseline period of a comparison
+	PhaseBaseline = "baseline"
+	PhaseLLM      = "llm"
+	// PhaseAgent is a model request of the agent mode, Event.Step numbers them
+	PhaseAgent = "agent"
+	// PhaseTool is a tool call of the agent mode, the finished call is in Event.Tool
+	PhaseTool = "tool"
+
+	StatusStarted = "started"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+	// StatusRetry means the previous answer was rejected, tokens streamed so far should be discarded
+	StatusRetry = "retry"
+	// StatusJoined means the request joined an identical analysis in progress, it gets no tokens,
+	// only the progress from now on and the result
+	StatusJoined = "joined"
+)
+
+type Event struct {
+	Type    EventType    `json:"-"`
+	Phase   string       `json:"phase,omitempty"`
+	Source  string       `json:"source,omitempty"`
+	Status  string       `json:"status,omitempty"`
+	Attempt int          `json:"attempt,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Text    string       `json:"text,omitempty"`
+	Step    int          `json:"step,omitempty"`
+	Tool    *ToolCall    `json:"tool,omitempty"`
+	Result  *LLMResponse `json:"-"`
+}
+
+// ProgressFunc receives events of a single analysis. It is never called concurrently nor after
+// the analysis returned, so it may write to the http.ResponseWriter directly.
+type ProgressFunc func(Event)
+
+func (f ProgressFunc) emit(e Event) {
+	if f != nil {
+		f(e)
+	}
+}
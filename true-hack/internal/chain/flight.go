@@ -0,0 +1,149 @@
+package chain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// flight is an analysis shared by the identical requests made while it runs
+type flight struct {
+	done   chan struct{}
+	result *LLMResponse
+	err    error
+	cancel context.CancelFunc
+	// waiters is the number of requests waiting for the result, it is guarded by flightGroup.mu
+	waiters int
+
+	// mu guards subscribers, it is held while an event is delivered
+	mu          sync.Mutex
+	subscribers []*subscriber
+}
+
+// subscriber is a streaming request waiting for a flight
+type subscriber struct {
+	progress ProgressFunc
+	// tokens is false for requests that joined late, a part of the answer would make no sense
+	tokens bool
+}
+
+// emit passes the event to every request currently waiting, one at a time
+func (f *flight) emit(e Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, s := range f.subscribers {
+		if e.Type == EventToken && !s.tokens {
+			continue
+		}
+		s.progress.emit(e)
+	}
+}
+
+// subscribe adds a request, one that joined late is told so first
+func (f *flight) subscribe(s *subscriber, joined bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if joined {
+		s.progress.emit(Event{Type: EventProgress, Status: StatusJoined})
+	}
+	f.subscribers = append(f.subscribers, s)
+}
+
+// unsubscribe returns once the progress function is no longer called
+func (f *flight) unsubscribe(s *subscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.subscribers = slices.DeleteFunc(f.subscribers, func(other *subscriber) bool { return other == s })
+}
+
+// flightGroup coalesces identical analyses: a request made while the same one runs waits for
+// its result instead of collecting the evidence and asking the model again
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do runs analyze once for all requests with the same key made while it runs, they all get the same
+// result. Analyze always gets a progress function, its events go to every streaming request waiting
+// at the time, whether the request that started the analysis streams or not. Tokens go only to the
+// request that started it, requests joining later get a StatusJoined event, then the progress events. The analysis
+// outlives the request that started it, it's canceled only when every request waiting for it is gone.
+func (g *flightGroup) do(ctx context.Context, key string, progress ProgressFunc, analyze func(context.Context, ProgressFunc) (*LLMResponse, error)) (*LLMResponse, bool, error) {
+	g.mu.Lock()
+	f, shared := g.flights[key]
+	if !shared {
+		runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+
+		go func() {
+			defer cancel()
+			result, err := analyze(runCtx, f.emit)
+
+			g.mu.Lock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mu.Unlock()
+
+			f.result, f.err = result, err
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	if progress != nil {
+		s := &subscriber{progress: progress, tokens: !shared}
+		f.subscribe(s, shared)
+		defer f.unsubscribe(s)
+	}
+
+	select {
+	case <-f.done:
+		return f.result, shared, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Nobody waits for the result anymore, a new request starts over
+			f.cancel()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// requestKey identifies an analysis request with its period already resolved
+func requestKey(req AnalysisRequest) string {
+	mode := req.Mode
+	if mode == "" {
+		mode = ModePrompt
+	}
+
+	var baseline TimeRange
+	if req.Baseline != nil {
+		baseline = *req.Baseline
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%d\x00%d", mode, req.Query,
+		req.TimeRange.Start.UnixNano(), req.TimeRange.End.UnixNano(), baseline.Start.UnixNano(), baseline.End.UnixNano())
+	// The order metrics are listed in doesn't change what is collected
+	fmt.Fprintf(h, "\x00%s", strings.Join(slices.Sorted(slices.Values(req.Metrics)), "\x00"))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,158 @@
+package chain
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects the events of a request
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) progress(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) list() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func TestFlightWithoutStreaming(t *testing.T) {
+	g := newFlightGroup()
+
+	result, shared, err := g.do(t.Context(), "key", nil, func(_ context.Context, progress ProgressFunc) (*LLMResponse, error) {
+		// Nobody listens, the events are dropped
+		progress(Event{Type: EventToken, Text: "done"})
+		progress(Event{Type: EventProgress, Phase: PhaseLLM, Status: StatusDone})
+		return &LLMResponse{Analysis: "done"}, nil
+	})
+	if err != nil || shared || result.Analysis != "done" {
+		t.Fatalf("do() = %+v, %v, %v", result, shared, err)
+	}
+}
+
+func TestFlightStreamingJoinsNonStreaming(t *testing.T) {
+	g := newFlightGroup()
+
+	started := make(chan struct{})
+	joined := make(chan struct{})
+	var late recorder
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, shared, err := g.do(t.Context(), "key", nil, func(_ context.Context, progress ProgressFunc) (*LLMResponse, error) {
+			close(started)
+			<-joined
+			progress(Event{Type: EventProgress, Phase: PhaseCollect, Source: "logs", Status: StatusDone})
+			progress(Event{Type: EventToken, Text: "Errors started"})
+			progress(Event{Type: EventProgress, Phase: PhaseLLM, Status: StatusDone})
+			return &LLMResponse{Analysis: "Errors started"}, nil
+		})
+		if err != nil || shared {
+			t.Errorf("first request: shared = %v, err = %v", shared, err)
+		}
+	}()
+
+	<-started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		result, shared, err := g.do(t.Context(), "key", late.progress, func(context.Context, ProgressFunc) (*LLMResponse, error) {
+			t.Error("the identical analysis ran twice")
+			return nil, nil
+		})
+		if err != nil || !shared || result.Analysis != "Errors started" {
+			t.Errorf("late request: do() = %+v, %v, %v", result, shared, err)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(late.list()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("late request didn't join")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(joined)
+	wg.Wait()
+
+	events := late.list()
+	if len(events) != 3 || events[0].Status != StatusJoined ||
+		events[1].Phase != PhaseCollect || events[2].Phase != PhaseLLM {
+		t.Errorf("late request got %+v, want joined, collect and llm progress without tokens", events)
+	}
+}
+
+func TestFlightLateJoiner(t *testing.T) {
+	g := newFlightGroup()
+
+	started := make(chan struct{})
+	joined := make(chan struct{})
+	var first, late recorder
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, shared, err := g.do(t.Context(), "key", first.progress, func(_ context.Context, progress ProgressFunc) (*LLMResponse, error) {
+			progress(Event{Type: EventToken, Text: "Errors "})
+			close(started)
+			<-joined
+			progress(Event{Type: EventToken, Text: "started"})
+			progress(Event{Type: EventProgress, Phase: PhaseLLM, Status: StatusDone})
+			return &LLMResponse{Analysis: "Errors started"}, nil
+		})
+		if err != nil || shared {
+			t.Errorf("first request: shared = %v, err = %v", shared, err)
+		}
+	}()
+
+	<-started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		result, shared, err := g.do(t.Context(), "key", late.progress, func(context.Context, ProgressFunc) (*LLMResponse, error) {
+			t.Error("the identical analysis ran twice")
+			return nil, nil
+		})
+		if err != nil || !shared || result.Analysis != "Errors started" {
+			t.Errorf("late request: do() = %+v, %v, %v", result, shared, err)
+		}
+	}()
+
+	// The late request is subscribed once it got the joined event
+	deadline := time.Now().Add(5 * time.Second)
+	for len(late.list()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("late request didn't join")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(joined)
+	wg.Wait()
+
+	var tokens int
+	for _, e := range first.list() {
+		if e.Type == EventToken {
+			tokens++
+		}
+	}
+	if tokens != 2 {
+		t.Errorf("first request got %d tokens, want 2", tokens)
+	}
+
+	events := late.list()
+	if len(events) != 2 || events[0].Status != StatusJoined || events[1].Status != StatusDone {
+		t.Errorf("late request got %+v, want joined and done without tokens", events)
+	}
+}
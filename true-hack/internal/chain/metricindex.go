@@ -0,0 +1,174 @@
+package chain
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/embedding"
+
+	"go.uber.org/zap"
+)
+
+// metricsLookback is how far back series are looked up to find label sets of metrics
+const metricsLookback = time.Hour
+
+// MetricSource lists metrics that can be indexed, implemented by collector.PrometheusCollector
+type MetricSource interface {
+	GetMetricsInfo(ctx context.Context, lookback time.Duration) ([]collector.MetricInfo, error)
+}
+
+type metricEntry struct {
+	name   string
+	text   string
+	vector []float32
+}
+
+// MetricIndex is an in-memory vector index of metric names, HELP texts and label sets.
+// It is used to pick the metrics relevant to a question instead of sending all of them.
+type MetricIndex struct {
+	source   MetricSource
+	embedder embedding.Embedder
+	logger   *zap.Logger
+
+	mu      sync.RWMutex
+	entries []metricEntry
+}
+
+func NewMetricIndex(source MetricSource, embedder embedding.Embedder, logger *zap.Logger) *MetricIndex {
+	return &MetricIndex{
+		source:   source,
+		embedder: embedder,
+		logger:   logger,
+	}
+}
+
+// Run refreshes the index right away and then every interval until ctx is done
+func (i *MetricIndex) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := i.Refresh(ctx); err != nil && ctx.Err() == nil {
+			i.logger.Warn("Failed to refresh metric index", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh rebuilds the index. Vectors of metrics whose description didn't change are reused.
+func (i *MetricIndex) Refresh(ctx context.Context) error {
+	infos, err := i.source.GetMetricsInfo(ctx, metricsLookback)
+	if err != nil {
+		return fmt.Errorf("get metrics info: %w", err)
+	}
+
+	i.mu.RLock()
+	known := make(map[string][]float32, len(i.entries))
+	for _, entry := range i.entries {
+		known[entry.text] = entry.vector
+	}
+	i.mu.RUnlock()
+
+	entries := make([]metricEntry, len(infos))
+	var missing []int
+	var texts []string
+	for n, info := range infos {
+		text := describeMetric(info)
+		entries[n] = metricEntry{name: info.Name, text: text, vector: known[text]}
+		if entries[n].vector == nil {
+			missing = append(missing, n)
+			texts = append(texts, text)
+		}
+	}
+
+	if len(texts) > 0 {
+		vectors, err := i.embedder.Embed(ctx, texts)
+		if err != nil {
+			return fmt.Errorf("embed metrics: %w", err)
+		}
+		for n, vector := range vectors {
+			entries[missing[n]].vector = vector
+		}
+	}
+
+	i.mu.Lock()
+	i.entries = entries
+	i.mu.Unlock()
+
+	i.logger.Info("Refreshed metric index",
+		zap.Int("metrics", len(entries)),
+		zap.Int("embedded", len(texts)))
+
+	return nil
+}
+
+// Search returns names of up to k metrics most similar to the query.
+// It returns nothing until the first Refresh succeeded.
+func (i *MetricIndex) Search(ctx context.Context, query string, k int) ([]string, error) {
+	i.mu.RLock()
+	entries := i.entries
+	i.mu.RUnlock()
+
+	if len(entries) == 0 || k <= 0 {
+		return nil, nil
+	}
+
+	vectors, err := i.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("embed query: %w", err)
+	}
+
+	type scored struct {
+		name  string
+		score float32
+	}
+	results := make([]scored, len(entries))
+	for n, entry := range entries {
+		results[n] = scored{name: entry.name, score: embedding.Cosine(vectors[0], entry.vector)}
+	}
+	slices.SortStableFunc(results, func(a, b scored) int {
+		return cmp.Compare(b.score, a.score)
+	})
+
+	names := make([]string, 0, k)
+	for _, result := range results[:min(k, len(results))] {
+		names = append(names, result.name)
+	}
+	return names, nil
+}
+
+// describeMetric builds the text that is embedded for a metric
+func describeMetric(info collector.MetricInfo) string {
+	var b strings.Builder
+	b.WriteString(info.Name)
+	if info.Type != "" {
+		b.WriteString(" (" + info.Type + ")")
+	}
+	if info.Help != "" {
+		b.WriteString(": " + info.Help)
+	}
+
+	labels := make([]string, 0, len(info.Labels))
+	for name := range info.Labels {
+		labels = append(labels, name)
+	}
+	slices.Sort(labels)
+	for _, name := range labels {
+		// Values come in series order, sort them so the text is stable between refreshes
+		values := slices.Sorted(slices.Values(info.Labels[name]))
+		fmt.Fprintf(&b, "\n%s: %s", name, strings.Join(values, ", "))
+	}
+
+	return b.String()
+}
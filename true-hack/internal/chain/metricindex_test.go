@@ -0,0 +1,112 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/embedding"
+
+	"go.uber.org/zap"
+)
+
+// metricSource lists fixed metrics, or fails with err
+type metricSource struct {
+	infos []collector.MetricInfo
+	err   error
+}
+
+func (s *metricSource) GetMetricsInfo(_ context.Context, _ time.Duration) ([]collector.MetricInfo, error) {
+	return s.infos, s.err
+}
+
+// countingEmbedder counts the texts it embeds
+type countingEmbedder struct {
+	embedding.Embedder
+	texts int
+}
+
+func (e *countingEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.texts += len(texts)
+	return e.Embedder.Embed(ctx, texts)
+}
+
+func TestMetricIndex(t *testing.T) {
+	source := &metricSource{infos: []collector.MetricInfo{
+		{Name: "http_requests_total", Type: "counter", Help: "Total HTTP requests", Labels: map[string][]string{"code": {"500", "200"}}},
+		{Name: "node_memory_bytes", Type: "gauge", Help: "Memory in use"},
+		{Name: "grpc_server_handled_total", Type: "counter", Help: "Handled gRPC calls"},
+	}}
+	embedder := &countingEmbedder{Embedder: embedding.NewHashEmbedder(256)}
+	index := NewMetricIndex(source, embedder, zap.NewNop())
+
+	// Nothing is found until the first refresh
+	if names, err := index.Search(t.Context(), "memory", 2); err != nil || names != nil {
+		t.Fatalf("Search() before refresh = %v, %v", names, err)
+	}
+
+	if err := index.Refresh(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		k     int
+		want  []string
+	}{
+		{query: "how much memory is used", k: 1, want: []string{"node_memory_bytes"}},
+		{query: "http requests failing with 500", k: 1, want: []string{"http_requests_total"}},
+		{query: "grpc handled calls", k: 1, want: []string{"grpc_server_handled_total"}},
+		{query: "memory", k: 10, want: []string{"node_memory_bytes"}},
+		{query: "memory", k: 0, want: nil},
+	}
+	for _, tt := range tests {
+		names, err := index.Search(t.Context(), tt.query, tt.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.k > len(source.infos) && len(names) != len(source.infos) {
+			t.Errorf("Search(%q, %d) returned %d names, want all %d", tt.query, tt.k, len(names), len(source.infos))
+		}
+		if len(tt.want) == 0 && len(names) != 0 || len(tt.want) > 0 && (len(names) == 0 || names[0] != tt.want[0]) {
+			t.Errorf("Search(%q, %d) = %v, want %v first", tt.query, tt.k, names, tt.want)
+		}
+	}
+
+	// Unchanged metrics are not embedded again, a changed description is
+	embedder.texts = 0
+	source.infos[1].Help = "Resident memory"
+	if err := index.Refresh(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if embedder.texts != 1 {
+		t.Errorf("embedded %d metrics on refresh, want 1", embedder.texts)
+	}
+
+	// A failed refresh keeps the index
+	source.err = errors.New("connection refused")
+	if err := index.Refresh(t.Context()); err == nil {
+		t.Error("Refresh() didn't fail")
+	}
+	if names, _ := index.Search(t.Context(), "memory", 1); !slices.Equal(names, []string{"node_memory_bytes"}) {
+		t.Errorf("Search() after a failed refresh = %v", names)
+	}
+}
+
+func TestDescribeMetric(t *testing.T) {
+	info := collector.MetricInfo{
+		Name:   "http_requests_total",
+		Type:   "counter",
+		Help:   "Total HTTP requests",
+		Labels: map[string][]string{"method": {"POST", "GET"}, "code": {"500", "200"}},
+	}
+	want := "http_requests_total (counter): Total HTTP requests\ncode: 200, 500\nmethod: GET, POST"
+	if got := describeMetric(info); got != want {
+		t.Errorf("describeMetric() = %q, want %q", got, want)
+	}
+	if got := describeMetric(collector.MetricInfo{Name: "up"}); got != "up" {
+		t.Errorf("describeMetric() without metadata = %q", got)
+	}
+}
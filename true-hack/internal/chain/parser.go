@@ -1,10 +1,14 @@
 package chain
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
 )
 
 type LLMResponse struct {
@@ -12,19 +16,135 @@ type LLMResponse struct {
 	Confidence  float32  `json:"confidence"`
 	Suggestions []string `json:"suggestions"`
 	Metrics     []string `json:"relevant_metrics"`
+	// Notes list data sources that failed or returned partial data, they are set by the analyzer, not the model
+	Notes []string `json:"notes,omitempty"`
+	// TimeRange is the analyzed period, set by the analyzer
+	TimeRange *ResolvedTimeRange `json:"time_range,omitempty"`
+	// Transcript lists the tool calls of the agent mode, set by the analyzer
+	Transcript []ToolCall `json:"transcript,omitempty"`
+	// Provider is the name of the LLM provider that gave the answer, set by the analyzer
+	Provider string `json:"provider,omitempty"`
+}
+
+// Response modes tell the LLM endpoint how to enforce the LLMResponse structure
+const (
+	// ResponseModeJSON uses response_format=json_object, the schema is described in the prompt
+	ResponseModeJSON = "json_object"
+	// ResponseModeFunction forces a call of the reportFunctionName function with llmResponseSchema as parameters
+	ResponseModeFunction = "function"
+	// ResponseModeText relies on the prompt only, for endpoints without JSON mode support
+	ResponseModeText = "text"
+)
+
+const reportFunctionName = "report_analysis"
+
+// llmResponseSchema is the JSON schema of LLMResponse
+var llmResponseSchema = jsonschema.Definition{
+	Type: jsonschema.Object,
+	Properties: map[string]jsonschema.Definition{
+		"analysis": {
+			Type:        jsonschema.String,
+			Description: "Explanation of what is happening in the system",
+		},
+		"confidence": {
+			Type:        jsonschema.Number,
+			Description: "Confidence of the analysis from 0 to 1",
+		},
+		"suggestions": {
+			Type:        jsonschema.Array,
+			Description: "Concrete actions to take",
+			Items:       &jsonschema.Definition{Type: jsonschema.String},
+		},
+		"relevant_metrics": {
+			Type:        jsonschema.Array,
+			Description: "Names of the metrics the analysis is based on",
+			Items:       &jsonschema.Definition{Type: jsonschema.String},
+		},
+	},
+	Required: []string{"analysis", "confidence", "suggestions", "relevant_metrics"},
+}
+
+// schemaInstruction is appended to the system prompt so the model knows the exact shape of the answer
+func schemaInstruction() string {
+	schema, _ := json.Marshal(llmResponseSchema)
+	return "Respond with a single JSON object and nothing else. It must match this JSON schema:\n" + string(schema)
+}
+
+var codeFenceRegex = regexp.MustCompile("(?s)^```(?:json)?\\s*(.*?)\\s*```$")
+
+// decodeLLMResponse strictly decodes and validates a JSON answer of the model
+func decodeLLMResponse(content string) (*LLMResponse, error) {
+	content = strings.TrimSpace(content)
+	// Models like to wrap JSON into markdown even in JSON mode
+	if matches := codeFenceRegex.FindStringSubmatch(content); len(matches) > 1 {
+		content = matches[1]
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &fields); err != nil {
+		return nil, fmt.Errorf("response is not a JSON object: %w", err)
+	}
+
+	var errs []error
+	for _, name := range llmResponseSchema.Required {
+		if _, ok := fields[name]; !ok {
+			errs = append(errs, fmt.Errorf("missing required field %q", name))
+		}
+	}
+	for name := range fields {
+		if _, ok := llmResponseSchema.Properties[name]; !ok {
+			errs = append(errs, fmt.Errorf("unknown field %q", name))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	var resp LLMResponse
+	decoder := json.NewDecoder(bytes.NewReader([]byte(content)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("response does not match schema: %w", err)
+	}
+
+	if err := validateLLMResponse(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func validateLLMResponse(resp *LLMResponse) error {
+	var errs []error
+
+	if strings.TrimSpace(resp.Analysis) == "" {
+		errs = append(errs, errors.New("field \"analysis\" must not be empty"))
+	}
+	if resp.Confidence < 0 || resp.Confidence > 1 {
+		errs = append(errs, fmt.Errorf("field \"confidence\" must be between 0 and 1, got %v", resp.Confidence))
+	}
+	if resp.Suggestions == nil {
+		errs = append(errs, errors.New("field \"suggestions\" must be an array"))
+	}
+	if resp.Metrics == nil {
+		errs = append(errs, errors.New("field \"relevant_metrics\" must be an array"))
+	}
+
+	return errors.Join(errs...)
 }
 
+// parseLLMResponse is the last resort for answers that never passed validation.
+// JSON is accepted leniently, unknown fields are ignored, but it still has to be a valid answer.
 func parseLLMResponse(response string) (*LLMResponse, error) {
 	// Try to parse as JSON first
 	var llmResp LLMResponse
-	if err := json.Unmarshal([]byte(response), &llmResp); err == nil {
+	if err := json.Unmarshal([]byte(response), &llmResp); err == nil && validateLLMResponse(&llmResp) == nil {
 		return &llmResp, nil
 	}
 
-	// If not JSON, try to parse using regex
+	// If not JSON, try to parse using regex.
+	// Confidence stays zero unless the model stated it, the answer is unverified.
 	resp := &LLMResponse{
 		Analysis:    response,
-		Confidence:  0.8, // Default confidence
 		Suggestions: []string{},
 		Metrics:     []string{},
 	}
@@ -33,20 +153,22 @@ func parseLLMResponse(response string) (*LLMResponse, error) {
 	confidenceRegex := regexp.MustCompile(`confidence:?\s*([0-9.]+)`)
 	if matches := confidenceRegex.FindStringSubmatch(response); len(matches) > 1 {
 		fmt.Sscanf(matches[1], "%f", &resp.Confidence)
+		// Something like "confidence: 85" is not on the 0..1 scale, better no confidence than a wrong one
+		if resp.Confidence < 0 || resp.Confidence > 1 {
+			resp.Confidence = 0
+		}
 	}
 
 	// Extract suggestions
 	suggestionRegex := regexp.MustCompile(`suggestion:?\s*([^\n]+)`)
-	resp.Suggestions = suggestionRegex.FindAllString(response, -1)
-	for i, s := range resp.Suggestions {
-		resp.Suggestions[i] = strings.TrimSpace(strings.TrimPrefix(s, "suggestion:"))
+	for _, s := range suggestionRegex.FindAllString(response, -1) {
+		resp.Suggestions = append(resp.Suggestions, strings.TrimSpace(strings.TrimPrefix(s, "suggestion:")))
 	}
 
 	// Extract metrics
 	metricRegex := regexp.MustCompile(`metric:?\s*([^\n]+)`)
-	resp.Metrics = metricRegex.FindAllString(response, -1)
-	for i, m := range resp.Metrics {
-		resp.Metrics[i] = strings.TrimSpace(strings.TrimPrefix(m, "metric:"))
+	for _, m := range metricRegex.FindAllString(response, -1) {
+		resp.Metrics = append(resp.Metrics, strings.TrimSpace(strings.TrimPrefix(m, "metric:")))
 	}
 
 	return resp, nil
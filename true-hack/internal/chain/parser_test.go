@@ -0,0 +1,69 @@
+package chain
+
+import (
+	"testing"
+)
+
+func TestParseLLMResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		response       string
+		wantAnalysis   string
+		wantConfidence float32
+	}{
+		{
+			name:           "valid JSON with extra fields",
+			response:       `{"analysis": "disk is full", "confidence": 0.7, "suggestions": [], "relevant_metrics": [], "severity": "high"}`,
+			wantAnalysis:   "disk is full",
+			wantConfidence: 0.7,
+		},
+		{
+			name:           "JSON with confidence out of range is treated as text",
+			response:       `{"analysis": "disk is full", "confidence": 85, "suggestions": [], "relevant_metrics": []}`,
+			wantAnalysis:   `{"analysis": "disk is full", "confidence": 85, "suggestions": [], "relevant_metrics": []}`,
+			wantConfidence: 0,
+		},
+		{
+			name:           "JSON without analysis is treated as text",
+			response:       `{"confidence": 0.5}`,
+			wantAnalysis:   `{"confidence": 0.5}`,
+			wantConfidence: 0,
+		},
+		{
+			name:           "text with confidence",
+			response:       "disk is full\nconfidence: 0.8",
+			wantAnalysis:   "disk is full\nconfidence: 0.8",
+			wantConfidence: 0.8,
+		},
+		{
+			name:           "text with confidence in percent",
+			response:       "disk is full\nconfidence: 85",
+			wantAnalysis:   "disk is full\nconfidence: 85",
+			wantConfidence: 0,
+		},
+		{
+			name:           "text without confidence",
+			response:       "disk is full",
+			wantAnalysis:   "disk is full",
+			wantConfidence: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := parseLLMResponse(tt.response)
+			if err != nil {
+				t.Fatalf("parseLLMResponse: %v", err)
+			}
+			if resp.Analysis != tt.wantAnalysis {
+				t.Errorf("analysis = %q, want %q", resp.Analysis, tt.wantAnalysis)
+			}
+			if resp.Confidence != tt.wantConfidence {
+				t.Errorf("confidence = %v, want %v", resp.Confidence, tt.wantConfidence)
+			}
+			if resp.Suggestions == nil || resp.Metrics == nil {
+				t.Errorf("suggestions = %v, metrics = %v, want arrays", resp.Suggestions, resp.Metrics)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/rag"
+
+	"go.uber.org/zap"
+)
+
+// indexEvidence stores collected logs and spans, so they can be retrieved by this and later analyses.
+// It runs on the request path, the analysis retrieves from the evidence it has just collected. Only
+// chunks that are not stored yet are embedded, a remote embedder costs a request per analysis that
+// collected new logs or traces.
+func (a *Analyzer) indexEvidence(ctx context.Context, evidence []*collector.Evidence) {
+	for _, e := range evidence {
+		var err error
+		switch e.Kind {
+		case collector.KindLogs:
+			err = a.evidenceIndex.IndexLogs(ctx, e.Source, e.Logs)
+		case collector.KindTraces:
+			err = a.evidenceIndex.IndexSpans(ctx, e.Source, e.Spans)
+		}
+		if err != nil {
+			a.logger.Warn("Failed to index evidence",
+				zap.String("source", e.Source),
+				zap.Error(err))
+		}
+	}
+}
+
+// retrieve returns chunks of the given kind within the window most related to the question,
+// in chronological order so the model can follow the sequence of events, and the tokens they take.
+// Chunks are ranked, so the least relevant are dropped first when they don't fit into maxTokens.
+func (a *Analyzer) retrieve(ctx context.Context, question, kind string, startTime, endTime time.Time, k, maxTokens int) ([]string, int) {
+	results, err := a.evidenceIndex.Search(ctx, question, rag.Filter{
+		Kinds: []string{kind},
+		Start: startTime,
+		End:   endTime,
+	}, k)
+	if err != nil {
+		a.logger.Warn("Failed to retrieve evidence",
+			zap.String("kind", kind),
+			zap.Error(err))
+		return nil, 0
+	}
+
+	var selected []rag.Result
+	var totalTokens int
+	for _, result := range results {
+		tokens := a.tokenizer.Count(formatRetrieved(result))
+		if totalTokens+tokens > maxTokens {
+			continue
+		}
+		selected = append(selected, result)
+		totalTokens += tokens
+	}
+	slices.SortStableFunc(selected, func(a, b rag.Result) int {
+		return a.Start.Compare(b.Start)
+	})
+
+	lines := make([]string, 0, len(selected))
+	for _, result := range selected {
+		lines = append(lines, formatRetrieved(result))
+	}
+
+	a.logger.Debug("Retrieved evidence",
+		zap.String("kind", kind),
+		zap.Int("chunks", len(lines)),
+		zap.Int("tokens", totalTokens),
+		zap.Int("budget", maxTokens))
+
+	return lines, totalTokens
+}
+
+func formatRetrieved(result rag.Result) string {
+	return fmt.Sprintf("[%s, relevance %.2f]\n%s\n", result.Source, result.Score, result.Text)
+}
@@ -0,0 +1,281 @@
+package chain
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"true-hack/internal/collector"
+)
+
+const (
+	// rawPointsWindow is the longest series span that is sent point by point next to its stats
+	rawPointsWindow = 10 * time.Minute
+	// maxStepChanges limits how many step changes are reported per series
+	maxStepChanges = 3
+	// stepThreshold is how many robust standard deviations of noise the level has to shift to count as a step
+	stepThreshold = 5
+)
+
+// seriesStats is the compact description of a series that replaces its points in the prompt
+type seriesStats struct {
+	count          int
+	min, max, mean float64
+	p50, p95       float64
+	first, last    float64
+	// slope is the least squares trend per minute
+	slope float64
+	steps []stepChange
+}
+
+// stepChange is a point where the series level shifted and stayed there
+type stepChange struct {
+	time          time.Time
+	before, after float64
+	// score is the shift in robust standard deviations
+	score float64
+}
+
+// formatSeries renders a series of a metric for the prompt. Points are replaced by their stats,
+// short series also keep their raw points.
+func formatSeries(name string, s collector.Series) string {
+	points := cleanPoints(s.Points)
+	if len(points) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(name + s.LabelString() + ": ")
+	if len(points) == 1 {
+		b.WriteString(formatValue(points[0].Value) + "\n")
+		return b.String()
+	}
+
+	b.WriteString(computeSeriesStats(points).String() + "\n")
+
+	if points[len(points)-1].Time.Sub(points[0].Time) <= rawPointsWindow {
+		for _, point := range points {
+			fmt.Fprintf(&b, "  %s: %s\n", point.Time.Format(time.TimeOnly), formatValue(point.Value))
+		}
+	}
+	return b.String()
+}
+
+// cleanPoints drops NaN and infinite values. Stale markers and divisions by zero come as NaN,
+// they would poison every stat.
+func cleanPoints(points []collector.Point) []collector.Point {
+	return slices.DeleteFunc(slices.Clone(points), func(p collector.Point) bool {
+		return math.IsNaN(p.Value) || math.IsInf(p.Value, 0)
+	})
+}
+
+func computeSeriesStats(points []collector.Point) seriesStats {
+	if len(points) == 0 {
+		return seriesStats{}
+	}
+
+	sorted := slices.Sorted(slices.Values(values(points)))
+
+	return seriesStats{
+		count: len(points),
+		min:   sorted[0],
+		max:   sorted[len(sorted)-1],
+		mean:  mean(sorted),
+		p50:   quantile(sorted, 0.5),
+		p95:   quantile(sorted, 0.95),
+		first: points[0].Value,
+		last:  points[len(points)-1].Value,
+		slope: trendSlope(points),
+		steps: findStepChanges(points),
+	}
+}
+
+func (s seriesStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "n=%d min=%s max=%s mean=%s p50=%s p95=%s last=%s trend=%s/min",
+		s.count,
+		formatValue(s.min),
+		formatValue(s.max),
+		formatValue(s.mean),
+		formatValue(s.p50),
+		formatValue(s.p95),
+		formatValue(s.last),
+		formatSigned(s.slope))
+
+	// Relative change over the window, meaningless around zero
+	if s.first != 0 {
+		fmt.Fprintf(&b, " change=%+.0f%%", (s.last-s.first)/math.Abs(s.first)*100)
+	}
+
+	for i, step := range s.steps {
+		if i == 0 {
+			b.WriteString(" steps:")
+		}
+		fmt.Fprintf(&b, " %s %s->%s", step.time.Format(time.RFC3339), formatValue(step.before), formatValue(step.after))
+	}
+	return b.String()
+}
+
+// trendSlope fits a line through the points and returns its slope per minute
+func trendSlope(points []collector.Point) float64 {
+	if len(points) < 2 {
+		return 0
+	}
+
+	start := points[0].Time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, point := range points {
+		x := point.Time.Sub(start).Minutes()
+		sumX += x
+		sumY += point.Value
+		sumXY += x * point.Value
+		sumXX += x * x
+	}
+
+	n := float64(len(points))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// findStepChanges compares the median level of a sliding window before and after every point.
+// A shift larger than stepThreshold times the noise of the series is a step, of several
+// neighbouring candidates the largest one is kept. The noise is estimated from differences of
+// consecutive points, a single jump barely changes their median, so steps don't hide themselves.
+// The levels of a trending series differ by the trend alone, so it is subtracted from the shift.
+func findStepChanges(points []collector.Point) []stepChange {
+	window := max(5, len(points)/10)
+	if len(points) < 2*window {
+		return nil
+	}
+
+	diffs := make([]float64, len(points)-1)
+	for i := range diffs {
+		diffs[i] = points[i+1].Value - points[i].Value
+	}
+	noise := mad(diffs) / math.Sqrt2
+	// Medians of the windows are a window of points apart
+	drift := median(diffs) * float64(window)
+
+	type candidate struct {
+		stepChange
+		index int
+	}
+
+	var candidates []candidate
+	for i := window; i+window <= len(points); i++ {
+		levelBefore := median(values(points[i-window : i]))
+		levelAfter := median(values(points[i : i+window]))
+
+		spread := noise
+		if spread == 0 {
+			// Flat series, any difference is a step. Scale by the level to compare with others.
+			spread = math.Max(math.Abs(levelBefore), math.Abs(levelAfter)) * 1e-3
+		}
+		if spread == 0 {
+			continue
+		}
+
+		score := math.Min(math.Abs(levelAfter-levelBefore-drift)/spread, maxScore)
+		if score >= stepThreshold {
+			candidates = append(candidates, candidate{
+				stepChange: stepChange{time: points[i].Time, before: levelBefore, after: levelAfter, score: score},
+				index:      i,
+			})
+		}
+	}
+
+	// Keep the strongest candidates that are at least a window apart
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(b.score, a.score)
+	})
+	var picked []candidate
+	for _, c := range candidates {
+		if len(picked) == maxStepChanges {
+			break
+		}
+		if !slices.ContainsFunc(picked, func(p candidate) bool { return abs(p.index-c.index) < window }) {
+			picked = append(picked, c)
+		}
+	}
+	slices.SortFunc(picked, func(a, b candidate) int {
+		return a.index - b.index
+	})
+
+	steps := make([]stepChange, len(picked))
+	for i, c := range picked {
+		steps[i] = c.stepChange
+	}
+	return steps
+}
+
+func values(points []collector.Point) []float64 {
+	result := make([]float64, len(points))
+	for i, point := range points {
+		result[i] = point.Value
+	}
+	return result
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func median(values []float64) float64 {
+	return quantile(slices.Sorted(slices.Values(values)), 0.5)
+}
+
+// mad is the median absolute deviation scaled to be comparable with the standard deviation
+func mad(values []float64) float64 {
+	m := median(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - m)
+	}
+	return 1.4826 * median(deviations)
+}
+
+// quantile expects sorted values, values or durations, and interpolates between the closest ranks
+func quantile[T ~float64 | ~int64](sorted []T, q float64) T {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := q * float64(len(sorted)-1)
+	lower := int(pos)
+	if lower+1 >= len(sorted) {
+		return sorted[lower]
+	}
+	return sorted[lower] + T(float64(sorted[lower+1]-sorted[lower])*(pos-float64(lower)))
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// formatValue keeps 4 significant digits, enough to see the shape of a metric
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
+
+func formatSigned(v float64) string {
+	if v >= 0 {
+		return "+" + formatValue(v)
+	}
+	return formatValue(v)
+}
@@ -0,0 +1,248 @@
+package chain
+
+import (
+	"math"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+)
+
+var seriesStart = time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// testPoints places values a step apart starting at seriesStart
+func testPoints(step time.Duration, values ...float64) []collector.Point {
+	points := make([]collector.Point, len(values))
+	for i, v := range values {
+		points[i] = collector.Point{Time: seriesStart.Add(time.Duration(i) * step), Value: v}
+	}
+	return points
+}
+
+// levels returns n values spread uniformly within noise around level, the same for every run
+func levels(n int, level, noise float64) []float64 {
+	random := rand.New(rand.NewPCG(uint64(n), uint64(level)))
+	result := make([]float64, n)
+	for i := range result {
+		result[i] = level + noise*(2*random.Float64()-1)
+	}
+	return result
+}
+
+// ramp returns n values growing by one from start
+func ramp(n int, start float64) []float64 {
+	result := make([]float64, n)
+	for i := range result {
+		result[i] = start + float64(i)
+	}
+	return result
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestQuantile(t *testing.T) {
+	tests := []struct {
+		sorted []float64
+		q      float64
+		want   float64
+	}{
+		{sorted: nil, q: 0.5, want: 0},
+		{sorted: []float64{5}, q: 0.5, want: 5},
+		{sorted: []float64{5}, q: 0.95, want: 5},
+		{sorted: []float64{1, 2, 3, 4}, q: 0, want: 1},
+		{sorted: []float64{1, 2, 3, 4}, q: 0.5, want: 2.5},
+		{sorted: []float64{1, 2, 3, 4}, q: 1, want: 4},
+		{sorted: []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, q: 0.95, want: 9.55},
+	}
+
+	for _, tt := range tests {
+		if got := quantile(tt.sorted, tt.q); !approxEqual(got, tt.want) {
+			t.Errorf("quantile(%v, %v) = %v, want %v", tt.sorted, tt.q, got, tt.want)
+		}
+	}
+
+	// Durations interpolate the same way, to the nanosecond
+	durations := []time.Duration{time.Millisecond, 3 * time.Millisecond}
+	if got := quantile(durations, 0.95); got != 2900*time.Microsecond {
+		t.Errorf("quantile(%v, 0.95) = %v, want 2.9ms", durations, got)
+	}
+}
+
+func TestComputeSeriesStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []collector.Point
+		want   seriesStats
+	}{
+		{
+			name:   "empty",
+			points: nil,
+			want:   seriesStats{},
+		},
+		{
+			name:   "single point",
+			points: testPoints(time.Minute, 7),
+			want:   seriesStats{count: 1, min: 7, max: 7, mean: 7, p50: 7, p95: 7, first: 7, last: 7},
+		},
+		{
+			name:   "growing",
+			points: testPoints(time.Minute, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10),
+			want:   seriesStats{count: 10, min: 1, max: 10, mean: 5.5, p50: 5.5, p95: 9.55, first: 1, last: 10, slope: 1},
+		},
+		{
+			name:   "falling every 30 seconds",
+			points: testPoints(30*time.Second, 10, 8, 6, 4, 2),
+			want:   seriesStats{count: 5, min: 2, max: 10, mean: 6, p50: 6, p95: 9.6, first: 10, last: 2, slope: -4},
+		},
+		{
+			name:   "unordered values",
+			points: testPoints(time.Minute, 3, 1, 2),
+			want:   seriesStats{count: 3, min: 1, max: 3, mean: 2, p50: 2, p95: 2.9, first: 3, last: 2, slope: -0.5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := computeSeriesStats(tt.points)
+			if got.count != tt.want.count {
+				t.Errorf("count = %d, want %d", got.count, tt.want.count)
+			}
+			for _, field := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"min", got.min, tt.want.min},
+				{"max", got.max, tt.want.max},
+				{"mean", got.mean, tt.want.mean},
+				{"p50", got.p50, tt.want.p50},
+				{"p95", got.p95, tt.want.p95},
+				{"first", got.first, tt.want.first},
+				{"last", got.last, tt.want.last},
+				{"slope", got.slope, tt.want.slope},
+			} {
+				if !approxEqual(field.got, field.want) {
+					t.Errorf("%s = %v, want %v", field.name, field.got, field.want)
+				}
+			}
+			if len(got.steps) != 0 {
+				t.Errorf("got steps %+v in a series without them", got.steps)
+			}
+		})
+	}
+}
+
+func TestFindStepChanges(t *testing.T) {
+	step := func(parts ...[]float64) []float64 {
+		var result []float64
+		for _, part := range parts {
+			result = append(result, part...)
+		}
+		return result
+	}
+
+	type wantStep struct {
+		index int
+		// shift is the difference of the levels after and before the step
+		shift float64
+	}
+	tests := []struct {
+		name   string
+		values []float64
+		want   []wantStep
+	}{
+		{name: "too short", values: step(levels(4, 10, 0), levels(5, 20, 0))},
+		{name: "flat", values: levels(40, 10, 0)},
+		{name: "noise", values: levels(40, 10, 1)},
+		{name: "ramp", values: ramp(40, 0)},
+		{name: "single spike", values: step(levels(20, 10, 0.1), []float64{50}, levels(19, 10, 0.1))},
+		{
+			name:   "step up",
+			values: step(levels(20, 10, 0.1), levels(20, 20, 0.1)),
+			want:   []wantStep{{index: 20, shift: 10}},
+		},
+		{
+			// Levels of the windows differ by 5 points of the trend besides the step of 50
+			name:   "step on a ramp",
+			values: step(ramp(20, 0), ramp(20, 70)),
+			want:   []wantStep{{index: 20, shift: 55}},
+		},
+		{
+			name:   "flat step down",
+			values: step(levels(20, 100, 0), levels(20, 50, 0)),
+			want:   []wantStep{{index: 20, shift: -50}},
+		},
+		{
+			name:   "up and back",
+			values: step(levels(30, 10, 0.1), levels(30, 20, 0.1), levels(30, 10, 0.1)),
+			want:   []wantStep{{index: 30, shift: 10}, {index: 60, shift: -10}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points := testPoints(time.Minute, tt.values...)
+			window := max(5, len(points)/10)
+
+			got := findStepChanges(points)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d steps %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i, want := range tt.want {
+				// Windows around the change see the same levels, any of them may be reported
+				index := int(got[i].time.Sub(seriesStart) / time.Minute)
+				if abs(index-want.index) >= window {
+					t.Errorf("step %d at point %d, want within %d of %d", i, index, window, want.index)
+				}
+				if shift := got[i].after - got[i].before; math.Abs(shift-want.shift) > 0.5 {
+					t.Errorf("step %d from %v to %v shifts by %v, want %v", i, got[i].before, got[i].after, shift, want.shift)
+				}
+				if got[i].score < stepThreshold {
+					t.Errorf("step %d score %v is below the threshold", i, got[i].score)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatSeries(t *testing.T) {
+	labels := map[string]string{"job": "api"}
+	tests := []struct {
+		name      string
+		points    []collector.Point
+		want      string
+		wantLines int
+	}{
+		{name: "empty", points: nil, want: "", wantLines: 0},
+		{name: "only NaN", points: testPoints(time.Minute, math.NaN(), math.Inf(1)), want: "", wantLines: 0},
+		{name: "single point", points: testPoints(time.Minute, 0.25), want: "up{job=api}: 0.25\n", wantLines: 1},
+		{
+			name:   "short window keeps raw points",
+			points: testPoints(time.Minute, levels(11, 1, 0)...),
+			want: "up{job=api}: n=11 min=1 max=1 mean=1 p50=1 p95=1 last=1 trend=+0/min change=+0%\n" +
+				"  12:00:00: 1\n",
+			wantLines: 12,
+		},
+		{
+			name:      "long window has stats only",
+			points:    testPoints(time.Minute, levels(12, 1, 0)...),
+			want:      "up{job=api}: n=12 min=1 max=1 mean=1 p50=1 p95=1 last=1 trend=+0/min change=+0%\n",
+			wantLines: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatSeries("up", collector.Series{Labels: labels, Points: tt.points})
+			if !strings.HasPrefix(got, tt.want) {
+				t.Errorf("got %q, want it to start with %q", got, tt.want)
+			}
+			if lines := strings.Count(got, "\n"); lines != tt.wantLines {
+				t.Errorf("got %d lines, want %d:\n%s", lines, tt.wantLines, got)
+			}
+		})
+	}
+}
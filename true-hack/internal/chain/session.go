@@ -0,0 +1,354 @@
+package chain
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"true-hack/internal/collector"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// ErrSessionNotFound is returned for unknown and expired sessions
+var ErrSessionNotFound = errors.New("session not found")
+
+// Turn is a question of a session and its answer
+type Turn struct {
+	Question string       `json:"question"`
+	Answer   *LLMResponse `json:"answer"`
+	AskedAt  time.Time    `json:"asked_at"`
+}
+
+// SessionInfo describes a session without its evidence
+type SessionInfo struct {
+	ID string `json:"id"`
+	// TimeRange is nil until the first question, it may be inferred from it
+	TimeRange *ResolvedTimeRange `json:"time_range,omitempty"`
+	Baseline  *TimeRange         `json:"baseline,omitempty"`
+	// Metrics are all metrics collected so far, empty if all metrics were collected
+	Metrics   []string  `json:"metrics,omitempty"`
+	Turns     []Turn    `json:"turns"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// session keeps what a conversation needs between questions. Evidence is collected with the
+// first question, follow-ups reuse it and only collect metrics it lacks.
+type session struct {
+	id        string
+	createdAt time.Time
+	// touched is the last access, it is guarded by SessionStore.mu
+	touched time.Time
+
+	// mu serializes questions of the session, it is held while the model answers
+	mu        sync.Mutex
+	request   AnalysisRequest
+	set       *evidenceSet
+	turns     []Turn
+	updatedAt time.Time
+}
+
+func (s *session) info() SessionInfo {
+	info := SessionInfo{
+		ID:        s.id,
+		Baseline:  s.request.Baseline,
+		Turns:     slices.Clone(s.turns),
+		CreatedAt: s.createdAt,
+		UpdatedAt: s.updatedAt,
+	}
+	if info.Turns == nil {
+		info.Turns = []Turn{}
+	}
+	if s.set != nil {
+		timeRange := s.set.timeRange
+		info.TimeRange = &timeRange
+		info.Metrics = slices.Clone(s.set.query.Metrics)
+	}
+	return info
+}
+
+// SessionStore keeps sessions in memory until they are not accessed for longer than the TTL
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	ttl      time.Duration
+	max      int
+}
+
+// NewSessionStore creates a store of at most max sessions, the least recently used
+// one is dropped to make room for a new one
+func NewSessionStore(ttl time.Duration, max int) *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*session),
+		ttl:      ttl,
+		max:      max,
+	}
+}
+
+func (s *SessionStore) create(req AnalysisRequest) (*session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	sess := &session{
+		id:        id,
+		createdAt: now,
+		touched:   now,
+		request:   req,
+		updatedAt: now,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeExpired(now)
+	if len(s.sessions) >= s.max {
+		var oldest *session
+		for _, candidate := range s.sessions {
+			if oldest == nil || candidate.touched.Before(oldest.touched) {
+				oldest = candidate
+			}
+		}
+		delete(s.sessions, oldest.id)
+	}
+	s.sessions[id] = sess
+
+	return sess, nil
+}
+
+func (s *SessionStore) get(id string) (*session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	now := time.Now()
+	if now.Sub(sess.touched) > s.ttl {
+		delete(s.sessions, id)
+		return nil, ErrSessionNotFound
+	}
+	sess.touched = now
+	return sess, nil
+}
+
+func (s *SessionStore) delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sessions[id]; !ok {
+		return ErrSessionNotFound
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+// removeExpired must be called with s.mu held
+func (s *SessionStore) removeExpired(now time.Time) {
+	for id, sess := range s.sessions {
+		if now.Sub(sess.touched) > s.ttl {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateSession starts a conversation about the period of req. The time range, baseline and
+// metrics of req are kept for all questions. With a non-empty req.Query it is asked right away.
+func (a *Analyzer) CreateSession(ctx context.Context, req AnalysisRequest, progress ProgressFunc) (SessionInfo, error) {
+	sess, err := a.sessions.create(req)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+
+	if req.Query != "" {
+		if _, err := a.Ask(ctx, sess.id, req.Query, nil, progress); err != nil {
+			a.sessions.delete(sess.id)
+			return SessionInfo{}, err
+		}
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.info(), nil
+}
+
+// Session returns the session with its questions and answers
+func (a *Analyzer) Session(id string) (SessionInfo, error) {
+	sess, err := a.sessions.get(id)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.info(), nil
+}
+
+// DeleteSession drops the session and its evidence
+func (a *Analyzer) DeleteSession(id string) error {
+	return a.sessions.delete(id)
+}
+
+// Ask answers a question within a session. The first question collects the evidence, later ones
+// reuse it together with the earlier questions and answers, and only collect the metrics related
+// to the question that haven't been collected yet. metrics are collected in addition to those.
+// Questions of a session are answered one at a time. The answer is also reported as EventResult.
+func (a *Analyzer) Ask(ctx context.Context, id, question string, metrics []string, progress ProgressFunc) (*LLMResponse, error) {
+	sess, err := a.sessions.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.set == nil {
+		req := sess.request
+		req.Query = question
+		req.Metrics = append(slices.Clone(req.Metrics), metrics...)
+		timeRange := a.resolveTimeRange(req, time.Now())
+		req.TimeRange = TimeRange{Start: timeRange.Start, End: timeRange.End}
+
+		sess.set, err = a.gather(ctx, req, timeRange, progress)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := a.collectMissingMetrics(ctx, sess.set, question, metrics, progress); err != nil {
+		return nil, err
+	}
+
+	messages, err := a.buildMessages(ctx, question, sess.set, a.sessionHistory(sess.turns))
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := a.requestAnalysis(ctx, messages, progress)
+	if err != nil {
+		return nil, err
+	}
+	result.Notes = slices.Clone(sess.set.notes)
+	timeRange := sess.set.timeRange
+	result.TimeRange = &timeRange
+
+	sess.updatedAt = time.Now()
+	sess.turns = append(sess.turns, Turn{Question: question, Answer: result, AskedAt: sess.updatedAt})
+
+	progress.emit(Event{Type: EventResult, Result: result})
+	return result, nil
+}
+
+// collectMissingMetrics collects the metrics related to a follow-up question that the session
+// lacks. Logs and traces already cover the whole period, they are reused as is.
+func (a *Analyzer) collectMissingMetrics(ctx context.Context, set *evidenceSet, question string, metrics []string, progress ProgressFunc) error {
+	// No metric names means all metrics were collected
+	if len(set.query.Metrics) == 0 {
+		return nil
+	}
+
+	wanted := slices.Concat(metrics, a.searchMetrics(ctx, question))
+	var missing []string
+	for _, metric := range wanted {
+		if !slices.Contains(set.query.Metrics, metric) && !slices.Contains(missing, metric) {
+			missing = append(missing, metric)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	var collectors []collector.Collector
+	for _, e := range set.evidence {
+		if e.Kind != collector.KindMetrics {
+			continue
+		}
+		if c, ok := a.collectors.Get(e.Source); ok && !slices.Contains(collectors, c) {
+			collectors = append(collectors, c)
+		}
+	}
+	if len(collectors) == 0 {
+		return nil
+	}
+
+	query := set.query
+	query.Question = question
+	query.Metrics = missing
+	evidence, notes, err := a.collect(ctx, PhaseCollect, collectors, query, progress)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		// The question can still be answered with what the session has
+		a.logger.Warn("Failed to collect additional metrics", zap.Strings("metrics", missing), zap.Error(err))
+		set.notes = append(set.notes, fmt.Sprintf("metrics %v are unavailable: %v", missing, err))
+		return nil
+	}
+
+	set.evidence = append(set.evidence, evidence...)
+	set.notes = append(set.notes, notes...)
+	set.query.Metrics = append(set.query.Metrics, missing...)
+	return nil
+}
+
+// historyAnswer is what the model answered, without the fields the analyzer sets. The model
+// would repeat them and its answer would be rejected.
+type historyAnswer struct {
+	Analysis    string   `json:"analysis"`
+	Confidence  float32  `json:"confidence"`
+	Suggestions []string `json:"suggestions"`
+	Metrics     []string `json:"relevant_metrics"`
+}
+
+// sessionHistory turns earlier questions and answers into chat messages. The evidence sent with
+// them is left out, the current question gets the evidence related to it. The most recent turns
+// are kept within historyShare of the context window.
+func (a *Analyzer) sessionHistory(turns []Turn) []openai.ChatCompletionMessage {
+	limit := int(float64(a.contextWindow()) * historyShare)
+
+	var result []openai.ChatCompletionMessage
+	var total int
+	for _, turn := range slices.Backward(turns) {
+		// The answer is repeated in the form the model is asked to respond in
+		content, err := json.Marshal(historyAnswer{
+			Analysis:    turn.Answer.Analysis,
+			Confidence:  turn.Answer.Confidence,
+			Suggestions: turn.Answer.Suggestions,
+			Metrics:     turn.Answer.Metrics,
+		})
+		if err != nil {
+			continue
+		}
+
+		question := "Question: " + turn.Question
+		tokens := a.tokenizer.Count(question) + a.tokenizer.Count(string(content)) + 2*messageOverhead
+		if total+tokens > limit {
+			break
+		}
+		total += tokens
+
+		result = append(result,
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: string(content)},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: question},
+		)
+	}
+	slices.Reverse(result)
+	return result
+}
@@ -0,0 +1,260 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/llm"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// metricsCollector returns a flat series of every queried metric and records the metrics asked for
+type metricsCollector struct {
+	mu      sync.Mutex
+	queried [][]string
+}
+
+func (c *metricsCollector) Name() string {
+	return "prometheus"
+}
+
+func (c *metricsCollector) Collect(_ context.Context, q collector.Query) (*collector.Evidence, error) {
+	c.mu.Lock()
+	c.queried = append(c.queried, slices.Clone(q.Metrics))
+	c.mu.Unlock()
+
+	evidence := &collector.Evidence{Source: c.Name(), Kind: collector.KindMetrics}
+	for _, metric := range q.Metrics {
+		evidence.Metrics = append(evidence.Metrics, collector.MetricData{
+			Name:   metric,
+			Series: []collector.Series{{Points: []collector.Point{{Time: q.End, Value: 1}}}},
+		})
+	}
+	return evidence, nil
+}
+
+func (c *metricsCollector) calls() [][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.queried)
+}
+
+func TestSessionStoreExpiry(t *testing.T) {
+	store := NewSessionStore(time.Minute, 10)
+
+	fresh, err := store.create(AnalysisRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := store.create(AnalysisRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.touched = time.Now().Add(-2 * time.Minute)
+
+	if _, err := store.get(stale.id); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("get of an expired session: err = %v, want ErrSessionNotFound", err)
+	}
+	if _, ok := store.sessions[stale.id]; ok {
+		t.Error("expired session is still kept")
+	}
+
+	// Access prolongs the session
+	fresh.touched = time.Now().Add(-50 * time.Second)
+	if _, err := store.get(fresh.id); err != nil {
+		t.Fatalf("get of a live session: %v", err)
+	}
+	if time.Since(fresh.touched) > time.Second {
+		t.Error("get didn't update the last access")
+	}
+
+	// Creating a session drops the expired ones nobody asked for
+	fresh.touched = time.Now().Add(-2 * time.Minute)
+	if _, err := store.create(AnalysisRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.sessions[fresh.id]; ok {
+		t.Error("expired session survived the creation of another one")
+	}
+
+	if err := store.delete(fresh.id); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("delete of a removed session: err = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestSessionStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewSessionStore(time.Hour, 2)
+	now := time.Now()
+
+	first, err := store.create(AnalysisRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.create(AnalysisRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.touched = now.Add(-2 * time.Minute)
+	second.touched = now.Add(-time.Minute)
+
+	// The first session is used again, so the second one is the least recently used
+	if _, err := store.get(first.id); err != nil {
+		t.Fatal(err)
+	}
+	third, err := store.create(AnalysisRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.sessions) != 2 {
+		t.Errorf("store keeps %d sessions, want at most 2", len(store.sessions))
+	}
+	for _, tt := range []struct {
+		sess *session
+		want bool
+	}{{first, true}, {second, false}, {third, true}} {
+		if _, err := store.get(tt.sess.id); (err == nil) != tt.want {
+			t.Errorf("session %s: get err = %v, want kept = %v", tt.sess.id, err, tt.want)
+		}
+	}
+}
+
+func TestSessionFollowUpsReuseEvidence(t *testing.T) {
+	logs := &countingCollector{}
+	metrics := &metricsCollector{}
+	collectors, err := collector.NewRegistry(logs, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := llm.NewFake("fake", testAnswer).Record()
+	answers, err := NewMemoryCache(time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	analyzer, err := NewAnalyzer([]llm.LLM{provider}, zap.NewNop(), collectors, nil, nil, testConfig(), answers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := testRequest()
+	req.Query = ""
+	req.Metrics = []string{"cpu"}
+	info, err := analyzer.CreateSession(t.Context(), req, nil)
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if len(metrics.calls()) != 0 {
+		t.Error("a session without a question collected evidence")
+	}
+
+	questions := []struct {
+		question string
+		metrics  []string
+	}{
+		{question: "Why does the api fail?"},
+		{question: "Is memory involved?", metrics: []string{"memory", "cpu"}},
+		{question: "And what about the last deploy?"},
+	}
+	for _, q := range questions {
+		if _, err := analyzer.Ask(t.Context(), info.ID, q.question, q.metrics, nil); err != nil {
+			t.Fatalf("Ask(%q): %v", q.question, err)
+		}
+	}
+
+	if got := logs.calls.Load(); got != 1 {
+		t.Errorf("logs were collected %d times, want once for the session", got)
+	}
+	// The first question collects the session metrics, the second one only the one missing
+	want := [][]string{{"cpu"}, {"memory"}}
+	if got := metrics.calls(); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("metrics collected %v, want %v", got, want)
+	}
+
+	info, err = analyzer.Session(info.ID)
+	if err != nil {
+		t.Fatalf("Session: %v", err)
+	}
+	if len(info.Turns) != 3 || !slices.Equal(info.Metrics, []string{"cpu", "memory"}) {
+		t.Errorf("session has %d turns and metrics %v, want 3 turns of cpu and memory", len(info.Turns), info.Metrics)
+	}
+
+	// The last question is asked with the earlier ones and the evidence of both metrics
+	requests := provider.Requests()
+	last := requests[len(requests)-1].Messages
+	var asked []string
+	for _, message := range last {
+		if message.Role == openai.ChatMessageRoleUser {
+			asked = append(asked, message.Content)
+		}
+	}
+	if len(asked) != 3 || asked[0] != "Question: Why does the api fail?" || asked[1] != "Question: Is memory involved?" {
+		t.Fatalf("last request asked %q, want the earlier questions before the new one", asked)
+	}
+	for _, want := range []string{"And what about the last deploy?", "Metric: cpu", "Metric: memory", "request failed"} {
+		if !strings.Contains(asked[2], want) {
+			t.Errorf("last question doesn't contain %q:\n%s", want, asked[2])
+		}
+	}
+}
+
+func TestAskUnknownSession(t *testing.T) {
+	analyzer, source := newTestAnalyzer(t, testConfig(), llm.NewFake("fake", testAnswer))
+
+	if _, err := analyzer.Ask(t.Context(), "missing", "Why does the api fail?", nil, nil); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Ask: err = %v, want ErrSessionNotFound", err)
+	}
+	if _, err := analyzer.Session("missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Session: err = %v, want ErrSessionNotFound", err)
+	}
+	if err := analyzer.DeleteSession("missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("DeleteSession: err = %v, want ErrSessionNotFound", err)
+	}
+	if got := source.calls.Load(); got != 0 {
+		t.Errorf("collected %d times for an unknown session", got)
+	}
+}
+
+func TestSessionHistoryRepeatsModelFieldsOnly(t *testing.T) {
+	analyzer, _ := newTestAnalyzer(t, testConfig(), llm.NewFake("fake", testAnswer))
+	start := time.Date(2025, 1, 1, 11, 0, 0, 0, time.UTC)
+
+	turns := []Turn{{
+		Question: "Why does the api fail?",
+		Answer: &LLMResponse{
+			Analysis:    "The database refuses connections",
+			Confidence:  0.7,
+			Suggestions: []string{"Check the connection pool"},
+			Metrics:     []string{"db_connections"},
+			Notes:       []string{"jaeger timed out"},
+			TimeRange:   &ResolvedTimeRange{Start: start, End: start.Add(time.Hour), Source: "request"},
+			Transcript:  []ToolCall{{Step: 1, Tool: "query_logql", Arguments: "{}"}},
+			Provider:    "local",
+		},
+	}}
+
+	messages := analyzer.sessionHistory(turns)
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want the question and the answer", len(messages))
+	}
+	for _, message := range messages {
+		if message.Role != openai.ChatMessageRoleAssistant {
+			continue
+		}
+		// The model sees its earlier answers as examples, they must pass the validation of answers
+		answer, err := decodeLLMResponse(message.Content)
+		if err != nil {
+			t.Fatalf("earlier answer %s is not a valid answer: %v", message.Content, err)
+		}
+		if answer.Analysis != turns[0].Answer.Analysis {
+			t.Errorf("analysis = %q, want %q", answer.Analysis, turns[0].Answer.Analysis)
+		}
+	}
+}
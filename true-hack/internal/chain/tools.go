@@ -0,0 +1,587 @@
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/timerange"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+const (
+	// toolTimeout bounds a single tool call, a slow query shouldn't take the whole request
+	toolTimeout = 30 * time.Second
+	// defaultTraceLimit and defaultListLimit apply when the model doesn't set a limit
+	defaultTraceLimit = 20
+	defaultListLimit  = 100
+	// maxToolLimit caps the limit the model may ask for
+	maxToolLimit = 1000
+)
+
+// agentTool is a function the model can call, run gets its JSON arguments
+type agentTool struct {
+	definition openai.FunctionDefinition
+	run        func(ctx context.Context, arguments string) (string, error)
+}
+
+// toolbox is the set of tools of a single agent run. Only tools backed by a registered
+// collector are offered, their times default to the analyzed period.
+type toolbox struct {
+	analyzer  *Analyzer
+	timeRange ResolvedTimeRange
+	now       time.Time
+	tools     []agentTool
+}
+
+func (a *Analyzer) newToolbox(timeRange ResolvedTimeRange, now time.Time) *toolbox {
+	t := &toolbox{
+		analyzer:  a,
+		timeRange: timeRange,
+		now:       now,
+	}
+
+	if catalogers := findSources[collector.Cataloger](a.collectors); len(catalogers.names) > 0 {
+		t.tools = append(t.tools, t.listMetrics(catalogers))
+	}
+	if sources := findSources[collector.PromQLQuerier](a.collectors); len(sources.names) > 0 {
+		t.tools = append(t.tools, t.queryPromQL(sources))
+	}
+	if sources := findSources[collector.LogQLQuerier](a.collectors); len(sources.names) > 0 {
+		t.tools = append(t.tools, t.queryLogQL(sources))
+	}
+	if sources := findSources[collector.TraceSearcher](a.collectors); len(sources.names) > 0 {
+		t.tools = append(t.tools, t.findTraces(sources), t.getTrace(sources))
+	}
+
+	return t
+}
+
+// definitions lists the tools for the request, report_analysis ends the run
+func (t *toolbox) definitions() []openai.Tool {
+	result := make([]openai.Tool, 0, len(t.tools)+1)
+	for _, tool := range t.tools {
+		definition := tool.definition
+		result = append(result, openai.Tool{Type: openai.ToolTypeFunction, Function: &definition})
+	}
+	return append(result, openai.Tool{
+		Type: openai.ToolTypeFunction,
+		Function: &openai.FunctionDefinition{
+			Name:        reportFunctionName,
+			Description: "Report the final result of the analysis, this ends the investigation",
+			Parameters:  llmResponseSchema,
+		},
+	})
+}
+
+// call runs a tool call of the model and records it for the transcript. The result is truncated
+// to Config.AgentToolResultTokens, errors are shown to the model so it can correct the call.
+func (t *toolbox) call(ctx context.Context, step int, call openai.ToolCall) ToolCall {
+	record := ToolCall{
+		Step:      step,
+		Tool:      call.Function.Name,
+		Arguments: call.Function.Arguments,
+	}
+
+	index := slices.IndexFunc(t.tools, func(tool agentTool) bool {
+		return tool.definition.Name == call.Function.Name
+	})
+	if index < 0 {
+		record.Error = fmt.Sprintf("unknown tool %q", call.Function.Name)
+		return record
+	}
+
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, toolTimeout)
+	defer cancel()
+	result, err := t.tools[index].run(ctx, call.Function.Arguments)
+	record.DurationMs = time.Since(started).Milliseconds()
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	limit := t.analyzer.config.AgentToolResultTokens
+	record.Result = t.analyzer.tokenizer.Truncate(result, limit)
+	if len(record.Result) < len(result) {
+		record.Result += fmt.Sprintf("\n[truncated to %d tokens, narrow the query to see the rest]", limit)
+	}
+	return record
+}
+
+// toolSources are the collectors implementing T, the model picks one by name if there are several
+type toolSources[T any] struct {
+	names  []string
+	byName map[string]T
+}
+
+func findSources[T any](registry *collector.Registry) toolSources[T] {
+	result := toolSources[T]{byName: make(map[string]T)}
+	for _, c := range registry.Collectors() {
+		if source, ok := c.(T); ok {
+			result.names = append(result.names, c.Name())
+			result.byName[c.Name()] = source
+		}
+	}
+	return result
+}
+
+// pick returns the named source, the first one if name is empty
+func (s toolSources[T]) pick(name string) (T, error) {
+	if name == "" {
+		return s.byName[s.names[0]], nil
+	}
+	source, ok := s.byName[name]
+	if !ok {
+		return source, fmt.Errorf("unknown source %q, available: %s", name, strings.Join(s.names, ", "))
+	}
+	return source, nil
+}
+
+// withSource adds the source parameter to the tool parameters if there is a choice
+func (s toolSources[T]) withSource(properties map[string]jsonschema.Definition) map[string]jsonschema.Definition {
+	if len(s.names) > 1 {
+		properties["source"] = jsonschema.Definition{
+			Type:        jsonschema.String,
+			Description: "Data source to query, the first one by default",
+			Enum:        s.names,
+		}
+	}
+	return properties
+}
+
+// windowProperties are the start and end parameters shared by the query tools
+func windowProperties(properties map[string]jsonschema.Definition) map[string]jsonschema.Definition {
+	properties["start"] = jsonschema.Definition{
+		Type:        jsonschema.String,
+		Description: "Start of the window: RFC3339, a Unix timestamp or relative like now-15m. Defaults to the start of the analyzed period",
+	}
+	properties["end"] = jsonschema.Definition{
+		Type:        jsonschema.String,
+		Description: "End of the window in the same formats as start. Defaults to the end of the analyzed period",
+	}
+	return properties
+}
+
+// window resolves the start and end arguments of a tool call
+func (t *toolbox) window(start, end string) (time.Time, time.Time, error) {
+	from, to := t.timeRange.Start, t.timeRange.End
+
+	var err error
+	if start != "" {
+		if from, err = timerange.Parse(start, t.now); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("start: %w", err)
+		}
+	}
+	if end != "" {
+		if to, err = timerange.ParseEnd(end, t.now); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("end: %w", err)
+		}
+	}
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, errors.New("end is before start")
+	}
+	return from, to, nil
+}
+
+func decodeArguments(arguments string, v any) error {
+	if strings.TrimSpace(arguments) == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(arguments), v); err != nil {
+		return fmt.Errorf("invalid arguments: %v", err)
+	}
+	return nil
+}
+
+// toolLimit applies the default to a limit argument and caps it
+func toolLimit(limit, defaultLimit int) int {
+	if limit <= 0 {
+		return defaultLimit
+	}
+	return min(limit, maxToolLimit)
+}
+
+func (t *toolbox) listMetrics(sources toolSources[collector.Cataloger]) agentTool {
+	return agentTool{
+		definition: openai.FunctionDefinition{
+			Name:        "list_metrics",
+			Description: "List metric names with their type and help, log streams and traced services and operations",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"search": {
+						Type:        jsonschema.String,
+						Description: "Case-insensitive substring of the name or help, e.g. http or latency",
+					},
+					"kind": {
+						Type: jsonschema.String,
+						Enum: []string{string(collector.KindMetrics), string(collector.KindLogs), string(collector.KindTraces)},
+					},
+					"limit": {
+						Type:        jsonschema.Integer,
+						Description: fmt.Sprintf("Maximum number of entries, %d by default", defaultListLimit),
+					},
+				},
+			},
+		},
+		run: func(ctx context.Context, arguments string) (string, error) {
+			var args struct {
+				Search string `json:"search"`
+				Kind   string `json:"kind"`
+				Limit  int    `json:"limit"`
+			}
+			if err := decodeArguments(arguments, &args); err != nil {
+				return "", err
+			}
+			search := strings.ToLower(args.Search)
+
+			var entries []collector.CatalogEntry
+			var errs []error
+			for _, name := range sources.names {
+				catalog, err := sources.byName[name].Catalog(ctx)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", name, err))
+					continue
+				}
+				for _, entry := range catalog {
+					if args.Kind != "" && string(entry.Kind) != args.Kind {
+						continue
+					}
+					if !strings.Contains(strings.ToLower(entry.Name), search) && !strings.Contains(strings.ToLower(entry.Help), search) {
+						continue
+					}
+					entries = append(entries, entry)
+				}
+			}
+			// Some sources failing still leaves the others to list
+			if len(errs) == len(sources.names) {
+				return "", errors.Join(errs...)
+			}
+
+			limit := toolLimit(args.Limit, defaultListLimit)
+			var b strings.Builder
+			fmt.Fprintf(&b, "%d entries\n", len(entries))
+			for _, entry := range entries[:min(len(entries), limit)] {
+				fmt.Fprintf(&b, "%s (%s %s, %s)", entry.Name, entry.Kind, entry.Type, entry.Source)
+				if entry.Help != "" {
+					b.WriteString(": " + entry.Help)
+				}
+				b.WriteString("\n")
+			}
+			if len(entries) > limit {
+				fmt.Fprintf(&b, "... %d more, narrow the search\n", len(entries)-limit)
+			}
+			return b.String(), errors.Join(errs...)
+		},
+	}
+}
+
+func (t *toolbox) queryPromQL(sources toolSources[collector.PromQLQuerier]) agentTool {
+	return agentTool{
+		definition: openai.FunctionDefinition{
+			Name:        "query_promql",
+			Description: "Evaluate a PromQL expression over a window. Series are summarized by their stats, short windows also list points",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: sources.withSource(windowProperties(map[string]jsonschema.Definition{
+					"query": {
+						Type:        jsonschema.String,
+						Description: "PromQL expression, e.g. sum by (service) (rate(http_requests_total{code=~\"5..\"}[5m]))",
+					},
+				})),
+				Required: []string{"query"},
+			},
+		},
+		run: func(ctx context.Context, arguments string) (string, error) {
+			var args struct {
+				Query  string `json:"query"`
+				Start  string `json:"start"`
+				End    string `json:"end"`
+				Source string `json:"source"`
+			}
+			if err := decodeArguments(arguments, &args); err != nil {
+				return "", err
+			}
+			if strings.TrimSpace(args.Query) == "" {
+				return "", errors.New("query is required")
+			}
+			start, end, err := t.window(args.Start, args.End)
+			if err != nil {
+				return "", err
+			}
+			source, err := sources.pick(args.Source)
+			if err != nil {
+				return "", err
+			}
+
+			series, err := source.QueryPromQL(ctx, args.Query, start, end)
+			if err != nil {
+				return "", err
+			}
+			if len(series) == 0 {
+				return "no data", nil
+			}
+
+			var b strings.Builder
+			fmt.Fprintf(&b, "%d series\n", len(series))
+			for _, s := range series {
+				b.WriteString(formatSeries("series", s))
+			}
+			return b.String(), nil
+		},
+	}
+}
+
+func (t *toolbox) queryLogQL(sources toolSources[collector.LogQLQuerier]) agentTool {
+	return agentTool{
+		definition: openai.FunctionDefinition{
+			Name:        "query_logql",
+			Description: "Fetch log lines matching a LogQL log query, the most recent ones are returned",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: sources.withSource(windowProperties(map[string]jsonschema.Definition{
+					"query": {
+						Type:        jsonschema.String,
+						Description: "LogQL log query, e.g. {service=\"api\"} |= \"error\"",
+					},
+					"limit": {
+						Type:        jsonschema.Integer,
+						Description: fmt.Sprintf("Maximum number of lines, %d by default", defaultListLimit),
+					},
+				})),
+				Required: []string{"query"},
+			},
+		},
+		run: func(ctx context.Context, arguments string) (string, error) {
+			var args struct {
+				Query  string `json:"query"`
+				Start  string `json:"start"`
+				End    string `json:"end"`
+				Limit  int    `json:"limit"`
+				Source string `json:"source"`
+			}
+			if err := decodeArguments(arguments, &args); err != nil {
+				return "", err
+			}
+			if strings.TrimSpace(args.Query) == "" {
+				return "", errors.New("query is required")
+			}
+			start, end, err := t.window(args.Start, args.End)
+			if err != nil {
+				return "", err
+			}
+			source, err := sources.pick(args.Source)
+			if err != nil {
+				return "", err
+			}
+
+			// Lines received before an error are still worth showing
+			entries, err := source.QueryRange(ctx, args.Query, start, end)
+			if len(entries) == 0 {
+				if err != nil {
+					return "", err
+				}
+				return "no log lines", nil
+			}
+
+			limit := toolLimit(args.Limit, defaultListLimit)
+			var b strings.Builder
+			fmt.Fprintf(&b, "%d lines", len(entries))
+			if len(entries) > limit {
+				fmt.Fprintf(&b, ", the last %d", limit)
+				entries = entries[len(entries)-limit:]
+			}
+			b.WriteString("\n")
+			for _, entry := range entries {
+				b.WriteString(entry.String() + "\n")
+			}
+			return b.String(), err
+		},
+	}
+}
+
+func (t *toolbox) findTraces(sources toolSources[collector.TraceSearcher]) agentTool {
+	return agentTool{
+		definition: openai.FunctionDefinition{
+			Name:        "find_traces",
+			Description: "Search traces of a service. Returns error groups, latency per operation and the slowest spans with their trace IDs",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: sources.withSource(windowProperties(map[string]jsonschema.Definition{
+					"service": {Type: jsonschema.String},
+					"operation": {
+						Type:        jsonschema.String,
+						Description: "Operation name, all operations by default",
+					},
+					"tags": {
+						Type:        jsonschema.Object,
+						Description: "Span tags that must match, e.g. {\"error\": \"true\"}",
+					},
+					"min_duration": {
+						Type:        jsonschema.String,
+						Description: "Only traces at least this long, e.g. 500ms or 2s",
+					},
+					"limit": {
+						Type:        jsonschema.Integer,
+						Description: fmt.Sprintf("Maximum number of traces, %d by default", defaultTraceLimit),
+					},
+				})),
+				Required: []string{"service"},
+			},
+		},
+		run: func(ctx context.Context, arguments string) (string, error) {
+			var args struct {
+				Service     string            `json:"service"`
+				Operation   string            `json:"operation"`
+				Tags        map[string]string `json:"tags"`
+				MinDuration string            `json:"min_duration"`
+				Start       string            `json:"start"`
+				End         string            `json:"end"`
+				Limit       int               `json:"limit"`
+				Source      string            `json:"source"`
+			}
+			if err := decodeArguments(arguments, &args); err != nil {
+				return "", err
+			}
+			if args.Service == "" {
+				return "", errors.New("service is required, list_metrics with kind traces lists the services")
+			}
+			query := collector.TraceQuery{
+				Service:   args.Service,
+				Operation: args.Operation,
+				Tags:      args.Tags,
+				Limit:     toolLimit(args.Limit, defaultTraceLimit),
+			}
+			var err error
+			if query.Start, query.End, err = t.window(args.Start, args.End); err != nil {
+				return "", err
+			}
+			if args.MinDuration != "" {
+				if query.MinDuration, err = time.ParseDuration(args.MinDuration); err != nil {
+					return "", fmt.Errorf("min_duration: %w", err)
+				}
+			}
+			source, err := sources.pick(args.Source)
+			if err != nil {
+				return "", err
+			}
+
+			spans, err := source.FindTraces(ctx, query)
+			if err != nil {
+				return "", err
+			}
+			if len(spans) == 0 {
+				return "no traces found", nil
+			}
+
+			traces := make(map[string]struct{})
+			for _, span := range spans {
+				traces[span.TraceID] = struct{}{}
+			}
+			return fmt.Sprintf("%d traces, %d spans\n", len(traces), len(spans)) + strings.Join(summarizeTraces(spans), ""), nil
+		},
+	}
+}
+
+func (t *toolbox) getTrace(sources toolSources[collector.TraceSearcher]) agentTool {
+	return agentTool{
+		definition: openai.FunctionDefinition{
+			Name:        "get_trace",
+			Description: "Get all spans of a trace as a tree with their offsets from the trace start, durations and errors",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: sources.withSource(map[string]jsonschema.Definition{
+					"trace_id": {Type: jsonschema.String},
+				}),
+				Required: []string{"trace_id"},
+			},
+		},
+		run: func(ctx context.Context, arguments string) (string, error) {
+			var args struct {
+				TraceID string `json:"trace_id"`
+				Source  string `json:"source"`
+			}
+			if err := decodeArguments(arguments, &args); err != nil {
+				return "", err
+			}
+			if args.TraceID == "" {
+				return "", errors.New("trace_id is required")
+			}
+			source, err := sources.pick(args.Source)
+			if err != nil {
+				return "", err
+			}
+
+			spans, err := source.GetTrace(ctx, args.TraceID)
+			if err != nil {
+				return "", err
+			}
+			return formatTrace(spans), nil
+		},
+	}
+}
+
+// formatTrace renders spans ordered by start as a call tree
+func formatTrace(spans []collector.Span) string {
+	if len(spans) == 0 {
+		return "trace not found"
+	}
+
+	ids := make(map[string]bool, len(spans))
+	for _, span := range spans {
+		ids[span.SpanID] = true
+	}
+	children := make(map[string][]collector.Span)
+	var roots []collector.Span
+	for _, span := range spans {
+		// Spans whose parent wasn't received are shown as roots
+		if span.ParentSpanID == "" || span.ParentSpanID == span.SpanID || !ids[span.ParentSpanID] {
+			roots = append(roots, span)
+			continue
+		}
+		children[span.ParentSpanID] = append(children[span.ParentSpanID], span)
+	}
+
+	start := spans[0].StartTime
+	var b strings.Builder
+	fmt.Fprintf(&b, "Trace %s: %d spans\n", spans[0].TraceID, len(spans))
+
+	visited := make(map[string]bool, len(spans))
+	var walk func(span collector.Span, depth int)
+	walk = func(span collector.Span, depth int) {
+		if visited[span.SpanID] {
+			return
+		}
+		visited[span.SpanID] = true
+
+		fmt.Fprintf(&b, "%s%s %s: +%s %s", strings.Repeat("  ", depth+1),
+			span.Service, span.Operation, span.StartTime.Sub(start), span.Duration)
+		if span.Error {
+			message := span.ErrorMessage
+			if message == "" {
+				message = "no error message"
+			}
+			b.WriteString(" error: " + message)
+		}
+		b.WriteString("\n")
+
+		for _, child := range children[span.SpanID] {
+			walk(child, depth+1)
+		}
+	}
+	for _, root := range roots {
+		walk(root, 0)
+	}
+	// Spans whose parents form a cycle are not reachable from any root, show them as roots too
+	for _, span := range spans {
+		walk(span, 0)
+	}
+	return b.String()
+}
@@ -0,0 +1,136 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+)
+
+// queryCollector answers the queries of the agent tools with fixed data
+type queryCollector struct {
+	// series is the number of series every PromQL query returns
+	series int
+}
+
+func (c *queryCollector) Name() string {
+	return "stub"
+}
+
+func (c *queryCollector) Collect(_ context.Context, _ collector.Query) (*collector.Evidence, error) {
+	return &collector.Evidence{Source: c.Name(), Kind: collector.KindMetrics}, nil
+}
+
+func (c *queryCollector) QueryPromQL(_ context.Context, _ string, start, end time.Time) ([]collector.Series, error) {
+	result := make([]collector.Series, c.series)
+	for i := range result {
+		result[i] = collector.Series{
+			Labels: map[string]string{"pod": fmt.Sprintf("api-%d", i)},
+			Points: []collector.Point{{Time: start, Value: 1}, {Time: end, Value: float64(i + 2)}},
+		}
+	}
+	return result, nil
+}
+
+func (c *queryCollector) QueryRange(_ context.Context, _ string, _, end time.Time) ([]collector.LogEntry, error) {
+	return []collector.LogEntry{{
+		Timestamp: end.Add(-time.Minute),
+		Labels:    map[string]string{"app": "api"},
+		Line:      "request failed: connection refused",
+	}}, nil
+}
+
+func (c *queryCollector) FindTraces(_ context.Context, q collector.TraceQuery) ([]collector.Span, error) {
+	return []collector.Span{testSpan(q.Service, "GET /users", "t1", time.Second, "timeout")}, nil
+}
+
+func (c *queryCollector) GetTrace(_ context.Context, traceID string) ([]collector.Span, error) {
+	return []collector.Span{testSpan("api", "GET /users", traceID, time.Second, "timeout")}, nil
+}
+
+func TestFormatTrace(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	span := func(id, parent, service string, offset time.Duration) collector.Span {
+		return collector.Span{
+			Service:      service,
+			Operation:    "call",
+			TraceID:      "t1",
+			SpanID:       id,
+			ParentSpanID: parent,
+			StartTime:    start.Add(offset),
+			Duration:     time.Millisecond,
+		}
+	}
+
+	tests := []struct {
+		name  string
+		spans []collector.Span
+		want  []string // lines in this order
+	}{
+		{
+			name:  "no spans",
+			spans: nil,
+			want:  []string{"trace not found"},
+		},
+		{
+			name: "children are indented under their parent",
+			spans: []collector.Span{
+				span("a", "", "api", 0),
+				span("b", "a", "db", time.Millisecond),
+				span("c", "b", "disk", 2*time.Millisecond),
+			},
+			want: []string{
+				"Trace t1: 3 spans\n",
+				"  api call: +0s 1ms\n",
+				"    db call: +1ms 1ms\n",
+				"      disk call: +2ms 1ms\n",
+			},
+		},
+		{
+			name: "missing parent is shown as a root",
+			spans: []collector.Span{
+				span("a", "", "api", 0),
+				span("b", "lost", "db", time.Millisecond),
+			},
+			want: []string{
+				"  api call: +0s 1ms\n",
+				"  db call: +1ms 1ms\n",
+			},
+		},
+		{
+			name: "parent cycle is shown once",
+			spans: []collector.Span{
+				span("a", "", "api", 0),
+				span("b", "c", "db", time.Millisecond),
+				span("c", "b", "cache", 2*time.Millisecond),
+			},
+			want: []string{
+				"Trace t1: 3 spans\n",
+				"  api call: +0s 1ms\n",
+				"  db call: +1ms 1ms\n",
+				"    cache call: +2ms 1ms\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatTrace(tt.spans)
+
+			rest := got
+			for _, line := range tt.want {
+				index := strings.Index(rest, line)
+				if index < 0 {
+					t.Fatalf("missing %q in order, got:\n%s", line, got)
+				}
+				rest = rest[index+len(line):]
+			}
+			if lines := strings.Count(got, "\n"); len(tt.spans) > 0 && lines != len(tt.spans)+1 {
+				t.Errorf("got %d lines, want a header and a line per span:\n%s", lines, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package chain
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"true-hack/internal/collector"
+)
+
+const (
+	// slowestOperationsPerService limits how many operations are listed for each service
+	slowestOperationsPerService = 5
+	// slowestSpans limits how many individual slow spans are listed with their trace IDs
+	slowestSpans = 10
+	// errorSignatures limits how many distinct error groups are listed
+	errorSignatures = 20
+)
+
+type operationStats struct {
+	service   string
+	operation string
+	durations []time.Duration
+	errors    int
+}
+
+type errorGroup struct {
+	service   string
+	operation string
+	message   string
+	count     int
+	traceID   string
+}
+
+// summarizeTraces turns raw spans into a compact report: grouped error spans, per-service error rates
+// with the slowest operations by p95 latency and the slowest individual spans.
+func summarizeTraces(spans []collector.Span) []string {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	stats := make(map[string]*operationStats)
+	services := make(map[string][2]int) // total spans, error spans
+	errGroups := make(map[string]*errorGroup)
+
+	for _, span := range spans {
+		key := span.Service + "\x00" + span.Operation
+		st, ok := stats[key]
+		if !ok {
+			st = &operationStats{service: span.Service, operation: span.Operation}
+			stats[key] = st
+		}
+		st.durations = append(st.durations, span.Duration)
+
+		counts := services[span.Service]
+		counts[0]++
+
+		if span.Error {
+			st.errors++
+			counts[1]++
+
+			errKey := key + "\x00" + span.ErrorMessage
+			group, ok := errGroups[errKey]
+			if !ok {
+				group = &errorGroup{
+					service:   span.Service,
+					operation: span.Operation,
+					message:   span.ErrorMessage,
+					traceID:   span.TraceID,
+				}
+				errGroups[errKey] = group
+			}
+			group.count++
+		}
+		services[span.Service] = counts
+	}
+
+	var result []string
+
+	// Error spans go first, they are usually the most relevant part of the report
+	groups := make([]*errorGroup, 0, len(errGroups))
+	for _, group := range errGroups {
+		groups = append(groups, group)
+	}
+	slices.SortFunc(groups, func(a, b *errorGroup) int {
+		if a.count != b.count {
+			return b.count - a.count
+		}
+		return strings.Compare(a.service+a.operation+a.message, b.service+b.operation+b.message)
+	})
+	if len(groups) > 0 {
+		result = append(result, "Error spans:\n")
+		for _, group := range groups[:min(len(groups), errorSignatures)] {
+			message := group.message
+			if message == "" {
+				message = "no error message"
+			}
+			result = append(result, fmt.Sprintf("  %s %s: %d errors (%s), example trace %s\n",
+				group.service, group.operation, group.count, message, group.traceID))
+		}
+	}
+
+	serviceNames := make([]string, 0, len(services))
+	for service := range services {
+		serviceNames = append(serviceNames, service)
+	}
+	slices.Sort(serviceNames)
+
+	byService := make(map[string][]*operationStats)
+	for _, st := range stats {
+		slices.Sort(st.durations)
+		byService[st.service] = append(byService[st.service], st)
+	}
+
+	for _, service := range serviceNames {
+		counts := services[service]
+		result = append(result, fmt.Sprintf("Service %s: %d spans, %d errors (%.1f%%)\n",
+			service, counts[0], counts[1], 100*float64(counts[1])/float64(counts[0])))
+
+		ops := byService[service]
+		slices.SortFunc(ops, func(a, b *operationStats) int {
+			if c := cmp.Compare(quantile(b.durations, 0.95), quantile(a.durations, 0.95)); c != 0 {
+				return c
+			}
+			return strings.Compare(a.operation, b.operation)
+		})
+		for _, op := range ops[:min(len(ops), slowestOperationsPerService)] {
+			result = append(result, fmt.Sprintf("  %s: count=%d errors=%d p50=%s p95=%s max=%s\n",
+				op.operation, len(op.durations), op.errors,
+				quantile(op.durations, 0.5), quantile(op.durations, 0.95), op.durations[len(op.durations)-1]))
+		}
+	}
+
+	slowest := slices.Clone(spans)
+	slices.SortFunc(slowest, func(a, b collector.Span) int {
+		return cmp.Compare(b.Duration, a.Duration)
+	})
+	result = append(result, "Slowest spans:\n")
+	for _, span := range slowest[:min(len(slowest), slowestSpans)] {
+		result = append(result, "  "+span.String()+"\n")
+	}
+
+	return result
+}
@@ -0,0 +1,126 @@
+package chain
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+)
+
+func testSpan(service, operation, traceID string, duration time.Duration, errMessage string) collector.Span {
+	return collector.Span{
+		Service:      service,
+		Operation:    operation,
+		TraceID:      traceID,
+		SpanID:       traceID + "-span",
+		Duration:     duration,
+		Error:        errMessage != "",
+		ErrorMessage: errMessage,
+	}
+}
+
+func TestSummarizeTraces(t *testing.T) {
+	var many []collector.Span
+	for i := range 12 {
+		many = append(many, testSpan("api", "GET /users", fmt.Sprintf("t%02d", i), time.Duration(i+1)*time.Millisecond, ""))
+	}
+
+	tests := []struct {
+		name    string
+		spans   []collector.Span
+		want    []string // lines in this order
+		exclude []string
+	}{
+		{
+			name: "errors grouped by message, larger groups first",
+			spans: []collector.Span{
+				testSpan("api", "GET /users", "t1", 10*time.Millisecond, "timeout"),
+				testSpan("api", "GET /users", "t2", 20*time.Millisecond, "timeout"),
+				testSpan("db", "SELECT", "t3", 5*time.Millisecond, "connection refused"),
+				testSpan("api", "GET /users", "t4", 30*time.Millisecond, "timeout"),
+				testSpan("api", "GET /users", "t5", 40*time.Millisecond, ""),
+			},
+			want: []string{
+				"Error spans:\n",
+				"  api GET /users: 3 errors (timeout), example trace t1\n",
+				"  db SELECT: 1 errors (connection refused), example trace t3\n",
+				"Service api: 4 spans, 3 errors (75.0%)\n",
+				"Service db: 1 spans, 1 errors (100.0%)\n",
+				"Slowest spans:\n",
+			},
+		},
+		{
+			name: "error without message",
+			spans: []collector.Span{
+				{Service: "api", Operation: "POST /orders", TraceID: "t1", Duration: time.Millisecond, Error: true},
+			},
+			want: []string{"  api POST /orders: 1 errors (no error message), example trace t1\n"},
+		},
+		{
+			name: "no errors",
+			spans: []collector.Span{
+				testSpan("api", "GET /users", "t1", time.Millisecond, ""),
+			},
+			want:    []string{"Service api: 1 spans, 0 errors (0.0%)\n"},
+			exclude: []string{"Error spans:\n"},
+		},
+		{
+			name: "operations by p95",
+			spans: []collector.Span{
+				testSpan("api", "fast", "t1", time.Millisecond, ""),
+				testSpan("api", "slow", "t2", time.Second, ""),
+				testSpan("api", "fast", "t3", 3*time.Millisecond, ""),
+			},
+			want: []string{
+				"  slow: count=1 errors=0 p50=1s p95=1s max=1s\n",
+				"  fast: count=2 errors=0 p50=2ms p95=2.9ms max=3ms\n",
+			},
+		},
+		{
+			name:  "slowest spans are limited",
+			spans: many,
+			want: []string{
+				"Slowest spans:\n",
+				"  " + many[11].String() + "\n",
+				"  " + many[10].String() + "\n",
+				"  " + many[2].String() + "\n",
+			},
+			exclude: []string{
+				"  " + many[1].String() + "\n",
+				"  " + many[0].String() + "\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := summarizeTraces(tt.spans)
+
+			last := -1
+			for _, want := range tt.want {
+				i := slices.Index(got, want)
+				if i < 0 {
+					t.Fatalf("missing %q in\n%s", want, strings.Join(got, ""))
+				}
+				if i < last {
+					t.Errorf("%q is out of order in\n%s", want, strings.Join(got, ""))
+				}
+				last = i
+			}
+			for _, line := range tt.exclude {
+				if slices.Contains(got, line) {
+					t.Errorf("unexpected %q in\n%s", line, strings.Join(got, ""))
+				}
+			}
+		})
+	}
+}
+
+func TestSummarizeTracesEmpty(t *testing.T) {
+	if got := summarizeTraces(nil); got != nil {
+		t.Errorf("summarizeTraces(nil) = %q, want nil", got)
+	}
+}
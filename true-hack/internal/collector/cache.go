@@ -0,0 +1,81 @@
+package collector
+
+import (
+	"strings"
+	"time"
+
+	"true-hack/internal/cache"
+)
+
+// cacheUser is implemented by collectors that cache their query results, see Registry.UseCache
+type cacheUser interface {
+	useCache(c *cache.LRU[any])
+}
+
+// UseCache makes the registered collectors, and those added later, cache their query results in c.
+// Windows are widened to step boundaries, see AlignWindow, so queries made seconds apart share entries.
+func (r *Registry) UseCache(c *cache.LRU[any]) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache = c
+	for _, collector := range r.collectors {
+		if u, ok := collector.(cacheUser); ok {
+			u.useCache(c)
+		}
+	}
+}
+
+// AlignWindow widens the window to the boundaries of the step metrics are queried with:
+// start is moved back and end forward by less than a step. Aligning twice changes nothing.
+func AlignWindow(start, end time.Time) (time.Time, time.Time) {
+	start, end, _ = alignWindow(start, end)
+	return start, end
+}
+
+func alignWindow(start, end time.Time) (time.Time, time.Time, time.Duration) {
+	if !end.After(start) {
+		return start, end, 0
+	}
+	for {
+		step := rangeStep(start, end)
+		if step > steps[len(steps)-1] {
+			// Exact steps of very long windows grow with the window, these are left as they are
+			return start, end, step
+		}
+		alignedStart := start.Truncate(step)
+		alignedEnd := end.Truncate(step)
+		if alignedEnd.Before(end) {
+			alignedEnd = alignedEnd.Add(step)
+		}
+		// The wider window may need a larger step, align again until it's stable
+		if alignedStart.Equal(start) && alignedEnd.Equal(end) {
+			return start, end, step
+		}
+		start, end = alignedStart, alignedEnd
+	}
+}
+
+// cached returns the value of key, calling fetch on a miss. Failed fetches are not cached,
+// neither are their partial results. Without a cache fetch is always called.
+func cached[T any](c *cache.LRU[any], key string, fetch func() (T, error)) (T, error) {
+	if c == nil {
+		return fetch()
+	}
+	if value, ok := c.Get(key); ok {
+		if v, ok := value.(T); ok {
+			return v, nil
+		}
+	}
+
+	v, err := fetch()
+	if err == nil {
+		c.Set(key, v)
+	}
+	return v, err
+}
+
+// cacheKey joins the parts with a separator that can't appear in them
+func cacheKey(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,172 @@
+package collector
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"true-hack/internal/cache"
+
+	"go.uber.org/zap"
+)
+
+func TestAlignWindow(t *testing.T) {
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name               string
+		start, end         time.Time
+		wantStart, wantEnd time.Time
+		wantStep           time.Duration
+	}{
+		{
+			name:      "empty window",
+			start:     base,
+			end:       base,
+			wantStart: base,
+			wantEnd:   base,
+		},
+		{
+			name:      "aligned window",
+			start:     base,
+			end:       base.Add(time.Hour),
+			wantStart: base,
+			wantEnd:   base.Add(time.Hour),
+			wantStep:  30 * time.Second,
+		},
+		{
+			name:      "start and end inside a step",
+			start:     base.Add(5 * time.Second),
+			end:       base.Add(10*time.Minute + 5*time.Second),
+			wantStart: base,
+			wantEnd:   base.Add(10*time.Minute + 15*time.Second),
+			wantStep:  15 * time.Second,
+		},
+		{
+			// An hour and 20s needs a minute step, the window is aligned to it
+			name:      "wider window needs a larger step",
+			start:     base.Add(10 * time.Second),
+			end:       base.Add(time.Hour + 30*time.Second),
+			wantStart: base,
+			wantEnd:   base.Add(time.Hour + time.Minute),
+			wantStep:  time.Minute,
+		},
+		{
+			name:      "window longer than the round steps is left as is",
+			start:     base.Add(time.Second),
+			end:       base.Add(240*day + time.Second),
+			wantStart: base.Add(time.Second),
+			wantEnd:   base.Add(240*day + time.Second),
+			wantStep:  2 * day,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, step := alignWindow(tt.start, tt.end)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) || step != tt.wantStep {
+				t.Fatalf("alignWindow() = %s, %s, %s, want %s, %s, %s",
+					start, end, step, tt.wantStart, tt.wantEnd, tt.wantStep)
+			}
+			if step != 0 && rangeStep(start, end) != step {
+				t.Errorf("aligned window is queried with step %s, not %s", rangeStep(start, end), step)
+			}
+
+			again, againEnd := AlignWindow(start, end)
+			if !again.Equal(start) || !againEnd.Equal(end) {
+				t.Errorf("aligning twice moved the window to %s, %s", again, againEnd)
+			}
+		})
+	}
+}
+
+func TestPrometheusCache(t *testing.T) {
+	end := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	server, queries := fakePrometheus(t, map[string]promBehavior{"broken": {fail: true}})
+
+	c, err := NewPrometheusCollector(PrometheusConfig{URL: server.URL}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lru, err := cache.New[any](time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := NewRegistry(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.UseCache(lru)
+
+	query := func(query string, start, end time.Time) []Series {
+		t.Helper()
+		series, err := c.QueryPromQL(t.Context(), query, start, end)
+		if err != nil && query != "broken" {
+			t.Fatal(err)
+		}
+		return series
+	}
+
+	first := query("up", end.Add(-time.Hour), end)
+	if queries.Load() != 1 {
+		t.Fatalf("made %d queries, want 1", queries.Load())
+	}
+
+	// Seconds later the window aligns to the same steps
+	repeated := query("up", end.Add(-time.Hour+5*time.Second), end.Add(5*time.Second))
+	if queries.Load() != 2 {
+		t.Fatalf("made %d queries, want the later end to widen the window by a step", queries.Load())
+	}
+	again := query("up", end.Add(-time.Hour+10*time.Second), end.Add(10*time.Second))
+	if queries.Load() != 2 {
+		t.Errorf("made %d queries, want the aligned repeat served from the cache", queries.Load())
+	}
+	if len(first) != 1 || len(again) != 1 || !again[0].Points[0].Time.Equal(repeated[0].Points[0].Time) {
+		t.Errorf("cached result %+v differs from %+v", again, repeated)
+	}
+
+	// Another query misses, failures are not cached
+	query("rate(errors[5m])", end.Add(-time.Hour), end)
+	query("broken", end.Add(-time.Hour), end)
+	if _, err := c.QueryPromQL(t.Context(), "broken", end.Add(-time.Hour), end); err == nil {
+		t.Error("failed query was cached as a success")
+	}
+	if queries.Load() != 5 {
+		t.Errorf("made %d queries, want 5", queries.Load())
+	}
+}
+
+func TestCached(t *testing.T) {
+	lru, err := cache.New[any](time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	fetch := func(value string, err error) func() (string, error) {
+		return func() (string, error) {
+			calls++
+			return value, err
+		}
+	}
+
+	if v, err := cached(lru, "key", fetch("", errors.New("timeout"))); err == nil || v != "" {
+		t.Fatalf("cached() = %q, %v, want the error", v, err)
+	}
+	if v, _ := cached(lru, "key", fetch("fresh", nil)); v != "fresh" || calls != 2 {
+		t.Fatalf("cached() = %q after %d calls, want a fetch after the failure", v, calls)
+	}
+	if v, _ := cached(lru, "key", fetch("other", nil)); v != "fresh" || calls != 2 {
+		t.Errorf("cached() = %q after %d calls, want the cached value", v, calls)
+	}
+	// A value of another type under the key is a miss
+	if v, _ := cached(lru, "key", func() (int, error) { calls++; return 1, nil }); v != 1 || calls != 3 {
+		t.Errorf("cached() = %d after %d calls, want a fetch", v, calls)
+	}
+	// Without a cache every call fetches
+	cached(nil, "key", fetch("fresh", nil))
+	if calls != 4 {
+		t.Errorf("%d calls without a cache, want 4", calls)
+	}
+}
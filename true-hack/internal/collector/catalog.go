@@ -0,0 +1,25 @@
+package collector
+
+import (
+	"context"
+	"time"
+)
+
+// catalogLookback is how far back sources look for series and streams when listing them
+const catalogLookback = time.Hour
+
+// CatalogEntry is something a source can be asked about: a metric, a log stream, a service or an operation
+type CatalogEntry struct {
+	Name string
+	// Type is the metric type for metrics, "stream" for log streams, "service" or "operation" for traces
+	Type string
+	Help string
+	// Source is the name of the collector the entry comes from
+	Source string
+	Kind   Kind
+}
+
+// Cataloger is implemented by collectors that can list what they can be queried for
+type Cataloger interface {
+	Catalog(ctx context.Context) ([]CatalogEntry, error)
+}
@@ -0,0 +1,243 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"true-hack/internal/cache"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// Kind tells the analyzer how to budget and render the evidence of a data source
+type Kind string
+
+const (
+	KindMetrics Kind = "metrics"
+	KindLogs    Kind = "logs"
+	KindTraces  Kind = "traces"
+)
+
+// Query describes what the analyzer needs from data sources
+type Query struct {
+	Question string
+	Start    time.Time
+	End      time.Time
+	// Metrics restricts metric sources to the given names, empty means all
+	Metrics []string
+	// BaselineStart and BaselineEnd are an optional reference window, metric sources
+	// query it too so the analyzer can tell unusual behaviour from the usual one
+	BaselineStart time.Time
+	BaselineEnd   time.Time
+}
+
+// HasBaseline tells whether a reference window is requested
+func (q Query) HasBaseline() bool {
+	return q.BaselineEnd.After(q.BaselineStart)
+}
+
+// MetricData is the result of a single metric query. Sources returning numbers fill Series,
+// others can put preformatted text into Text.
+type MetricData struct {
+	Name   string
+	Text   string
+	Series []Series
+	// Baseline holds the series of the reference window if the query had one
+	Baseline []Series
+}
+
+// Series is a single time series of a metric
+type Series struct {
+	// Labels are the labels of the series without the metric name
+	Labels map[string]string
+	Points []Point
+}
+
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// LabelString formats labels as {name=value, ...} sorted by name, empty for a series without labels
+func (s Series) LabelString() string {
+	if len(s.Labels) == 0 {
+		return ""
+	}
+
+	labels := make([]string, 0, len(s.Labels))
+	for name, value := range s.Labels {
+		labels = append(labels, name+"="+value)
+	}
+	sort.Strings(labels)
+	return "{" + strings.Join(labels, ", ") + "}"
+}
+
+// Evidence is what a Collector returns, only the field matching Kind is filled
+type Evidence struct {
+	Source  string
+	Kind    Kind
+	Metrics []MetricData
+	Logs    []LogEntry
+	Spans   []Span
+	// Notes explain why the evidence is incomplete, e.g. the source timed out
+	Notes []string
+}
+
+// Collector is a data source the analyzer can gather evidence from
+type Collector interface {
+	// Name identifies the source in logs and prompts, it must be unique within a Registry
+	Name() string
+	Collect(ctx context.Context, q Query) (*Evidence, error)
+}
+
+// withTimeout bounds a whole Collect call by the query_timeout of the source, zero means no limit
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timedOut tells whether collection stopped because of the source timeout rather than because
+// the caller gave up. In the first case whatever was collected so far is still worth returning.
+func timedOut(parent, ctx context.Context) bool {
+	return parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// Factory builds a collector from its config section, decode unmarshals the section into a typed struct
+type Factory func(name string, decode func(v any) error, logger *zap.Logger) (Collector, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// RegisterFactory makes a source type available to config. It is meant to be called from init.
+func RegisterFactory(typ string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, ok := factories[typ]; ok {
+		panic(fmt.Sprintf("collector factory %q is already registered", typ))
+	}
+	factories[typ] = factory
+}
+
+// Types returns the registered source types
+func Types() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	types := make([]string, 0, len(factories))
+	for typ := range factories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// SourceConfig is an entry of the sources list in config.yaml.
+// Fields besides type and name are decoded by the factory of the type.
+type SourceConfig struct {
+	Type string
+	Name string
+
+	node yaml.Node
+}
+
+func (s *SourceConfig) UnmarshalYAML(node *yaml.Node) error {
+	var head struct {
+		Type string `yaml:"type"`
+		Name string `yaml:"name"`
+	}
+	if err := node.Decode(&head); err != nil {
+		return err
+	}
+
+	s.Type = head.Type
+	s.Name = head.Name
+	s.node = *node
+	return nil
+}
+
+// New builds a collector of a registered type
+func New(cfg SourceConfig, logger *zap.Logger) (Collector, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[cfg.Type]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown source type %q, known types: %v", cfg.Type, Types())
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = cfg.Type
+	}
+
+	c, err := factory(name, cfg.node.Decode, logger)
+	if err != nil {
+		return nil, fmt.Errorf("create %s source %q: %w", cfg.Type, name, err)
+	}
+	return c, nil
+}
+
+// Registry is the ordered set of collectors the analyzer iterates over
+type Registry struct {
+	mu         sync.RWMutex
+	collectors []Collector
+	// cache is given to collectors as they are added, see UseCache
+	cache *cache.LRU[any]
+}
+
+func NewRegistry(collectors ...Collector) (*Registry, error) {
+	r := &Registry{}
+	for _, c := range collectors {
+		if err := r.Add(c); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Registry) Add(c Collector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.collectors {
+		if existing.Name() == c.Name() {
+			return fmt.Errorf("source %q is already registered", c.Name())
+		}
+	}
+	if u, ok := c.(cacheUser); ok && r.cache != nil {
+		u.useCache(r.cache)
+	}
+	r.collectors = append(r.collectors, c)
+	return nil
+}
+
+// Get returns a collector by name
+func (r *Registry) Get(name string) (Collector, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, c := range r.collectors {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Collectors returns a snapshot of registered collectors in registration order
+func (r *Registry) Collectors() []Collector {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]Collector(nil), r.collectors...)
+}
@@ -0,0 +1,176 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+type stubCollector struct {
+	name string
+	url  string
+}
+
+func (s *stubCollector) Name() string {
+	return s.name
+}
+
+func (s *stubCollector) Collect(ctx context.Context, q Query) (*Evidence, error) {
+	return &Evidence{Source: s.name, Kind: KindLogs}, nil
+}
+
+var registerStub sync.Once
+
+// useStubFactory registers the "stub" type once, factories are global and can't be registered twice
+func useStubFactory() {
+	registerStub.Do(func() {
+		RegisterFactory("stub", func(name string, decode func(v any) error, logger *zap.Logger) (Collector, error) {
+			var cfg struct {
+				URL string `yaml:"url"`
+			}
+			if err := decode(&cfg); err != nil {
+				return nil, err
+			}
+			if cfg.URL == "" {
+				return nil, errors.New("url is required")
+			}
+			return &stubCollector{name: name, url: cfg.URL}, nil
+		})
+	})
+}
+
+func decodeSources(t *testing.T, text string) []SourceConfig {
+	t.Helper()
+
+	var sources []SourceConfig
+	if err := yaml.Unmarshal([]byte(text), &sources); err != nil {
+		t.Fatalf("unmarshal sources: %v", err)
+	}
+	return sources
+}
+
+func TestNewDecodesSourceConfigThroughFactory(t *testing.T) {
+	useStubFactory()
+
+	sources := decodeSources(t, `
+- type: stub
+  name: primary
+  url: http://primary:3100
+- type: stub
+  url: http://default:3100
+`)
+	if len(sources) != 2 {
+		t.Fatalf("got %d sources, want 2", len(sources))
+	}
+	if sources[0].Type != "stub" || sources[0].Name != "primary" {
+		t.Errorf("head = %q/%q, want stub/primary", sources[0].Type, sources[0].Name)
+	}
+
+	tests := []struct {
+		source   SourceConfig
+		wantName string
+		wantURL  string
+	}{
+		{source: sources[0], wantName: "primary", wantURL: "http://primary:3100"},
+		// Without a name the source is named after its type
+		{source: sources[1], wantName: "stub", wantURL: "http://default:3100"},
+	}
+	for _, tt := range tests {
+		c, err := New(tt.source, zap.NewNop())
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		stub, ok := c.(*stubCollector)
+		if !ok {
+			t.Fatalf("New returned %T, want *stubCollector", c)
+		}
+		if stub.name != tt.wantName || stub.url != tt.wantURL {
+			t.Errorf("got %q at %q, want %q at %q", stub.name, stub.url, tt.wantName, tt.wantURL)
+		}
+	}
+}
+
+func TestNewReportsFactoryErrors(t *testing.T) {
+	useStubFactory()
+
+	sources := decodeSources(t, `
+- type: stub
+  name: broken
+`)
+	_, err := New(sources[0], zap.NewNop())
+	if err == nil {
+		t.Fatal("New succeeded without url")
+	}
+	if !strings.Contains(err.Error(), `stub source "broken"`) || !strings.Contains(err.Error(), "url is required") {
+		t.Errorf("error %q doesn't name the source and the cause", err)
+	}
+}
+
+func TestNewRejectsUnknownType(t *testing.T) {
+	useStubFactory()
+
+	sources := decodeSources(t, `
+- type: influx
+  name: metrics
+`)
+	_, err := New(sources[0], zap.NewNop())
+	if err == nil {
+		t.Fatal("New succeeded for an unknown type")
+	}
+	for _, want := range []string{`unknown source type "influx"`, "prometheus", "loki", "jaeger", "stub"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
+
+func TestRegisterFactoryPanicsOnDuplicateType(t *testing.T) {
+	useStubFactory()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering stub twice didn't panic")
+		}
+	}()
+	RegisterFactory("stub", func(string, func(any) error, *zap.Logger) (Collector, error) {
+		return nil, nil
+	})
+}
+
+func TestRegistryRejectsDuplicateNames(t *testing.T) {
+	_, err := NewRegistry(&stubCollector{name: "loki"}, &stubCollector{name: "loki"})
+	if err == nil || !strings.Contains(err.Error(), `source "loki" is already registered`) {
+		t.Fatalf("NewRegistry with duplicates: err = %v", err)
+	}
+
+	r, err := NewRegistry(&stubCollector{name: "loki"}, &stubCollector{name: "jaeger"})
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	if err := r.Add(&stubCollector{name: "jaeger"}); err == nil {
+		t.Error("Add accepted a duplicate name")
+	}
+	if err := r.Add(&stubCollector{name: "prometheus"}); err != nil {
+		t.Errorf("Add: %v", err)
+	}
+
+	var names []string
+	for _, c := range r.Collectors() {
+		names = append(names, c.Name())
+	}
+	if got := strings.Join(names, ","); got != "loki,jaeger,prometheus" {
+		t.Errorf("collectors = %s, want registration order loki,jaeger,prometheus", got)
+	}
+
+	if c, ok := r.Get("jaeger"); !ok || c.Name() != "jaeger" {
+		t.Errorf("Get(jaeger) = %v, %v", c, ok)
+	}
+	if _, ok := r.Get("tempo"); ok {
+		t.Error("Get found an unregistered source")
+	}
+}
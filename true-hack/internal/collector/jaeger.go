@@ -4,66 +4,246 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"io"
+	"maps"
+	"slices"
+	"strconv"
 	"time"
 
+	"true-hack/internal/cache"
+
+	jaegermodel "github.com/jaegertracing/jaeger-idl/model/v1"
 	"github.com/jaegertracing/jaeger-idl/proto-gen/api_v2"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
+// searchDepth limits the number of traces fetched per service
+const searchDepth = 200
+
+// Span is a flattened Jaeger span with the error status already resolved from its tags.
+type Span struct {
+	Service      string
+	Operation    string
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	StartTime    time.Time
+	Duration     time.Duration
+	Error        bool
+	ErrorMessage string
+}
+
+func (s Span) String() string {
+	str := fmt.Sprintf("Trace: [ServiceName=%s;TraceID=%s;SpanID=%s;Duration=%s;StartTime=%s;OperationName=%s",
+		s.Service, s.TraceID, s.SpanID, s.Duration.String(), s.StartTime.String(), s.Operation)
+	if s.Error {
+		str += ";Error=" + s.ErrorMessage
+	}
+	return str + "]"
+}
+
+func init() {
+	RegisterFactory("jaeger", func(name string, decode func(v any) error, logger *zap.Logger) (Collector, error) {
+		var cfg JaegerConfig
+		if err := decode(&cfg); err != nil {
+			return nil, fmt.Errorf("decode config: %w", err)
+		}
+
+		c, err := NewJaegerCollector(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		c.name = name
+		return c, nil
+	})
+}
+
+type JaegerConfig struct {
+	URL          string        `yaml:"url" env:"URL"`
+	QueryTimeout time.Duration `yaml:"query_timeout" env:"QUERY_TIMEOUT"`
+}
+
 type JaegerCollector struct {
+	name   string
 	logger *zap.Logger
 
-	client api_v2.QueryServiceClient
+	client  api_v2.QueryServiceClient
+	timeout time.Duration
+	cache   *cache.LRU[any]
 }
 
-func NewJaegerCollector(url string, logger *zap.Logger) (*JaegerCollector, error) {
+func NewJaegerCollector(cfg JaegerConfig, logger *zap.Logger) (*JaegerCollector, error) {
 	cc, err := grpc.NewClient(
-		url,
+		cfg.URL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		return nil, err
 	}
 
 	return &JaegerCollector{
-		client: api_v2.NewQueryServiceClient(cc),
-		logger: logger,
+		name:    "jaeger",
+		client:  api_v2.NewQueryServiceClient(cc),
+		logger:  logger,
+		timeout: cfg.QueryTimeout,
 	}, nil
 }
 
-func (c *JaegerCollector) Collect(ctx context.Context, start, end time.Time) ([]string, error) {
+func (c *JaegerCollector) Name() string {
+	return c.name
+}
+
+// Collect returns spans of the query window. When query_timeout expires the spans of
+// services searched so far are returned with a note.
+func (c *JaegerCollector) Collect(ctx context.Context, q Query) (*Evidence, error) {
+	parent := ctx
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	evidence := &Evidence{
+		Source: c.name,
+		Kind:   KindTraces,
+	}
+
+	spans, err := c.FindSpans(ctx, q.Start, q.End)
+	if err != nil {
+		if !timedOut(parent, ctx) || len(spans) == 0 {
+			return nil, err
+		}
+		evidence.Notes = append(evidence.Notes, fmt.Sprintf("%s timed out after %s, not all services were searched",
+			c.name, c.timeout))
+	}
+	evidence.Spans = spans
+
+	return evidence, nil
+}
+
+// FindSpans returns spans of traces started within [start, end] for every known service.
+// On error the spans found before it are returned along with the error.
+func (c *JaegerCollector) FindSpans(ctx context.Context, start, end time.Time) ([]Span, error) {
 	resp, err := c.client.GetServices(ctx, &api_v2.GetServicesRequest{})
 	if err != nil {
 		return nil, fmt.Errorf("get services: %w", err)
 	}
 
-	var result []string
+	var result []Span
+	seen := make(map[string]struct{})
 	for _, service := range resp.GetServices() {
-		traces, err := c.findTraces(ctx, service, start, end)
+		traces, err := c.FindTraces(ctx, TraceQuery{Service: service, Start: start, End: end})
+		if err != nil {
+			return result, fmt.Errorf("find traces for service %s: %w", service, err)
+		}
+		// The same trace is returned for every service it passes through
+		for _, span := range traces {
+			key := span.TraceID + ":" + span.SpanID
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			result = append(result, span)
+		}
+	}
+
+	return result, nil
+}
+
+// Catalog lists traced services and their operations
+func (c *JaegerCollector) Catalog(ctx context.Context) ([]CatalogEntry, error) {
+	resp, err := c.client.GetServices(ctx, &api_v2.GetServicesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("get services: %w", err)
+	}
+
+	services := slices.Sorted(slices.Values(resp.GetServices()))
+
+	var result []CatalogEntry
+	for _, service := range services {
+		result = append(result, CatalogEntry{
+			Name:   service,
+			Type:   "service",
+			Source: c.name,
+			Kind:   KindTraces,
+		})
+
+		operations, err := c.client.GetOperations(ctx, &api_v2.GetOperationsRequest{Service: service})
 		if err != nil {
-			return nil, fmt.Errorf("find traces for service %s: %w", service, err)
+			return nil, fmt.Errorf("get operations of service %s: %w", service, err)
+		}
+		names := make([]string, 0, len(operations.GetOperations()))
+		for _, operation := range operations.GetOperations() {
+			names = append(names, operation.Name)
+		}
+		slices.Sort(names)
+		for _, name := range slices.Compact(names) {
+			result = append(result, CatalogEntry{
+				Name:   service + " " + name,
+				Type:   "operation",
+				Source: c.name,
+				Kind:   KindTraces,
+			})
 		}
-		result = append(result, traces...)
 	}
 
 	return result, nil
 }
 
-func (c *JaegerCollector) findTraces(ctx context.Context, serviceName string, start, end time.Time) ([]string, error) {
+// TraceQuery selects traces of a service, all fields but Service are optional
+type TraceQuery struct {
+	Service   string
+	Operation string
+	// Tags must all match span tags, e.g. http.status_code=500
+	Tags        map[string]string
+	Start, End  time.Time
+	MinDuration time.Duration
+	// Limit is the number of traces to fetch, searchDepth if zero
+	Limit int
+}
+
+func (c *JaegerCollector) useCache(lru *cache.LRU[any]) {
+	c.cache = lru
+}
+
+// FindTraces returns spans of the traces matching the query. With a cache the window is aligned,
+// see AlignWindow, and the result is cached.
+func (c *JaegerCollector) FindTraces(ctx context.Context, q TraceQuery) ([]Span, error) {
+	if c.cache == nil || !q.End.After(q.Start) {
+		return c.findTraces(ctx, q)
+	}
+
+	q.Start, q.End = AlignWindow(q.Start, q.End)
+	parts := []string{c.name, "traces", q.Service, q.Operation, q.MinDuration.String(), strconv.Itoa(q.Limit),
+		strconv.FormatInt(q.Start.Unix(), 10), strconv.FormatInt(q.End.Unix(), 10)}
+	for _, tag := range slices.Sorted(maps.Keys(q.Tags)) {
+		parts = append(parts, tag+"="+q.Tags[tag])
+	}
+	return cached(c.cache, cacheKey(parts...), func() ([]Span, error) {
+		return c.findTraces(ctx, q)
+	})
+}
+
+func (c *JaegerCollector) findTraces(ctx context.Context, q TraceQuery) ([]Span, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = searchDepth
+	}
+
 	stream, err := c.client.FindTraces(ctx, &api_v2.FindTracesRequest{
 		Query: &api_v2.TraceQueryParameters{
-			ServiceName:  serviceName,
-			StartTimeMin: start,
-			StartTimeMax: end,
+			ServiceName:   q.Service,
+			OperationName: q.Operation,
+			Tags:          q.Tags,
+			StartTimeMin:  q.Start,
+			StartTimeMax:  q.End,
+			DurationMin:   q.MinDuration,
+			SearchDepth:   int32(limit),
 		},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("find traces: %w", err)
 	}
 
-	var result []string
+	var result []Span
 	for {
 		resp, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
@@ -74,11 +254,81 @@ func (c *JaegerCollector) findTraces(ctx context.Context, serviceName string, st
 		}
 
 		for _, span := range resp.Spans {
-			str := fmt.Sprintf("Trace: [ServiceName=%s;TraceID=%s;SpanID=%s;Duration=%s;StartTime=%s;ProcessID=%s;OperationName=%s]",
-				serviceName, span.TraceID.String(), span.SpanID.String(), span.Duration.String(), span.StartTime.String(), span.ProcessID, span.OperationName)
-			result = append(result, str)
+			result = append(result, convertSpan(q.Service, span))
+		}
+	}
+
+	return result, nil
+}
+
+// GetTrace returns all spans of a trace ordered by their start
+func (c *JaegerCollector) GetTrace(ctx context.Context, traceID string) ([]Span, error) {
+	id, err := jaegermodel.TraceIDFromString(traceID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace id %q: %w", traceID, err)
+	}
+
+	stream, err := c.client.GetTrace(ctx, &api_v2.GetTraceRequest{TraceID: id})
+	if err != nil {
+		return nil, fmt.Errorf("get trace: %w", err)
+	}
+
+	var result []Span
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get trace stream receive: %w", err)
+		}
+
+		for _, span := range resp.Spans {
+			result = append(result, convertSpan("", span))
 		}
 	}
 
+	slices.SortStableFunc(result, func(a, b Span) int {
+		return a.StartTime.Compare(b.StartTime)
+	})
 	return result, nil
 }
+
+func convertSpan(serviceName string, span jaegermodel.Span) Span {
+	// A trace of one service contains spans of its downstream services as well
+	if span.Process != nil && span.Process.ServiceName != "" {
+		serviceName = span.Process.ServiceName
+	}
+
+	result := Span{
+		Service:   serviceName,
+		Operation: span.OperationName,
+		TraceID:   span.TraceID.String(),
+		SpanID:    span.SpanID.String(),
+		StartTime: span.StartTime,
+		Duration:  span.Duration,
+	}
+	if parent := span.ParentSpanID(); parent != 0 {
+		result.ParentSpanID = parent.String()
+	}
+
+	for _, tag := range span.Tags {
+		switch tag.Key {
+		case "error":
+			result.Error = result.Error || tag.VBool || tag.VStr == "true"
+		case "otel.status_code":
+			result.Error = result.Error || tag.VStr == "ERROR"
+		case "rpc.grpc.status_code":
+			if tag.VInt64 != 0 {
+				result.Error = true
+				if result.ErrorMessage == "" {
+					result.ErrorMessage = "grpc status code " + strconv.FormatInt(tag.VInt64, 10)
+				}
+			}
+		case "otel.status_description", "error.message":
+			result.ErrorMessage = tag.VStr
+		}
+	}
+
+	return result
+}
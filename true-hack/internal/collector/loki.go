@@ -2,22 +2,354 @@ package collector
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"true-hack/internal/cache"
+
 	"go.uber.org/zap"
 )
 
+const (
+	defaultLokiQuery    = `{container=~".+"}`
+	defaultLokiPageSize = 1000
+	defaultLokiMaxLines = 5000
+)
+
+func init() {
+	RegisterFactory("loki", func(name string, decode func(v any) error, logger *zap.Logger) (Collector, error) {
+		var cfg LokiConfig
+		if err := decode(&cfg); err != nil {
+			return nil, fmt.Errorf("decode config: %w", err)
+		}
+
+		c, err := NewLokiCollector(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		c.name = name
+		return c, nil
+	})
+}
+
+type LokiConfig struct {
+	URL          string        `yaml:"url" env:"URL"`
+	Query        string        `yaml:"query" env:"QUERY"`
+	QueryTimeout time.Duration `yaml:"query_timeout" env:"QUERY_TIMEOUT"`
+	PageSize     int           `yaml:"page_size" env:"PAGE_SIZE"`
+	MaxLines     int           `yaml:"max_lines" env:"MAX_LINES"`
+}
+
 type LokiCollector struct {
+	name   string
 	logger *zap.Logger
+
+	client   *http.Client
+	timeout  time.Duration
+	url      string
+	query    string
+	pageSize int
+	maxLines int
+	cache    *cache.LRU[any]
+}
+
+// LogEntry is a single log line returned by Loki together with the labels of its stream.
+type LogEntry struct {
+	Timestamp time.Time
+	Labels    map[string]string
+	Line      string
+}
+
+func (e LogEntry) String() string {
+	names := make([]string, 0, len(e.Labels))
+	for name := range e.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	labels := make([]string, 0, len(names))
+	for _, name := range names {
+		labels = append(labels, fmt.Sprintf("%s=%s", name, e.Labels[name]))
+	}
+
+	return fmt.Sprintf("%s {%s} %s", e.Timestamp.Format(time.RFC3339Nano), strings.Join(labels, ", "), e.Line)
 }
 
-func NewLokiCollector(url string, logger *zap.Logger) (*LokiCollector, error) {
+func NewLokiCollector(cfg LokiConfig, logger *zap.Logger) (*LokiCollector, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("loki url is empty")
+	}
+	if cfg.Query == "" {
+		cfg.Query = defaultLokiQuery
+	}
+	if cfg.PageSize <= 0 {
+		cfg.PageSize = defaultLokiPageSize
+	}
+	if cfg.MaxLines <= 0 {
+		cfg.MaxLines = defaultLokiMaxLines
+	}
+
 	return &LokiCollector{
-		logger: logger,
+		name:     "loki",
+		logger:   logger,
+		client:   &http.Client{},
+		timeout:  cfg.QueryTimeout,
+		url:      strings.TrimSuffix(cfg.URL, "/"),
+		query:    cfg.Query,
+		pageSize: cfg.PageSize,
+		maxLines: cfg.MaxLines,
 	}, nil
 }
 
-func (c *LokiCollector) Collect(ctx context.Context, start, end time.Time) (string, error) {
-	// TODO: Implement Loki collector
-	return "", nil
+func (c *LokiCollector) Name() string {
+	return c.name
+}
+
+// Collect runs the configured LogQL selector over the query window and returns log lines in chronological order.
+// When query_timeout expires the pages received so far are returned with a note.
+func (c *LokiCollector) Collect(ctx context.Context, q Query) (*Evidence, error) {
+	parent := ctx
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	evidence := &Evidence{
+		Source: c.name,
+		Kind:   KindLogs,
+	}
+
+	entries, err := c.QueryRange(ctx, c.query, q.Start, q.End)
+	if err != nil {
+		if !timedOut(parent, ctx) || len(entries) == 0 {
+			return nil, err
+		}
+		evidence.Notes = append(evidence.Notes, fmt.Sprintf("%s timed out after %s, logs before %s are missing",
+			c.name, c.timeout, entries[0].Timestamp.Format(time.RFC3339)))
+	}
+	evidence.Logs = entries
+
+	return evidence, nil
+}
+
+func (c *LokiCollector) useCache(lru *cache.LRU[any]) {
+	c.cache = lru
+}
+
+// QueryRange pages through /loki/api/v1/query_range from the end of the window until it is exhausted
+// or MaxLines is reached, so the most recent lines are kept. Entries are in chronological order.
+// On error the entries received before it are returned along with the error. With a cache the
+// window is aligned, see AlignWindow, and complete results are cached.
+func (c *LokiCollector) QueryRange(ctx context.Context, query string, start, end time.Time) ([]LogEntry, error) {
+	if c.cache == nil || !end.After(start) {
+		return c.queryRange(ctx, query, start, end)
+	}
+
+	start, end = AlignWindow(start, end)
+	key := cacheKey(c.name, "logql", query, strconv.Itoa(c.maxLines),
+		strconv.FormatInt(start.Unix(), 10), strconv.FormatInt(end.Unix(), 10))
+	return cached(c.cache, key, func() ([]LogEntry, error) {
+		return c.queryRange(ctx, query, start, end)
+	})
+}
+
+func (c *LokiCollector) queryRange(ctx context.Context, query string, start, end time.Time) ([]LogEntry, error) {
+	// Pages go backward from end so that MaxLines keeps the most recent lines, result is newest first
+	var result []LogEntry
+	// seen holds the entries received at the timestamp the next page ends at
+	var seen map[string]bool
+	var boundary time.Time
+
+	to := end
+	for len(result) < c.maxLines && to.After(start) {
+		// The entries received at the boundary come again, room is made for them
+		limit := min(c.pageSize, c.maxLines-len(result)) + len(seen)
+
+		page, err := c.queryPage(ctx, query, start, to, limit)
+		if err != nil {
+			slices.Reverse(result)
+			return result, fmt.Errorf("query range: %w", err)
+		}
+
+		added := 0
+		for _, entry := range page {
+			key := entry.String()
+			if entry.Timestamp.Equal(boundary) && seen[key] {
+				continue
+			}
+			if !entry.Timestamp.Equal(boundary) {
+				boundary, seen = entry.Timestamp, make(map[string]bool)
+			}
+			seen[key] = true
+			result = append(result, entry)
+			added++
+			if len(result) == c.maxLines {
+				break
+			}
+		}
+
+		if len(page) < limit {
+			break
+		}
+		// Loki treats end as exclusive, the next page ends right after the oldest received entry so
+		// that the lines sharing its timestamp are not lost, the ones already received are skipped.
+		// If Loki caps the limit below them the rest of that timestamp is given up to make progress.
+		to = boundary.Add(time.Nanosecond)
+		if added == 0 {
+			to = boundary
+			seen = nil
+		}
+	}
+	slices.Reverse(result)
+
+	c.logger.Debug("Collected logs",
+		zap.String("query", query),
+		zap.Int("lines", len(result)),
+		zap.Time("start", start),
+		zap.Time("end", end))
+
+	return result, nil
+}
+
+type lokiQueryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// Catalog lists the streams matching the configured selector that had logs within catalogLookback
+func (c *LokiCollector) Catalog(ctx context.Context) ([]CatalogEntry, error) {
+	now := time.Now()
+	params := url.Values{}
+	params.Set("match[]", c.query)
+	params.Set("start", strconv.FormatInt(now.Add(-catalogLookback).UnixNano(), 10))
+	params.Set("end", strconv.FormatInt(now.UnixNano(), 10))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/loki/api/v1/series?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("loki returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var body struct {
+		Status string              `json:"status"`
+		Data   []map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if body.Status != "success" {
+		return nil, fmt.Errorf("loki returned status %q", body.Status)
+	}
+
+	result := make([]CatalogEntry, 0, len(body.Data))
+	for _, labels := range body.Data {
+		result = append(result, CatalogEntry{
+			Name:   streamSelector(labels),
+			Type:   "stream",
+			Source: c.name,
+			Kind:   KindLogs,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result, nil
+}
+
+// streamSelector formats labels as a LogQL stream selector, e.g. {app="api", container="api-1"}
+func streamSelector(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	matchers := make([]string, 0, len(names))
+	for _, name := range names {
+		matchers = append(matchers, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return "{" + strings.Join(matchers, ", ") + "}"
+}
+
+func (c *LokiCollector) queryPage(ctx context.Context, query string, start, end time.Time, limit int) ([]LogEntry, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(start.UnixNano(), 10))
+	params.Set("end", strconv.FormatInt(end.UnixNano(), 10))
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("direction", "backward")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/loki/api/v1/query_range?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Loki reports query errors as plain text
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("loki returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var body lokiQueryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if body.Status != "success" {
+		return nil, fmt.Errorf("loki returned status %q: %s", body.Status, body.Error)
+	}
+	if body.Data.ResultType != "streams" {
+		return nil, fmt.Errorf("unexpected result type %q", body.Data.ResultType)
+	}
+
+	var result []LogEntry
+	for _, stream := range body.Data.Result {
+		for _, value := range stream.Values {
+			ns, err := strconv.ParseInt(value[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parse timestamp %q: %w", value[0], err)
+			}
+			result = append(result, LogEntry{
+				Timestamp: time.Unix(0, ns).UTC(),
+				Labels:    stream.Stream,
+				Line:      value[1],
+			})
+		}
+	}
+
+	// Entries are ordered only within a stream, merge them newest first so paging stays monotonic
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Timestamp.After(result[j].Timestamp)
+	})
+
+	return result, nil
 }
@@ -0,0 +1,239 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeLoki serves query_range over entries the way Loki does: start is inclusive, end is
+// exclusive and backward queries return the newest entries
+func fakeLoki(t *testing.T, entries []LogEntry) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(fakeLokiHandler(t, entries))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func fakeLokiHandler(t *testing.T, entries []LogEntry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		start, _ := strconv.ParseInt(query.Get("start"), 10, 64)
+		end, _ := strconv.ParseInt(query.Get("end"), 10, 64)
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		if query.Get("direction") != "backward" {
+			t.Errorf("direction = %q, want backward", query.Get("direction"))
+		}
+
+		var matched []LogEntry
+		for _, entry := range entries {
+			ns := entry.Timestamp.UnixNano()
+			if ns >= start && ns < end {
+				matched = append(matched, entry)
+			}
+		}
+		sort.SliceStable(matched, func(i, j int) bool {
+			return matched[i].Timestamp.After(matched[j].Timestamp)
+		})
+		matched = matched[:min(limit, len(matched))]
+
+		var body lokiQueryResponse
+		body.Status = "success"
+		body.Data.ResultType = "streams"
+		streams := make(map[string]int)
+		for _, entry := range matched {
+			app := entry.Labels["app"]
+			i, ok := streams[app]
+			if !ok {
+				i = len(body.Data.Result)
+				streams[app] = i
+				body.Data.Result = append(body.Data.Result, struct {
+					Stream map[string]string `json:"stream"`
+					Values [][2]string       `json:"values"`
+				}{Stream: entry.Labels})
+			}
+			body.Data.Result[i].Values = append(body.Data.Result[i].Values,
+				[2]string{strconv.FormatInt(entry.Timestamp.UnixNano(), 10), entry.Line})
+		}
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+func logEntry(ts time.Time, app, line string) LogEntry {
+	return LogEntry{Timestamp: ts.UTC(), Labels: map[string]string{"app": app}, Line: line}
+}
+
+func TestLokiQueryRange(t *testing.T) {
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	second := func(n int) time.Time { return base.Add(time.Duration(n) * time.Second) }
+
+	tests := []struct {
+		name     string
+		entries  []LogEntry
+		pageSize int
+		maxLines int
+		want     []string
+	}{
+		{
+			name: "single page",
+			entries: []LogEntry{
+				logEntry(second(1), "api", "a"),
+				logEntry(second(2), "db", "b"),
+				logEntry(second(3), "api", "c"),
+			},
+			pageSize: 10,
+			maxLines: 10,
+			want:     []string{"a", "b", "c"},
+		},
+		{
+			name: "max lines keeps the most recent",
+			entries: []LogEntry{
+				logEntry(second(1), "api", "a"),
+				logEntry(second(2), "api", "b"),
+				logEntry(second(3), "api", "c"),
+				logEntry(second(4), "api", "d"),
+				logEntry(second(5), "api", "e"),
+			},
+			pageSize: 2,
+			maxLines: 3,
+			want:     []string{"c", "d", "e"},
+		},
+		{
+			name: "page boundary inside a timestamp",
+			entries: []LogEntry{
+				logEntry(second(1), "api", "a"),
+				logEntry(second(2), "api", "b"),
+				logEntry(second(2), "db", "c"),
+				logEntry(second(2), "web", "d"),
+				logEntry(second(3), "api", "e"),
+			},
+			pageSize: 2,
+			maxLines: 10,
+			want:     []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name: "more lines at a timestamp than a page",
+			entries: []LogEntry{
+				logEntry(second(1), "api", "a"),
+				logEntry(second(2), "api", "b"),
+				logEntry(second(2), "db", "c"),
+				logEntry(second(2), "web", "d"),
+			},
+			pageSize: 2,
+			maxLines: 10,
+			want:     []string{"a", "b", "c", "d"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakeLoki(t, tt.entries)
+			c, err := NewLokiCollector(LokiConfig{URL: server.URL, PageSize: tt.pageSize, MaxLines: tt.maxLines}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := c.QueryRange(t.Context(), `{app=~".+"}`, base, second(10))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var lines []string
+			for i, entry := range entries {
+				lines = append(lines, entry.Line)
+				if i > 0 && entry.Timestamp.Before(entries[i-1].Timestamp) {
+					t.Errorf("entry %d is out of order", i)
+				}
+			}
+			sort.Strings(lines)
+			if !slices.Equal(lines, tt.want) {
+				t.Errorf("lines = %v, want %v", lines, tt.want)
+			}
+		})
+	}
+}
+
+func TestLokiCollectTimeout(t *testing.T) {
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	var entries []LogEntry
+	for n := range 4 {
+		entries = append(entries, logEntry(base.Add(time.Duration(n+1)*time.Second), "api", fmt.Sprint("line ", n)))
+	}
+
+	tests := []struct {
+		name string
+		// fastPages are answered at once, the following pages hang
+		fastPages int
+		wantLines int
+		wantNote  string
+		wantErr   bool
+	}{
+		{
+			name:      "complete",
+			fastPages: 3,
+			wantLines: 4,
+		},
+		{
+			name:      "pages before the timeout are kept with a note",
+			fastPages: 1,
+			wantLines: 2,
+			wantNote:  "loki timed out after 100ms, logs before 2025-01-01T12:00:03Z are missing",
+		},
+		{
+			name:      "timeout before any page fails",
+			fastPages: 0,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := fakeLokiHandler(t, entries)
+			var pages atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if int(pages.Add(1)) > tt.fastPages {
+					<-r.Context().Done()
+					return
+				}
+				handler.ServeHTTP(w, r)
+			}))
+			t.Cleanup(server.Close)
+
+			c, err := NewLokiCollector(LokiConfig{URL: server.URL, PageSize: 2, MaxLines: 10, QueryTimeout: 100 * time.Millisecond}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			evidence, err := c.Collect(t.Context(), Query{Start: base, End: base.Add(time.Minute)})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Collect() = %+v, want an error", evidence)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(evidence.Logs) != tt.wantLines {
+				t.Errorf("got %d lines, want %d", len(evidence.Logs), tt.wantLines)
+			}
+			var wantNotes []string
+			if tt.wantNote != "" {
+				wantNotes = []string{tt.wantNote}
+			}
+			if !slices.Equal(evidence.Notes, wantNotes) {
+				t.Errorf("notes = %q, want %q", evidence.Notes, wantNotes)
+			}
+		})
+	}
+}
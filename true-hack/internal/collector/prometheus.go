@@ -3,37 +3,106 @@ package collector
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"true-hack/internal/cache"
+
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 	"go.uber.org/zap"
 )
 
+const (
+	// maxPointsPerSeries is the point budget for a single series returned by a range query
+	maxPointsPerSeries = 120
+	// minStep should not be lower than the scrape interval, otherwise points are just duplicated
+	minStep = 15 * time.Second
+	// defaultWorkers is how many metrics are queried at once when workers is not configured
+	defaultWorkers = 8
+)
+
+// steps are the "round" step values rangeStep picks from, so timestamps stay human friendly
+var steps = []time.Duration{
+	15 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	2 * time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	3 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+}
+
+func init() {
+	RegisterFactory("prometheus", func(name string, decode func(v any) error, logger *zap.Logger) (Collector, error) {
+		var cfg PrometheusConfig
+		if err := decode(&cfg); err != nil {
+			return nil, fmt.Errorf("decode config: %w", err)
+		}
+
+		c, err := NewPrometheusCollector(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		c.name = name
+		return c, nil
+	})
+}
+
+type PrometheusConfig struct {
+	URL          string        `yaml:"url" env:"URL"`
+	QueryTimeout time.Duration `yaml:"query_timeout" env:"QUERY_TIMEOUT"`
+	// Workers is how many metrics are queried concurrently
+	Workers int `yaml:"workers" env:"WORKERS"`
+	// MetricTimeout bounds the query of a single metric, a slow metric is skipped
+	MetricTimeout time.Duration `yaml:"metric_timeout" env:"METRIC_TIMEOUT"`
+}
+
 type PrometheusCollector struct {
-	client v1.API
-	logger *zap.Logger
+	name          string
+	client        v1.API
+	logger        *zap.Logger
+	timeout       time.Duration
+	metricTimeout time.Duration
+	workers       int
+	cache         *cache.LRU[any]
 }
 
-func NewPrometheusCollector(url string, logger *zap.Logger) (*PrometheusCollector, error) {
+func NewPrometheusCollector(cfg PrometheusConfig, logger *zap.Logger) (*PrometheusCollector, error) {
 	client, err := api.NewClient(api.Config{
-		Address: url,
+		Address: cfg.URL,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Prometheus client: %w", err)
 	}
 
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
 	return &PrometheusCollector{
-		client: v1.NewAPI(client),
-		logger: logger,
+		name:          "prometheus",
+		client:        v1.NewAPI(client),
+		logger:        logger,
+		timeout:       cfg.QueryTimeout,
+		metricTimeout: cfg.MetricTimeout,
+		workers:       workers,
 	}, nil
 }
 
-func (p *PrometheusCollector) GetAllMetrics() ([]string, error) {
+func (p *PrometheusCollector) GetAllMetrics(ctx context.Context) ([]string, error) {
 	// Get all metric names
-	ctx := context.Background()
 	names, warnings, err := p.client.LabelValues(ctx, "__name__", nil, time.Time{}, time.Time{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get metric names: %v", err)
@@ -55,121 +124,352 @@ func (p *PrometheusCollector) GetAllMetrics() ([]string, error) {
 	return metrics, nil
 }
 
-func (p *PrometheusCollector) GetMetricData(metric string, startTime, endTime time.Time) (string, error) {
-	// Escape dots in metric name with underscores for Prometheus query
-	escapedMetric := strings.ReplaceAll(metric, ".", "_")
+// Catalog lists metric names with their type and help from the metadata API
+func (p *PrometheusCollector) Catalog(ctx context.Context) ([]CatalogEntry, error) {
+	names, err := p.GetAllMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := p.client.Metadata(ctx, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metrics metadata: %v", err)
+	}
+
+	result := make([]CatalogEntry, 0, len(names))
+	for _, name := range names {
+		entry := CatalogEntry{
+			Name:   name,
+			Source: p.name,
+			Kind:   KindMetrics,
+		}
+		if meta := metadata[name]; len(meta) > 0 {
+			entry.Type = string(meta[0].Type)
+			entry.Help = meta[0].Help
+		}
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+// MetricInfo describes a metric for search: its metadata and the labels its series have
+type MetricInfo struct {
+	Name string
+	Type string
+	Help string
+	// Labels maps label names to a few of their values
+	Labels map[string][]string
+}
+
+// maxLabelValues limits how many example values of a label are kept in MetricInfo
+const maxLabelValues = 5
+
+// GetMetricsInfo returns metadata and label sets of every metric that has series in the last lookback
+func (p *PrometheusCollector) GetMetricsInfo(ctx context.Context, lookback time.Duration) ([]MetricInfo, error) {
+	metadata, err := p.client.Metadata(ctx, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metrics metadata: %v", err)
+	}
+
+	now := time.Now()
+	series, warnings, err := p.client.Series(ctx, []string{`{__name__=~".+"}`}, now.Add(-lookback), now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get series: %v", err)
+	}
+	if len(warnings) > 0 {
+		p.logger.Warn("Got warnings while fetching series", zap.Strings("warnings", warnings))
+	}
+
+	infos := make(map[string]*MetricInfo)
+	for _, labels := range series {
+		name := string(labels[model.MetricNameLabel])
+		info, ok := infos[name]
+		if !ok {
+			info = &MetricInfo{
+				Name:   name,
+				Labels: make(map[string][]string),
+			}
+			if meta := metadata[name]; len(meta) > 0 {
+				info.Type = string(meta[0].Type)
+				info.Help = meta[0].Help
+			}
+			infos[name] = info
+		}
+
+		for label, value := range labels {
+			if label == model.MetricNameLabel {
+				continue
+			}
+			values := info.Labels[string(label)]
+			if len(values) < maxLabelValues && !slices.Contains(values, string(value)) {
+				info.Labels[string(label)] = append(values, string(value))
+			}
+		}
+	}
+
+	result := make([]MetricInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, *info)
+	}
+	slices.SortFunc(result, func(a, b MetricInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return result, nil
+}
+
+// QueryMetric returns the series of a metric within the window, or their values at endTime if the window is empty.
+// Dots in the name are replaced with underscores.
+func (p *PrometheusCollector) QueryMetric(ctx context.Context, metric string, startTime, endTime time.Time) ([]Series, error) {
+	return p.QueryPromQL(ctx, strings.ReplaceAll(metric, ".", "_"), startTime, endTime)
+}
+
+func (p *PrometheusCollector) useCache(c *cache.LRU[any]) {
+	p.cache = c
+}
+
+// QueryPromQL evaluates a PromQL expression over the window, or at endTime if the window is empty.
+// With a cache the window is aligned to the step and the result is cached, instant queries are not.
+func (p *PrometheusCollector) QueryPromQL(ctx context.Context, query string, startTime, endTime time.Time) ([]Series, error) {
+	if p.cache == nil || !endTime.After(startTime) {
+		return p.queryPromQL(ctx, query, startTime, endTime)
+	}
+
+	startTime, endTime, step := alignWindow(startTime, endTime)
+	key := cacheKey(p.name, "promql", query, step.String(),
+		strconv.FormatInt(startTime.Unix(), 10), strconv.FormatInt(endTime.Unix(), 10))
+	return cached(p.cache, key, func() ([]Series, error) {
+		return p.queryPromQL(ctx, query, startTime, endTime)
+	})
+}
 
-	p.logger.Debug("Querying metric",
-		zap.String("metric", metric),
-		zap.String("escaped", escapedMetric),
+func (p *PrometheusCollector) queryPromQL(ctx context.Context, query string, startTime, endTime time.Time) ([]Series, error) {
+	p.logger.Debug("Querying Prometheus",
+		zap.String("query", query),
 		zap.Time("start", startTime),
 		zap.Time("end", endTime))
 
-	// For gauge metrics, we can use Query instead of QueryRange
-	value, warnings, err := p.client.Query(context.Background(), escapedMetric, time.Now())
+	var value model.Value
+	var warnings v1.Warnings
+	var err error
+	if endTime.After(startTime) {
+		step := rangeStep(startTime, endTime)
+		p.logger.Debug("Using range query",
+			zap.String("query", query),
+			zap.Duration("step", step))
+
+		value, warnings, err = p.client.QueryRange(ctx, query, v1.Range{
+			Start: startTime,
+			End:   endTime,
+			Step:  step,
+		})
+	} else {
+		// Empty window, the best we can do is a snapshot at its end
+		value, warnings, err = p.client.Query(ctx, query, endTime)
+	}
 	if err != nil {
-		p.logger.Error("Failed to query metric",
-			zap.String("metric", metric),
-			zap.String("escaped", escapedMetric),
+		p.logger.Error("Failed to query Prometheus",
+			zap.String("query", query),
 			zap.Error(err))
-		return "", fmt.Errorf("failed to query metric: %v", err)
+		return nil, fmt.Errorf("failed to query metric: %v", err)
 	}
 	if len(warnings) > 0 {
-		p.logger.Warn("Got warnings while querying metric",
-			zap.String("metric", metric),
+		p.logger.Warn("Got warnings while querying Prometheus",
+			zap.String("query", query),
 			zap.Strings("warnings", warnings))
 	}
 
-	p.logger.Debug("Got metric response",
-		zap.String("metric", metric),
+	p.logger.Debug("Got query response",
+		zap.String("query", query),
 		zap.String("type", fmt.Sprintf("%T", value)))
 
-	// Format the result
-	var result strings.Builder
+	var result []Series
 	switch v := value.(type) {
 	case model.Vector:
 		p.logger.Debug("Got vector response",
-			zap.String("metric", metric),
+			zap.String("query", query),
 			zap.Int("samples", len(v)))
 		for _, sample := range v {
-			// Format labels
-			labels := make([]string, 0, len(sample.Metric))
-			for name, value := range sample.Metric {
-				if name != "__name__" { // Skip metric name as it's already in the output
-					labels = append(labels, fmt.Sprintf("%s=%s", name, value))
-				}
-			}
-			labelStr := strings.Join(labels, ", ")
-			if labelStr != "" {
-				labelStr = "{" + labelStr + "}"
-			}
-
-			result.WriteString(fmt.Sprintf("%s%s: %v\n", metric, labelStr, sample.Value))
+			result = append(result, Series{
+				Labels: seriesLabels(sample.Metric),
+				Points: []Point{{Time: sample.Timestamp.Time(), Value: float64(sample.Value)}},
+			})
 		}
 	case model.Matrix:
 		p.logger.Debug("Got matrix response",
-			zap.String("metric", metric),
+			zap.String("query", query),
 			zap.Int("streams", len(v)))
 		for _, stream := range v {
-			// Format labels
-			labels := make([]string, 0, len(stream.Metric))
-			for name, value := range stream.Metric {
-				if name != "__name__" {
-					labels = append(labels, fmt.Sprintf("%s=%s", name, value))
-				}
-			}
-			labelStr := strings.Join(labels, ", ")
-			if labelStr != "" {
-				labelStr = "{" + labelStr + "}"
-			}
-
-			result.WriteString(fmt.Sprintf("%s%s:\n", metric, labelStr))
-			for _, point := range stream.Values {
-				result.WriteString(fmt.Sprintf("  %s: %v\n",
-					point.Timestamp.Time().Format(time.RFC3339),
-					point.Value))
+			points := make([]Point, len(stream.Values))
+			for i, point := range stream.Values {
+				points[i] = Point{Time: point.Timestamp.Time(), Value: float64(point.Value)}
 			}
+			result = append(result, Series{
+				Labels: seriesLabels(stream.Metric),
+				Points: points,
+			})
 		}
+	case *model.Scalar:
+		// Expressions like scalar(...) or time()
+		result = append(result, Series{
+			Points: []Point{{Time: v.Timestamp.Time(), Value: float64(v.Value)}},
+		})
 	default:
 		p.logger.Warn("Unexpected response type",
-			zap.String("metric", metric),
+			zap.String("query", query),
 			zap.String("type", fmt.Sprintf("%T", value)))
 	}
 
-	if result.Len() == 0 {
-		p.logger.Warn("Empty result for metric",
-			zap.String("metric", metric),
+	if len(result) == 0 {
+		p.logger.Warn("Empty result for query",
+			zap.String("query", query),
 			zap.String("type", fmt.Sprintf("%T", value)))
 	}
 
-	return result.String(), nil
+	return result, nil
 }
 
-func (p *PrometheusCollector) Collect(ctx context.Context, metrics []string, start, end time.Time) (string, error) {
-	var result strings.Builder
+// seriesLabels converts Prometheus labels skipping the metric name, it's already known
+func seriesLabels(metric model.Metric) map[string]string {
+	labels := make(map[string]string, len(metric))
+	for name, value := range metric {
+		if name != model.MetricNameLabel {
+			labels[string(name)] = string(value)
+		}
+	}
+	return labels
+}
+
+func (p *PrometheusCollector) Name() string {
+	return p.name
+}
+
+// Collect queries the requested metrics, or every known metric if none are requested.
+// Metrics are queried by a pool of workers, results keep the order of the metric list.
+// When query_timeout expires the metrics collected so far are returned with a note.
+func (p *PrometheusCollector) Collect(ctx context.Context, q Query) (*Evidence, error) {
+	parent := ctx
+	ctx, cancel := withTimeout(ctx, p.timeout)
+	defer cancel()
+
+	metrics := q.Metrics
+	if len(metrics) == 0 {
+		allMetrics, err := p.GetAllMetrics(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get all metrics: %v", err)
+		}
+		metrics = allMetrics
+	}
 
 	p.logger.Info("Starting metrics collection",
 		zap.Int("metrics_count", len(metrics)),
-		zap.Time("start", start),
-		zap.Time("end", end))
+		zap.Int("workers", p.workers),
+		zap.Time("start", q.Start),
+		zap.Time("end", q.End))
 
-	for _, metric := range metrics {
-		data, err := p.GetMetricData(metric, start, end)
-		if err != nil {
-			p.logger.Warn("Failed to get metric data",
-				zap.String("metric", metric),
-				zap.Error(err))
-			continue
+	// Every worker writes to its own slot, so the result doesn't depend on which query finished first
+	results := make([]MetricData, len(metrics))
+	done := make([]bool, len(metrics))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(p.workers, len(metrics)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				data, err := p.fetchMetric(ctx, metrics[i], q)
+				if err != nil {
+					if ctx.Err() == nil {
+						p.logger.Warn("Failed to get metric data",
+							zap.String("metric", metrics[i]),
+							zap.Error(err))
+						done[i] = true
+					}
+					continue
+				}
+				results[i] = data
+				done[i] = true
+			}
+		}()
+	}
+
+feed:
+	for i := range metrics {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil && !timedOut(parent, ctx) {
+		return nil, ctx.Err()
+	}
+
+	evidence := &Evidence{
+		Source: p.name,
+		Kind:   KindMetrics,
+	}
+	queried := 0
+	for i, data := range results {
+		if done[i] {
+			queried++
 		}
-		if data != "" {
-			result.WriteString(data)
-			result.WriteString("\n")
+		if len(data.Series) > 0 {
+			evidence.Metrics = append(evidence.Metrics, data)
 		}
 	}
+	if queried < len(metrics) {
+		evidence.Notes = append(evidence.Notes, fmt.Sprintf("%s timed out after %s, queried %d of %d metrics",
+			p.name, p.timeout, queried, len(metrics)))
+	}
 
-	if result.Len() == 0 {
+	if len(evidence.Metrics) == 0 {
 		p.logger.Warn("No metrics data collected")
 	}
 
-	return result.String(), nil
+	return evidence, nil
+}
+
+// fetchMetric queries the window and the baseline window of the query bounded by metric_timeout.
+// Without baseline the metric is still useful, so its failure is only logged.
+func (p *PrometheusCollector) fetchMetric(ctx context.Context, metric string, q Query) (MetricData, error) {
+	if p.metricTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.metricTimeout)
+		defer cancel()
+	}
+
+	series, err := p.QueryMetric(ctx, metric, q.Start, q.End)
+	if err != nil {
+		return MetricData{}, err
+	}
+	data := MetricData{Name: metric, Series: series}
+
+	if q.HasBaseline() && len(series) > 0 {
+		data.Baseline, err = p.QueryMetric(ctx, metric, q.BaselineStart, q.BaselineEnd)
+		if err != nil {
+			p.logger.Warn("Failed to get metric baseline",
+				zap.String("metric", metric),
+				zap.Error(err))
+		}
+	}
+
+	return data, nil
+}
+
+// rangeStep picks the smallest round step that keeps the window within maxPointsPerSeries
+func rangeStep(start, end time.Time) time.Duration {
+	step := max(end.Sub(start)/maxPointsPerSeries, minStep)
+	for _, s := range steps {
+		if s >= step {
+			return s
+		}
+	}
+	// Windows longer than a few months: fall back to an exact step
+	return step.Truncate(time.Second)
 }
@@ -0,0 +1,188 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRangeStep(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		want   time.Duration
+	}{
+		{name: "empty window", window: 0, want: minStep},
+		{name: "shorter than min step times points", window: 10 * time.Minute, want: 15 * time.Second},
+		{name: "exactly min step times points", window: 30 * time.Minute, want: 15 * time.Second},
+		{name: "just over a round step", window: 30*time.Minute + time.Second, want: 30 * time.Second},
+		{name: "hour", window: time.Hour, want: 30 * time.Second},
+		{name: "day", window: day, want: 15 * time.Minute},
+		{name: "largest round step", window: 120 * day, want: day},
+		{name: "longer than round steps", window: 240 * day, want: 2 * day},
+		{name: "exact step is truncated to seconds", window: 240*day + time.Second, want: 2 * day},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rangeStep(start, start.Add(tt.window))
+			if got != tt.want {
+				t.Errorf("rangeStep(%s) = %s, want %s", tt.window, got, tt.want)
+			}
+			if points := tt.window / got; points > maxPointsPerSeries {
+				t.Errorf("step %s gives %d points, more than %d", got, points, maxPointsPerSeries)
+			}
+		})
+	}
+}
+
+// promBehavior is how fakePrometheus answers a query
+type promBehavior struct {
+	delay time.Duration
+	fail  bool
+}
+
+// fakePrometheus answers range queries with a single series per query, queries listed in behaviors
+// are delayed or fail. It counts the queries it got.
+func fakePrometheus(t *testing.T, behaviors map[string]promBehavior) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var queries atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query_range" {
+			http.NotFound(w, r)
+			return
+		}
+		queries.Add(1)
+		query := r.FormValue("query")
+		behavior := behaviors[query]
+
+		select {
+		case <-time.After(behavior.delay):
+		case <-r.Context().Done():
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if behavior.fail {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"status": "error", "errorType": "bad_data", "error": "unknown metric %s"}`, query)
+			return
+		}
+		start, _ := strconv.ParseFloat(r.FormValue("start"), 64)
+		fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"__name__": %q, "pod": "api-0"}, "values": [[%v, "1"]]}]}}`,
+			query, start)
+	}))
+	t.Cleanup(server.Close)
+	return server, &queries
+}
+
+func TestPrometheusCollect(t *testing.T) {
+	end := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	metrics := []string{"m0", "m1", "m2", "m3"}
+
+	tests := []struct {
+		name      string
+		config    PrometheusConfig
+		behaviors map[string]promBehavior
+		want      []string
+		wantNote  string
+	}{
+		{
+			name:   "results keep the order of the metric list",
+			config: PrometheusConfig{Workers: 4},
+			behaviors: map[string]promBehavior{
+				"m0": {delay: 60 * time.Millisecond},
+				"m1": {delay: 40 * time.Millisecond},
+				"m2": {delay: 20 * time.Millisecond},
+			},
+			want: []string{"m0", "m1", "m2", "m3"},
+		},
+		{
+			name:      "failing metric is skipped",
+			config:    PrometheusConfig{Workers: 2},
+			behaviors: map[string]promBehavior{"m1": {fail: true}},
+			want:      []string{"m0", "m2", "m3"},
+		},
+		{
+			name:      "slow metric is skipped after metric timeout",
+			config:    PrometheusConfig{Workers: 2, MetricTimeout: 50 * time.Millisecond},
+			behaviors: map[string]promBehavior{"m2": {delay: time.Minute}},
+			want:      []string{"m0", "m1", "m3"},
+		},
+		{
+			name:      "query timeout returns what was collected with a note",
+			config:    PrometheusConfig{Workers: 1, QueryTimeout: 200 * time.Millisecond},
+			behaviors: map[string]promBehavior{"m1": {delay: time.Minute}},
+			want:      []string{"m0"},
+			wantNote:  "prometheus timed out after 200ms, queried 1 of 4 metrics",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := fakePrometheus(t, tt.behaviors)
+			tt.config.URL = server.URL
+			c, err := NewPrometheusCollector(tt.config, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			evidence, err := c.Collect(t.Context(), Query{Start: end.Add(-time.Hour), End: end, Metrics: metrics})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, data := range evidence.Metrics {
+				names = append(names, data.Name)
+				if len(data.Series) != 1 || data.Series[0].Labels["pod"] != "api-0" {
+					t.Errorf("metric %s has series %+v", data.Name, data.Series)
+				}
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("metrics = %v, want %v", names, tt.want)
+			}
+
+			var wantNotes []string
+			if tt.wantNote != "" {
+				wantNotes = []string{tt.wantNote}
+			}
+			if !slices.Equal(evidence.Notes, wantNotes) {
+				t.Errorf("notes = %q, want %q", evidence.Notes, wantNotes)
+			}
+		})
+	}
+}
+
+func TestPrometheusCollectCanceled(t *testing.T) {
+	server, queries := fakePrometheus(t, map[string]promBehavior{"m0": {delay: time.Minute}})
+	c, err := NewPrometheusCollector(PrometheusConfig{URL: server.URL, Workers: 1, QueryTimeout: time.Minute}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A caller that gives up gets an error, not a partial result
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	end := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	evidence, err := c.Collect(ctx, Query{Start: end.Add(-time.Hour), End: end, Metrics: []string{"m0", "m1"}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Collect() = %+v, %v, want the deadline of the caller", evidence, err)
+	}
+	if got := queries.Load(); got != 1 {
+		t.Errorf("made %d queries after the caller gave up, want 1", got)
+	}
+}
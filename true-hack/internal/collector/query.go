@@ -0,0 +1,23 @@
+package collector
+
+import (
+	"context"
+	"time"
+)
+
+// PromQLQuerier is implemented by collectors that evaluate arbitrary PromQL. It and the other
+// query interfaces back the tools the analyzer offers the model in agent mode.
+type PromQLQuerier interface {
+	QueryPromQL(ctx context.Context, query string, start, end time.Time) ([]Series, error)
+}
+
+// LogQLQuerier is implemented by collectors that run arbitrary LogQL log queries
+type LogQLQuerier interface {
+	QueryRange(ctx context.Context, query string, start, end time.Time) ([]LogEntry, error)
+}
+
+// TraceSearcher is implemented by collectors that search traces and fetch them by ID
+type TraceSearcher interface {
+	FindTraces(ctx context.Context, q TraceQuery) ([]Span, error)
+	GetTrace(ctx context.Context, traceID string) ([]Span, error)
+}
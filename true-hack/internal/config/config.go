@@ -0,0 +1,337 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"true-hack/internal/chain"
+	"true-hack/internal/collector"
+	"true-hack/internal/embedding"
+	"true-hack/internal/llm"
+	"true-hack/internal/rag"
+
+	"github.com/caarlos0/env/v11"
+	"gopkg.in/yaml.v3"
+)
+
+// Config mirrors configs/config.yaml. Every scalar can be overridden by an environment
+// variable named after its path, e.g. OPENAI_MODEL or LOKI_QUERY_TIMEOUT.
+type Config struct {
+	Server struct {
+		Port int `yaml:"port" env:"PORT"`
+	} `yaml:"server" envPrefix:"SERVER_"`
+
+	Prometheus collector.PrometheusConfig `yaml:"prometheus" envPrefix:"PROMETHEUS_"`
+	Loki       collector.LokiConfig       `yaml:"loki" envPrefix:"LOKI_"`
+	Jaeger     collector.JaegerConfig     `yaml:"jaeger" envPrefix:"JAEGER_"`
+	// Sources lists additional data sources, see collector.RegisterFactory for available types
+	Sources []collector.SourceConfig `yaml:"sources"`
+
+	OpenAI     OpenAIConfig     `yaml:"openai" envPrefix:"OPENAI_"`
+	LLM        LLMConfig        `yaml:"llm"`
+	Embeddings embedding.Config `yaml:"embeddings" envPrefix:"EMBEDDINGS_"`
+	RAG        rag.Config       `yaml:"rag" envPrefix:"RAG_"`
+	Chain      ChainConfig      `yaml:"chain" envPrefix:"CHAIN_"`
+	Cache      CacheConfig      `yaml:"cache" envPrefix:"CACHE_"`
+}
+
+// CacheConfig configures the cache of analysis results and the cache of data collected from the sources
+type CacheConfig struct {
+	// Backend keeps the analysis results: memory (default), sqlite or redis. Collected data is always kept in memory.
+	Backend string `yaml:"backend" env:"BACKEND"`
+	// Path is the database file of the sqlite backend
+	Path string `yaml:"path" env:"PATH"`
+	// RedisURL locates the server of the redis backend, e.g. redis://:password@redis:6379/0
+	RedisURL string `yaml:"redis_url" env:"REDIS_URL"`
+	// RedisPrefix is prepended to the keys of the redis backend
+	RedisPrefix string `yaml:"redis_prefix" env:"REDIS_PREFIX"`
+
+	TTL time.Duration `yaml:"ttl" env:"TTL"`
+	// MaxEntries bounds the cache, the least recently used result is evicted first
+	MaxEntries int `yaml:"max_entries" env:"MAX_ENTRIES"`
+	// CleanupInterval is how often expired results and evidence are dropped in the background
+	CleanupInterval time.Duration `yaml:"cleanup_interval" env:"CLEANUP_INTERVAL"`
+	// EvidenceTTL is how long query results of the sources are reused
+	EvidenceTTL time.Duration `yaml:"evidence_ttl" env:"EVIDENCE_TTL"`
+	// EvidenceMaxEntries bounds the cached query results, a query of a single metric is one entry
+	EvidenceMaxEntries int `yaml:"evidence_max_entries" env:"EVIDENCE_MAX_ENTRIES"`
+}
+
+// OpenAIConfig is the primary LLM provider, its API is also used for embeddings
+type OpenAIConfig struct {
+	// Name identifies the provider in answers and logs
+	Name   string `yaml:"name" env:"NAME"`
+	APIKey string `yaml:"api_key" env:"API_KEY"`
+	// TokenFile is read when APIKey is empty
+	TokenFile   string  `yaml:"token_file" env:"TOKEN_FILE"`
+	BaseURL     string  `yaml:"base_url" env:"BASE_URL"`
+	Model       string  `yaml:"model" env:"MODEL"`
+	Temperature float32 `yaml:"temperature" env:"TEMPERATURE"`
+	MaxTokens   int     `yaml:"max_tokens" env:"MAX_TOKENS"`
+	// Timeout bounds a single model request, after it the fallbacks are asked. Zero means no limit.
+	Timeout time.Duration `yaml:"timeout" env:"TIMEOUT"`
+}
+
+// LLMConfig lists the providers asked when the primary one fails
+type LLMConfig struct {
+	// Fallbacks are asked in order, each one when the previous one fails or times out
+	Fallbacks []llm.Config `yaml:"fallbacks"`
+}
+
+type ChainConfig struct {
+	SystemPrompt    string `yaml:"system_prompt" env:"SYSTEM_PROMPT"`
+	MetricsTemplate string `yaml:"metrics_template" env:"METRICS_TEMPLATE"`
+	LogsTemplate    string `yaml:"logs_template" env:"LOGS_TEMPLATE"`
+	TracesTemplate  string `yaml:"traces_template" env:"TRACES_TEMPLATE"`
+	// ComparisonTemplate renders differences from the baseline period, {{.TimeRange}} is the baseline
+	ComparisonTemplate string `yaml:"comparison_template" env:"COMPARISON_TEMPLATE"`
+	// ResponseMode is json_object, function or text, see chain.ResponseModeJSON
+	ResponseMode      string `yaml:"response_mode" env:"RESPONSE_MODE"`
+	MaxRepairAttempts int    `yaml:"max_repair_attempts" env:"MAX_REPAIR_ATTEMPTS"`
+	// MetricsTopK is how many metrics related to the question are shown when none are requested,
+	// anomalous series of other metrics are shown too
+	MetricsTopK int `yaml:"metrics_top_k" env:"METRICS_TOP_K"`
+	// MetricIndexRefresh is how often the metric index is rebuilt from Prometheus
+	MetricIndexRefresh time.Duration `yaml:"metric_index_refresh" env:"METRIC_INDEX_REFRESH"`
+	// LogsTopK and TracesTopK are how many log chunks and traces are retrieved for a question
+	LogsTopK   int `yaml:"logs_top_k" env:"LOGS_TOP_K"`
+	TracesTopK int `yaml:"traces_top_k" env:"TRACES_TOP_K"`
+	// ContextWindow is the context window of openai.model in tokens, zero means the known one
+	ContextWindow int `yaml:"context_window" env:"CONTEXT_WINDOW"`
+	// AnomalyBaseline is the window before the analyzed one that metrics are compared with
+	AnomalyBaseline time.Duration `yaml:"anomaly_baseline" env:"ANOMALY_BASELINE"`
+	// MetricSeriesTopK is how many of the most anomalous series are put into the prompt
+	MetricSeriesTopK int `yaml:"metric_series_top_k" env:"METRIC_SERIES_TOP_K"`
+	// SessionTTL is how long an idle conversation is kept with its evidence
+	SessionTTL time.Duration `yaml:"session_ttl" env:"SESSION_TTL"`
+	// MaxSessions limits the conversations kept in memory
+	MaxSessions int `yaml:"max_sessions" env:"MAX_SESSIONS"`
+	// DefaultTimeRange is analyzed when neither the request nor the question name a period
+	DefaultTimeRange time.Duration `yaml:"default_time_range" env:"DEFAULT_TIME_RANGE"`
+	// AgentMaxSteps and AgentMaxTokens bound the model requests of the agent mode
+	AgentMaxSteps  int `yaml:"agent_max_steps" env:"AGENT_MAX_STEPS"`
+	AgentMaxTokens int `yaml:"agent_max_tokens" env:"AGENT_MAX_TOKENS"`
+	// AgentToolResultTokens is how much of a tool result the model is shown
+	AgentToolResultTokens int `yaml:"agent_tool_result_tokens" env:"AGENT_TOOL_RESULT_TOKENS"`
+}
+
+// Load reads the YAML file, applies environment overrides and validates the result
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+
+	cfg := &Config{}
+	cfg.OpenAI.Name = llm.ProviderOpenAI
+	cfg.OpenAI.TokenFile = ".token_key"
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("parse config file: %w", err)
+	}
+
+	if err := env.Parse(cfg); err != nil {
+		return nil, fmt.Errorf("parse environment: %w", err)
+	}
+
+	if cfg.OpenAI.APIKey == "" && cfg.OpenAI.TokenFile != "" {
+		token, err := os.ReadFile(cfg.OpenAI.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read API key file: %w", err)
+		}
+		cfg.OpenAI.APIKey = strings.TrimSpace(string(token))
+	}
+	for i, fallback := range cfg.LLM.Fallbacks {
+		if fallback.APIKey != "" || fallback.TokenFile == "" {
+			continue
+		}
+		token, err := os.ReadFile(fallback.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read API key file of llm provider %q: %w", fallback.Name, err)
+		}
+		cfg.LLM.Fallbacks[i].APIKey = strings.TrimSpace(string(token))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// Validate reports all problems at once so a broken config can be fixed in one go
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port: must be in 1..65535, got %d", c.Server.Port))
+	}
+	if c.Prometheus.URL == "" {
+		errs = append(errs, errors.New("prometheus.url: must not be empty"))
+	}
+	if c.Prometheus.Workers < 0 {
+		errs = append(errs, fmt.Errorf("prometheus.workers: must not be negative, got %d", c.Prometheus.Workers))
+	}
+	if c.Loki.URL == "" {
+		errs = append(errs, errors.New("loki.url: must not be empty"))
+	}
+	if c.Jaeger.URL == "" {
+		errs = append(errs, errors.New("jaeger.url: must not be empty"))
+	}
+	for i, source := range c.Sources {
+		if source.Type == "" {
+			errs = append(errs, fmt.Errorf("sources[%d].type: must not be empty", i))
+		}
+	}
+
+	if c.OpenAI.Name == "" {
+		errs = append(errs, errors.New("openai.name: must not be empty"))
+	}
+	if c.OpenAI.APIKey == "" {
+		errs = append(errs, errors.New("openai.api_key: must be set in config, OPENAI_API_KEY or openai.token_file"))
+	}
+	if c.OpenAI.BaseURL == "" {
+		errs = append(errs, errors.New("openai.base_url: must not be empty"))
+	}
+	if c.OpenAI.Temperature < 0 || c.OpenAI.Temperature > 2 {
+		errs = append(errs, fmt.Errorf("openai.temperature: must be in 0..2, got %v", c.OpenAI.Temperature))
+	}
+	if c.OpenAI.MaxTokens <= 0 {
+		errs = append(errs, fmt.Errorf("openai.max_tokens: must be positive, got %d", c.OpenAI.MaxTokens))
+	}
+	if c.OpenAI.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("openai.timeout: must not be negative, got %s", c.OpenAI.Timeout))
+	}
+	names := []string{c.OpenAI.Name}
+	for i, fallback := range c.LLM.Fallbacks {
+		if fallback.Name == "" {
+			errs = append(errs, fmt.Errorf("llm.fallbacks[%d].name: must not be empty", i))
+		} else if slices.Contains(names, fallback.Name) {
+			errs = append(errs, fmt.Errorf("llm.fallbacks[%d].name: provider %q is already defined", i, fallback.Name))
+		}
+		names = append(names, fallback.Name)
+
+		switch fallback.Type {
+		case llm.ProviderOpenAI, llm.ProviderFake:
+		case llm.ProviderOllama:
+			if fallback.BaseURL == "" {
+				errs = append(errs, fmt.Errorf("llm.fallbacks[%d].base_url: must not be empty for the ollama provider", i))
+			}
+			if fallback.Model == "" {
+				errs = append(errs, fmt.Errorf("llm.fallbacks[%d].model: must not be empty for the ollama provider", i))
+			}
+		case llm.ProviderAnthropic:
+			if fallback.APIKey == "" {
+				errs = append(errs, fmt.Errorf("llm.fallbacks[%d].api_key: must be set for the anthropic provider", i))
+			}
+			if fallback.Model == "" {
+				errs = append(errs, fmt.Errorf("llm.fallbacks[%d].model: must not be empty for the anthropic provider", i))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("llm.fallbacks[%d].type: unknown provider %q", i, fallback.Type))
+		}
+		if fallback.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("llm.fallbacks[%d].timeout: must not be negative, got %s", i, fallback.Timeout))
+		}
+	}
+
+	switch c.Embeddings.Provider {
+	case embedding.ProviderHash, "":
+	case embedding.ProviderOpenAI:
+		if c.Embeddings.Model == "" {
+			errs = append(errs, errors.New("embeddings.model: must not be empty for the openai provider"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("embeddings.provider: unknown provider %q", c.Embeddings.Provider))
+	}
+	if c.Chain.MetricsTopK <= 0 {
+		errs = append(errs, fmt.Errorf("chain.metrics_top_k: must be positive, got %d", c.Chain.MetricsTopK))
+	}
+	if c.RAG.Retention < 0 {
+		errs = append(errs, fmt.Errorf("rag.retention: must not be negative, got %s", c.RAG.Retention))
+	}
+	if c.RAG.Path != "" && c.RAG.CleanupInterval <= 0 {
+		errs = append(errs, fmt.Errorf("rag.cleanup_interval: must be positive, got %s", c.RAG.CleanupInterval))
+	}
+	if c.Chain.LogsTopK < 0 || c.Chain.TracesTopK < 0 {
+		errs = append(errs, errors.New("chain.logs_top_k, chain.traces_top_k: must not be negative"))
+	}
+	if c.Chain.MetricIndexRefresh <= 0 {
+		errs = append(errs, fmt.Errorf("chain.metric_index_refresh: must be positive, got %s", c.Chain.MetricIndexRefresh))
+	}
+
+	switch c.Cache.Backend {
+	case chain.CacheMemory, "":
+	case chain.CacheSQLite:
+		if c.Cache.Path == "" {
+			errs = append(errs, errors.New("cache.path: must not be empty for the sqlite backend"))
+		}
+	case chain.CacheRedis:
+		if c.Cache.RedisURL == "" {
+			errs = append(errs, errors.New("cache.redis_url: must not be empty for the redis backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cache.backend: unknown backend %q", c.Cache.Backend))
+	}
+	if c.Cache.TTL <= 0 {
+		errs = append(errs, fmt.Errorf("cache.ttl: must be positive, got %s", c.Cache.TTL))
+	}
+	if c.Cache.MaxEntries <= 0 {
+		errs = append(errs, fmt.Errorf("cache.max_entries: must be positive, got %d", c.Cache.MaxEntries))
+	}
+	if c.Cache.CleanupInterval <= 0 {
+		errs = append(errs, fmt.Errorf("cache.cleanup_interval: must be positive, got %s", c.Cache.CleanupInterval))
+	}
+	if c.Cache.EvidenceTTL <= 0 {
+		errs = append(errs, fmt.Errorf("cache.evidence_ttl: must be positive, got %s", c.Cache.EvidenceTTL))
+	}
+	if c.Cache.EvidenceMaxEntries <= 0 {
+		errs = append(errs, fmt.Errorf("cache.evidence_max_entries: must be positive, got %d", c.Cache.EvidenceMaxEntries))
+	}
+
+	if err := c.ChainConfig().Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// ChainConfig builds the analyzer config from the openai and chain sections
+func (c *Config) ChainConfig() *chain.Config {
+	return &chain.Config{
+		Model:           c.OpenAI.Model,
+		Temperature:     c.OpenAI.Temperature,
+		MaxTokens:       c.OpenAI.MaxTokens,
+		ContextWindow:   c.Chain.ContextWindow,
+		SystemPrompt:    c.Chain.SystemPrompt,
+		MetricsTemplate: c.Chain.MetricsTemplate,
+		LogsTemplate:    c.Chain.LogsTemplate,
+		TracesTemplate:  c.Chain.TracesTemplate,
+
+		ComparisonTemplate: c.Chain.ComparisonTemplate,
+
+		ResponseMode:      c.Chain.ResponseMode,
+		MaxRepairAttempts: c.Chain.MaxRepairAttempts,
+		MetricsTopK:       c.Chain.MetricsTopK,
+		LogsTopK:          c.Chain.LogsTopK,
+		TracesTopK:        c.Chain.TracesTopK,
+		AnomalyBaseline:   c.Chain.AnomalyBaseline,
+		MetricSeriesTopK:  c.Chain.MetricSeriesTopK,
+		DefaultTimeRange:  c.Chain.DefaultTimeRange,
+		SessionTTL:        c.Chain.SessionTTL,
+		MaxSessions:       c.Chain.MaxSessions,
+
+		AgentMaxSteps:         c.Chain.AgentMaxSteps,
+		AgentMaxTokens:        c.Chain.AgentMaxTokens,
+		AgentToolResultTokens: c.Chain.AgentToolResultTokens,
+
+		EvidenceTTL: c.Cache.EvidenceTTL,
+	}
+}
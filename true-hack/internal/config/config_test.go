@@ -0,0 +1,236 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/chain"
+	"true-hack/internal/llm"
+)
+
+// writeConfig writes the shipped config with the replacements applied and returns its path
+func writeConfig(t *testing.T, replacements ...string) string {
+	t.Helper()
+
+	data, err := os.ReadFile("../../configs/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	for i := 0; i+1 < len(replacements); i += 2 {
+		if !strings.Contains(content, replacements[i]) {
+			t.Fatalf("config has no %q", replacements[i])
+		}
+		content = strings.Replace(content, replacements[i], replacements[i+1], 1)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "key")
+
+	cfg, err := Load(writeConfig(t))
+	if err != nil {
+		t.Fatalf("shipped config doesn't load: %v", err)
+	}
+	if cfg.OpenAI.APIKey != "key" {
+		t.Errorf("OpenAI.APIKey = %q, want the one of the environment", cfg.OpenAI.APIKey)
+	}
+	if cfg.OpenAI.Model != "mws-gpt-alpha" {
+		t.Errorf("OpenAI.Model = %q, want the one of the file", cfg.OpenAI.Model)
+	}
+}
+
+func TestLoadUnknownField(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "key")
+
+	_, err := Load(writeConfig(t, `  model: "mws-gpt-alpha"`, `  modle: "mws-gpt-alpha"`))
+	if err == nil || !strings.Contains(err.Error(), "modle") {
+		t.Errorf("Load() = %v, want an error naming the unknown field", err)
+	}
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "key")
+	t.Setenv("OPENAI_MODEL", "gpt-4o")
+	t.Setenv("SERVER_PORT", "9000")
+	t.Setenv("LOKI_QUERY_TIMEOUT", "5s")
+	t.Setenv("CACHE_BACKEND", chain.CacheRedis)
+	t.Setenv("CACHE_REDIS_URL", "redis://redis:6379/0")
+
+	cfg, err := Load(writeConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OpenAI.Model != "gpt-4o" {
+		t.Errorf("OpenAI.Model = %q, want gpt-4o", cfg.OpenAI.Model)
+	}
+	if cfg.Server.Port != 9000 {
+		t.Errorf("Server.Port = %d, want 9000", cfg.Server.Port)
+	}
+	if cfg.Loki.QueryTimeout != 5*time.Second {
+		t.Errorf("Loki.QueryTimeout = %s, want 5s", cfg.Loki.QueryTimeout)
+	}
+	if cfg.Cache.Backend != chain.CacheRedis || cfg.Cache.RedisURL != "redis://redis:6379/0" {
+		t.Errorf("Cache = %q %q, want the redis backend of the environment", cfg.Cache.Backend, cfg.Cache.RedisURL)
+	}
+	if cfg.ChainConfig().Model != "gpt-4o" {
+		t.Errorf("chain model = %q, want the overridden one", cfg.ChainConfig().Model)
+	}
+}
+
+func TestLoadTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	primary := filepath.Join(dir, "primary")
+	fallback := filepath.Join(dir, "fallback")
+	if err := os.WriteFile(primary, []byte("  primary-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fallback, []byte("fallback-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fallbacks := `  fallbacks:
+    - name: anthropic
+      type: anthropic
+      model: "claude-sonnet-4-5"
+      token_file: "` + fallback + `"`
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    string
+		wantErr string
+	}{
+		{name: "key from the file", env: map[string]string{"OPENAI_TOKEN_FILE": primary}, want: "primary-key"},
+		{name: "key of the environment wins", env: map[string]string{"OPENAI_TOKEN_FILE": primary, "OPENAI_API_KEY": "env-key"}, want: "env-key"},
+		{name: "missing file", env: map[string]string{"OPENAI_TOKEN_FILE": filepath.Join(dir, "missing")}, wantErr: "read API key file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OPENAI_API_KEY", "")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := Load(writeConfig(t, "  fallbacks: []", fallbacks))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() = %v, want an error with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.OpenAI.APIKey != tt.want {
+				t.Errorf("OpenAI.APIKey = %q, want %q", cfg.OpenAI.APIKey, tt.want)
+			}
+			if got := cfg.LLM.Fallbacks[0].APIKey; got != "fallback-key" {
+				t.Errorf("fallback APIKey = %q, want the content of its token file", got)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "key")
+	valid, err := Load(writeConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Config) {},
+		},
+		{
+			name: "all problems are reported",
+			modify: func(c *Config) {
+				c.Server.Port = 0
+				c.OpenAI.APIKey = ""
+				c.Cache.TTL = -time.Minute
+			},
+			want: []string{"server.port", "openai.api_key", "cache.ttl"},
+		},
+		{
+			name: "fallbacks",
+			modify: func(c *Config) {
+				c.LLM.Fallbacks = []llm.Config{
+					{Name: c.OpenAI.Name, Type: llm.ProviderOpenAI},
+					{Name: "ollama", Type: llm.ProviderOllama},
+					{Name: "anthropic", Type: llm.ProviderAnthropic},
+					{Name: "other", Type: "gemini"},
+				}
+			},
+			want: []string{
+				"llm.fallbacks[0].name: provider \"mws\" is already defined",
+				"llm.fallbacks[1].base_url",
+				"llm.fallbacks[1].model",
+				"llm.fallbacks[2].api_key",
+				"llm.fallbacks[2].model",
+				"llm.fallbacks[3].type: unknown provider \"gemini\"",
+			},
+		},
+		{
+			name: "cache backends",
+			modify: func(c *Config) {
+				c.Cache.Backend = chain.CacheSQLite
+				c.Cache.Path = ""
+			},
+			want: []string{"cache.path"},
+		},
+		{
+			name: "rag cleanup only matters with a path",
+			modify: func(c *Config) {
+				c.RAG.Path = ""
+				c.RAG.CleanupInterval = 0
+			},
+		},
+		{
+			name: "rag cleanup",
+			modify: func(c *Config) {
+				c.RAG.CleanupInterval = 0
+			},
+			want: []string{"rag.cleanup_interval"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *valid
+			c.LLM.Fallbacks = nil
+			tt.modify(&c)
+
+			err := c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() = nil, want %v", tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() = %v, doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	ProviderOpenAI = "openai"
+	ProviderHash   = "hash"
+)
+
+const (
+	defaultBatchSize  = 256
+	defaultDimensions = 512
+)
+
+// Embedder turns texts into vectors, the vectors of a single Embedder are comparable with Cosine
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+type Config struct {
+	// Provider is ProviderOpenAI or ProviderHash
+	Provider string `yaml:"provider" env:"PROVIDER"`
+	// Model is the embeddings model of the OpenAI-compatible API
+	Model string `yaml:"model" env:"MODEL"`
+	// BatchSize limits the number of texts in a single embeddings request
+	BatchSize int `yaml:"batch_size" env:"BATCH_SIZE"`
+	// Dimensions is the vector size of the hash embedder
+	Dimensions int `yaml:"dimensions" env:"DIMENSIONS"`
+}
+
+// New creates an embedder for the configured provider, client is only used by ProviderOpenAI
+func New(cfg Config, client *openai.Client) (Embedder, error) {
+	switch cfg.Provider {
+	case ProviderOpenAI:
+		if cfg.Model == "" {
+			return nil, fmt.Errorf("embeddings model is required for provider %q", cfg.Provider)
+		}
+		return NewOpenAIEmbedder(client, cfg.Model, cfg.BatchSize), nil
+	case ProviderHash, "":
+		return NewHashEmbedder(cfg.Dimensions), nil
+	default:
+		return nil, fmt.Errorf("unknown embeddings provider %q", cfg.Provider)
+	}
+}
+
+// OpenAIEmbedder uses the /embeddings endpoint of an OpenAI-compatible API
+type OpenAIEmbedder struct {
+	client    *openai.Client
+	model     openai.EmbeddingModel
+	batchSize int
+}
+
+func NewOpenAIEmbedder(client *openai.Client, model string, batchSize int) *OpenAIEmbedder {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	return &OpenAIEmbedder{
+		client:    client,
+		model:     openai.EmbeddingModel(model),
+		batchSize: batchSize,
+	}
+}
+
+func (e *OpenAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	result := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += e.batchSize {
+		batch := texts[start:min(start+e.batchSize, len(texts))]
+
+		resp, err := e.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+			Input: batch,
+			Model: e.model,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create embeddings: %w", err)
+		}
+		if len(resp.Data) != len(batch) {
+			return nil, fmt.Errorf("create embeddings: got %d vectors for %d texts", len(resp.Data), len(batch))
+		}
+
+		vectors := make([][]float32, len(batch))
+		for _, item := range resp.Data {
+			if item.Index < 0 || item.Index >= len(batch) {
+				return nil, fmt.Errorf("create embeddings: unexpected index %d", item.Index)
+			}
+			vectors[item.Index] = normalize(item.Embedding)
+		}
+		result = append(result, vectors...)
+	}
+
+	return result, nil
+}
+
+// HashEmbedder is a local stand-in for an embeddings model. It hashes words and their
+// character trigrams into a fixed size vector, so texts sharing words or word parts
+// (grpc_server_handled_total and "grpc handled requests") end up close to each other.
+type HashEmbedder struct {
+	dimensions int
+}
+
+func NewHashEmbedder(dimensions int) *HashEmbedder {
+	if dimensions <= 0 {
+		dimensions = defaultDimensions
+	}
+	return &HashEmbedder{dimensions: dimensions}
+}
+
+func (e *HashEmbedder) Embed(_ context.Context, texts []string) ([][]float32, error) {
+	result := make([][]float32, len(texts))
+	for i, text := range texts {
+		result[i] = e.embed(text)
+	}
+	return result, nil
+}
+
+func (e *HashEmbedder) embed(text string) []float32 {
+	vector := make([]float32, e.dimensions)
+
+	for _, word := range Tokenize(text) {
+		e.add(vector, "w:"+word, 1)
+
+		padded := "^" + word + "$"
+		for i := 0; i+3 <= len(padded); i++ {
+			e.add(vector, "t:"+padded[i:i+3], 0.5)
+		}
+	}
+
+	return normalize(vector)
+}
+
+func (e *HashEmbedder) add(vector []float32, feature string, weight float32) {
+	h := fnv.New64a()
+	h.Write([]byte(feature))
+	sum := h.Sum64()
+
+	// The highest bit picks the sign, which keeps collisions from only adding up
+	if sum>>63 == 1 {
+		weight = -weight
+	}
+	vector[sum%uint64(len(vector))] += weight
+}
+
+// Tokenize splits text into lower-cased words, snake_case and camelCase parts are separate words
+func Tokenize(text string) []string {
+	var words []string
+	var current []rune
+
+	flush := func() {
+		if len(current) > 0 {
+			words = append(words, strings.ToLower(string(current)))
+			current = current[:0]
+		}
+	}
+
+	runes := []rune(text)
+	for i, r := range runes {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			// GetLeaderboard -> get, leaderboard
+			if unicode.IsUpper(r) && len(current) > 0 && i > 0 && unicode.IsLower(runes[i-1]) {
+				flush()
+			}
+			current = append(current, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return words
+}
+
+// Cosine returns the cosine similarity of two vectors
+func Cosine(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return float32(dot / math.Sqrt(normA*normB))
+}
+
+func normalize(vector []float32) []float32 {
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return vector
+	}
+
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+	return vector
+}
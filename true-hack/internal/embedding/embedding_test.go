@@ -0,0 +1,190 @@
+package embedding
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func norm(vector []float32) float64 {
+	var sum float64
+	for _, v := range vector {
+		sum += float64(v) * float64(v)
+	}
+	return math.Sqrt(sum)
+}
+
+func TestHashEmbedder(t *testing.T) {
+	e := NewHashEmbedder(128)
+	texts := []string{
+		"grpc_server_handled_total",
+		"grpc handled requests",
+		"node_memory_bytes",
+		"",
+	}
+	vectors, err := e.Embed(t.Context(), texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := e.Embed(t.Context(), texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, vector := range vectors {
+		if len(vector) != 128 {
+			t.Fatalf("vector %d has %d dimensions, want 128", i, len(vector))
+		}
+		if !slices.Equal(vector, again[i]) {
+			t.Errorf("vector of %q differs between calls", texts[i])
+		}
+	}
+	for i := range 3 {
+		if n := norm(vectors[i]); math.Abs(n-1) > 1e-6 {
+			t.Errorf("vector of %q has norm %v, want 1", texts[i], n)
+		}
+	}
+	// Nothing to hash, the vector stays zero instead of becoming NaN
+	if n := norm(vectors[3]); n != 0 {
+		t.Errorf("empty text has norm %v, want 0", n)
+	}
+
+	related := Cosine(vectors[0], vectors[1])
+	unrelated := Cosine(vectors[0], vectors[2])
+	if related <= unrelated {
+		t.Errorf("similarity of related texts %v is not above unrelated %v", related, unrelated)
+	}
+	if got := Cosine(vectors[0], vectors[0][:64]); got != 0 {
+		t.Errorf("Cosine() of different lengths = %v, want 0", got)
+	}
+
+	if got := len(NewHashEmbedder(0).embed("up")); got != defaultDimensions {
+		t.Errorf("default dimensions = %d, want %d", got, defaultDimensions)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "grpc_server_handled_total", want: []string{"grpc", "server", "handled", "total"}},
+		{text: "GetLeaderboard", want: []string{"get", "leaderboard"}},
+		{text: "HTTPServer 5xx errors!", want: []string{"httpserver", "5xx", "errors"}},
+		{text: "  ", want: nil},
+	}
+
+	for _, tt := range tests {
+		if got := Tokenize(tt.text); !slices.Equal(got, tt.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// fakeEmbeddings serves /embeddings, every text gets the vector [len(text), 0] unless reorder is set,
+// then vectors come in reverse order. It records the requests.
+func fakeEmbeddings(t *testing.T, reorder, short bool) (*openai.Client, *[]openai.EmbeddingRequest) {
+	t.Helper()
+
+	var requests []openai.EmbeddingRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Input []string `json:"input"`
+			Model string   `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		requests = append(requests, openai.EmbeddingRequest{Input: req.Input, Model: openai.EmbeddingModel(req.Model)})
+
+		var data []string
+		for i, text := range req.Input {
+			if short && i > 0 {
+				break
+			}
+			data = append(data, fmt.Sprintf(`{"object": "embedding", "index": %d, "embedding": [%d, 0]}`, i, len(text)))
+		}
+		if reorder {
+			slices.Reverse(data)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"object": "list", "model": %q, "data": [%s]}`, req.Model, strings.Join(data, ","))
+	}))
+	t.Cleanup(server.Close)
+
+	config := openai.DefaultConfig("key")
+	config.BaseURL = server.URL + "/v1"
+	return openai.NewClientWithConfig(config), &requests
+}
+
+func TestOpenAIEmbedder(t *testing.T) {
+	texts := []string{"a", "bb", "ccc"}
+
+	t.Run("batches keep the order of texts", func(t *testing.T) {
+		client, requests := fakeEmbeddings(t, true, false)
+		e := NewOpenAIEmbedder(client, "text-embedding-3-small", 2)
+
+		vectors, err := e.Embed(t.Context(), texts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*requests) != 2 {
+			t.Fatalf("made %d requests, want 2 batches", len(*requests))
+		}
+		for i, want := range [][]string{{"a", "bb"}, {"ccc"}} {
+			req := (*requests)[i]
+			if !slices.Equal(req.Input.([]string), want) || req.Model != "text-embedding-3-small" {
+				t.Errorf("request %d = %+v, want input %q", i, req, want)
+			}
+		}
+		// Vectors are normalized and matched with their texts by index
+		for i, vector := range vectors {
+			if !slices.Equal(vector, []float32{1, 0}) {
+				t.Errorf("vector of %q = %v, want [1 0]", texts[i], vector)
+			}
+		}
+	})
+
+	t.Run("missing vectors fail", func(t *testing.T) {
+		client, _ := fakeEmbeddings(t, false, true)
+		e := NewOpenAIEmbedder(client, "text-embedding-3-small", 0)
+
+		if _, err := e.Embed(t.Context(), texts); err == nil || !strings.Contains(err.Error(), "got 1 vectors for 3 texts") {
+			t.Errorf("Embed() error = %v, want a count mismatch", err)
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "hash by default", cfg: Config{}},
+		{name: "hash", cfg: Config{Provider: ProviderHash, Dimensions: 64}},
+		{name: "openai", cfg: Config{Provider: ProviderOpenAI, Model: "text-embedding-3-small"}},
+		{name: "openai without model", cfg: Config{Provider: ProviderOpenAI}, wantErr: true},
+		{name: "unknown provider", cfg: Config{Provider: "other"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg, openai.NewClient("key"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
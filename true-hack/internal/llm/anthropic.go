@@ -0,0 +1,322 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultAnthropicURL = "https://api.anthropic.com"
+	anthropicVersion    = "2023-06-01"
+	// defaultAnthropicMaxTokens is sent when the request has no limit, the API requires one
+	defaultAnthropicMaxTokens = 4096
+)
+
+// Anthropic uses the /v1/messages API. It has no JSON mode, the schema instruction in the
+// prompt is relied on instead.
+type Anthropic struct {
+	name    string
+	client  *http.Client
+	url     string
+	apiKey  string
+	model   string
+	timeout time.Duration
+}
+
+// NewAnthropic creates a provider for the API at baseURL, the public one if empty
+func NewAnthropic(name, baseURL, apiKey, model string, timeout time.Duration) *Anthropic {
+	if baseURL == "" {
+		baseURL = defaultAnthropicURL
+	}
+	return &Anthropic{
+		name:    name,
+		client:  &http.Client{},
+		url:     strings.TrimSuffix(baseURL, "/") + "/v1/messages",
+		apiKey:  apiKey,
+		model:   model,
+		timeout: timeout,
+	}
+}
+
+func (a *Anthropic) Name() string {
+	return a.name
+}
+
+type anthropicRequest struct {
+	Model       string               `json:"model"`
+	System      string               `json:"system,omitempty"`
+	Messages    []anthropicMessage   `json:"messages"`
+	MaxTokens   int                  `json:"max_tokens"`
+	Temperature float32              `json:"temperature"`
+	Tools       []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice  *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Stream      bool                 `json:"stream,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+// anthropicBlock is a content block: text, tool_use or tool_result
+type anthropicBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	// ID and Name identify a tool_use, Input are its arguments
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// ToolUseID and Content are the result of a tool_use
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type anthropicResponse struct {
+	Content []anthropicBlock `json:"content"`
+}
+
+type anthropicError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicEvent is an event of a streamed answer
+type anthropicEvent struct {
+	Type         string         `json:"type"`
+	Index        int            `json:"index"`
+	ContentBlock anthropicBlock `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+	} `json:"delta"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (a *Anthropic) Complete(ctx context.Context, req openai.ChatCompletionRequest, onDelta func(string)) (openai.ChatCompletionMessage, error) {
+	ctx, cancel := withTimeout(ctx, a.timeout)
+	defer cancel()
+
+	body := anthropicRequest{
+		Model:     req.Model,
+		MaxTokens: req.MaxTokens,
+		// The API accepts 0..1 only
+		Temperature: min(req.Temperature, 1),
+		Stream:      onDelta != nil,
+	}
+	if a.model != "" {
+		body.Model = a.model
+	}
+	if body.MaxTokens <= 0 {
+		body.MaxTokens = defaultAnthropicMaxTokens
+	}
+	body.System, body.Messages = anthropicMessages(req.Messages)
+	for _, tool := range req.Tools {
+		if tool.Function == nil {
+			continue
+		}
+		body.Tools = append(body.Tools, anthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: tool.Function.Parameters,
+		})
+	}
+	if name := forcedFunction(req); name != "" {
+		body.ToolChoice = &anthropicToolChoice{Type: "tool", Name: name}
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, fmt.Errorf("encode messages request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(payload))
+	if err != nil {
+		return openai.ChatCompletionMessage{}, fmt.Errorf("create messages request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Api-Key", a.apiKey)
+	httpReq.Header.Set("Anthropic-Version", anthropicVersion)
+
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, fmt.Errorf("send messages request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		var errResp anthropicError
+		if json.Unmarshal(data, &errResp) == nil && errResp.Error.Message != "" {
+			return openai.ChatCompletionMessage{}, fmt.Errorf("messages request failed with status %d: %s: %s",
+				resp.StatusCode, errResp.Error.Type, errResp.Error.Message)
+		}
+		return openai.ChatCompletionMessage{}, fmt.Errorf("messages request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	if onDelta == nil {
+		var result anthropicResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return openai.ChatCompletionMessage{}, fmt.Errorf("decode messages response: %w", err)
+		}
+		return openaiMessage(result.Content), nil
+	}
+
+	blocks, err := receiveAnthropicStream(resp.Body, onDelta)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, err
+	}
+	return openaiMessage(blocks), nil
+}
+
+// receiveAnthropicStream assembles the content blocks from the Server-Sent Events of the answer
+func receiveAnthropicStream(body io.Reader, onDelta func(string)) ([]anthropicBlock, error) {
+	var blocks []anthropicBlock
+	// Tool arguments arrive as pieces of JSON, they are only valid together
+	var inputs []string
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+			return nil, fmt.Errorf("decode messages event: %w", err)
+		}
+
+		switch event.Type {
+		case "content_block_start":
+			for event.Index >= len(blocks) {
+				blocks = append(blocks, anthropicBlock{})
+				inputs = append(inputs, "")
+			}
+			blocks[event.Index] = event.ContentBlock
+			blocks[event.Index].Input = nil
+		case "content_block_delta":
+			if event.Index >= len(blocks) {
+				return nil, fmt.Errorf("messages event for unknown content block %d", event.Index)
+			}
+			switch event.Delta.Type {
+			case "text_delta":
+				blocks[event.Index].Text += event.Delta.Text
+				onDelta(event.Delta.Text)
+			case "input_json_delta":
+				inputs[event.Index] += event.Delta.PartialJSON
+				onDelta(event.Delta.PartialJSON)
+			}
+		case "error":
+			return nil, fmt.Errorf("messages stream failed: %s: %s", event.Error.Type, event.Error.Message)
+		case "message_stop":
+			for i := range blocks {
+				if blocks[i].Type == "tool_use" {
+					blocks[i].Input = json.RawMessage(inputs[i])
+				}
+			}
+			return blocks, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("receive messages stream: %w", err)
+	}
+	return nil, errors.New("messages stream ended before the message stopped")
+}
+
+// anthropicMessages translates the messages: system messages become the system prompt, tool
+// calls and their results become content blocks. Consecutive messages of the same role are
+// merged, the API requires the roles to alternate.
+func anthropicMessages(messages []openai.ChatCompletionMessage) (string, []anthropicMessage) {
+	var system []string
+	var result []anthropicMessage
+	for _, message := range messages {
+		role := message.Role
+		var blocks []anthropicBlock
+		switch message.Role {
+		case openai.ChatMessageRoleSystem:
+			system = append(system, message.Content)
+			continue
+		case openai.ChatMessageRoleTool:
+			role = openai.ChatMessageRoleUser
+			blocks = append(blocks, anthropicBlock{Type: "tool_result", ToolUseID: message.ToolCallID, Content: message.Content})
+		case openai.ChatMessageRoleAssistant:
+			if message.Content != "" {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: message.Content})
+			}
+			for _, call := range message.ToolCalls {
+				input := json.RawMessage(call.Function.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+			}
+		default:
+			role = openai.ChatMessageRoleUser
+			blocks = append(blocks, anthropicBlock{Type: "text", Text: message.Content})
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		if len(result) > 0 && result[len(result)-1].Role == role {
+			result[len(result)-1].Content = append(result[len(result)-1].Content, blocks...)
+			continue
+		}
+		result = append(result, anthropicMessage{Role: role, Content: blocks})
+	}
+	return strings.Join(system, "\n\n"), result
+}
+
+// openaiMessage translates the content blocks of an answer
+func openaiMessage(blocks []anthropicBlock) openai.ChatCompletionMessage {
+	message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	var content strings.Builder
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			content.WriteString(block.Text)
+		case "tool_use":
+			arguments := string(block.Input)
+			if arguments == "" {
+				arguments = "{}"
+			}
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+				ID:   block.ID,
+				Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{
+					Name:      block.Name,
+					Arguments: arguments,
+				},
+			})
+		}
+	}
+	message.Content = content.String()
+	return message
+}
@@ -0,0 +1,262 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// fakeAnthropic serves /v1/messages with the status and body, a streaming request gets the body
+// as Server-Sent Events. It records the requests.
+func fakeAnthropic(t *testing.T, status int, body string) (*Anthropic, *[]anthropicRequest) {
+	t.Helper()
+
+	var requests []anthropicRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Api-Key") != "key" || r.Header.Get("Anthropic-Version") != anthropicVersion {
+			t.Errorf("headers = %v", r.Header)
+		}
+		var req anthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		requests = append(requests, req)
+
+		w.Header().Set("Content-Type", "application/json")
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	return NewAnthropic("claude", server.URL+"/", "key", "claude-sonnet-4-5", 0), &requests
+}
+
+// anthropicStream frames events the way the API streams them
+func anthropicStream(events ...string) string {
+	var b strings.Builder
+	for _, event := range events {
+		var head struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal([]byte(event), &head)
+		fmt.Fprintf(&b, "event: %s\ndata: %s\n\n", head.Type, event)
+	}
+	return b.String()
+}
+
+func TestAnthropicComplete(t *testing.T) {
+	req := openai.ChatCompletionRequest{
+		Model:       "gpt-4o",
+		Temperature: 1.5,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: "You analyze incidents."},
+			{Role: openai.ChatMessageRoleUser, Content: "Why does the api fail?"},
+		},
+	}
+
+	t.Run("plain completion", func(t *testing.T) {
+		provider, requests := fakeAnthropic(t, http.StatusOK,
+			`{"id": "msg_1", "role": "assistant", "content": [{"type": "text", "text": "Errors "}, {"type": "text", "text": "started"}]}`)
+
+		message, err := provider.Complete(t.Context(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Role != openai.ChatMessageRoleAssistant || message.Content != "Errors started" || len(message.ToolCalls) != 0 {
+			t.Errorf("message = %+v", message)
+		}
+
+		got := (*requests)[0]
+		if got.Model != "claude-sonnet-4-5" || got.System != "You analyze incidents." || got.Stream {
+			t.Errorf("request = %+v", got)
+		}
+		// The API requires a limit and a temperature up to 1
+		if got.MaxTokens != defaultAnthropicMaxTokens || got.Temperature != 1 {
+			t.Errorf("max tokens %d, temperature %v", got.MaxTokens, got.Temperature)
+		}
+		if len(got.Messages) != 1 || got.Messages[0].Role != "user" || got.Messages[0].Content[0].Text != "Why does the api fail?" {
+			t.Errorf("messages = %+v", got.Messages)
+		}
+	})
+
+	t.Run("tool call", func(t *testing.T) {
+		provider, requests := fakeAnthropic(t, http.StatusOK, `{"content": [
+			{"type": "text", "text": "Checking errors"},
+			{"type": "tool_use", "id": "toolu_1", "name": "query_promql", "input": {"query": "up"}}
+		]}`)
+
+		toolReq := req
+		toolReq.MaxTokens = 512
+		toolReq.Tools = []openai.Tool{
+			{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+				Name:        "query_promql",
+				Description: "Runs a PromQL query",
+				Parameters:  json.RawMessage(`{"type": "object"}`),
+			}},
+			// Only functions are translated
+			{Type: "other"},
+		}
+		toolReq.ToolChoice = openai.ToolChoice{Type: openai.ToolTypeFunction, Function: openai.ToolFunction{Name: "query_promql"}}
+
+		message, err := provider.Complete(t.Context(), toolReq, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := openai.ToolCall{ID: "toolu_1", Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: "query_promql", Arguments: `{"query": "up"}`}}
+		if message.Content != "Checking errors" || len(message.ToolCalls) != 1 || message.ToolCalls[0].ID != want.ID ||
+			message.ToolCalls[0].Function != want.Function {
+			t.Errorf("message = %+v, want the tool call %+v", message, want)
+		}
+
+		got := (*requests)[0]
+		if len(got.Tools) != 1 || got.Tools[0].Name != "query_promql" || got.Tools[0].Description != "Runs a PromQL query" {
+			t.Errorf("tools = %+v", got.Tools)
+		}
+		if schema, _ := json.Marshal(got.Tools[0].InputSchema); string(schema) != `{"type":"object"}` {
+			t.Errorf("input schema = %s", schema)
+		}
+		if got.ToolChoice == nil || *got.ToolChoice != (anthropicToolChoice{Type: "tool", Name: "query_promql"}) || got.MaxTokens != 512 {
+			t.Errorf("tool choice = %+v, max tokens %d", got.ToolChoice, got.MaxTokens)
+		}
+	})
+
+	t.Run("streamed response", func(t *testing.T) {
+		provider, requests := fakeAnthropic(t, http.StatusOK, anthropicStream(
+			`{"type": "message_start", "message": {"id": "msg_1", "role": "assistant", "content": []}}`,
+			`{"type": "content_block_start", "index": 0, "content_block": {"type": "text", "text": ""}}`,
+			`{"type": "ping"}`,
+			`{"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "Errors "}}`,
+			`{"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "started"}}`,
+			`{"type": "content_block_stop", "index": 0}`,
+			`{"type": "content_block_start", "index": 1, "content_block": {"type": "tool_use", "id": "toolu_1", "name": "get_trace", "input": {}}}`,
+			`{"type": "content_block_delta", "index": 1, "delta": {"type": "input_json_delta", "partial_json": "{\"trace_id\": "}}`,
+			`{"type": "content_block_delta", "index": 1, "delta": {"type": "input_json_delta", "partial_json": "\"t1\"}"}}`,
+			`{"type": "content_block_stop", "index": 1}`,
+			`{"type": "message_delta", "delta": {"stop_reason": "tool_use"}}`,
+			`{"type": "message_stop"}`,
+		))
+
+		var deltas []string
+		message, err := provider.Complete(t.Context(), req, func(text string) { deltas = append(deltas, text) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Content != "Errors started" || len(message.ToolCalls) != 1 ||
+			message.ToolCalls[0].Function != (openai.FunctionCall{Name: "get_trace", Arguments: `{"trace_id": "t1"}`}) {
+			t.Errorf("message = %+v", message)
+		}
+		if !slices.Equal(deltas, []string{"Errors ", "started", `{"trace_id": `, `"t1"}`}) {
+			t.Errorf("deltas = %q", deltas)
+		}
+		if !(*requests)[0].Stream {
+			t.Error("request doesn't stream")
+		}
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			status  int
+			body    string
+			stream  bool
+			wantErr string
+		}{
+			{
+				name:    "api error",
+				status:  http.StatusTooManyRequests,
+				body:    `{"type": "error", "error": {"type": "rate_limit_error", "message": "slow down"}}`,
+				wantErr: "messages request failed with status 429: rate_limit_error: slow down",
+			},
+			{
+				name:    "error without details",
+				status:  http.StatusBadGateway,
+				body:    "bad gateway\n",
+				wantErr: "messages request failed with status 502: bad gateway",
+			},
+			{
+				name:    "error event",
+				status:  http.StatusOK,
+				body:    anthropicStream(`{"type": "error", "error": {"type": "overloaded_error", "message": "Overloaded"}}`),
+				stream:  true,
+				wantErr: "messages stream failed: overloaded_error: Overloaded",
+			},
+			{
+				name:    "stream cut short",
+				status:  http.StatusOK,
+				body:    anthropicStream(`{"type": "content_block_start", "index": 0, "content_block": {"type": "text", "text": ""}}`),
+				stream:  true,
+				wantErr: "messages stream ended before the message stopped",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				provider, _ := fakeAnthropic(t, tt.status, tt.body)
+				var onDelta func(string)
+				if tt.stream {
+					onDelta = func(string) {}
+				}
+				if _, err := provider.Complete(t.Context(), req, onDelta); err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Complete() error = %v, want %q", err, tt.wantErr)
+				}
+			})
+		}
+	})
+}
+
+func TestAnthropicMessages(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "You analyze incidents."},
+		{Role: openai.ChatMessageRoleUser, Content: "Why does the api fail?"},
+		{Role: openai.ChatMessageRoleSystem, Content: "Answer in JSON."},
+		{Role: openai.ChatMessageRoleAssistant, Content: "Checking", ToolCalls: []openai.ToolCall{
+			{ID: "call_1", Function: openai.FunctionCall{Name: "query_promql", Arguments: `{"query": "up"}`}},
+			{ID: "call_2", Function: openai.FunctionCall{Name: "get_trace", Arguments: `{"trace_id": `}},
+		}},
+		{Role: openai.ChatMessageRoleTool, ToolCallID: "call_1", Content: "up 1"},
+		{Role: openai.ChatMessageRoleTool, ToolCallID: "call_2", Content: "trace t1"},
+		{Role: openai.ChatMessageRoleUser, Content: "Continue"},
+		// Nothing to send
+		{Role: openai.ChatMessageRoleAssistant},
+	}
+
+	system, got := anthropicMessages(messages)
+	if system != "You analyze incidents.\n\nAnswer in JSON." {
+		t.Errorf("system = %q", system)
+	}
+
+	// Tool results and the next question are one user message, the roles alternate
+	want := []anthropicMessage{
+		{Role: "user", Content: []anthropicBlock{{Type: "text", Text: "Why does the api fail?"}}},
+		{Role: "assistant", Content: []anthropicBlock{
+			{Type: "text", Text: "Checking"},
+			{Type: "tool_use", ID: "call_1", Name: "query_promql", Input: json.RawMessage(`{"query": "up"}`)},
+			// Arguments that aren't JSON would be rejected
+			{Type: "tool_use", ID: "call_2", Name: "get_trace", Input: json.RawMessage(`{}`)},
+		}},
+		{Role: "user", Content: []anthropicBlock{
+			{Type: "tool_result", ToolUseID: "call_1", Content: "up 1"},
+			{Type: "tool_result", ToolUseID: "call_2", Content: "trace t1"},
+			{Type: "text", Text: "Continue"},
+		}},
+	}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("messages = %s\nwant %s", gotJSON, wantJSON)
+	}
+}
@@ -0,0 +1,124 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Fake answers with fixed texts in order, the last one is repeated. A request forcing a function
+// call gets the text as the arguments of that call. With Record it keeps the requests it got.
+type Fake struct {
+	name      string
+	answers   []string
+	toolCalls map[int][]openai.FunctionCall
+	err       error
+	record    bool
+
+	mu       sync.Mutex
+	calls    int
+	requests []openai.ChatCompletionRequest
+}
+
+func NewFake(name string, answers ...string) *Fake {
+	return &Fake{name: name, answers: answers}
+}
+
+// FailWith makes every request fail with err, e.g. to exercise fallbacks
+func (f *Fake) FailWith(err error) *Fake {
+	f.err = err
+	return f
+}
+
+// CallTools makes the n-th request, counting from 1, answer with calls of the functions instead
+// of a text, like a model querying tools. A request forcing a function still gets that call.
+func (f *Fake) CallTools(n int, calls ...openai.FunctionCall) *Fake {
+	if f.toolCalls == nil {
+		f.toolCalls = make(map[int][]openai.FunctionCall)
+	}
+	f.toolCalls[n] = calls
+	return f
+}
+
+// Record makes the fake keep its requests for Requests. It is meant for tests, a configured
+// fake provider would accumulate them for as long as the process runs.
+func (f *Fake) Record() *Fake {
+	f.record = true
+	return f
+}
+
+func (f *Fake) Name() string {
+	return f.name
+}
+
+func (f *Fake) Complete(ctx context.Context, req openai.ChatCompletionRequest, onDelta func(string)) (openai.ChatCompletionMessage, error) {
+	f.mu.Lock()
+	f.calls++
+	n := f.calls
+	if f.record {
+		f.requests = append(f.requests, req)
+	}
+	f.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return openai.ChatCompletionMessage{}, err
+	}
+	if f.err != nil {
+		return openai.ChatCompletionMessage{}, f.err
+	}
+	if len(f.answers) == 0 {
+		return openai.ChatCompletionMessage{}, errors.New("fake provider has no answers")
+	}
+
+	message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	calls, ok := f.toolCalls[n]
+	if ok && forcedFunction(req) == "" {
+		for i, call := range calls {
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+				ID:       fmt.Sprintf("call_%d_%d", n, i),
+				Type:     openai.ToolTypeFunction,
+				Function: call,
+			})
+		}
+		return message, nil
+	}
+
+	answer := f.answers[min(n, len(f.answers))-1]
+	if onDelta != nil {
+		onDelta(answer)
+	}
+
+	if name := forcedFunction(req); name != "" {
+		message.ToolCalls = []openai.ToolCall{{
+			ID:   fmt.Sprintf("call_%d", n),
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      name,
+				Arguments: answer,
+			},
+		}}
+	} else {
+		message.Content = answer
+	}
+	return message, nil
+}
+
+// Calls returns the number of requests made so far
+func (f *Fake) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls
+}
+
+// Requests returns the requests made so far if the fake records them
+func (f *Fake) Requests() []openai.ChatCompletionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.requests)
+}
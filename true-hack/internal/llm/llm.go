@@ -0,0 +1,103 @@
+// Package llm talks to chat models of different providers. Requests and answers use the types
+// of the OpenAI API, the other providers translate them to their own.
+package llm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// ProviderOpenAI is any OpenAI-compatible chat completions API
+	ProviderOpenAI = "openai"
+	// ProviderOllama is the native /api/chat of Ollama
+	ProviderOllama = "ollama"
+	// ProviderAnthropic is the /v1/messages API of Anthropic
+	ProviderAnthropic = "anthropic"
+	// ProviderFake answers with a fixed text, for tests and running without a model
+	ProviderFake = "fake"
+)
+
+// LLM is a chat model
+type LLM interface {
+	// Name identifies the provider in logs and answers
+	Name() string
+	// Complete sends a chat request, the model of the provider overrides req.Model if set.
+	// With a non-nil onDelta the answer is streamed, every piece of the text and of tool call
+	// arguments is passed to it as soon as it arrives.
+	Complete(ctx context.Context, req openai.ChatCompletionRequest, onDelta func(string)) (openai.ChatCompletionMessage, error)
+}
+
+type Config struct {
+	// Name identifies the provider, it must be unique
+	Name string `yaml:"name"`
+	// Type is ProviderOpenAI, ProviderOllama, ProviderAnthropic or ProviderFake
+	Type    string `yaml:"type"`
+	BaseURL string `yaml:"base_url"`
+	APIKey  string `yaml:"api_key"`
+	// TokenFile is read when APIKey is empty
+	TokenFile string `yaml:"token_file"`
+	// Model overrides the model of the analyzer, it is required for Ollama and Anthropic as they
+	// don't serve the OpenAI models
+	Model string `yaml:"model"`
+	// Timeout bounds a single request, zero means no limit
+	Timeout time.Duration `yaml:"timeout"`
+	// Answer is what the fake provider answers
+	Answer string `yaml:"answer"`
+}
+
+// New creates the provider of the configured type
+func New(cfg Config) (LLM, error) {
+	switch cfg.Type {
+	case ProviderOpenAI:
+		clientConfig := openai.DefaultConfig(cfg.APIKey)
+		if cfg.BaseURL != "" {
+			clientConfig.BaseURL = cfg.BaseURL
+		}
+		return NewOpenAI(cfg.Name, openai.NewClientWithConfig(clientConfig), cfg.Model, cfg.Timeout), nil
+	case ProviderOllama:
+		if cfg.BaseURL == "" {
+			return nil, fmt.Errorf("provider %q: base url is required", cfg.Name)
+		}
+		if cfg.Model == "" {
+			return nil, fmt.Errorf("provider %q: model is required", cfg.Name)
+		}
+		return NewOllama(cfg.Name, cfg.BaseURL, cfg.APIKey, cfg.Model, cfg.Timeout), nil
+	case ProviderAnthropic:
+		if cfg.APIKey == "" {
+			return nil, fmt.Errorf("provider %q: api key is required", cfg.Name)
+		}
+		if cfg.Model == "" {
+			return nil, fmt.Errorf("provider %q: model is required", cfg.Name)
+		}
+		return NewAnthropic(cfg.Name, cfg.BaseURL, cfg.APIKey, cfg.Model, cfg.Timeout), nil
+	case ProviderFake:
+		return NewFake(cfg.Name, cfg.Answer), nil
+	default:
+		return nil, fmt.Errorf("provider %q: unknown type %q", cfg.Name, cfg.Type)
+	}
+}
+
+// withTimeout bounds a request by the timeout of the provider, zero means no limit
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// forcedFunction is the function the request forces the model to call, if any
+func forcedFunction(req openai.ChatCompletionRequest) string {
+	switch choice := req.ToolChoice.(type) {
+	case openai.ToolChoice:
+		return choice.Function.Name
+	case *openai.ToolChoice:
+		if choice != nil {
+			return choice.Function.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,33 @@
+package llm
+
+import "testing"
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "openai inherits the model", cfg: Config{Name: "backup", Type: ProviderOpenAI}},
+		{name: "ollama", cfg: Config{Name: "local", Type: ProviderOllama, BaseURL: "http://ollama:11434", Model: "llama3.1"}},
+		{name: "ollama without model", cfg: Config{Name: "local", Type: ProviderOllama, BaseURL: "http://ollama:11434"}, wantErr: true},
+		{name: "ollama without base url", cfg: Config{Name: "local", Type: ProviderOllama, Model: "llama3.1"}, wantErr: true},
+		{name: "anthropic", cfg: Config{Name: "claude", Type: ProviderAnthropic, APIKey: "key", Model: "claude-sonnet-4-5"}},
+		{name: "anthropic without model", cfg: Config{Name: "claude", Type: ProviderAnthropic, APIKey: "key"}, wantErr: true},
+		{name: "anthropic without api key", cfg: Config{Name: "claude", Type: ProviderAnthropic, Model: "claude-sonnet-4-5"}, wantErr: true},
+		{name: "fake", cfg: Config{Name: "fake", Type: ProviderFake, Answer: "{}"}},
+		{name: "unknown type", cfg: Config{Name: "other", Type: "other"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := New(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && provider.Name() != tt.cfg.Name {
+				t.Errorf("Name() = %q, want %q", provider.Name(), tt.cfg.Name)
+			}
+		})
+	}
+}
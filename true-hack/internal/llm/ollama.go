@@ -0,0 +1,203 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Ollama uses the native /api/chat endpoint of Ollama. It has no tool choice, a forced function
+// is only offered, the model may answer with text instead.
+type Ollama struct {
+	name    string
+	client  *http.Client
+	url     string
+	apiKey  string
+	model   string
+	timeout time.Duration
+}
+
+// NewOllama creates a provider for the server at baseURL, e.g. http://ollama:11434. The api key
+// is only needed behind an authenticating proxy.
+func NewOllama(name, baseURL, apiKey, model string, timeout time.Duration) *Ollama {
+	return &Ollama{
+		name:    name,
+		client:  &http.Client{},
+		url:     strings.TrimSuffix(baseURL, "/") + "/api/chat",
+		apiKey:  apiKey,
+		model:   model,
+		timeout: timeout,
+	}
+}
+
+func (o *Ollama) Name() string {
+	return o.name
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []openai.Tool   `json:"tools,omitempty"`
+	Format   string          `json:"format,omitempty"`
+	Stream   bool            `json:"stream"`
+	Options  ollamaOptions   `json:"options"`
+}
+
+type ollamaOptions struct {
+	Temperature float32 `json:"temperature"`
+	NumPredict  int     `json:"num_predict,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	// ToolName tells which tool a tool message is the result of
+	ToolName string `json:"tool_name,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaResponse struct {
+	Message ollamaMessage `json:"message"`
+	Done    bool          `json:"done"`
+	Error   string        `json:"error"`
+}
+
+func (o *Ollama) Complete(ctx context.Context, req openai.ChatCompletionRequest, onDelta func(string)) (openai.ChatCompletionMessage, error) {
+	ctx, cancel := withTimeout(ctx, o.timeout)
+	defer cancel()
+
+	body := ollamaRequest{
+		Model:    req.Model,
+		Messages: ollamaMessages(req.Messages),
+		Tools:    req.Tools,
+		Stream:   onDelta != nil,
+		Options:  ollamaOptions{Temperature: req.Temperature, NumPredict: req.MaxTokens},
+	}
+	if o.model != "" {
+		body.Model = o.model
+	}
+	if req.ResponseFormat != nil && req.ResponseFormat.Type == openai.ChatCompletionResponseFormatTypeJSONObject {
+		body.Format = "json"
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, fmt.Errorf("encode chat request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(payload))
+	if err != nil {
+		return openai.ChatCompletionMessage{}, fmt.Errorf("create chat request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if o.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	resp, err := o.client.Do(httpReq)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, fmt.Errorf("send chat request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp ollamaResponse
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if json.Unmarshal(data, &errResp) == nil && errResp.Error != "" {
+			return openai.ChatCompletionMessage{}, fmt.Errorf("chat request failed with status %d: %s", resp.StatusCode, errResp.Error)
+		}
+		return openai.ChatCompletionMessage{}, fmt.Errorf("chat request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	// Without streaming the single object is read the same way as a stream of one
+	message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	var content strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var chunk ollamaResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return openai.ChatCompletionMessage{}, fmt.Errorf("decode chat response: %w", err)
+		}
+		if chunk.Error != "" {
+			return openai.ChatCompletionMessage{}, fmt.Errorf("chat request failed: %s", chunk.Error)
+		}
+
+		if chunk.Message.Content != "" {
+			content.WriteString(chunk.Message.Content)
+			if onDelta != nil {
+				onDelta(chunk.Message.Content)
+			}
+		}
+		// Tool calls arrive whole, Ollama doesn't number them
+		for _, call := range chunk.Message.ToolCalls {
+			arguments := string(call.Function.Arguments)
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+				ID:   fmt.Sprintf("call_%d", len(message.ToolCalls)),
+				Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{
+					Name:      call.Function.Name,
+					Arguments: arguments,
+				},
+			})
+			if onDelta != nil {
+				onDelta(arguments)
+			}
+		}
+
+		if chunk.Done {
+			message.Content = content.String()
+			return message, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return openai.ChatCompletionMessage{}, fmt.Errorf("receive chat response: %w", err)
+	}
+	return openai.ChatCompletionMessage{}, errors.New("chat response ended before it was done")
+}
+
+// ollamaMessages translates the messages, tool call arguments are objects and tool results
+// are matched to their calls by tool name instead of ID
+func ollamaMessages(messages []openai.ChatCompletionMessage) []ollamaMessage {
+	toolNames := make(map[string]string)
+	result := make([]ollamaMessage, 0, len(messages))
+	for _, message := range messages {
+		m := ollamaMessage{Role: message.Role, Content: message.Content}
+		for _, call := range message.ToolCalls {
+			toolNames[call.ID] = call.Function.Name
+
+			var c ollamaToolCall
+			c.Function.Name = call.Function.Name
+			c.Function.Arguments = json.RawMessage(call.Function.Arguments)
+			if !json.Valid(c.Function.Arguments) {
+				c.Function.Arguments = json.RawMessage("{}")
+			}
+			m.ToolCalls = append(m.ToolCalls, c)
+		}
+		if message.Role == openai.ChatMessageRoleTool {
+			m.ToolName = toolNames[message.ToolCallID]
+		}
+		result = append(result, m)
+	}
+	return result
+}
@@ -0,0 +1,213 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// fakeOllama serves /api/chat with the status and the lines of the body, a single line without
+// streaming. It records the requests.
+func fakeOllama(t *testing.T, status int, lines ...string) (*Ollama, *[]ollamaRequest) {
+	t.Helper()
+
+	var requests []ollamaRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer key" {
+			t.Errorf("Authorization = %q", got)
+		}
+		var req ollamaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		requests = append(requests, req)
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(status)
+		fmt.Fprint(w, strings.Join(lines, "\n"))
+	}))
+	t.Cleanup(server.Close)
+
+	return NewOllama("local", server.URL, "key", "llama3.1", 0), &requests
+}
+
+func TestOllamaComplete(t *testing.T) {
+	req := openai.ChatCompletionRequest{
+		Model:          "gpt-4o",
+		Temperature:    0.2,
+		MaxTokens:      512,
+		ResponseFormat: &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject},
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: "You analyze incidents."},
+			{Role: openai.ChatMessageRoleUser, Content: "Why does the api fail?"},
+		},
+	}
+
+	t.Run("plain completion", func(t *testing.T) {
+		provider, requests := fakeOllama(t, http.StatusOK,
+			`{"model": "llama3.1", "message": {"role": "assistant", "content": "Errors started"}, "done": true}`)
+
+		message, err := provider.Complete(t.Context(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Role != openai.ChatMessageRoleAssistant || message.Content != "Errors started" {
+			t.Errorf("message = %+v", message)
+		}
+
+		got := (*requests)[0]
+		if got.Model != "llama3.1" || got.Stream || got.Format != "json" ||
+			got.Options != (ollamaOptions{Temperature: 0.2, NumPredict: 512}) {
+			t.Errorf("request = %+v", got)
+		}
+		// The system prompt stays a message
+		if len(got.Messages) != 2 || got.Messages[0].Role != openai.ChatMessageRoleSystem || got.Messages[0].Content != "You analyze incidents." {
+			t.Errorf("messages = %+v", got.Messages)
+		}
+	})
+
+	t.Run("tool call", func(t *testing.T) {
+		provider, requests := fakeOllama(t, http.StatusOK,
+			`{"message": {"role": "assistant", "content": "", "tool_calls": [`+
+				`{"function": {"name": "query_promql", "arguments": {"query": "up"}}}, `+
+				`{"function": {"name": "get_trace", "arguments": {"trace_id": "t1"}}}]}, "done": true}`)
+
+		toolReq := req
+		toolReq.ResponseFormat = nil
+		toolReq.Tools = []openai.Tool{{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+			Name:       "query_promql",
+			Parameters: json.RawMessage(`{"type": "object"}`),
+		}}}
+
+		message, err := provider.Complete(t.Context(), toolReq, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Ollama doesn't number the calls, they get IDs in order
+		want := []openai.ToolCall{
+			{ID: "call_0", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "query_promql", Arguments: `{"query": "up"}`}},
+			{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "get_trace", Arguments: `{"trace_id": "t1"}`}},
+		}
+		if len(message.ToolCalls) != len(want) {
+			t.Fatalf("tool calls = %+v", message.ToolCalls)
+		}
+		for i, call := range message.ToolCalls {
+			if call.ID != want[i].ID || call.Type != want[i].Type || call.Function != want[i].Function {
+				t.Errorf("tool call %d = %+v, want %+v", i, call, want[i])
+			}
+		}
+
+		got := (*requests)[0]
+		if len(got.Tools) != 1 || got.Tools[0].Function.Name != "query_promql" || got.Format != "" {
+			t.Errorf("request = %+v", got)
+		}
+	})
+
+	t.Run("streamed response", func(t *testing.T) {
+		provider, requests := fakeOllama(t, http.StatusOK,
+			`{"message": {"role": "assistant", "content": "Errors "}, "done": false}`,
+			``,
+			`{"message": {"role": "assistant", "content": "started"}, "done": false}`,
+			`{"message": {"role": "assistant", "content": "", "tool_calls": [{"function": {"name": "get_trace", "arguments": {"trace_id": "t1"}}}]}, "done": false}`,
+			`{"message": {"role": "assistant", "content": ""}, "done": true}`)
+
+		var deltas []string
+		message, err := provider.Complete(t.Context(), req, func(text string) { deltas = append(deltas, text) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Content != "Errors started" || len(message.ToolCalls) != 1 || message.ToolCalls[0].Function.Name != "get_trace" {
+			t.Errorf("message = %+v", message)
+		}
+		if !slices.Equal(deltas, []string{"Errors ", "started", `{"trace_id": "t1"}`}) {
+			t.Errorf("deltas = %q", deltas)
+		}
+		if !(*requests)[0].Stream {
+			t.Error("request doesn't stream")
+		}
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			status  int
+			lines   []string
+			wantErr string
+		}{
+			{
+				name:    "api error",
+				status:  http.StatusNotFound,
+				lines:   []string{`{"error": "model \"llama3.1\" not found"}`},
+				wantErr: `chat request failed with status 404: model "llama3.1" not found`,
+			},
+			{
+				name:    "error without details",
+				status:  http.StatusBadGateway,
+				lines:   []string{"bad gateway"},
+				wantErr: "chat request failed with status 502: bad gateway",
+			},
+			{
+				name:    "error in the stream",
+				status:  http.StatusOK,
+				lines:   []string{`{"message": {"content": "Errors "}}`, `{"error": "out of memory"}`},
+				wantErr: "chat request failed: out of memory",
+			},
+			{
+				name:    "stream cut short",
+				status:  http.StatusOK,
+				lines:   []string{`{"message": {"content": "Errors "}}`},
+				wantErr: "chat response ended before it was done",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				provider, _ := fakeOllama(t, tt.status, tt.lines...)
+				if _, err := provider.Complete(t.Context(), req, func(string) {}); err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Complete() error = %v, want %q", err, tt.wantErr)
+				}
+			})
+		}
+	})
+}
+
+func TestOllamaMessages(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "You analyze incidents."},
+		{Role: openai.ChatMessageRoleUser, Content: "Why does the api fail?"},
+		{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{
+			{ID: "call_1", Function: openai.FunctionCall{Name: "query_promql", Arguments: `{"query": "up"}`}},
+			{ID: "call_2", Function: openai.FunctionCall{Name: "get_trace", Arguments: `{"trace_id": `}},
+		}},
+		{Role: openai.ChatMessageRoleTool, ToolCallID: "call_2", Content: "trace t1"},
+		{Role: openai.ChatMessageRoleTool, ToolCallID: "call_1", Content: "up 1"},
+		{Role: openai.ChatMessageRoleTool, ToolCallID: "call_9", Content: "unknown"},
+	}
+
+	got, err := json.Marshal(ollamaMessages(messages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Arguments are objects, invalid ones become empty, results are matched by tool name
+	want := `[{"role":"system","content":"You analyze incidents."},` +
+		`{"role":"user","content":"Why does the api fail?"},` +
+		`{"role":"assistant","content":"","tool_calls":[` +
+		`{"function":{"name":"query_promql","arguments":{"query":"up"}}},` +
+		`{"function":{"name":"get_trace","arguments":{}}}]},` +
+		`{"role":"tool","content":"trace t1","tool_name":"get_trace"},` +
+		`{"role":"tool","content":"up 1","tool_name":"query_promql"},` +
+		`{"role":"tool","content":"unknown"}]`
+	if string(got) != want {
+		t.Errorf("messages = %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,108 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenAI uses the chat completions endpoint of an OpenAI-compatible API
+type OpenAI struct {
+	name    string
+	client  *openai.Client
+	model   string
+	timeout time.Duration
+}
+
+func NewOpenAI(name string, client *openai.Client, model string, timeout time.Duration) *OpenAI {
+	return &OpenAI{
+		name:    name,
+		client:  client,
+		model:   model,
+		timeout: timeout,
+	}
+}
+
+func (o *OpenAI) Name() string {
+	return o.name
+}
+
+// Complete without onDelta waits for the whole answer, otherwise it streams the answer and
+// assembles the message from the deltas
+func (o *OpenAI) Complete(ctx context.Context, req openai.ChatCompletionRequest, onDelta func(string)) (openai.ChatCompletionMessage, error) {
+	ctx, cancel := withTimeout(ctx, o.timeout)
+	defer cancel()
+
+	if o.model != "" {
+		req.Model = o.model
+	}
+
+	if onDelta == nil {
+		resp, err := o.client.CreateChatCompletion(ctx, req)
+		if err != nil {
+			return openai.ChatCompletionMessage{}, fmt.Errorf("failed to get chat completion: %v", err)
+		}
+		if len(resp.Choices) == 0 {
+			return openai.ChatCompletionMessage{}, errors.New("failed to get chat completion: no choices returned")
+		}
+		return resp.Choices[0].Message, nil
+	}
+
+	stream, err := o.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, fmt.Errorf("failed to start chat completion stream: %v", err)
+	}
+	defer stream.Close()
+
+	message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	var content strings.Builder
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return openai.ChatCompletionMessage{}, fmt.Errorf("failed to receive chat completion stream: %v", err)
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta
+
+		if delta.Content != "" {
+			content.WriteString(delta.Content)
+			onDelta(delta.Content)
+		}
+
+		// Tool call arguments arrive in pieces, the index tells which call a piece belongs to
+		for _, call := range delta.ToolCalls {
+			index := max(len(message.ToolCalls)-1, 0)
+			if call.Index != nil {
+				index = *call.Index
+			}
+			for index >= len(message.ToolCalls) {
+				message.ToolCalls = append(message.ToolCalls, openai.ToolCall{Type: openai.ToolTypeFunction})
+			}
+
+			existing := &message.ToolCalls[index]
+			if call.ID != "" {
+				existing.ID = call.ID
+			}
+			if call.Function.Name != "" {
+				existing.Function.Name = call.Function.Name
+			}
+			existing.Function.Arguments += call.Function.Arguments
+			if call.Function.Arguments != "" {
+				onDelta(call.Function.Arguments)
+			}
+		}
+	}
+
+	message.Content = content.String()
+	return message, nil
+}
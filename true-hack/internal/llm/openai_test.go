@@ -0,0 +1,131 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// fakeOpenAI serves chat completions. A streaming request gets chunks as Server-Sent Events,
+// every chunk is the delta of a choice, otherwise the answer is message. It records the requests.
+func fakeOpenAI(t *testing.T, message string, chunks []string) (*openai.Client, *[]openai.ChatCompletionRequest) {
+	t.Helper()
+
+	var requests []openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		var req openai.ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		requests = append(requests, req)
+
+		if !req.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"id": "1", "object": "chat.completion", "model": %q, "choices": [{"index": 0, "message": %s, "finish_reason": "stop"}]}`,
+				req.Model, message)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: {\"id\": \"1\", \"object\": \"chat.completion.chunk\", \"model\": %q, \"choices\": [{\"index\": 0, \"delta\": %s}]}\n\n",
+				req.Model, chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+
+	config := openai.DefaultConfig("key")
+	config.BaseURL = server.URL + "/v1"
+	return openai.NewClientWithConfig(config), &requests
+}
+
+func TestOpenAIComplete(t *testing.T) {
+	req := openai.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Why does the api fail?"}},
+	}
+
+	t.Run("without streaming", func(t *testing.T) {
+		client, requests := fakeOpenAI(t, `{"role": "assistant", "content": "Errors started"}`, nil)
+		provider := NewOpenAI("backup", client, "gpt-4o-mini", 0)
+
+		message, err := provider.Complete(t.Context(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Content != "Errors started" {
+			t.Errorf("content = %q", message.Content)
+		}
+		// The model of the provider replaces the one of the request
+		if got := (*requests)[0]; got.Model != "gpt-4o-mini" || got.Stream {
+			t.Errorf("request = %+v", got)
+		}
+	})
+
+	t.Run("streamed content", func(t *testing.T) {
+		client, requests := fakeOpenAI(t, "", []string{
+			`{"role": "assistant"}`,
+			`{"content": "Errors "}`,
+			`{"content": "started"}`,
+		})
+		provider := NewOpenAI("primary", client, "", 0)
+
+		var deltas []string
+		message, err := provider.Complete(t.Context(), req, func(text string) { deltas = append(deltas, text) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Role != openai.ChatMessageRoleAssistant || message.Content != "Errors started" {
+			t.Errorf("message = %+v", message)
+		}
+		if !slices.Equal(deltas, []string{"Errors ", "started"}) {
+			t.Errorf("deltas = %q", deltas)
+		}
+		if got := (*requests)[0]; got.Model != "gpt-4o" || !got.Stream {
+			t.Errorf("request = %+v", got)
+		}
+	})
+
+	t.Run("tool call arguments split across chunks", func(t *testing.T) {
+		client, _ := fakeOpenAI(t, "", []string{
+			`{"role": "assistant", "tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "query_promql", "arguments": ""}}]}`,
+			`{"tool_calls": [{"index": 0, "function": {"arguments": "{\"query\""}}]}`,
+			`{"tool_calls": [{"index": 1, "id": "call_2", "type": "function", "function": {"name": "get_trace", "arguments": "{\"trace_id\": "}}]}`,
+			`{"tool_calls": [{"index": 0, "function": {"arguments": ": \"up\"}"}}]}`,
+			`{"tool_calls": [{"index": 1, "function": {"arguments": "\"t1\"}"}}]}`,
+		})
+		provider := NewOpenAI("primary", client, "", 0)
+
+		var deltas int
+		message, err := provider.Complete(t.Context(), req, func(string) { deltas++ })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []openai.ToolCall{
+			{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "query_promql", Arguments: `{"query": "up"}`}},
+			{ID: "call_2", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "get_trace", Arguments: `{"trace_id": "t1"}`}},
+		}
+		if len(message.ToolCalls) != len(want) {
+			t.Fatalf("tool calls = %+v", message.ToolCalls)
+		}
+		for i, call := range message.ToolCalls {
+			if call.ID != want[i].ID || call.Type != want[i].Type || call.Function != want[i].Function {
+				t.Errorf("tool call %d = %+v, want %+v", i, call, want[i])
+			}
+		}
+		if message.Content != "" || deltas != 4 {
+			t.Errorf("content = %q, %d deltas, want the 4 argument pieces", message.Content, deltas)
+		}
+	})
+}
@@ -0,0 +1,238 @@
+package rag
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/embedding"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// logBucket aligns log chunks in time, so overlapping windows produce the same chunks
+	logBucket = time.Minute
+	// spansPerChunk limits how many spans of a trace are described in its chunk
+	spansPerChunk = 30
+)
+
+type Config struct {
+	// Path of the store file, empty disables retrieval
+	Path      string        `yaml:"path" env:"PATH"`
+	Retention time.Duration `yaml:"retention" env:"RETENTION"`
+	// CleanupInterval is how often expired documents are dropped in the background
+	CleanupInterval time.Duration `yaml:"cleanup_interval" env:"CLEANUP_INTERVAL"`
+	// ChunkLines is the maximum number of log lines in a chunk
+	ChunkLines int `yaml:"chunk_lines" env:"CHUNK_LINES"`
+}
+
+// Index chunks logs and spans, embeds the chunks and keeps them in a Store
+type Index struct {
+	store      *Store
+	embedder   embedding.Embedder
+	logger     *zap.Logger
+	chunkLines int
+}
+
+func NewIndex(store *Store, embedder embedding.Embedder, chunkLines int, logger *zap.Logger) *Index {
+	if chunkLines <= 0 {
+		chunkLines = 10
+	}
+
+	return &Index{
+		store:      store,
+		embedder:   embedder,
+		logger:     logger,
+		chunkLines: chunkLines,
+	}
+}
+
+// Run drops expired documents from the store every interval until ctx is done
+func (i *Index) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := i.store.Cleanup(); err != nil {
+				i.logger.Warn("Failed to clean up rag store", zap.Error(err))
+			}
+		}
+	}
+}
+
+// IndexLogs splits log lines of every stream into chunks of at most chunkLines lines within a minute
+func (i *Index) IndexLogs(ctx context.Context, source string, entries []collector.LogEntry) error {
+	type chunkKey struct {
+		stream string
+		bucket time.Time
+	}
+	chunks := make(map[chunkKey][]collector.LogEntry)
+	var keys []chunkKey
+	for _, entry := range entries {
+		key := chunkKey{stream: streamLabels(entry.Labels), bucket: entry.Timestamp.Truncate(logBucket)}
+		if _, ok := chunks[key]; !ok {
+			keys = append(keys, key)
+		}
+		chunks[key] = append(chunks[key], entry)
+	}
+
+	var docs []Document
+	for _, key := range keys {
+		lines := chunks[key]
+		slices.SortStableFunc(lines, func(a, b collector.LogEntry) int {
+			return a.Timestamp.Compare(b.Timestamp)
+		})
+
+		for part := 0; part*i.chunkLines < len(lines); part++ {
+			chunk := lines[part*i.chunkLines : min((part+1)*i.chunkLines, len(lines))]
+
+			var text strings.Builder
+			text.WriteString(key.stream)
+			for _, line := range chunk {
+				fmt.Fprintf(&text, "\n%s %s", line.Timestamp.Format(time.RFC3339Nano), line.Line)
+			}
+
+			docs = append(docs, Document{
+				ID:     documentID(KindLog, source, key.stream, key.bucket.Format(time.RFC3339), fmt.Sprint(part)),
+				Kind:   KindLog,
+				Source: source,
+				Start:  chunk[0].Timestamp,
+				End:    chunk[len(chunk)-1].Timestamp,
+				Text:   text.String(),
+			})
+		}
+	}
+
+	return i.add(ctx, docs)
+}
+
+// IndexSpans makes a chunk of every trace, the chunk lists its spans in start order
+func (i *Index) IndexSpans(ctx context.Context, source string, spans []collector.Span) error {
+	traces := make(map[string][]collector.Span)
+	var traceIDs []string
+	for _, span := range spans {
+		if _, ok := traces[span.TraceID]; !ok {
+			traceIDs = append(traceIDs, span.TraceID)
+		}
+		traces[span.TraceID] = append(traces[span.TraceID], span)
+	}
+
+	docs := make([]Document, 0, len(traceIDs))
+	for _, traceID := range traceIDs {
+		trace := traces[traceID]
+		slices.SortStableFunc(trace, func(a, b collector.Span) int {
+			return a.StartTime.Compare(b.StartTime)
+		})
+
+		start := trace[0].StartTime
+		end := start
+		errorCount := 0
+		for _, span := range trace {
+			if spanEnd := span.StartTime.Add(span.Duration); spanEnd.After(end) {
+				end = spanEnd
+			}
+			if span.Error {
+				errorCount++
+			}
+		}
+
+		var text strings.Builder
+		fmt.Fprintf(&text, "Trace %s: %d spans, %d errors, duration %s",
+			traceID, len(trace), errorCount, end.Sub(start))
+		for _, span := range trace[:min(len(trace), spansPerChunk)] {
+			fmt.Fprintf(&text, "\n  %s %s %s", span.Service, span.Operation, span.Duration)
+			if span.Error {
+				fmt.Fprintf(&text, " error: %s", span.ErrorMessage)
+			}
+		}
+
+		docs = append(docs, Document{
+			ID:     documentID(KindSpan, source, traceID),
+			Kind:   KindSpan,
+			Source: source,
+			Start:  start,
+			End:    end,
+			Text:   text.String(),
+		})
+	}
+
+	return i.add(ctx, docs)
+}
+
+// Search returns up to k chunks matching the filter, most related to the query first
+func (i *Index) Search(ctx context.Context, query string, filter Filter, k int) ([]Result, error) {
+	if k <= 0 {
+		return nil, nil
+	}
+
+	vectors, err := i.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("embed query: %w", err)
+	}
+
+	return i.store.Search(vectors[0], filter, k), nil
+}
+
+// add embeds and stores documents that are new or grew since they were stored.
+// A chunk at the edge of a window can be partial, it never replaces a fuller one.
+func (i *Index) add(ctx context.Context, docs []Document) error {
+	var fresh []Document
+	var texts []string
+	for _, doc := range docs {
+		if existing, ok := i.store.Get(doc.ID); ok && len(existing.Text) >= len(doc.Text) {
+			continue
+		}
+		fresh = append(fresh, doc)
+		texts = append(texts, doc.Text)
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	vectors, err := i.embedder.Embed(ctx, texts)
+	if err != nil {
+		return fmt.Errorf("embed documents: %w", err)
+	}
+	for n := range fresh {
+		fresh[n].Vector = vectors[n]
+	}
+
+	if err := i.store.Add(fresh); err != nil {
+		return fmt.Errorf("store documents: %w", err)
+	}
+
+	i.logger.Debug("Indexed documents",
+		zap.Int("new", len(fresh)),
+		zap.Int("total", i.store.Len()))
+
+	return nil
+}
+
+func streamLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func documentID(parts ...string) string {
+	h := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,239 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+	"true-hack/internal/embedding"
+
+	"go.uber.org/zap"
+)
+
+// countingEmbedder counts the texts it embeds
+type countingEmbedder struct {
+	embedding.Embedder
+	texts int
+}
+
+func (e *countingEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.texts += len(texts)
+	return e.Embedder.Embed(ctx, texts)
+}
+
+func newTestIndex(t *testing.T, chunkLines int) (*Index, *countingEmbedder) {
+	t.Helper()
+
+	store := openStore(t, filepath.Join(t.TempDir(), "rag.jsonl"), 0)
+	embedder := &countingEmbedder{Embedder: embedding.NewHashEmbedder(64)}
+	return NewIndex(store, embedder, chunkLines, zap.NewNop()), embedder
+}
+
+var indexStart = time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func logLine(app string, offset time.Duration, line string) collector.LogEntry {
+	return collector.LogEntry{
+		Timestamp: indexStart.Add(offset),
+		Labels:    map[string]string{"app": app},
+		Line:      line,
+	}
+}
+
+// logChunk returns the stored chunk of the stream of app in the minute starting at offset
+func logChunk(i *Index, app string, offset time.Duration, part int) (Document, bool) {
+	stream := streamLabels(map[string]string{"app": app})
+	bucket := indexStart.Add(offset).Format(time.RFC3339)
+	return i.store.Get(documentID(KindLog, "loki", stream, bucket, fmt.Sprint(part)))
+}
+
+func TestIndexLogs(t *testing.T) {
+	// Seven lines in the first minute, out of order
+	var minute []collector.LogEntry
+	for _, n := range []int{6, 0, 3, 1, 5, 2, 4} {
+		minute = append(minute, logLine("api", time.Duration(n)*time.Second, fmt.Sprintf("line %d", n)))
+	}
+
+	tests := []struct {
+		name    string
+		entries []collector.LogEntry
+		// want are the lines of each chunk by app, minute and part
+		want map[string][]string
+	}{
+		{
+			name:    "empty input",
+			entries: nil,
+			want:    map[string][]string{},
+		},
+		{
+			name:    "chunks of at most chunk lines in time order",
+			entries: minute,
+			want: map[string][]string{
+				"api 0 0": {"line 0", "line 1", "line 2"},
+				"api 0 1": {"line 3", "line 4", "line 5"},
+				"api 0 2": {"line 6"},
+			},
+		},
+		{
+			name: "minute boundary splits chunks",
+			entries: []collector.LogEntry{
+				logLine("api", 59*time.Second, "before"),
+				logLine("api", time.Minute, "after"),
+			},
+			want: map[string][]string{
+				"api 0 0": {"before"},
+				"api 1 0": {"after"},
+			},
+		},
+		{
+			name: "streams are chunked separately",
+			entries: []collector.LogEntry{
+				logLine("api", time.Second, "api line"),
+				logLine("db", 2*time.Second, "db line"),
+			},
+			want: map[string][]string{
+				"api 0 0": {"api line"},
+				"db 0 0":  {"db line"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, embedder := newTestIndex(t, 3)
+			if err := index.IndexLogs(t.Context(), "loki", tt.entries); err != nil {
+				t.Fatal(err)
+			}
+
+			if index.store.Len() != len(tt.want) || embedder.texts != len(tt.want) {
+				t.Errorf("stored %d chunks, embedded %d, want %d", index.store.Len(), embedder.texts, len(tt.want))
+			}
+			for key, lines := range tt.want {
+				var app string
+				var minute, part int
+				fmt.Sscanf(key, "%s %d %d", &app, &minute, &part)
+
+				doc, ok := logChunk(index, app, time.Duration(minute)*time.Minute, part)
+				if !ok {
+					t.Errorf("chunk %s not stored", key)
+					continue
+				}
+				got := strings.Split(doc.Text, "\n")[1:]
+				for n := range got {
+					// Drop the timestamp
+					got[n] = got[n][strings.Index(got[n], " ")+1:]
+				}
+				if strings.Join(got, "|") != strings.Join(lines, "|") {
+					t.Errorf("chunk %s has %q, want %q", key, got, lines)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexLogsAgain(t *testing.T) {
+	index, embedder := newTestIndex(t, 10)
+	window := []collector.LogEntry{
+		logLine("api", 10*time.Second, "first"),
+		logLine("api", 20*time.Second, "second"),
+		logLine("api", 70*time.Second, "third"),
+	}
+	if err := index.IndexLogs(t.Context(), "loki", window); err != nil {
+		t.Fatal(err)
+	}
+	if embedder.texts != 2 {
+		t.Fatalf("embedded %d chunks, want 2", embedder.texts)
+	}
+
+	// The same window is not embedded again
+	if err := index.IndexLogs(t.Context(), "loki", window); err != nil {
+		t.Fatal(err)
+	}
+	if embedder.texts != 2 {
+		t.Errorf("embedded %d chunks after indexing the same window, want 2", embedder.texts)
+	}
+
+	// A window cutting the first minute in half doesn't replace the full chunk
+	if err := index.IndexLogs(t.Context(), "loki", window[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	if doc, _ := logChunk(index, "api", 0, 0); !strings.Contains(doc.Text, "first") {
+		t.Errorf("partial chunk replaced the full one: %q", doc.Text)
+	}
+
+	// A chunk that grew is embedded again, the unchanged one is not
+	grown := append(window, logLine("api", 30*time.Second, "late"))
+	if err := index.IndexLogs(t.Context(), "loki", grown); err != nil {
+		t.Fatal(err)
+	}
+	if embedder.texts != 3 {
+		t.Errorf("embedded %d chunks after a chunk grew, want 3", embedder.texts)
+	}
+	if doc, _ := logChunk(index, "api", 0, 0); !strings.Contains(doc.Text, "late") {
+		t.Errorf("grown chunk not stored: %q", doc.Text)
+	}
+	if index.store.Len() != 2 {
+		t.Errorf("stored %d chunks, want 2", index.store.Len())
+	}
+}
+
+func TestIndexSpans(t *testing.T) {
+	span := func(traceID string, offset, duration time.Duration, errMessage string) collector.Span {
+		return collector.Span{
+			Service:      "api",
+			Operation:    "GET /users",
+			TraceID:      traceID,
+			StartTime:    indexStart.Add(offset),
+			Duration:     duration,
+			Error:        errMessage != "",
+			ErrorMessage: errMessage,
+		}
+	}
+
+	var long []collector.Span
+	for n := range spansPerChunk + 10 {
+		long = append(long, span("t3", time.Duration(n)*time.Millisecond, time.Millisecond, ""))
+	}
+
+	index, embedder := newTestIndex(t, 10)
+	if err := index.IndexSpans(t.Context(), "jaeger", nil); err != nil {
+		t.Fatal(err)
+	}
+	if index.store.Len() != 0 || embedder.texts != 0 {
+		t.Fatalf("empty input stored %d chunks", index.store.Len())
+	}
+
+	spans := append([]collector.Span{
+		span("t1", 10*time.Millisecond, 5*time.Millisecond, "timeout"),
+		span("t2", 0, time.Second, ""),
+		span("t1", 0, 50*time.Millisecond, ""),
+	}, long...)
+	for range 2 {
+		if err := index.IndexSpans(t.Context(), "jaeger", spans); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if index.store.Len() != 3 || embedder.texts != 3 {
+		t.Fatalf("stored %d chunks, embedded %d, want a chunk per trace embedded once", index.store.Len(), embedder.texts)
+	}
+
+	doc, ok := index.store.Get(documentID(KindSpan, "jaeger", "t1"))
+	if !ok {
+		t.Fatal("trace t1 not stored")
+	}
+	want := "Trace t1: 2 spans, 1 errors, duration 50ms\n  api GET /users 50ms\n  api GET /users 5ms error: timeout"
+	if doc.Text != want {
+		t.Errorf("got %q, want %q", doc.Text, want)
+	}
+	if !doc.Start.Equal(indexStart) || !doc.End.Equal(indexStart.Add(50*time.Millisecond)) {
+		t.Errorf("chunk covers %s to %s", doc.Start, doc.End)
+	}
+
+	doc, _ = index.store.Get(documentID(KindSpan, "jaeger", "t3"))
+	if lines := strings.Count(doc.Text, "\n"); lines != spansPerChunk {
+		t.Errorf("long trace lists %d spans, want %d", lines, spansPerChunk)
+	}
+}
@@ -0,0 +1,339 @@
+package rag
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"true-hack/internal/embedding"
+)
+
+// Document kinds
+const (
+	KindLog  = "log"
+	KindSpan = "span"
+)
+
+// Document is a chunk of evidence with its embedding
+type Document struct {
+	ID     string
+	Kind   string
+	Source string
+	// Start and End are the time range the chunk covers
+	Start  time.Time
+	End    time.Time
+	Text   string
+	Vector []float32
+}
+
+// Filter restricts a search to documents of the given kinds overlapping [Start, End]
+type Filter struct {
+	Kinds []string
+	Start time.Time
+	End   time.Time
+}
+
+func (f Filter) match(doc *Document) bool {
+	if len(f.Kinds) > 0 && !slices.Contains(f.Kinds, doc.Kind) {
+		return false
+	}
+	if !f.Start.IsZero() && doc.End.Before(f.Start) {
+		return false
+	}
+	if !f.End.IsZero() && doc.Start.After(f.End) {
+		return false
+	}
+	return true
+}
+
+type Result struct {
+	Document
+	Score float32
+}
+
+// record is a line of the store file, the vector is stored as little-endian float32 bytes
+type record struct {
+	ID     string    `json:"id"`
+	Kind   string    `json:"kind"`
+	Source string    `json:"source"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Text   string    `json:"text"`
+	Vector []byte    `json:"vector"`
+}
+
+// Store is a file-backed vector store. Documents are kept in memory and appended to a
+// JSON lines file, a document with an existing ID replaces the old one. The file is
+// compacted on open and whenever it holds twice as many records as live documents.
+// Expired documents are never returned, Cleanup drops them from memory.
+type Store struct {
+	path      string
+	retention time.Duration
+
+	mu      sync.RWMutex
+	docs    map[string]*Document
+	file    *os.File
+	records int
+}
+
+// Open loads the store from path, creating the file if needed. Documents ending before
+// now-retention are dropped, zero retention keeps everything.
+func Open(path string, retention time.Duration) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create store directory: %w", err)
+	}
+
+	s := &Store{
+		path:      path,
+		retention: retention,
+		docs:      make(map[string]*Document),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A crash can leave a partially written last line, skip it
+			continue
+		}
+		doc := fromRecord(rec)
+		s.docs[doc.ID] = &doc
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read store: %w", err)
+	}
+
+	return nil
+}
+
+// Add stores documents, replacing the ones with the same ID
+func (s *Store) Add(docs []Document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := bufio.NewWriter(s.file)
+	for _, doc := range docs {
+		line, err := json.Marshal(toRecord(doc))
+		if err != nil {
+			return fmt.Errorf("encode document %s: %w", doc.ID, err)
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+
+		s.docs[doc.ID] = &doc
+		s.records++
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write store: %w", err)
+	}
+
+	if s.records > 2*len(s.docs) {
+		return s.compact()
+	}
+	return nil
+}
+
+// Search returns up to k documents matching the filter, most similar to the vector first
+func (s *Store) Search(vector []float32, filter Filter, k int) []Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	type scored struct {
+		doc   *Document
+		score float32
+	}
+	deadline := s.deadline()
+	var candidates []scored
+	for _, doc := range s.docs {
+		if !filter.match(doc) || doc.End.Before(deadline) {
+			continue
+		}
+		candidates = append(candidates, scored{doc: doc, score: embedding.Cosine(vector, doc.Vector)})
+	}
+
+	slices.SortFunc(candidates, func(a, b scored) int {
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.doc.ID, b.doc.ID)
+	})
+
+	// Only the documents returned are copied
+	results := make([]Result, 0, min(k, len(candidates)))
+	for _, c := range candidates[:min(k, len(candidates))] {
+		results = append(results, Result{Document: *c.doc, Score: c.score})
+	}
+	return results
+}
+
+// Get returns a document by ID
+func (s *Store) Get(id string) (Document, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, ok := s.docs[id]
+	if !ok || doc.End.Before(s.deadline()) {
+		return Document{}, false
+	}
+	return *doc, true
+}
+
+// Len returns the number of documents held, expired ones count until Cleanup drops them
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.docs)
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Cleanup drops expired documents and compacts the file when it holds twice as many records as live documents
+func (s *Store) Cleanup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	if s.records > 2*len(s.docs) {
+		return s.compact()
+	}
+	return nil
+}
+
+// deadline is the end time before which documents are expired, zero without retention
+func (s *Store) deadline() time.Time {
+	if s.retention <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-s.retention)
+}
+
+// expire drops expired documents. Must be called with mu held.
+func (s *Store) expire() {
+	deadline := s.deadline()
+	for id, doc := range s.docs {
+		if doc.End.Before(deadline) {
+			delete(s.docs, id)
+		}
+	}
+}
+
+// compact drops expired documents and rewrites the file with live ones only. Must be called with mu held.
+func (s *Store) compact() error {
+	s.expire()
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("create store: %w", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, doc := range s.docs {
+		line, err := json.Marshal(toRecord(*doc))
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("encode document %s: %w", doc.ID, err)
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write store: %w", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("replace store: %w", err)
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	s.records = len(s.docs)
+
+	return nil
+}
+
+func toRecord(doc Document) record {
+	vector := make([]byte, 4*len(doc.Vector))
+	for i, v := range doc.Vector {
+		binary.LittleEndian.PutUint32(vector[4*i:], math.Float32bits(v))
+	}
+
+	return record{
+		ID:     doc.ID,
+		Kind:   doc.Kind,
+		Source: doc.Source,
+		Start:  doc.Start,
+		End:    doc.End,
+		Text:   doc.Text,
+		Vector: vector,
+	}
+}
+
+func fromRecord(rec record) Document {
+	vector := make([]float32, len(rec.Vector)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(rec.Vector[4*i:]))
+	}
+
+	return Document{
+		ID:     rec.ID,
+		Kind:   rec.Kind,
+		Source: rec.Source,
+		Start:  rec.Start,
+		End:    rec.End,
+		Text:   rec.Text,
+		Vector: vector,
+	}
+}
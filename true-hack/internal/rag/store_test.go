@@ -0,0 +1,179 @@
+package rag
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testDoc(id, text string, end time.Time) Document {
+	return Document{
+		ID:     id,
+		Kind:   KindLog,
+		Source: "loki",
+		Start:  end.Add(-time.Minute),
+		End:    end,
+		Text:   text,
+		Vector: []float32{1, 0.5, -0.25},
+	}
+}
+
+func openStore(t *testing.T, path string, retention time.Duration) *Store {
+	t.Helper()
+
+	s, err := Open(path, retention)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func fileLines(t *testing.T, path string) int {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestStoreReopenAfterPartialWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rag.jsonl")
+	now := time.Now().UTC()
+
+	s := openStore(t, path, 0)
+	if err := s.Add([]Document{testDoc("a", "first", now), testDoc("b", "second", now)}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// A crash in the middle of a write leaves a line without its end
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"id":"c","kind":"log","text":"thi`)
+	file.Close()
+
+	s = openStore(t, path, 0)
+	if s.Len() != 2 {
+		t.Fatalf("Len() = %d after reopen, want 2", s.Len())
+	}
+	doc, ok := s.Get("a")
+	if !ok || doc.Text != "first" {
+		t.Fatalf("Get(a) = %q, %v, want first", doc.Text, ok)
+	}
+	if len(doc.Vector) != 3 || doc.Vector[2] != -0.25 {
+		t.Errorf("vector = %v after reopen", doc.Vector)
+	}
+
+	// Records appended after the reopen must not be glued to the partial line
+	if err := s.Add([]Document{testDoc("c", "third", now)}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openStore(t, path, 0)
+	if _, ok := s.Get("c"); !ok || s.Len() != 3 {
+		t.Errorf("Get(c) = %v, Len() = %d after second reopen, want true, 3", ok, s.Len())
+	}
+}
+
+func TestStoreReplaceByID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rag.jsonl")
+	now := time.Now().UTC()
+
+	s := openStore(t, path, 0)
+	if err := s.Add([]Document{testDoc("a", "old", now)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add([]Document{testDoc("a", "new", now)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", s.Len())
+	}
+	if doc, _ := s.Get("a"); doc.Text != "new" {
+		t.Errorf("Get(a) = %q, want new", doc.Text)
+	}
+	if results := s.Search([]float32{1, 0.5, -0.25}, Filter{}, 10); len(results) != 1 || results[0].Text != "new" {
+		t.Errorf("Search() = %+v, want the new document only", results)
+	}
+	s.Close()
+
+	s = openStore(t, path, 0)
+	if doc, _ := s.Get("a"); doc.Text != "new" || s.Len() != 1 {
+		t.Errorf("Get(a) = %q, Len() = %d after reopen, want new, 1", doc.Text, s.Len())
+	}
+}
+
+func TestStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rag.jsonl")
+	now := time.Now().UTC()
+
+	s := openStore(t, path, 0)
+	if err := s.Add([]Document{testDoc("a", "v0", now), testDoc("b", "v0", now)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add([]Document{testDoc("a", "v1", now), testDoc("b", "v1", now)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileLines(t, path); got != 4 {
+		t.Fatalf("file has %d lines before compaction, want 4", got)
+	}
+
+	// The fifth record exceeds twice the two live documents
+	if err := s.Add([]Document{testDoc("a", "v2", now)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileLines(t, path); got != 2 {
+		t.Errorf("file has %d lines after compaction, want 2", got)
+	}
+	if doc, _ := s.Get("a"); doc.Text != "v2" {
+		t.Errorf("Get(a) = %q after compaction, want v2", doc.Text)
+	}
+
+	// The compacted file is appended to
+	if err := s.Add([]Document{testDoc("c", "v0", now)}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openStore(t, path, 0)
+	if s.Len() != 3 {
+		t.Errorf("Len() = %d after reopen, want 3", s.Len())
+	}
+}
+
+func TestStoreRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rag.jsonl")
+	now := time.Now().UTC()
+
+	s := openStore(t, path, time.Hour)
+	if err := s.Add([]Document{
+		testDoc("fresh", "fresh", now),
+		testDoc("expired", "expired", now.Add(-2*time.Hour)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	results := s.Search([]float32{1, 0.5, -0.25}, Filter{}, 10)
+	if len(results) != 1 || results[0].ID != "fresh" {
+		t.Errorf("Search() = %+v, want the fresh document only", results)
+	}
+	if _, ok := s.Get("expired"); ok {
+		t.Error("Get(expired) found an expired document")
+	}
+
+	if err := s.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 1 {
+		t.Errorf("Len() = %d after Cleanup, want 1", s.Len())
+	}
+}
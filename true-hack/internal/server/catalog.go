@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"true-hack/internal/collector"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// catalogTTL is how long the combined catalog is served before sources are asked again
+	catalogTTL = time.Minute
+	// catalogTimeout limits how long a source may take to list its catalog
+	catalogTimeout = 15 * time.Second
+
+	defaultCatalogLimit = 100
+	maxCatalogLimit     = 1000
+)
+
+// CatalogEntry is an item of MetricsList
+type CatalogEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+	Help string `json:"help,omitempty"`
+	// Description duplicates Help for clients of the original MetricsList schema
+	Description string `json:"description,omitempty"`
+	Source      string `json:"source"`
+	Kind        string `json:"kind"`
+}
+
+// MetricsList is a page of the catalog matching the request filters
+type MetricsList struct {
+	Metrics []CatalogEntry `json:"metrics"`
+	Total   int            `json:"total"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+	// Warnings name the sources whose catalog could not be listed
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// catalog lists what the collectors can be queried for and caches it for catalogTTL
+type catalog struct {
+	collectors *collector.Registry
+	logger     *zap.Logger
+
+	mu        sync.Mutex
+	entries   []CatalogEntry
+	updatedAt time.Time
+	// refresh is the listing in progress, requests made meanwhile wait for it instead of starting another
+	refresh *catalogRefresh
+}
+
+// catalogRefresh is a listing of all sources, done is closed when entries and warnings are set
+type catalogRefresh struct {
+	done     chan struct{}
+	entries  []CatalogEntry
+	warnings []string
+}
+
+func newCatalog(collectors *collector.Registry, logger *zap.Logger) *catalog {
+	return &catalog{
+		collectors: collectors,
+		logger:     logger,
+	}
+}
+
+// list returns the cached catalog or lists it again when it is older than catalogTTL.
+// A failing source doesn't fail the whole catalog, it is reported in warnings instead.
+// Sources are listed without holding the lock, concurrent requests share one listing.
+func (c *catalog) list(ctx context.Context) ([]CatalogEntry, []string) {
+	c.mu.Lock()
+	if !c.updatedAt.IsZero() && time.Since(c.updatedAt) < catalogTTL {
+		entries := c.entries
+		c.mu.Unlock()
+		return entries, nil
+	}
+	refresh := c.refresh
+	if refresh == nil {
+		refresh = &catalogRefresh{done: make(chan struct{})}
+		c.refresh = refresh
+		// The listing outlives a request that gives up waiting, the others still need it
+		go c.fetch(context.WithoutCancel(ctx), refresh)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-refresh.done:
+		return refresh.entries, refresh.warnings
+	case <-ctx.Done():
+		return nil, []string{ctx.Err().Error()}
+	}
+}
+
+// fetch lists the catalogs of all sources into refresh and caches the result if every source answered
+func (c *catalog) fetch(ctx context.Context, refresh *catalogRefresh) {
+	defer close(refresh.done)
+
+	var entries []CatalogEntry
+	var warnings []string
+	for _, coll := range c.collectors.Collectors() {
+		cataloger, ok := coll.(collector.Cataloger)
+		if !ok {
+			continue
+		}
+
+		sourceCtx, cancel := context.WithTimeout(ctx, catalogTimeout)
+		items, err := cataloger.Catalog(sourceCtx)
+		cancel()
+		if err != nil {
+			c.logger.Warn("Failed to list catalog", zap.String("source", coll.Name()), zap.Error(err))
+			warnings = append(warnings, coll.Name()+": "+err.Error())
+			continue
+		}
+
+		for _, item := range items {
+			entries = append(entries, CatalogEntry{
+				Name:        item.Name,
+				Type:        item.Type,
+				Help:        item.Help,
+				Description: item.Help,
+				Source:      item.Source,
+				Kind:        string(item.Kind),
+			})
+		}
+	}
+	refresh.entries, refresh.warnings = entries, warnings
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refresh = nil
+	// Don't keep a catalog with failed sources, they may be back with the next request
+	if len(warnings) == 0 {
+		c.entries, c.updatedAt = entries, time.Now()
+	}
+}
+
+// handleMetrics lists the catalog of all sources. Query parameters:
+// q filters by a case-insensitive substring of the name or help, source and kind filter
+// by exact value, limit and offset select a page.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, err := intParam(query.Get("limit"), defaultCatalogLimit)
+	if err != nil || limit <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid limit")
+		return
+	}
+	limit = min(limit, maxCatalogLimit)
+
+	offset, err := intParam(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid offset")
+		return
+	}
+
+	entries, warnings := s.catalog.list(r.Context())
+
+	search := strings.ToLower(query.Get("q"))
+	source := query.Get("source")
+	kind := query.Get("kind")
+
+	matched := make([]CatalogEntry, 0)
+	for _, entry := range entries {
+		if source != "" && entry.Source != source {
+			continue
+		}
+		if kind != "" && entry.Kind != kind {
+			continue
+		}
+		if search != "" &&
+			!strings.Contains(strings.ToLower(entry.Name), search) &&
+			!strings.Contains(strings.ToLower(entry.Help), search) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+
+	// The offset may be anything up to MaxInt, clamp it before adding the limit
+	start := min(offset, len(matched))
+	page := matched[start:min(start+limit, len(matched))]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MetricsList{
+		Metrics:  page,
+		Total:    len(matched),
+		Limit:    limit,
+		Offset:   offset,
+		Warnings: warnings,
+	})
+}
+
+// intParam parses an optional integer query parameter
+func intParam(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
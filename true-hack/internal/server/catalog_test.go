@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"true-hack/internal/collector"
+
+	"go.uber.org/zap"
+)
+
+// catalogSource lists fixed entries, optionally after a delay or with an error, and counts the listings
+type catalogSource struct {
+	name    string
+	entries []collector.CatalogEntry
+	err     error
+	delay   time.Duration
+	calls   atomic.Int32
+}
+
+func (c *catalogSource) Name() string {
+	return c.name
+}
+
+func (c *catalogSource) Collect(_ context.Context, _ collector.Query) (*collector.Evidence, error) {
+	return &collector.Evidence{Source: c.name, Kind: collector.KindMetrics}, nil
+}
+
+func (c *catalogSource) Catalog(ctx context.Context) ([]collector.CatalogEntry, error) {
+	c.calls.Add(1)
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return c.entries, c.err
+}
+
+func testCatalogSource() *catalogSource {
+	source := &catalogSource{name: "prometheus"}
+	for _, name := range []string{"http_requests_total", "http_request_duration_seconds", "node_disk_io_time_seconds_total", "node_cpu_seconds_total", "up"} {
+		source.entries = append(source.entries, collector.CatalogEntry{
+			Name:   name,
+			Type:   "counter",
+			Help:   "Help of " + name,
+			Source: "prometheus",
+			Kind:   collector.KindMetrics,
+		})
+	}
+	return source
+}
+
+func TestHandleMetrics(t *testing.T) {
+	logs := &catalogSource{name: "loki", entries: []collector.CatalogEntry{
+		{Name: `{app="api"}`, Type: "stream", Help: "Disk errors", Source: "loki", Kind: collector.KindLogs},
+	}}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantNames  []string
+		wantTotal  int
+	}{
+		{
+			name:       "first page",
+			query:      "?limit=2",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{"http_requests_total", "http_request_duration_seconds"},
+			wantTotal:  6,
+		},
+		{
+			name:       "last partial page",
+			query:      "?limit=4&offset=4",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{"up", `{app="api"}`},
+			wantTotal:  6,
+		},
+		{
+			name:       "offset zero",
+			query:      "?limit=1&offset=0",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{"http_requests_total"},
+			wantTotal:  6,
+		},
+		{
+			name:       "offset at the end",
+			query:      "?offset=6",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{},
+			wantTotal:  6,
+		},
+		{
+			name:       "offset past the end",
+			query:      "?offset=100",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{},
+			wantTotal:  6,
+		},
+		{
+			name:       "offset above the spec maximum",
+			query:      fmt.Sprintf("?offset=%d", math.MaxInt),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "limit above the spec maximum",
+			query:      "?limit=1001",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "search is case-insensitive and matches the help",
+			query:      "?q=DISK",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{"node_disk_io_time_seconds_total", `{app="api"}`},
+			wantTotal:  2,
+		},
+		{
+			name:       "search and kind",
+			query:      "?q=disk&kind=logs",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{`{app="api"}`},
+			wantTotal:  1,
+		},
+		{
+			name:       "source",
+			query:      "?source=loki",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{`{app="api"}`},
+			wantTotal:  1,
+		},
+		{
+			name:       "no match",
+			query:      "?q=memory",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{},
+			wantTotal:  0,
+		},
+	}
+
+	s := newTestServer(t, time.Hour, testCatalogSource(), logs)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, http.MethodGet, "/api/v1/metrics"+tt.query, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var list MetricsList
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0, len(list.Metrics))
+			for _, entry := range list.Metrics {
+				names = append(names, entry.Name)
+			}
+			if !slices.Equal(names, tt.wantNames) || list.Total != tt.wantTotal {
+				t.Errorf("got %q of %d, want %q of %d", names, list.Total, tt.wantNames, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestHandleMetricsHugeOffset(t *testing.T) {
+	// Past the spec validation the handler must still not overflow the page bounds
+	s := newTestServer(t, time.Hour, testCatalogSource())
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/metrics?offset=%d&limit=1000", math.MaxInt), nil)
+	w := httptest.NewRecorder()
+	s.handleMetrics(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var list MetricsList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Metrics) != 0 || list.Total != 5 || list.Offset != math.MaxInt {
+		t.Errorf("got %+v", list)
+	}
+}
+
+func TestCatalogCache(t *testing.T) {
+	t.Run("cached until expired", func(t *testing.T) {
+		source := testCatalogSource()
+		c := newTestCatalog(t, source)
+
+		for range 2 {
+			if entries, warnings := c.list(t.Context()); len(entries) != 5 || warnings != nil {
+				t.Fatalf("got %d entries, warnings %q", len(entries), warnings)
+			}
+		}
+		if got := source.calls.Load(); got != 1 {
+			t.Fatalf("listed %d times before expiry, want 1", got)
+		}
+
+		c.mu.Lock()
+		c.updatedAt = time.Now().Add(-catalogTTL)
+		c.mu.Unlock()
+		c.list(t.Context())
+		if got := source.calls.Load(); got != 2 {
+			t.Errorf("listed %d times after expiry, want 2", got)
+		}
+	})
+
+	t.Run("failed source is not cached", func(t *testing.T) {
+		source := testCatalogSource()
+		failing := &catalogSource{name: "loki", err: errors.New("connection refused")}
+		c := newTestCatalog(t, source, failing)
+
+		for range 2 {
+			entries, warnings := c.list(t.Context())
+			if len(entries) != 5 || !slices.Equal(warnings, []string{"loki: connection refused"}) {
+				t.Fatalf("got %d entries, warnings %q", len(entries), warnings)
+			}
+		}
+		if got := failing.calls.Load(); got != 2 {
+			t.Errorf("listed %d times, want 2", got)
+		}
+	})
+
+	t.Run("concurrent requests share a listing", func(t *testing.T) {
+		source := testCatalogSource()
+		source.delay = 100 * time.Millisecond
+		c := newTestCatalog(t, source)
+
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if entries, _ := c.list(t.Context()); len(entries) != 5 {
+					t.Errorf("got %d entries", len(entries))
+				}
+			}()
+		}
+		wg.Wait()
+		if got := source.calls.Load(); got != 1 {
+			t.Errorf("listed %d times, want 1", got)
+		}
+	})
+
+	t.Run("request stops waiting for a slow source", func(t *testing.T) {
+		source := testCatalogSource()
+		source.delay = 200 * time.Millisecond
+		c := newTestCatalog(t, source)
+
+		ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+		defer cancel()
+		if entries, warnings := c.list(ctx); entries != nil || len(warnings) != 1 {
+			t.Fatalf("got %d entries, warnings %q", len(entries), warnings)
+		}
+
+		// The listing went on without the request and serves the next one
+		if entries, warnings := c.list(t.Context()); len(entries) != 5 || warnings != nil {
+			t.Fatalf("got %d entries, warnings %q", len(entries), warnings)
+		}
+		if got := source.calls.Load(); got != 1 {
+			t.Errorf("listed %d times, want 1", got)
+		}
+	})
+}
+
+func newTestCatalog(t *testing.T, sources ...collector.Collector) *catalog {
+	t.Helper()
+
+	collectors, err := collector.NewRegistry(sources...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newCatalog(collectors, zap.NewNop())
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"true-hack/docs"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// loadSpec parses the embedded OpenAPI document and builds a router matching requests to its operations
+func loadSpec() (routers.Router, error) {
+	spec, err := openapi3.NewLoader().LoadFromData(docs.OpenAPI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load OpenAPI spec: %w", err)
+	}
+	if err := spec.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI spec: %w", err)
+	}
+
+	// Servers list the development address, requests are matched by path only,
+	// whatever host and port the server is reached by
+	spec.Servers = nil
+
+	router, err := gorillamux.NewRouter(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OpenAPI router: %w", err)
+	}
+	return router, nil
+}
+
+// validateRequests rejects requests to operations of the spec that don't match it, with problem
+// details listing every invalid field. Requests outside the spec, like static files, pass through.
+func (s *Server) validateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := s.spec.FindRoute(r)
+		if err != nil {
+			if errors.Is(err, routers.ErrMethodNotAllowed) {
+				writeProblem(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("Method %s is not allowed", r.Method))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err = openapi3filter.ValidateRequest(r.Context(), &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError:         true,
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		})
+		if err != nil {
+			writeProblemDetails(w, validationProblem(r, err))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleSpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(docs.OpenAPI)
+}
+
+func (s *Server) handleSwaggerUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docs.SwaggerUI)
+}
+
+// swaggerUIFiles serves the embedded Swagger UI script and styles under /api/v1/docs/swagger-ui/
+func swaggerUIFiles() http.Handler {
+	return http.StripPrefix("/api/v1/docs/", http.FileServerFS(docs.SwaggerUIFiles))
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		// wantErrors are the invalid fields, nil for a response that is not a validation problem
+		wantErrors []FieldError
+	}{
+		{
+			name:       "bad body fields",
+			method:     http.MethodPost,
+			path:       "/api/v1/analyze",
+			body:       `{"query": 5, "mode": "other"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []FieldError{
+				{Pointer: "/mode", Detail: `value is not one of the allowed values ["prompt","agent"]`},
+				{Pointer: "/query", Detail: "value must be a string"},
+			},
+		},
+		{
+			name:       "missing body field",
+			method:     http.MethodPost,
+			path:       "/api/v1/analyze",
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []FieldError{{Pointer: "/query", Detail: `property "query" is missing`}},
+		},
+		{
+			name:       "body that is not json",
+			method:     http.MethodPost,
+			path:       "/api/v1/analyze",
+			body:       `not json`,
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []FieldError{{Detail: "invalid character 'o' in literal null (expecting 'u')"}},
+		},
+		{
+			name:       "bad query parameters",
+			method:     http.MethodGet,
+			path:       "/api/v1/metrics?limit=abc&kind=other",
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []FieldError{
+				{Parameter: "kind", Detail: `value is not one of the allowed values ["metrics","logs","traces"]`},
+				{Parameter: "limit", Detail: "value abc: an invalid integer: invalid syntax"},
+			},
+		},
+		{
+			name:       "method outside the spec",
+			method:     http.MethodGet,
+			path:       "/api/v1/analyze",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "valid request reaches the handler",
+			method:     http.MethodGet,
+			path:       "/api/v1/metrics?limit=10&kind=logs",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "route outside the spec passes through",
+			method:     http.MethodGet,
+			path:       "/nothing/here",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	s := newTestServer(t, time.Hour)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, tt.method, tt.path, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			contentType := w.Header().Get("Content-Type")
+
+			switch {
+			case tt.wantErrors != nil:
+				if contentType != "application/problem+json" {
+					t.Fatalf("Content-Type = %q", contentType)
+				}
+				var problem Problem
+				if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+					t.Fatal(err)
+				}
+				if problem.Type != "about:blank" || problem.Title != "Bad Request" || problem.Status != http.StatusBadRequest ||
+					problem.Instance != strings.Split(tt.path, "?")[0] || problem.Detail == "" {
+					t.Errorf("problem = %+v", problem)
+				}
+				slices.SortFunc(problem.Errors, func(a, b FieldError) int {
+					return cmp.Or(cmp.Compare(a.Pointer, b.Pointer), cmp.Compare(a.Parameter, b.Parameter))
+				})
+				if !slices.Equal(problem.Errors, tt.wantErrors) {
+					t.Errorf("errors = %+v, want %+v", problem.Errors, tt.wantErrors)
+				}
+			case tt.wantStatus == http.StatusMethodNotAllowed:
+				if contentType != "application/problem+json" {
+					t.Errorf("Content-Type = %q", contentType)
+				}
+			case tt.wantStatus == http.StatusNotFound:
+				// The file server answered, not the validation
+				if contentType == "application/problem+json" {
+					t.Errorf("route outside the spec got a problem: %s", w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestValidationProblem(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/analyze", nil)
+	problem := validationProblem(r, errors.New("request body is too large"))
+
+	want := []FieldError{{Detail: "request body is too large"}}
+	if problem.Status != http.StatusBadRequest || !slices.Equal(problem.Errors, want) {
+		t.Errorf("problem = %+v, want a single error without a field", problem)
+	}
+
+	w := httptest.NewRecorder()
+	writeProblemDetails(w, problem)
+	var body map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	// Members of RFC 9457, plus the errors extension
+	for _, member := range []string{"type", "title", "status", "detail", "instance", "errors"} {
+		if _, ok := body[member]; !ok {
+			t.Errorf("problem lacks %q: %v", member, body)
+		}
+	}
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
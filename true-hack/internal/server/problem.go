@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+// Problem is an error response in the problem details format of RFC 9457
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Errors lists every invalid field of a request that didn't match the spec
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError points to a single invalid part of a request
+type FieldError struct {
+	// Pointer is a JSON pointer into the request body
+	Pointer string `json:"pointer,omitempty"`
+	// Parameter is the name of an invalid query parameter
+	Parameter string `json:"parameter,omitempty"`
+	Detail    string `json:"detail"`
+}
+
+// writeProblem responds with a problem without field errors
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblemDetails(w, Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
+
+func writeProblemDetails(w http.ResponseWriter, problem Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// fieldProblem reports a single invalid field of the request body
+func fieldProblem(r *http.Request, pointer, detail string) Problem {
+	return Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(http.StatusBadRequest),
+		Status:   http.StatusBadRequest,
+		Detail:   "Invalid " + pointer + ": " + detail,
+		Instance: r.URL.Path,
+		Errors:   []FieldError{{Pointer: pointer, Detail: detail}},
+	}
+}
+
+// validationProblem turns the errors of openapi3filter.ValidateRequest into a problem
+// listing every invalid field
+func validationProblem(r *http.Request, err error) Problem {
+	problem := Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(http.StatusBadRequest),
+		Status:   http.StatusBadRequest,
+		Detail:   "Request doesn't match the API specification",
+		Instance: r.URL.Path,
+	}
+	collectFieldErrors(err, FieldError{}, &problem.Errors)
+	return problem
+}
+
+// collectFieldErrors walks nested errors, the parameter found on the way is kept in field.
+// Errors are matched by type, not errors.As, which would skip the levels carrying the field.
+func collectFieldErrors(err error, field FieldError, result *[]FieldError) {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		for _, inner := range e {
+			collectFieldErrors(inner, field, result)
+		}
+		return
+	case *openapi3filter.RequestError:
+		if e.Parameter != nil {
+			field.Parameter = e.Parameter.Name
+		}
+		if e.Err != nil {
+			collectFieldErrors(e.Err, field, result)
+			return
+		}
+		field.Detail = e.Reason
+	case *openapi3.SchemaError:
+		if path := e.JSONPointer(); field.Parameter == "" && len(path) > 0 {
+			field.Pointer = "/" + strings.Join(path, "/")
+		}
+		field.Detail = e.Reason
+	default:
+		field.Detail = err.Error()
+	}
+	*result = append(*result, field)
+}
@@ -1,14 +1,20 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"true-hack/internal/chain"
+	"true-hack/internal/collector"
 
+	"github.com/getkin/kin-openapi/routers"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
@@ -17,73 +23,205 @@ type Server struct {
 	analyzer *chain.Analyzer
 	logger   *zap.Logger
 	router   *mux.Router
+	catalog  *catalog
+	// spec matches requests to operations of docs/openapi.yaml for validation
+	spec routers.Router
+
+	mu   sync.Mutex
+	http *http.Server
 }
 
+// AnalyzeRequest is AnalysisRequest of docs/openapi.yaml
 type AnalyzeRequest struct {
-	Question  string   `json:"question"`
-	StartTime string   `json:"start_time"`
-	EndTime   string   `json:"end_time"`
-	Metrics   []string `json:"metrics"`
+	Query string `json:"query"`
+	// TimeRange is optional, without it the analyzer infers the period from the question
+	TimeRange *TimeRange `json:"time_range,omitempty"`
+	Metrics   []string   `json:"metrics"`
+	// Baseline is an optional reference period to compare with
+	Baseline *TimeRange `json:"baseline,omitempty"`
+	// Mode is prompt (default) or agent, see chain.ModeAgent
+	Mode string `json:"mode,omitempty"`
 }
 
-func NewServer(analyzer *chain.Analyzer, logger *zap.Logger) *Server {
+// NewServer fails only if the embedded OpenAPI spec is broken
+func NewServer(analyzer *chain.Analyzer, collectors *collector.Registry, logger *zap.Logger) (*Server, error) {
+	spec, err := loadSpec()
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Server{
 		analyzer: analyzer,
 		logger:   logger,
 		router:   mux.NewRouter(),
+		catalog:  newCatalog(collectors, logger),
+		spec:     spec,
 	}
 
+	s.router.Use(s.validateRequests)
 	s.router.HandleFunc("/api/v1/analyze", s.handleAnalyze).Methods("POST")
+	s.router.HandleFunc("/api/v1/analyze/stream", s.handleAnalyzeStream).Methods("POST")
+	s.router.HandleFunc("/api/v1/sessions", s.handleCreateSession).Methods("POST")
+	s.router.HandleFunc("/api/v1/sessions/{id}", s.handleGetSession).Methods("GET")
+	s.router.HandleFunc("/api/v1/sessions/{id}", s.handleDeleteSession).Methods("DELETE")
+	s.router.HandleFunc("/api/v1/sessions/{id}/messages", s.handleSessionMessage).Methods("POST")
+	s.router.HandleFunc("/api/v1/sessions/{id}/messages/stream", s.handleSessionMessageStream).Methods("POST")
 	s.router.HandleFunc("/api/v1/metrics", s.handleMetrics).Methods("GET")
+	s.router.HandleFunc("/api/v1/openapi.yaml", s.handleSpec).Methods("GET")
+	s.router.HandleFunc("/api/v1/docs", s.handleSwaggerUI).Methods("GET")
+	s.router.PathPrefix("/api/v1/docs/swagger-ui/").Handler(swaggerUIFiles()).Methods("GET")
 	s.router.PathPrefix("/").Handler(http.FileServer(http.Dir("static")))
 
-	return s
+	return s, nil
 }
 
 func (s *Server) handleAnalyze(w http.ResponseWriter, r *http.Request) {
-	var req AnalyzeRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		s.logger.Error("Failed to decode request", zap.Error(err))
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	req, ok := s.decodeAnalyzeRequest(w, r)
+	if !ok {
 		return
 	}
 
-	startTime, err := time.Parse(time.RFC3339, req.StartTime)
+	result, err := s.analyzer.Analyze(r.Context(), req)
 	if err != nil {
-		http.Error(w, "Invalid start time format", http.StatusBadRequest)
+		s.logger.Error("Failed to analyze", zap.Error(err))
+		writeProblem(w, r, http.StatusInternalServerError, fmt.Sprintf("Analysis failed: %v", err))
 		return
 	}
 
-	endTime, err := time.Parse(time.RFC3339, req.EndTime)
-	if err != nil {
-		http.Error(w, "Invalid end time format", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleAnalyzeStream runs the analysis and reports it as Server-Sent Events, see streamAnalysis
+func (s *Server) handleAnalyzeStream(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeAnalyzeRequest(w, r)
+	if !ok {
 		return
 	}
 
-	result, err := s.analyzer.Analyze(r.Context(), req.Question, startTime, endTime, req.Metrics)
+	s.streamAnalysis(w, r, func(progress chain.ProgressFunc) (*chain.LLMResponse, error) {
+		return s.analyzer.AnalyzeStream(r.Context(), req, progress)
+	})
+}
+
+// streamAnalysis runs analyze and reports it as Server-Sent Events:
+// "progress" for every collection and LLM phase, "token" for pieces of the answer,
+// "result" with the final LLMResponse and "error" if the analysis failed.
+func (s *Server) streamAnalysis(w http.ResponseWriter, r *http.Request, analyze func(chain.ProgressFunc) (*chain.LLMResponse, error)) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, r, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(event string, data any) {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			s.logger.Error("Failed to encode event", zap.String("event", event), zap.Error(err))
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		flusher.Flush()
+	}
+
+	_, err := analyze(func(e chain.Event) {
+		if e.Type == chain.EventResult {
+			send(string(e.Type), e.Result)
+			return
+		}
+		send(string(e.Type), e)
+	})
 	if err != nil {
 		s.logger.Error("Failed to analyze", zap.Error(err))
-		http.Error(w, fmt.Sprintf("Analysis failed: %v", err), http.StatusInternalServerError)
-		return
+		send("error", map[string]string{"error": fmt.Sprintf("Analysis failed: %v", err)})
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+// decodeAnalyzeRequest decodes a request already validated against the spec
+// and checks what the spec can't express
+func (s *Server) decodeAnalyzeRequest(w http.ResponseWriter, r *http.Request) (chain.AnalysisRequest, bool) {
+	var req AnalyzeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.logger.Error("Failed to decode request", zap.Error(err))
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return chain.AnalysisRequest{}, false
+	}
+
+	// Relative times of a request are all resolved against the same now
+	now := time.Now()
+
+	result := chain.AnalysisRequest{
+		Query:   req.Query,
+		Metrics: req.Metrics,
+		Mode:    req.Mode,
+	}
+
+	if req.TimeRange != nil {
+		timeRange, ok := s.resolveTimeRange(w, r, "/time_range", req.TimeRange, now)
+		if !ok {
+			return chain.AnalysisRequest{}, false
+		}
+		result.TimeRange = timeRange
+	}
+
+	if req.Baseline != nil {
+		baseline, ok := s.resolveTimeRange(w, r, "/baseline", req.Baseline, now)
+		if !ok {
+			return chain.AnalysisRequest{}, false
+		}
+		result.Baseline = &baseline
+	}
+
+	return result, true
 }
 
-func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement metrics list endpoint
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"metrics": []string{
-			"process_cpu_seconds_total",
-			"process_resident_memory_bytes",
-			"http_requests_total",
-		},
-	})
+// resolveTimeRange turns a range of the request into absolute times, pointer locates it in the request for errors
+func (s *Server) resolveTimeRange(w http.ResponseWriter, r *http.Request, pointer string, t *TimeRange, now time.Time) (chain.TimeRange, bool) {
+	start, end, field, err := t.Resolve(now)
+	if err != nil {
+		writeProblemDetails(w, fieldProblem(r, pointer+field, err.Error()))
+		return chain.TimeRange{}, false
+	}
+	if !end.After(start) {
+		writeProblemDetails(w, fieldProblem(r, pointer, "end must be after start"))
+		return chain.TimeRange{}, false
+	}
+	return chain.TimeRange{Start: start, End: end}, true
 }
 
-func (s *Server) Start(port int) error {
+// Start serves requests until Shutdown. Request contexts are derived from ctx,
+// so cancelling it aborts running analyses.
+func (s *Server) Start(ctx context.Context, port int) error {
 	s.logger.Info("Starting server", zap.Int("port", port))
-	return http.ListenAndServe(":"+strconv.Itoa(port), s.router)
+	srv := &http.Server{
+		Addr:        ":" + strconv.Itoa(port),
+		Handler:     s.router,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	s.mu.Lock()
+	s.http = srv
+	s.mu.Unlock()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for running requests until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.http
+	s.mu.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
 }
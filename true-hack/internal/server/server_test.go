@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"true-hack/internal/chain"
+	"true-hack/internal/collector"
+	"true-hack/internal/llm"
+
+	"go.uber.org/zap"
+)
+
+const testAnswer = `{"analysis": "Errors of the api started after the deploy", "confidence": 0.8, "suggestions": [], "relevant_metrics": []}`
+
+func newTestServer(t *testing.T, sessionTTL time.Duration, sources ...collector.Collector) *Server {
+	t.Helper()
+	return newTestServerWith(t, llm.NewFake("fake", testAnswer), sessionTTL, sources...)
+}
+
+func newTestServerWith(t *testing.T, provider llm.LLM, sessionTTL time.Duration, sources ...collector.Collector) *Server {
+	t.Helper()
+
+	collectors, err := collector.NewRegistry(sources...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, err := chain.NewMemoryCache(time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &chain.Config{
+		Model:            "gpt-4o",
+		MaxTokens:        1000,
+		SystemPrompt:     "You analyze incidents.",
+		MetricSeriesTopK: 10,
+		SessionTTL:       sessionTTL,
+		MaxSessions:      10,
+		DefaultTimeRange: time.Hour,
+		AgentMaxSteps:    3,
+		AgentMaxTokens:   10000,
+
+		AgentToolResultTokens: 1000,
+	}
+	analyzer, err := chain.NewAnalyzer([]llm.LLM{provider}, zap.NewNop(), collectors, nil, nil, config, answers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(analyzer, collectors, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func serve(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// sseEvent is an event of a text/event-stream body
+type sseEvent struct {
+	name string
+	data string
+}
+
+// parseEvents splits a stream into events, every one must have an event and a data line
+func parseEvents(t *testing.T, body string) []sseEvent {
+	t.Helper()
+
+	if !strings.HasSuffix(body, "\n\n") {
+		t.Fatalf("stream doesn't end with a complete event: %q", body)
+	}
+	var events []sseEvent
+	for _, block := range strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n") {
+		lines := strings.Split(block, "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "event: ") || !strings.HasPrefix(lines[1], "data: ") {
+			t.Fatalf("malformed event %q", block)
+		}
+		event := sseEvent{name: strings.TrimPrefix(lines[0], "event: "), data: strings.TrimPrefix(lines[1], "data: ")}
+		if !json.Valid([]byte(event.data)) {
+			t.Fatalf("event %s has invalid data %q", event.name, event.data)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAnalyzeStream(t *testing.T) {
+	const request = `{"query": "Why does the api fail?", "time_range": "now-1h/now"}`
+
+	t.Run("progress, tokens and the result", func(t *testing.T) {
+		s := newTestServer(t, time.Hour)
+		w := serve(s, http.MethodPost, "/api/v1/analyze/stream", request)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+			t.Errorf("Content-Type = %q", got)
+		}
+
+		events := parseEvents(t, w.Body.String())
+		var names []string
+		var tokens strings.Builder
+		for _, event := range events {
+			names = append(names, event.name)
+			if event.name == string(chain.EventToken) {
+				var token chain.Event
+				if err := json.Unmarshal([]byte(event.data), &token); err != nil {
+					t.Fatal(err)
+				}
+				tokens.WriteString(token.Text)
+			}
+		}
+		if names[0] != string(chain.EventProgress) || tokens.Len() == 0 {
+			t.Errorf("got events %v, want progress first and tokens", names)
+		}
+		if !strings.Contains(tokens.String(), "Errors of the api") {
+			t.Errorf("tokens = %q, want the answer", tokens.String())
+		}
+
+		last := events[len(events)-1]
+		if last.name != string(chain.EventResult) {
+			t.Fatalf("last event is %s, want result", last.name)
+		}
+		var result chain.LLMResponse
+		if err := json.Unmarshal([]byte(last.data), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Analysis != "Errors of the api started after the deploy" {
+			t.Errorf("result = %+v", result)
+		}
+	})
+
+	t.Run("failure is the last event", func(t *testing.T) {
+		provider := llm.NewFake("fake", testAnswer).FailWith(errors.New("rate limited"))
+		s := newTestServerWith(t, provider, time.Hour)
+		w := serve(s, http.MethodPost, "/api/v1/analyze/stream", request)
+		// The stream has already started, the failure can't be a status code
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+
+		events := parseEvents(t, w.Body.String())
+		last := events[len(events)-1]
+		var body map[string]string
+		if err := json.Unmarshal([]byte(last.data), &body); err != nil {
+			t.Fatal(err)
+		}
+		if last.name != "error" || !strings.HasPrefix(body["error"], "Analysis failed: ") || !strings.Contains(body["error"], "rate limited") {
+			t.Errorf("last event is %s %q, want the error", last.name, last.data)
+		}
+		for _, event := range events {
+			if event.name == string(chain.EventResult) {
+				t.Error("failed analysis sent a result")
+			}
+		}
+	})
+
+	t.Run("invalid request is a problem, not a stream", func(t *testing.T) {
+		s := newTestServer(t, time.Hour)
+		w := serve(s, http.MethodPost, "/api/v1/analyze/stream", `{"query": "Why?", "time_range": "now/now-1h"}`)
+		if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("status %d, Content-Type %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+	})
+}
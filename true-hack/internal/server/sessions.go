@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"true-hack/internal/chain"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// MessageRequest is a question of a session, SessionMessage of docs/openapi.yaml
+type MessageRequest struct {
+	Query string `json:"query"`
+	// Metrics are collected in addition to the ones related to the question
+	Metrics []string `json:"metrics"`
+}
+
+// handleCreateSession starts a conversation. The body is an AnalyzeRequest whose query is
+// optional, with a query the session is returned with its answer.
+func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeAnalyzeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	session, err := s.analyzer.CreateSession(r.Context(), req, nil)
+	if err != nil {
+		s.logger.Error("Failed to create session", zap.Error(err))
+		writeProblem(w, r, http.StatusInternalServerError, fmt.Sprintf("Analysis failed: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/v1/sessions/"+session.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session)
+}
+
+func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	session, err := s.analyzer.Session(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeSessionError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+func (s *Server) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	if err := s.analyzer.DeleteSession(mux.Vars(r)["id"]); err != nil {
+		s.writeSessionError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleSessionMessage(w http.ResponseWriter, r *http.Request) {
+	var req MessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	result, err := s.analyzer.Ask(r.Context(), mux.Vars(r)["id"], req.Query, req.Metrics, nil)
+	if err != nil {
+		s.writeSessionError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleSessionMessageStream is handleSessionMessage reported as Server-Sent Events like /api/v1/analyze/stream
+func (s *Server) handleSessionMessageStream(w http.ResponseWriter, r *http.Request) {
+	var req MessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	// An unknown session is reported with a status code, not as an event of a started stream
+	id := mux.Vars(r)["id"]
+	if _, err := s.analyzer.Session(id); err != nil {
+		s.writeSessionError(w, r, err)
+		return
+	}
+
+	s.streamAnalysis(w, r, func(progress chain.ProgressFunc) (*chain.LLMResponse, error) {
+		return s.analyzer.Ask(r.Context(), id, req.Query, req.Metrics, progress)
+	})
+}
+
+func (s *Server) writeSessionError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, chain.ErrSessionNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "Session not found or expired")
+		return
+	}
+	s.logger.Error("Failed to answer in session", zap.Error(err))
+	writeProblem(w, r, http.StatusInternalServerError, fmt.Sprintf("Analysis failed: %v", err))
+}
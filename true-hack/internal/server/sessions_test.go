@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"true-hack/internal/chain"
+)
+
+func TestSessionNotFound(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	s := newTestServer(t, ttl)
+
+	w := serve(s, http.MethodPost, "/api/v1/sessions", `{"time_range": "now-1h/now"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create session: status %d: %s", w.Code, w.Body)
+	}
+	var session chain.SessionInfo
+	if err := json.NewDecoder(w.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(s, http.MethodGet, "/api/v1/sessions/"+session.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("get live session: status %d: %s", w.Code, w.Body)
+	}
+
+	time.Sleep(2 * ttl)
+
+	requests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{name: "get expired", method: http.MethodGet, path: "/api/v1/sessions/" + session.ID},
+		{name: "get unknown", method: http.MethodGet, path: "/api/v1/sessions/unknown"},
+		{name: "delete unknown", method: http.MethodDelete, path: "/api/v1/sessions/unknown"},
+		{name: "ask expired", method: http.MethodPost, path: "/api/v1/sessions/" + session.ID + "/messages", body: `{"query": "Why?"}`},
+		{name: "ask unknown", method: http.MethodPost, path: "/api/v1/sessions/unknown/messages", body: `{"query": "Why?"}`},
+		{name: "stream unknown", method: http.MethodPost, path: "/api/v1/sessions/unknown/messages/stream", body: `{"query": "Why?"}`},
+	}
+	for _, tt := range requests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, tt.method, tt.path, tt.body)
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("status %d, want 404: %s", w.Code, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("content type %q, want application/problem+json", ct)
+			}
+			var problem Problem
+			if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Status != http.StatusNotFound || problem.Detail != "Session not found or expired" || problem.Instance != tt.path {
+				t.Errorf("problem = %+v", problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"true-hack/internal/timerange"
+)
+
+// TimeRange is TimeRange of docs/openapi.yaml: either an object with start and optional end,
+// or a string "start/end" like now-15m/now. Times are RFC3339, Unix timestamps in seconds or
+// milliseconds, or Grafana-style expressions relative to now.
+type TimeRange struct {
+	Start TimePoint `json:"start"`
+	End   TimePoint `json:"end,omitempty"`
+	// Expression is the range given as a string
+	Expression string `json:"-"`
+}
+
+// TimePoint is a time given as a string or a Unix timestamp number
+type TimePoint string
+
+func (t *TimeRange) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		return json.Unmarshal(data, &t.Expression)
+	}
+
+	// Decode into a type without this method to avoid the recursion
+	type bounds TimeRange
+	return json.Unmarshal(data, (*bounds)(t))
+}
+
+func (p *TimePoint) UnmarshalJSON(data []byte) error {
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		*p = TimePoint(v.String())
+	case string:
+		*p = TimePoint(v)
+	default:
+		return fmt.Errorf("time must be a string or a number, got %s", data)
+	}
+	return nil
+}
+
+// Resolve returns absolute times of the range. On error field is the JSON pointer
+// of the invalid part relative to the range.
+func (t *TimeRange) Resolve(now time.Time) (start, end time.Time, field string, err error) {
+	if t.Expression != "" {
+		start, end, err = timerange.ParseRange(t.Expression, now)
+		return start, end, "", err
+	}
+
+	start, err = timerange.Parse(string(t.Start), now)
+	if err != nil {
+		return time.Time{}, time.Time{}, "/start", err
+	}
+
+	if t.End == "" {
+		return start, now, "", nil
+	}
+	end, err = timerange.ParseEnd(string(t.End), now)
+	if err != nil {
+		return time.Time{}, time.Time{}, "/end", err
+	}
+	return start, end, "", nil
+}
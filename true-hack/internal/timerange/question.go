@@ -0,0 +1,119 @@
+package timerange
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// "last 30 minutes", "past 2h", "in the last hour", "previous three days"
+	lastRegex = regexp.MustCompile(`(?i)\b(?:last|past|previous)\s+(?:(\d+|a|an|one|two|three|four|five|six|seven|eight|nine|ten|twelve|fifteen|twenty|thirty)\s*)?(seconds?|secs?|minutes?|mins?|m|hours?|hrs?|h|days?|d|weeks?|w)\b`)
+	// "за последние 30 минут", "последний час", "за последние 2 ч". \b is ASCII only in Go, so
+	// the end of a unit is checked by the following character.
+	lastRussianRegex = regexp.MustCompile(`(?i)(?:за\s+)?последн\p{L}*\s+(?:(\d+)\s*)?(секунд\p{L}*|сек|минут\p{L}*|мин|час\p{L}*|ч|сут\p{L}*|дн\p{L}*|день|недел\p{L}*)(?:[^\p{L}]|$)`)
+	halfHourRegex    = regexp.MustCompile(`(?i)\b(?:last|past)\s+half\s+(?:an\s+)?hour\b|(?:за\s+)?(?:последние\s+)?полчаса`)
+	sinceRegex       = regexp.MustCompile(`(?i)\bsince\s+([01]?\d|2[0-3]):([0-5]\d)\b|(?:^|\s)с\s+([01]?\d|2[0-3]):([0-5]\d)`)
+	todayRegex       = regexp.MustCompile(`(?i)\btoday\b|сегодня`)
+	yesterdayRegex   = regexp.MustCompile(`(?i)\byesterday\b|вчера`)
+
+	numberWords = map[string]int{
+		"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6, "seven": 7,
+		"eight": 8, "nine": 9, "ten": 10, "twelve": 12, "fifteen": 15, "twenty": 20, "thirty": 30,
+	}
+)
+
+// FromQuestion finds a period the question mentions: "in the last 30 minutes", "past 2 hours",
+// "since 14:30", "today", "yesterday", and their Russian equivalents. The phrase found is returned
+// to show where the range came from. The first period mentioned wins.
+func FromQuestion(question string, now time.Time) (start, end time.Time, phrase string, ok bool) {
+	type candidate struct {
+		index      int
+		start, end time.Time
+		phrase     string
+	}
+	var found []candidate
+
+	if loc := halfHourRegex.FindStringIndex(question); loc != nil {
+		found = append(found, candidate{loc[0], now.Add(-30 * time.Minute), now, question[loc[0]:loc[1]]})
+	}
+
+	for _, re := range []*regexp.Regexp{lastRegex, lastRussianRegex} {
+		match := re.FindStringSubmatchIndex(question)
+		if match == nil {
+			continue
+		}
+		n := 1
+		if match[2] >= 0 {
+			n = parseCount(question[match[2]:match[3]])
+		}
+		d, ok := unitDuration(question[match[4]:match[5]])
+		if !ok || n <= 0 || !fits(n, d) {
+			continue
+		}
+		found = append(found, candidate{match[0], now.Add(-time.Duration(n) * d), now, strings.TrimSpace(question[match[0]:match[5]])})
+	}
+
+	if match := sinceRegex.FindStringSubmatchIndex(question); match != nil {
+		hourAt, minuteAt := 2, 4
+		if match[2] < 0 {
+			hourAt, minuteAt = 6, 8
+		}
+		hour, _ := strconv.Atoi(question[match[hourAt]:match[hourAt+1]])
+		minute, _ := strconv.Atoi(question[match[minuteAt]:match[minuteAt+1]])
+		since := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+		if since.After(now) {
+			since = since.AddDate(0, 0, -1)
+		}
+		found = append(found, candidate{match[0], since, now, strings.TrimSpace(question[match[0]:match[1]])})
+	}
+
+	today := round(now, 'd', false)
+	if loc := todayRegex.FindStringIndex(question); loc != nil {
+		found = append(found, candidate{loc[0], today, now, question[loc[0]:loc[1]]})
+	}
+	if loc := yesterdayRegex.FindStringIndex(question); loc != nil {
+		found = append(found, candidate{loc[0], today.AddDate(0, 0, -1), today, question[loc[0]:loc[1]]})
+	}
+
+	if len(found) == 0 {
+		return time.Time{}, time.Time{}, "", false
+	}
+	first := found[0]
+	for _, c := range found[1:] {
+		if c.index < first.index {
+			first = c
+		}
+	}
+	return first.start, first.end, first.phrase, true
+}
+
+func parseCount(s string) int {
+	if n, ok := numberWords[strings.ToLower(s)]; ok {
+		return n
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// unitDuration maps an English or Russian time unit to its length
+func unitDuration(unit string) (time.Duration, bool) {
+	unit = strings.ToLower(unit)
+	switch {
+	case strings.HasPrefix(unit, "s"), strings.HasPrefix(unit, "сек"):
+		return time.Second, true
+	case strings.HasPrefix(unit, "m"), strings.HasPrefix(unit, "мин"):
+		return time.Minute, true
+	case strings.HasPrefix(unit, "h"), strings.HasPrefix(unit, "ч"), strings.HasPrefix(unit, "час"):
+		return time.Hour, true
+	case strings.HasPrefix(unit, "d"), strings.HasPrefix(unit, "дн"), strings.HasPrefix(unit, "день"), strings.HasPrefix(unit, "сут"):
+		return 24 * time.Hour, true
+	case strings.HasPrefix(unit, "w"), strings.HasPrefix(unit, "недел"):
+		return 7 * 24 * time.Hour, true
+	}
+	return 0, false
+}
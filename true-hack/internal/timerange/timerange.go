@@ -0,0 +1,177 @@
+// Package timerange parses the ways a period to analyze can be given: absolute timestamps,
+// Grafana-style expressions relative to now and phrases of a question like "in the last 30 minutes"
+package timerange
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// millisecondsFrom separates Unix timestamps in milliseconds, as Grafana sends them, from ones
+// in seconds. In seconds it is the year 33658.
+const millisecondsFrom = 1e12
+
+var (
+	unixRegex = regexp.MustCompile(`^\d+(\.\d+)?$`)
+	// relativeRegex matches now followed by any number of offsets and an optional rounding: now-1d/d
+	relativeRegex = regexp.MustCompile(`^now((?:[+-]\d+[smhdwMy])*)(?:/([smhdwMy]))?$`)
+	offsetRegex   = regexp.MustCompile(`([+-])(\d+)([smhdwMy])`)
+)
+
+// Parse parses a point in time: RFC3339, a Unix timestamp in seconds or milliseconds,
+// or an expression relative to now like now, now-15m or now-1d/d. Rounding goes down
+// to the start of the unit.
+func Parse(value string, now time.Time) (time.Time, error) {
+	return parse(value, now, false)
+}
+
+// ParseEnd is Parse for the end of a range, rounding goes up to the end of the unit,
+// so now-1d/d to now-1d/d is the whole of yesterday
+func ParseEnd(value string, now time.Time) (time.Time, error) {
+	return parse(value, now, true)
+}
+
+// ParseRange parses "start/end" of two Parse values, e.g. now-15m/now.
+// A single value is the start of a range ending now.
+func ParseRange(value string, now time.Time) (start, end time.Time, err error) {
+	value = strings.TrimSpace(value)
+
+	// Rounding uses a slash too, so try every one of them: now-1d/d/now
+	var splitErr error
+	for i := range len(value) {
+		if value[i] != '/' {
+			continue
+		}
+		start, startErr := Parse(value[:i], now)
+		end, endErr := ParseEnd(value[i+1:], now)
+		if startErr == nil && endErr == nil {
+			return start, end, nil
+		}
+		splitErr = errors.Join(startErr, endErr)
+	}
+
+	start, err = Parse(value, now)
+	if err != nil {
+		// The error of the last split names the invalid part, not the whole range
+		if splitErr != nil {
+			return time.Time{}, time.Time{}, splitErr
+		}
+		return time.Time{}, time.Time{}, err
+	}
+	return start, now, nil
+}
+
+func parse(value string, now time.Time, roundUp bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if match := relativeRegex.FindStringSubmatch(value); match != nil {
+		result := now
+		for _, offset := range offsetRegex.FindAllStringSubmatch(match[1], -1) {
+			n, err := strconv.Atoi(offset[2])
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid offset %q: %w", offset[0], err)
+			}
+			if offset[1] == "-" {
+				n = -n
+			}
+			if !fits(n, unitLength[offset[3][0]]) {
+				return time.Time{}, fmt.Errorf("offset %q is too large", offset[0])
+			}
+			result = add(result, n, offset[3][0])
+		}
+		if match[2] != "" {
+			result = round(result, match[2][0], roundUp)
+		}
+		return result, nil
+	}
+
+	if unixRegex.MatchString(value) {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q: %w", value, err)
+		}
+		if seconds >= millisecondsFrom {
+			return time.UnixMilli(int64(seconds)).In(now.Location()), nil
+		}
+		whole := int64(seconds)
+		return time.Unix(whole, int64((seconds-float64(whole))*1e9)).In(now.Location()), nil
+	}
+
+	result, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC3339, a Unix timestamp nor a relative time like now-1h", value)
+	}
+	return result, nil
+}
+
+// unitLength is the longest length of every unit of relative times
+var unitLength = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+	'M': 31 * 24 * time.Hour,
+	'y': 366 * 24 * time.Hour,
+}
+
+// fits tells whether n units make a time.Duration, about 292 years. Longer offsets overflow
+// time arithmetic and would silently give a wrong time.
+func fits(n int, unit time.Duration) bool {
+	limit := math.MaxInt64 / int64(unit)
+	return int64(n) <= limit && int64(n) >= -limit
+}
+
+// add moves t by n units, days and longer ones follow the calendar
+func add(t time.Time, n int, unit byte) time.Time {
+	switch unit {
+	case 's':
+		return t.Add(time.Duration(n) * time.Second)
+	case 'm':
+		return t.Add(time.Duration(n) * time.Minute)
+	case 'h':
+		return t.Add(time.Duration(n) * time.Hour)
+	case 'd':
+		return t.AddDate(0, 0, n)
+	case 'w':
+		return t.AddDate(0, 0, 7*n)
+	case 'M':
+		return t.AddDate(0, n, 0)
+	case 'y':
+		return t.AddDate(n, 0, 0)
+	}
+	return t
+}
+
+// round returns the start of the unit t is in, or with up the start of the next one.
+// Weeks start on Monday.
+func round(t time.Time, unit byte, up bool) time.Time {
+	year, month, day := t.Date()
+	var start time.Time
+	switch unit {
+	case 's':
+		start = t.Truncate(time.Second)
+	case 'm':
+		start = time.Date(year, month, day, t.Hour(), t.Minute(), 0, 0, t.Location())
+	case 'h':
+		start = time.Date(year, month, day, t.Hour(), 0, 0, 0, t.Location())
+	case 'd':
+		start = time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	case 'w':
+		start = time.Date(year, month, day-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	case 'M':
+		start = time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	case 'y':
+		start = time.Date(year, time.January, 1, 0, 0, 0, 0, t.Location())
+	}
+
+	if up {
+		return add(start, 1, unit)
+	}
+	return start
+}
@@ -0,0 +1,242 @@
+package timerange
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// now is a Wednesday afternoon
+var now = time.Date(2025, 1, 15, 14, 37, 25, 0, time.UTC)
+
+func date(month time.Month, day, hour, minute int) time.Time {
+	return time.Date(2025, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantEnd time.Time
+	}{
+		{value: "now", want: now, wantEnd: now},
+		{value: " now-15m ", want: now.Add(-15 * time.Minute), wantEnd: now.Add(-15 * time.Minute)},
+		{value: "now+1h", want: now.Add(time.Hour), wantEnd: now.Add(time.Hour)},
+		{value: "now-1d-2h", want: now.Add(-26 * time.Hour), wantEnd: now.Add(-26 * time.Hour)},
+		{value: "now/m", want: date(time.January, 15, 14, 37), wantEnd: date(time.January, 15, 14, 38)},
+		{value: "now/h", want: date(time.January, 15, 14, 0), wantEnd: date(time.January, 15, 15, 0)},
+		{value: "now-1d/d", want: date(time.January, 14, 0, 0), wantEnd: date(time.January, 15, 0, 0)},
+		{value: "now/w", want: date(time.January, 13, 0, 0), wantEnd: date(time.January, 20, 0, 0)},
+		{value: "now-1w/w", want: date(time.January, 6, 0, 0), wantEnd: date(time.January, 13, 0, 0)},
+		{value: "now/M", want: date(time.January, 1, 0, 0), wantEnd: date(time.February, 1, 0, 0)},
+		{value: "now-1M/M", want: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC), wantEnd: date(time.January, 1, 0, 0)},
+		{value: "now/y", want: date(time.January, 1, 0, 0), wantEnd: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{value: "2025-01-10T08:00:00Z", want: date(time.January, 10, 8, 0), wantEnd: date(time.January, 10, 8, 0)},
+		{value: "1736496000", want: date(time.January, 10, 8, 0), wantEnd: date(time.January, 10, 8, 0)},
+		{value: "1736496000.5", want: date(time.January, 10, 8, 0).Add(500 * time.Millisecond), wantEnd: date(time.January, 10, 8, 0).Add(500 * time.Millisecond)},
+		{value: "1736496000000", want: date(time.January, 10, 8, 0), wantEnd: date(time.January, 10, 8, 0)},
+		// Right below millisecondsFrom it is still seconds, at it milliseconds
+		{value: "999999999999", want: time.Unix(999999999999, 0).UTC(), wantEnd: time.Unix(999999999999, 0).UTC()},
+		{value: "1000000000000", want: time.Unix(1000000000, 0).UTC(), wantEnd: time.Unix(1000000000, 0).UTC()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := Parse(tt.value, now)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("Parse = %s, want %s", got, tt.want)
+			}
+
+			got, err = ParseEnd(tt.value, now)
+			if err != nil {
+				t.Fatalf("ParseEnd: %v", err)
+			}
+			if !got.Equal(tt.wantEnd) {
+				t.Errorf("ParseEnd = %s, want %s", got, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestParseWeekStartsOnMonday(t *testing.T) {
+	tests := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{now: date(time.January, 13, 0, 0), want: date(time.January, 13, 0, 0)},
+		{now: date(time.January, 13, 23, 59), want: date(time.January, 13, 0, 0)},
+		{now: date(time.January, 18, 12, 0), want: date(time.January, 13, 0, 0)},
+		{now: date(time.January, 19, 23, 59), want: date(time.January, 13, 0, 0)},
+		// The week crosses the year
+		{now: time.Date(2024, 12, 31, 12, 0, 0, 0, time.UTC), want: time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC)},
+		{now: date(time.January, 1, 12, 0), want: time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse("now/w", tt.now)
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("now/w on %s %s = %s, want %s", tt.now.Weekday(), tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr string
+	}{
+		{value: "yesterday", wantErr: "neither RFC3339"},
+		{value: "now-1x", wantErr: "neither RFC3339"},
+		{value: "now/q", wantErr: "neither RFC3339"},
+		{value: "2025-01-10 08:00", wantErr: "neither RFC3339"},
+		{value: "now-99999999999999999999h", wantErr: "invalid offset"},
+		{value: "now-9999999h", wantErr: `offset "-9999999h" is too large`},
+		{value: "now+2562048h", wantErr: `offset "+2562048h" is too large`},
+		{value: "now-9999999999s", wantErr: `offset "-9999999999s" is too large`},
+		{value: "now-200000d", wantErr: `offset "-200000d" is too large`},
+		{value: "now-300y", wantErr: `offset "-300y" is too large`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			_, err := Parse(tt.value, now)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Parse error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Offsets just within time.Duration work
+	if got, err := Parse("now-2562047h", now); err != nil || !got.Equal(now.Add(-2562047*time.Hour)) {
+		t.Errorf("Parse(now-2562047h) = %s, %v", got, err)
+	}
+	if _, err := Parse("now-250y", now); err != nil {
+		t.Errorf("Parse(now-250y): %v", err)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{value: "now-15m/now", wantStart: now.Add(-15 * time.Minute), wantEnd: now},
+		{value: "now-1h", wantStart: now.Add(-time.Hour), wantEnd: now},
+		// Both slashes could split the range, only one gives two valid times
+		{value: "now-1d/d/now-1d/d", wantStart: date(time.January, 14, 0, 0), wantEnd: date(time.January, 15, 0, 0)},
+		{value: "now-1d/d/now", wantStart: date(time.January, 14, 0, 0), wantEnd: now},
+		{value: "now-2h/now/h", wantStart: now.Add(-2 * time.Hour), wantEnd: date(time.January, 15, 15, 0)},
+		{value: "now/d", wantStart: date(time.January, 15, 0, 0), wantEnd: now},
+		{value: "now/w/now/w", wantStart: date(time.January, 13, 0, 0), wantEnd: date(time.January, 20, 0, 0)},
+		{value: "2025-01-10T08:00:00Z/2025-01-10T09:00:00Z", wantStart: date(time.January, 10, 8, 0), wantEnd: date(time.January, 10, 9, 0)},
+		{value: "1736496000000/1736499600000", wantStart: date(time.January, 10, 8, 0), wantEnd: date(time.January, 10, 9, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			start, end, err := ParseRange(tt.value, now)
+			if err != nil {
+				t.Fatalf("ParseRange: %v", err)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("ParseRange = %s - %s, want %s - %s", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestParseRangeErrors(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr string
+	}{
+		{value: "", wantErr: "neither RFC3339"},
+		{value: "last hour", wantErr: `"last hour" is neither RFC3339`},
+		{value: "now-1h/soon", wantErr: `"soon" is neither RFC3339`},
+		{value: "now-9999999h/now", wantErr: `offset "-9999999h" is too large`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			_, _, err := ParseRange(tt.value, now)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseRange error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFromQuestion(t *testing.T) {
+	today := date(time.January, 15, 0, 0)
+	yesterday := date(time.January, 14, 0, 0)
+
+	tests := []struct {
+		question   string
+		wantStart  time.Time
+		wantEnd    time.Time
+		wantPhrase string
+	}{
+		{question: "What happened in the last 30 minutes?", wantStart: now.Add(-30 * time.Minute), wantEnd: now, wantPhrase: "last 30 minutes"},
+		{question: "errors for the past 2h", wantStart: now.Add(-2 * time.Hour), wantEnd: now, wantPhrase: "past 2h"},
+		{question: "Latency over the previous three days", wantStart: now.Add(-72 * time.Hour), wantEnd: now, wantPhrase: "previous three days"},
+		{question: "what broke in the last hour", wantStart: now.Add(-time.Hour), wantEnd: now, wantPhrase: "last hour"},
+		{question: "LAST WEEK", wantStart: now.Add(-7 * 24 * time.Hour), wantEnd: now, wantPhrase: "LAST WEEK"},
+		{question: "spikes in the last half hour", wantStart: now.Add(-30 * time.Minute), wantEnd: now, wantPhrase: "last half hour"},
+		{question: "Что случилось за последние 15 минут?", wantStart: now.Add(-15 * time.Minute), wantEnd: now, wantPhrase: "за последние 15 минут"},
+		{question: "ошибки за последний час", wantStart: now.Add(-time.Hour), wantEnd: now, wantPhrase: "за последний час"},
+		{question: "за последние 2 ч", wantStart: now.Add(-2 * time.Hour), wantEnd: now, wantPhrase: "за последние 2 ч"},
+		{question: "что было за последние сутки", wantStart: now.Add(-24 * time.Hour), wantEnd: now, wantPhrase: "за последние сутки"},
+		{question: "последние 3 дня", wantStart: now.Add(-72 * time.Hour), wantEnd: now, wantPhrase: "последние 3 дня"},
+		{question: "за последние 10 мин.", wantStart: now.Add(-10 * time.Minute), wantEnd: now, wantPhrase: "за последние 10 мин"},
+		{question: "ошибки за полчаса", wantStart: now.Add(-30 * time.Minute), wantEnd: now, wantPhrase: "за полчаса"},
+		{question: "errors since 14:30", wantStart: date(time.January, 15, 14, 30), wantEnd: now, wantPhrase: "since 14:30"},
+		// 15:00 hasn't come yet today, so it is yesterday's
+		{question: "errors since 15:00", wantStart: date(time.January, 14, 15, 0), wantEnd: now, wantPhrase: "since 15:00"},
+		{question: "ошибки с 9:05", wantStart: date(time.January, 15, 9, 5), wantEnd: now, wantPhrase: "с 9:05"},
+		{question: "what failed today", wantStart: today, wantEnd: now, wantPhrase: "today"},
+		{question: "что сломалось вчера", wantStart: yesterday, wantEnd: today, wantPhrase: "вчера"},
+		// The first period mentioned wins
+		{question: "compare yesterday with the last hour", wantStart: yesterday, wantEnd: today, wantPhrase: "yesterday"},
+		{question: "in the last hour, unlike yesterday", wantStart: now.Add(-time.Hour), wantEnd: now, wantPhrase: "last hour"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.question, func(t *testing.T) {
+			start, end, phrase, ok := FromQuestion(tt.question, now)
+			if !ok {
+				t.Fatal("no period found")
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("got %s - %s, want %s - %s", start, end, tt.wantStart, tt.wantEnd)
+			}
+			if phrase != tt.wantPhrase {
+				t.Errorf("phrase = %q, want %q", phrase, tt.wantPhrase)
+			}
+		})
+	}
+}
+
+func TestFromQuestionNoPeriod(t *testing.T) {
+	for _, question := range []string{
+		"Why is the CPU usage high?",
+		"what was the last deploy",
+		"in the last 0 minutes",
+		// Too long to be a time.Duration
+		"in the last 1000000 days",
+		"last 99999999999999999999 seconds",
+		// "мин" is the beginning of a word here, not minutes
+		"последний минимум памяти",
+		"since 25:00",
+	} {
+		if start, end, phrase, ok := FromQuestion(question, now); ok {
+			t.Errorf("%q: got %s - %s from %q, want no period", question, start, end, phrase)
+		}
+	}
+}
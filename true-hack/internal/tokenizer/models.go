@@ -0,0 +1,40 @@
+package tokenizer
+
+import "strings"
+
+// defaultContextWindow is assumed for models missing from contextWindows,
+// chain.context_window in config should be set for them
+const defaultContextWindow = 8192
+
+// contextWindows maps model name prefixes to their context window in tokens.
+// The longest matching prefix wins, so specific versions can override a family.
+var contextWindows = map[string]int{
+	"gpt-3.5-turbo": 16385,
+	"gpt-4":         8192,
+	"gpt-4-32k":     32768,
+	"gpt-4-turbo":   128000,
+	"gpt-4-1106":    128000,
+	"gpt-4-0125":    128000,
+	"gpt-4o":        128000,
+	"gpt-4.1":       1047576,
+	"o1":            200000,
+	"o3":            200000,
+	"o4-mini":       200000,
+	"llama-3":       8192,
+	"llama-3.1":     128000,
+	"llama-3.3":     128000,
+	"qwen2.5":       32768,
+}
+
+// ContextWindow returns the context window of the model in tokens
+func ContextWindow(model string) int {
+	model = strings.ToLower(model)
+
+	window, matched := defaultContextWindow, 0
+	for prefix, size := range contextWindows {
+		if strings.HasPrefix(model, prefix) && len(prefix) > matched {
+			window, matched = size, len(prefix)
+		}
+	}
+	return window
+}
@@ -0,0 +1,81 @@
+package tokenizer
+
+import (
+	"strings"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// defaultEncoding is used for models tiktoken doesn't know, most OpenAI-compatible models
+// are close enough to it for budgeting
+const defaultEncoding = "cl100k_base"
+
+func init() {
+	// Encodings are embedded into the binary, so counting tokens never needs network access
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// Tokenizer counts tokens the way the model does, so prompt budgets can be checked before the request
+type Tokenizer interface {
+	Count(text string) int
+	// Truncate returns the longest prefix of text that fits into maxTokens tokens
+	Truncate(text string, maxTokens int) string
+}
+
+// ForModel returns a BPE tokenizer of the model's encoding, cl100k_base for unknown models
+// and an Estimator if no encoding could be loaded
+func ForModel(model string) Tokenizer {
+	enc, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		enc, err = tiktoken.GetEncoding(defaultEncoding)
+	}
+	if err != nil {
+		return Estimator{}
+	}
+	return &BPE{enc: enc}
+}
+
+// BPE counts tokens with a tiktoken encoding
+type BPE struct {
+	enc *tiktoken.Tiktoken
+}
+
+func (t *BPE) Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	return len(t.enc.EncodeOrdinary(text))
+}
+
+func (t *BPE) Truncate(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	tokens := t.enc.EncodeOrdinary(text)
+	if len(tokens) <= maxTokens {
+		return text
+	}
+	// Cutting tokens may split a multibyte character, drop the broken tail
+	return strings.ToValidUTF8(t.enc.Decode(tokens[:maxTokens]), "")
+}
+
+// Estimator is the fallback used when no encoding is available. Metrics and logs are full of
+// numbers and punctuation, so a token is assumed to be 3 bytes rather than the usual 4.
+type Estimator struct{}
+
+const bytesPerToken = 3
+
+func (Estimator) Count(text string) int {
+	return (len(text) + bytesPerToken - 1) / bytesPerToken
+}
+
+func (Estimator) Truncate(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	if n := maxTokens * bytesPerToken; len(text) > n {
+		return strings.ToValidUTF8(text[:n], "")
+	}
+	return text
+}
@@ -0,0 +1,112 @@
+package tokenizer
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCountCL100K(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{text: "", want: 0},
+		{text: "hello world", want: 2},
+		{text: "tiktoken is great!", want: 6},
+		{text: "Привет, мир", want: 6},
+		{text: `process_cpu_seconds_total{job="api"} 0.25`, want: 13},
+	}
+
+	// gpt-4 uses cl100k_base, models tiktoken doesn't know fall back to it
+	for _, model := range []string{"gpt-4", "llama-3.1-70b", "unknown"} {
+		tok := ForModel(model)
+		if _, ok := tok.(*BPE); !ok {
+			t.Fatalf("ForModel(%q) = %T, want *BPE", model, tok)
+		}
+		for _, tt := range tests {
+			if got := tok.Count(tt.text); got != tt.want {
+				t.Errorf("%s: Count(%q) = %d, want %d", model, tt.text, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		text      string
+		maxTokens int
+		want      string
+	}{
+		{text: "hello world", maxTokens: 2, want: "hello world"},
+		{text: "hello world", maxTokens: 1, want: "hello"},
+		{text: "hello world", maxTokens: 0, want: ""},
+		{text: "tiktoken is great!", maxTokens: 2, want: "tik"},
+	}
+
+	tok := ForModel("gpt-4")
+	for _, tt := range tests {
+		if got := tok.Truncate(tt.text, tt.maxTokens); got != tt.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", tt.text, tt.maxTokens, got, tt.want)
+		}
+	}
+
+	// A token boundary inside a multibyte character must not leave broken UTF-8
+	for n := range tok.Count("Привет, мир") {
+		if got := tok.Truncate("Привет, мир", n); !utf8.ValidString(got) {
+			t.Errorf("Truncate to %d tokens gave invalid UTF-8 %q", n, got)
+		}
+	}
+}
+
+func TestEstimator(t *testing.T) {
+	var tok Estimator
+
+	tests := []struct {
+		text string
+		want int
+	}{
+		{text: "", want: 0},
+		{text: "abc", want: 1},
+		{text: "abcd", want: 2},
+		{text: "hello world", want: 4},
+	}
+	for _, tt := range tests {
+		if got := tok.Count(tt.text); got != tt.want {
+			t.Errorf("Count(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+
+	if got := tok.Truncate("hello world", 2); got != "hello " {
+		t.Errorf("Truncate to 2 tokens = %q, want %q", got, "hello ")
+	}
+	if got := tok.Truncate("мир", 1); got != "м" {
+		t.Errorf("Truncate inside a character = %q, want %q", got, "м")
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	tests := []struct {
+		model string
+		want  int
+	}{
+		{model: "gpt-4", want: 8192},
+		{model: "gpt-4-0613", want: 8192},
+		{model: "gpt-4-32k-0613", want: 32768},
+		{model: "gpt-4-turbo-preview", want: 128000},
+		{model: "gpt-4o-mini", want: 128000},
+		{model: "GPT-4o", want: 128000},
+		{model: "gpt-4.1-nano", want: 1047576},
+		{model: "gpt-3.5-turbo-0125", want: 16385},
+		{model: "llama-3-8b", want: 8192},
+		{model: "llama-3.1-70b", want: 128000},
+		{model: "o3-mini", want: 200000},
+		{model: "mistral-7b", want: defaultContextWindow},
+		{model: "", want: defaultContextWindow},
+	}
+
+	for _, tt := range tests {
+		if got := ContextWindow(tt.model); got != tt.want {
+			t.Errorf("ContextWindow(%q) = %d, want %d", tt.model, got, tt.want)
+		}
+	}
+}